@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	_ "github.com/lib/pq"
 	"myconnectionsvr/modern-mcs/internal/audit"
@@ -43,6 +46,10 @@ func New(cfg config.Config) (*App, error) {
 
 	var userStore auth.UserStore
 	var sessionStore auth.SessionStore
+	var mfaPolicyStore auth.MFAPolicyStore
+	var loginAttemptStore auth.LoginAttemptStore
+	var apiTokenStore auth.APITokenStore
+	var roleStore auth.RoleStore
 	if db != nil {
 		userStore, err = auth.NewPostgresUserStore(db)
 		if err != nil {
@@ -54,17 +61,182 @@ func New(cfg config.Config) (*App, error) {
 			_ = db.Close()
 			return nil, fmt.Errorf("create postgres session store: %w", err)
 		}
+		mfaPolicyStore, err = auth.NewPostgresMFAPolicyStore(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create postgres mfa policy store: %w", err)
+		}
+		loginAttemptStore, err = auth.NewPostgresLoginAttemptStore(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create postgres login attempt store: %w", err)
+		}
+		apiTokenStore, err = auth.NewPostgresAPITokenStore(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create postgres api token store: %w", err)
+		}
+		roleStore, err = auth.NewPostgresRoleStore(db)
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("create postgres role store: %w", err)
+		}
 	} else {
 		userStore, err = auth.NewFileUserStore(cfg.Auth.UserStateFile)
 		if err != nil {
 			return nil, fmt.Errorf("create user store: %w", err)
 		}
+		mfaPolicyStore, err = auth.NewFileMFAPolicyStore(cfg.Auth.MFAPolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("create mfa policy store: %w", err)
+		}
+		loginAttemptStore, err = auth.NewFileLoginAttemptStore(cfg.Auth.LoginAttemptFile)
+		if err != nil {
+			return nil, fmt.Errorf("create login attempt store: %w", err)
+		}
+		apiTokenStore, err = auth.NewFileAPITokenStore(cfg.Auth.APITokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("create api token store: %w", err)
+		}
+		roleStore, err = auth.NewFileRoleStore(cfg.Auth.RoleFile)
+		if err != nil {
+			return nil, fmt.Errorf("create role store: %w", err)
+		}
+	}
+	var oidcConfig *auth.OIDCConfig
+	if cfg.Auth.OIDC.IssuerURL != "" {
+		oidcConfig = &auth.OIDCConfig{
+			IssuerURL:     cfg.Auth.OIDC.IssuerURL,
+			ClientID:      cfg.Auth.OIDC.ClientID,
+			ClientSecret:  cfg.Auth.OIDC.ClientSecret,
+			RedirectURL:   cfg.Auth.OIDC.RedirectURL,
+			Scopes:        cfg.Auth.OIDC.Scopes,
+			UsernameClaim: cfg.Auth.OIDC.UsernameClaim,
+			RoleClaim:     cfg.Auth.OIDC.RoleClaim,
+			RoleMap:       cfg.Auth.OIDC.RoleMap,
+			DefaultRoles:  cfg.Auth.OIDC.DefaultRoles,
+		}
+	}
+	var webauthnConfig *auth.WebAuthnConfig
+	if cfg.Auth.WebAuthn.RPID != "" {
+		webauthnConfig = &auth.WebAuthnConfig{
+			RPID:    cfg.Auth.WebAuthn.RPID,
+			RPName:  cfg.Auth.WebAuthn.RPName,
+			Origins: cfg.Auth.WebAuthn.Origins,
+		}
+	}
+	var jwtConfig *auth.JWTConfig
+	if cfg.Auth.JWT.Enabled {
+		jwtConfig = &auth.JWTConfig{
+			Algorithm:   cfg.Auth.JWT.Algorithm,
+			Issuer:      cfg.Auth.JWT.Issuer,
+			Audience:    cfg.Auth.JWT.Audience,
+			TTL:         cfg.Auth.JWT.TTL,
+			KeyRotation: cfg.Auth.JWT.KeyRotation,
+			KeyFile:     cfg.Auth.JWT.KeyFile,
+		}
+	}
+	var clientCertConfig *auth.ClientCertConfig
+	if cfg.HTTP.TLS.ClientCAFile != "" {
+		clientCertConfig = &auth.ClientCertConfig{
+			UsernameFrom: cfg.Auth.ClientCert.UsernameFrom,
+			RoleMap:      cfg.Auth.ClientCert.RoleMap,
+			DefaultRoles: cfg.Auth.ClientCert.DefaultRoles,
+		}
+	}
+	var authenticator auth.Authenticator
+	if cfg.Auth.LDAP.URL != "" {
+		ldapAuth, err := auth.NewLDAPAuthenticator(auth.LDAPConfig{
+			URL:                cfg.Auth.LDAP.URL,
+			StartTLS:           cfg.Auth.LDAP.StartTLS,
+			InsecureSkipVerify: cfg.Auth.LDAP.InsecureSkipVerify,
+			CACertFile:         cfg.Auth.LDAP.CACertFile,
+			BindDN:             cfg.Auth.LDAP.BindDN,
+			BindPassword:       cfg.Auth.LDAP.BindPassword,
+			BaseDN:             cfg.Auth.LDAP.BaseDN,
+			UserFilter:         cfg.Auth.LDAP.UserFilter,
+			UsernameAttribute:  cfg.Auth.LDAP.UsernameAttribute,
+			GroupAttribute:     cfg.Auth.LDAP.GroupAttribute,
+			RoleMap:            cfg.Auth.LDAP.RoleMap,
+			DefaultRoles:       cfg.Auth.LDAP.DefaultRoles,
+			Timeout:            cfg.Auth.LDAP.Timeout,
+		})
+		if err != nil {
+			if db != nil {
+				_ = db.Close()
+			}
+			return nil, fmt.Errorf("create ldap authenticator: %w", err)
+		}
+		authenticator = ldapAuth
+	}
+	var mailer auth.Mailer
+	if cfg.SMTP.Host != "" {
+		smtpMailer, err := auth.NewSMTPMailer(auth.SMTPConfig{
+			Host:               cfg.SMTP.Host,
+			Port:               cfg.SMTP.Port,
+			Username:           cfg.SMTP.Username,
+			Password:           cfg.SMTP.Password,
+			From:               cfg.SMTP.From,
+			TLS:                cfg.SMTP.TLS,
+			InsecureSkipVerify: cfg.SMTP.InsecureSkipVerify,
+			Timeout:            cfg.SMTP.Timeout,
+		})
+		if err != nil {
+			if db != nil {
+				_ = db.Close()
+			}
+			return nil, fmt.Errorf("create smtp mailer: %w", err)
+		}
+		mailer = smtpMailer
 	}
 	authService, err := auth.NewService(userStore, auth.ServiceConfig{
-		PasswordPepper:   cfg.Auth.PasswordPepper,
-		SessionTTL:       cfg.Auth.SessionTTL,
-		SessionStateFile: cfg.Auth.SessionStateFile,
-		SessionStore:     sessionStore,
+		PasswordPepper: cfg.Auth.PasswordPepper,
+		HashParams: auth.HashParams{
+			MemoryKiB:   uint32(cfg.Auth.PasswordHash.MemoryKiB),
+			Iterations:  uint32(cfg.Auth.PasswordHash.Iterations),
+			Parallelism: uint8(cfg.Auth.PasswordHash.Parallelism),
+		},
+		SessionTTL:         cfg.Auth.SessionTTL,
+		SessionMaxLifetime: cfg.Auth.SessionMaxLifetime,
+		SessionStateFile:   cfg.Auth.SessionStateFile,
+		SessionStore:       sessionStore,
+		MFAIssuer:          cfg.Auth.MFAIssuer,
+		MFAPolicyStore:     mfaPolicyStore,
+		LoginAttempts:      loginAttemptStore,
+		Throttle: auth.ThrottleConfig{
+			LockoutThreshold: cfg.Auth.LoginThrottle.LockoutThreshold,
+			LockoutDuration:  cfg.Auth.LoginThrottle.LockoutDuration,
+			IPThreshold:      cfg.Auth.LoginThrottle.IPThreshold,
+			BackoffAfter:     cfg.Auth.LoginThrottle.BackoffAfter,
+			BackoffBase:      cfg.Auth.LoginThrottle.BackoffBase,
+			BackoffMax:       cfg.Auth.LoginThrottle.BackoffMax,
+			FailureWindow:    cfg.Auth.LoginThrottle.FailureWindow,
+		},
+		OIDC:             oidcConfig,
+		WebAuthn:         webauthnConfig,
+		ClientCerts:      clientCertConfig,
+		Authenticator:    authenticator,
+		APITokens:        apiTokenStore,
+		Roles:            roleStore,
+		Mailer:           mailer,
+		PasswordResetURL: cfg.Auth.PasswordReset.URL,
+		PasswordResetTTL: cfg.Auth.PasswordReset.TTL,
+		PasswordPolicy: auth.PasswordPolicy{
+			MinLength:        cfg.Auth.PasswordPolicy.MinLength,
+			MaxLength:        auth.DefaultPasswordPolicy.MaxLength,
+			RequireUpper:     cfg.Auth.PasswordPolicy.RequireUpper,
+			RequireLower:     cfg.Auth.PasswordPolicy.RequireLower,
+			RequireDigit:     cfg.Auth.PasswordPolicy.RequireDigit,
+			RequireSymbol:    cfg.Auth.PasswordPolicy.RequireSymbol,
+			MaxAge:           cfg.Auth.PasswordPolicy.MaxAge,
+			History:          cfg.Auth.PasswordPolicy.History,
+			BreachedHashFile: cfg.Auth.PasswordPolicy.BreachedFile,
+		},
+		EndSessionOnPasswordChange: !cfg.Auth.KeepSessionOnPasswordChange,
+		ImpersonationTTL:           cfg.Auth.ImpersonationTTL,
+		SCIMToken:                  cfg.Auth.SCIMToken,
+		SCIMAllowAdminRole:         cfg.Auth.SCIMAllowAdminRole,
+		JWT:                        jwtConfig,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("create auth service: %w", err)
@@ -76,26 +248,46 @@ func New(cfg config.Config) (*App, error) {
 		return nil, fmt.Errorf("load auth session state: %w", err)
 	}
 
-	if _, err := userStore.GetByUsername(cfg.Auth.BootstrapUsername); err != nil {
-		if errors.Is(err, auth.ErrUserNotFound) {
-			if err := userStore.Put(auth.User{
-				ID:           "bootstrap-admin",
-				Username:     cfg.Auth.BootstrapUsername,
-				PasswordHash: authService.HashPassword(cfg.Auth.BootstrapPassword),
-				Roles:        []string{"admin"},
-			}); err != nil {
+	if bootstrapUser, err := userStore.GetByUsername(cfg.Auth.BootstrapUsername); err == nil {
+		// Deployments that never changed the configured bootstrap password are
+		// made to change it now, like freshly created ones.
+		if bootstrapUser.AuthProvider == "" && !bootstrapUser.MustChangePassword &&
+			authService.VerifyPassword(cfg.Auth.BootstrapPassword, bootstrapUser.PasswordHash) {
+			bootstrapUser.MustChangePassword = true
+			if err := userStore.Put(bootstrapUser); err != nil {
 				if db != nil {
 					_ = db.Close()
 				}
-				return nil, fmt.Errorf("create bootstrap user: %w", err)
+				return nil, fmt.Errorf("flag bootstrap user password change: %w", err)
+			}
+		}
+	} else if errors.Is(err, auth.ErrUserNotFound) {
+		passwordHash, err := authService.HashPassword(cfg.Auth.BootstrapPassword)
+		if err != nil {
+			if db != nil {
+				_ = db.Close()
 			}
-			logger.Info("bootstrap auth user created", "username", cfg.Auth.BootstrapUsername)
-		} else {
+			return nil, fmt.Errorf("hash bootstrap password: %w", err)
+		}
+		if err := userStore.Put(auth.User{
+			ID:           "bootstrap-admin",
+			Username:     cfg.Auth.BootstrapUsername,
+			PasswordHash: passwordHash,
+			Roles:        []string{"admin"},
+
+			MustChangePassword: true,
+		}); err != nil {
 			if db != nil {
 				_ = db.Close()
 			}
-			return nil, fmt.Errorf("check bootstrap user: %w", err)
+			return nil, fmt.Errorf("create bootstrap user: %w", err)
+		}
+		logger.Info("bootstrap auth user created", "username", cfg.Auth.BootstrapUsername)
+	} else {
+		if db != nil {
+			_ = db.Close()
 		}
+		return nil, fmt.Errorf("check bootstrap user: %w", err)
 	}
 
 	var sqlProfileService httpserver.SQLProfileService
@@ -126,10 +318,25 @@ func New(cfg config.Config) (*App, error) {
 
 	server := httpserver.New(cfg.HTTP, httpserver.Deps{
 		Auth:            authService,
+		Users:           authService,
+		MFA:             authService,
+		Lockouts:        authService,
+		OIDC:            authService,
+		AccessTokens:    authService,
+		ClientCerts:     authService,
+		WebAuthn:        authService,
+		APITokens:       authService,
+		Impersonation:   authService,
+		Roles:           authService,
+		SCIM:            authService,
+		PasswordReset:   authService,
 		SQLProfiles:     sqlProfileService,
 		Migrations:      migrationService,
 		Audit:           auditLogger,
 		FrontendDistDir: cfg.FrontendDistDir,
+		SessionCookie:   cfg.Auth.Cookie,
+		TrustedProxies:  cfg.HTTP.TrustedProxies,
+		Logger:          logger,
 	})
 
 	return &App{
@@ -150,23 +357,37 @@ func (a *App) Run(ctx context.Context) error {
 	errCh := make(chan error, 1)
 
 	go func() {
-		a.log.Info("http server starting", "addr", a.cfg.HTTP.Addr)
+		a.log.Info("http server starting", "addr", a.cfg.HTTP.Addr, "tls", a.cfg.HTTP.TLS.CertFile != "", "redirect_addr", a.cfg.HTTP.TLS.RedirectAddr)
 		errCh <- a.server.Start()
 	}()
 
-	select {
-	case <-ctx.Done():
-		a.log.Info("shutdown signal received")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), a.cfg.HTTP.ShutdownTimeout)
-		defer cancel()
-		if err := a.server.Shutdown(shutdownCtx); err != nil {
-			return fmt.Errorf("shutdown server: %w", err)
-		}
-		return nil
-	case err := <-errCh:
-		if errors.Is(err, http.ErrServerClosed) {
+	// SIGHUP reloads the TLS files at once, e.g. from a certificate renewal
+	// hook; changed files are otherwise picked up within a few seconds.
+	hup := make(chan os.Signal, 1)
+	if a.cfg.HTTP.TLS.CertFile != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case <-hup:
+			if err := a.server.ReloadTLS(); err != nil {
+				a.log.Error("reload tls files", "error", err)
+			}
+		case <-ctx.Done():
+			a.log.Info("shutdown signal received")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), a.cfg.HTTP.ShutdownTimeout)
+			defer cancel()
+			if err := a.server.Shutdown(shutdownCtx); err != nil {
+				return fmt.Errorf("shutdown server: %w", err)
+			}
 			return nil
+		case err := <-errCh:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return fmt.Errorf("server exited: %w", err)
 		}
-		return fmt.Errorf("server exited: %w", err)
 	}
 }
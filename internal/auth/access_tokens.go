@@ -0,0 +1,547 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrJWTDisabled = errors.New("signed access tokens not configured")
+
+const (
+	defaultJWTTTL         = 5 * time.Minute
+	defaultJWTKeyRotation = 24 * time.Hour
+	// minJWTKeyRotation leaves verifiers that cache the JWKS time to pick
+	// up a new key before it signs anything.
+	minJWTKeyRotation = time.Hour
+	// accessTokenJWTType is the RFC 9068 media type of JWT access tokens.
+	accessTokenJWTType = "at+jwt"
+	// jwtKeyRingSize holds the published next key, the signing key and the
+	// previous key, whose tokens may still be live.
+	jwtKeyRingSize = 3
+	// jwtDenyListRefresh is how often the deny-list is reloaded from the
+	// session store, and so how long other instances may accept a token
+	// after its session was revoked.
+	jwtDenyListRefresh = 5 * time.Second
+	// jwtKeyReloadInterval limits how often tokens with an unknown key ID
+	// make verify re-read the key file.
+	jwtKeyReloadInterval = 30 * time.Second
+	// jwtKeyLockWait is how long rotation waits for another instance to
+	// finish rotating; a lock older than jwtKeyLockStale was left behind by
+	// an instance that died while rotating and is broken.
+	jwtKeyLockWait  = 5 * time.Second
+	jwtKeyLockStale = 30 * time.Second
+)
+
+// JWTConfig makes sessions hand out short-lived signed JWTs as access tokens
+// instead of opaque ones. Algorithm is "EdDSA" (Ed25519) or "ES256". Signing
+// keys rotate every KeyRotation; KeyFile persists them so that restarts and
+// other instances sharing the file keep accepting issued tokens.
+type JWTConfig struct {
+	Algorithm   string
+	Issuer      string
+	Audience    string
+	TTL         time.Duration
+	KeyRotation time.Duration
+	KeyFile     string
+}
+
+type jwtSigningKey struct {
+	ID        string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	CreatedAt time.Time `json:"created_at"`
+	// PrivateKey is PKCS #8 DER.
+	PrivateKey []byte `json:"private_key"`
+
+	signer crypto.Signer
+}
+
+// jwtIssuer signs and verifies access tokens. The newest key is published
+// one rotation ahead of use, so that verifiers caching the JWKS already know
+// it when signing switches over.
+type jwtIssuer struct {
+	cfg JWTConfig
+
+	mu         sync.Mutex
+	keys       []jwtSigningKey // newest first
+	keyMtime   time.Time
+	lastReload time.Time
+
+	// denied caches the session store's deny-list of revoked session IDs,
+	// so that validation does not look every token up in the store.
+	denyMu     sync.Mutex
+	denied     map[string]time.Time
+	deniedLoad time.Time
+}
+
+func newJWTIssuer(cfg JWTConfig) (*jwtIssuer, error) {
+	if cfg.Algorithm != "EdDSA" && cfg.Algorithm != "ES256" {
+		return nil, fmt.Errorf("jwt algorithm must be EdDSA or ES256")
+	}
+	if cfg.Issuer == "" {
+		return nil, fmt.Errorf("jwt issuer is required")
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = defaultJWTTTL
+	}
+	if cfg.KeyRotation == 0 {
+		cfg.KeyRotation = defaultJWTKeyRotation
+	}
+	if cfg.TTL < 0 {
+		return nil, fmt.Errorf("jwt TTL must be > 0")
+	}
+	if cfg.KeyRotation < minJWTKeyRotation || cfg.KeyRotation < cfg.TTL {
+		return nil, fmt.Errorf("jwt key rotation must be >= %s and >= jwt TTL", minJWTKeyRotation)
+	}
+	j := &jwtIssuer{cfg: cfg}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.loadLocked(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (s *Service) JWTEnabled() bool {
+	return s.jwt != nil
+}
+
+// JWKS returns the JSON Web Key Set with the public keys that access tokens
+// are, or are about to be, signed with.
+func (s *Service) JWKS() ([]byte, error) {
+	if s.jwt == nil {
+		return nil, ErrJWTDisabled
+	}
+	s.jwt.mu.Lock()
+	if err := s.jwt.rotateLocked(s.nowFunc()); err != nil {
+		s.jwt.mu.Unlock()
+		return nil, err
+	}
+	keys := append([]jwtSigningKey(nil), s.jwt.keys...)
+	s.jwt.mu.Unlock()
+
+	set := jwkSet{Keys: make([]jwk, 0, len(keys))}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.publicJWK())
+	}
+	return json.Marshal(set)
+}
+
+// signAccessToken returns a JWT for session and when it expires. It carries
+// the session ID as "sid" so that revoking the session can deny it.
+func (s *Service) signAccessToken(session Session) (string, time.Time, error) {
+	now := s.nowFunc()
+	expiresAt := now.Add(s.jwt.cfg.TTL)
+	if session.AbsoluteExpiresAt.Before(expiresAt) {
+		expiresAt = session.AbsoluteExpiresAt
+	}
+	claims := map[string]any{
+		"iss":                s.jwt.cfg.Issuer,
+		"sub":                session.UserID,
+		"sid":                session.ID,
+		"jti":                mustID(16),
+		"preferred_username": session.Username,
+		"roles":              append([]string{}, session.Roles...),
+		"iat":                now.Unix(),
+		"exp":                expiresAt.Unix(),
+	}
+	if s.jwt.cfg.Audience != "" {
+		claims["aud"] = s.jwt.cfg.Audience
+	}
+	if session.PasswordChangeRequired {
+		claims["pcr"] = true
+	}
+	token, err := s.jwt.sign(claims, now)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// validateAccessToken checks a JWT access token from its signature and
+// claims alone. Revoked sessions are caught by the deny-list, which is
+// shared through the session store and reloaded every jwtDenyListRefresh.
+func (s *Service) validateAccessToken(token string) (Session, error) {
+	now := s.nowFunc()
+	claims, err := s.jwt.verify(token, now)
+	if err != nil {
+		return Session{}, ErrInvalidToken
+	}
+	if claimString(claims, "iss") != s.jwt.cfg.Issuer {
+		return Session{}, ErrInvalidToken
+	}
+	if s.jwt.cfg.Audience != "" && !containsString(claimStrings(claims, "aud"), s.jwt.cfg.Audience) {
+		return Session{}, ErrInvalidToken
+	}
+	exp, ok := claimUnix(claims, "exp")
+	if !ok || !now.Before(time.Unix(exp, 0)) {
+		return Session{}, ErrInvalidToken
+	}
+	iat, _ := claimUnix(claims, "iat")
+	sid := claimString(claims, "sid")
+	if sid == "" || claimString(claims, "sub") == "" {
+		return Session{}, ErrInvalidToken
+	}
+	denied, err := s.accessTokenDenied(sid, now)
+	if err != nil {
+		return Session{}, err
+	}
+	if denied {
+		return Session{}, ErrInvalidToken
+	}
+	pcr, _ := claims["pcr"].(bool)
+	return Session{
+		ID:                     sid,
+		Token:                  token,
+		UserID:                 claimString(claims, "sub"),
+		Username:               claimString(claims, "preferred_username"),
+		Roles:                  claimStrings(claims, "roles"),
+		CreatedAt:              time.Unix(iat, 0),
+		ExpiresAt:              time.Unix(exp, 0),
+		AbsoluteExpiresAt:      time.Unix(exp, 0),
+		LastSeenAt:             time.Unix(iat, 0),
+		PasswordChangeRequired: pcr,
+	}, nil
+}
+
+// denyAccessTokens rejects the access tokens already issued for the
+// sessions. Entries expire with the last token they can match, which keeps
+// the list as small as the revocations of the last TTL.
+func (s *Service) denyAccessTokens(sessionIDs ...string) error {
+	if s.jwt == nil || len(sessionIDs) == 0 {
+		return nil
+	}
+	now := s.nowFunc()
+	until := now.Add(s.jwt.cfg.TTL)
+	if err := s.sessions.DenyAccessTokens(sessionIDs, until); err != nil {
+		return err
+	}
+	s.jwt.denyMu.Lock()
+	defer s.jwt.denyMu.Unlock()
+	if s.jwt.denied == nil {
+		s.jwt.denied = make(map[string]time.Time)
+	}
+	for _, id := range sessionIDs {
+		s.jwt.denied[id] = until
+	}
+	return nil
+}
+
+// accessTokenDenied reports whether sessionID is on the deny-list, reloading
+// the list from the session store when it is older than jwtDenyListRefresh.
+func (s *Service) accessTokenDenied(sessionID string, now time.Time) (bool, error) {
+	s.jwt.denyMu.Lock()
+	defer s.jwt.denyMu.Unlock()
+	if s.jwt.denied == nil || now.Sub(s.jwt.deniedLoad) >= jwtDenyListRefresh || now.Before(s.jwt.deniedLoad) {
+		denied, err := s.sessions.DeniedAccessTokens(now)
+		if err != nil {
+			return false, fmt.Errorf("load access token deny-list: %w", err)
+		}
+		s.jwt.denied = denied
+		s.jwt.deniedLoad = now
+	}
+	until, ok := s.jwt.denied[sessionID]
+	return ok && !now.After(until), nil
+}
+
+// storedSession returns the live store record, and its key, of the session
+// that token belongs to.
+func (s *Service) storedSession(token string) (string, Session, error) {
+	if s.jwt == nil || !isJWT(token) {
+		key := s.hashSessionToken(token)
+		session, err := s.sessions.Get(key)
+		if errors.Is(err, ErrSessionNotFound) {
+			return "", Session{}, ErrInvalidToken
+		}
+		return key, session, err
+	}
+	claimed, err := s.validateAccessToken(token)
+	if err != nil {
+		return "", Session{}, err
+	}
+	key, session, err := s.sessions.GetByID(claimed.ID)
+	if errors.Is(err, ErrSessionNotFound) || (err == nil && session.RotatedAt != nil) {
+		return "", Session{}, ErrInvalidToken
+	}
+	return key, session, err
+}
+
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (j *jwtIssuer) sign(claims map[string]any, now time.Time) (string, error) {
+	j.mu.Lock()
+	if err := j.rotateLocked(now); err != nil {
+		j.mu.Unlock()
+		return "", err
+	}
+	key := j.keys[1]
+	j.mu.Unlock()
+
+	header, err := json.Marshal(jwtHeader{Alg: key.Alg, Kid: key.ID, Typ: accessTokenJWTType})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch priv := key.signer.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(priv, []byte(input))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("sign jwt: %w", err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		return "", fmt.Errorf("unsupported signing key %T", key.signer)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verify checks the signature of token and returns its claims. A key ID
+// that is not known yet makes it re-read the key file, which another
+// instance may have rotated, at most once per jwtKeyReloadInterval so that
+// forged key IDs cannot make every request hit the disk.
+func (j *jwtIssuer) verify(token string, now time.Time) (map[string]any, error) {
+	header, claims, input, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Typ != accessTokenJWTType {
+		return nil, fmt.Errorf("unexpected jwt type %q", header.Typ)
+	}
+	key, ok := j.key(header.Kid)
+	if !ok {
+		j.mu.Lock()
+		var err error
+		if j.cfg.KeyFile != "" && (now.Sub(j.lastReload) >= jwtKeyReloadInterval || now.Before(j.lastReload)) {
+			j.lastReload = now
+			err = j.loadLocked()
+		}
+		j.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if key, ok = j.key(header.Kid); !ok {
+			return nil, fmt.Errorf("unknown key id %q", header.Kid)
+		}
+	}
+	if header.Alg != key.Alg {
+		return nil, fmt.Errorf("key does not match alg %s", header.Alg)
+	}
+	if err := verifyJWTSignature(header.Alg, key.signer.Public(), input, sig); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (j *jwtIssuer) key(kid string) (jwtSigningKey, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, k := range j.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+	return jwtSigningKey{}, false
+}
+
+// rotateLocked makes sure there is a signing key and a published next key,
+// and promotes the next key once it has been published for a full rotation.
+func (j *jwtIssuer) rotateLocked(now time.Time) error {
+	due := len(j.keys) < 2 || now.Sub(j.keys[0].CreatedAt) >= j.cfg.KeyRotation
+	if !due {
+		return nil
+	}
+	unlock, err := j.lockKeyFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Another instance sharing the key file may have rotated already.
+	if err := j.loadLocked(); err != nil {
+		return err
+	}
+	changed := false
+	for len(j.keys) < 2 || now.Sub(j.keys[0].CreatedAt) >= j.cfg.KeyRotation {
+		k, err := newJWTSigningKey(j.cfg.Algorithm, now)
+		if err != nil {
+			return err
+		}
+		j.keys = append([]jwtSigningKey{k}, j.keys...)
+		changed = true
+	}
+	if len(j.keys) > jwtKeyRingSize {
+		j.keys = j.keys[:jwtKeyRingSize]
+	}
+	if changed {
+		return j.persistLocked()
+	}
+	return nil
+}
+
+// loadLocked reads the key file if it changed since it was last read.
+func (j *jwtIssuer) loadLocked() error {
+	if j.cfg.KeyFile == "" {
+		return nil
+	}
+	info, err := os.Stat(j.cfg.KeyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("stat jwt key file: %w", err)
+	}
+	if info.ModTime().Equal(j.keyMtime) {
+		return nil
+	}
+	b, err := os.ReadFile(j.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("read jwt key file: %w", err)
+	}
+	var keys []jwtSigningKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("decode jwt key file: %w", err)
+	}
+	for i := range keys {
+		priv, err := x509.ParsePKCS8PrivateKey(keys[i].PrivateKey)
+		if err != nil {
+			return fmt.Errorf("decode jwt key %s: %w", keys[i].ID, err)
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("decode jwt key %s: not a signing key", keys[i].ID)
+		}
+		keys[i].signer = signer
+	}
+	j.keys = keys
+	j.keyMtime = info.ModTime()
+	return nil
+}
+
+// lockKeyFile takes the lock file that serialises key rotation between
+// instances sharing the key file, and returns the function releasing it.
+func (j *jwtIssuer) lockKeyFile() (func(), error) {
+	if j.cfg.KeyFile == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(j.cfg.KeyFile), 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir jwt key dir: %w", err)
+	}
+	path := j.cfg.KeyFile + ".lock"
+	deadline := time.Now().Add(jwtKeyLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("lock jwt key file: %w", err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > jwtKeyLockStale {
+			_ = os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("lock jwt key file: %s is held by another instance", path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// persistLocked replaces the key file by renaming a complete copy over it,
+// so that other instances never read a partly written file.
+func (j *jwtIssuer) persistLocked() error {
+	if j.cfg.KeyFile == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(j.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode jwt key file: %w", err)
+	}
+	dir := filepath.Dir(j.cfg.KeyFile)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("mkdir jwt key dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(j.cfg.KeyFile)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write jwt key file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write jwt key file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write jwt key file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write jwt key file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), j.cfg.KeyFile); err != nil {
+		return fmt.Errorf("replace jwt key file: %w", err)
+	}
+	if info, err := os.Stat(j.cfg.KeyFile); err == nil {
+		j.keyMtime = info.ModTime()
+	}
+	return nil
+}
+
+func newJWTSigningKey(alg string, now time.Time) (jwtSigningKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "EdDSA":
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case "ES256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return jwtSigningKey{}, fmt.Errorf("unsupported jwt algorithm %q", alg)
+	}
+	if err != nil {
+		return jwtSigningKey{}, fmt.Errorf("generate jwt key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return jwtSigningKey{}, fmt.Errorf("encode jwt key: %w", err)
+	}
+	return jwtSigningKey{ID: mustID(8), Alg: alg, CreatedAt: now.UTC(), PrivateKey: der, signer: signer}, nil
+}
+
+func (k jwtSigningKey) publicJWK() jwk {
+	out := jwk{Kid: k.ID, Use: "sig", Alg: k.Alg}
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		out.Kty, out.Crv = "OKP", "Ed25519"
+		out.X = base64.RawURLEncoding.EncodeToString(pub)
+	case *ecdsa.PublicKey:
+		out.Kty, out.Crv = "EC", "P-256"
+		out.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+		out.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+	}
+	return out
+}
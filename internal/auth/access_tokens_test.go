@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAccessTokenTestService(t *testing.T, users UserStore, sessions SessionStore, jwt JWTConfig, now *time.Time) *Service {
+	t.Helper()
+	svc, err := NewService(users, ServiceConfig{PasswordPepper: "pepper", SessionTTL: 10 * time.Minute, SessionMaxLifetime: time.Hour, SessionStore: sessions, JWT: &jwt})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	svc.nowFunc = func() time.Time { return *now }
+	return svc
+}
+
+// lookupCountingSessionStore counts the session lookups validation makes.
+type lookupCountingSessionStore struct {
+	*InMemorySessionStore
+	lookups int
+}
+
+func (s *lookupCountingSessionStore) Get(tokenHash string) (Session, error) {
+	s.lookups++
+	return s.InMemorySessionStore.Get(tokenHash)
+}
+
+func (s *lookupCountingSessionStore) GetByID(sessionID string) (string, Session, error) {
+	s.lookups++
+	return s.InMemorySessionStore.GetByID(sessionID)
+}
+
+func TestAccessTokensValidateAcrossInstances(t *testing.T) {
+	for _, alg := range []string{"EdDSA", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			users := NewInMemoryUserStore()
+			now := time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC)
+			cfg := JWTConfig{Algorithm: alg, Issuer: "mcs", Audience: "mcs-api", KeyFile: filepath.Join(t.TempDir(), "jwt-keys.json")}
+			sessions := &lookupCountingSessionStore{InMemorySessionStore: NewInMemorySessionStore()}
+			svc := newAccessTokenTestService(t, users, sessions, cfg, &now)
+			// A second instance shares the stores and the key file.
+			other := newAccessTokenTestService(t, users, sessions, cfg, &now)
+			_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+			session, err := svc.Login("admin", "secret123", ClientInfo{})
+			if err != nil {
+				t.Fatalf("Login() error: %v", err)
+			}
+			if strings.Count(session.Token, ".") != 2 || !session.ExpiresAt.Equal(now.Add(defaultJWTTTL)) {
+				t.Fatalf("expected a JWT access token expiring after the TTL, got %q until %s", session.Token, session.ExpiresAt)
+			}
+			got, err := other.ValidateToken(session.Token)
+			if err != nil {
+				t.Fatalf("ValidateToken() on other instance error: %v", err)
+			}
+			if got.ID != session.ID || got.UserID != "u-1" || got.Username != "admin" || !slices.Equal(got.Roles, []string{"admin"}) {
+				t.Fatalf("unexpected session from claims %+v", got)
+			}
+			if sessions.lookups != 0 {
+				t.Fatalf("expected validation without session lookups, got %d", sessions.lookups)
+			}
+
+			tampered := session.Token[:len(session.Token)-4] + "AAAA"
+			if _, err := svc.ValidateToken(tampered); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected tampered token rejected, got %v", err)
+			}
+			foreign := newAccessTokenTestService(t, users, sessions, JWTConfig{Algorithm: alg, Issuer: "mcs", Audience: "mcs-api"}, &now)
+			if _, err := foreign.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected token from unknown key rejected, got %v", err)
+			}
+			elsewhere := newAccessTokenTestService(t, users, sessions, JWTConfig{Algorithm: alg, Issuer: "mcs", Audience: "other", KeyFile: cfg.KeyFile}, &now)
+			if _, err := elsewhere.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected token for another audience rejected, got %v", err)
+			}
+
+			if err := svc.Logout(session.Token); err != nil {
+				t.Fatalf("Logout() error: %v", err)
+			}
+			if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected logged out token denied, got %v", err)
+			}
+			if _, err := svc.Refresh(session.RefreshToken, ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected refresh after logout to fail, got %v", err)
+			}
+			// Other instances learn about the logout when they next reload
+			// the deny-list from the shared store.
+			if _, err := other.ValidateToken(session.Token); err != nil {
+				t.Fatalf("expected other instance to accept token until it reloads the deny-list, got %v", err)
+			}
+			now = now.Add(jwtDenyListRefresh)
+			if _, err := other.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected the shared deny-list to reject the token, got %v", err)
+			}
+			if denied, _ := sessions.DeniedAccessTokens(now); !denied[session.ID].Equal(now.Add(-jwtDenyListRefresh).Add(defaultJWTTTL)) {
+				t.Fatalf("expected the deny-list entry to expire with the token, got %v", denied)
+			}
+
+			now = now.Add(defaultJWTTTL)
+			if _, err := other.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected expired token rejected, got %v", err)
+			}
+			if err := sessions.DeleteExpired(now); err != nil {
+				t.Fatalf("DeleteExpired() error: %v", err)
+			}
+			if denied, _ := sessions.DeniedAccessTokens(time.Time{}); len(denied) != 0 {
+				t.Fatalf("expected the deny-list entry to be dropped after the token expired, got %v", denied)
+			}
+		})
+	}
+}
+
+func TestAccessTokensDeniedOnRefreshAndRoleChange(t *testing.T) {
+	users := NewInMemoryUserStore()
+	now := time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC)
+	svc := newAccessTokenTestService(t, users, nil, JWTConfig{Algorithm: "EdDSA", Issuer: "mcs"}, &now)
+	_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+	_ = users.Put(User{ID: "u-2", Username: "alice", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+	session, err := svc.Login("alice", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected access token of refreshed session denied, got %v", err)
+	}
+
+	if _, err := svc.UpdateUser("u-2", "alice", "", []string{"viewer"}); err != nil {
+		t.Fatalf("UpdateUser() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(refreshed.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected role change to deny the access token, got %v", err)
+	}
+	demoted, err := svc.Refresh(refreshed.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+	if got, err := svc.ValidateToken(demoted.Token); err != nil || !slices.Equal(got.Roles, []string{"viewer"}) {
+		t.Fatalf("expected refreshed token with new roles, got %+v, %v", got, err)
+	}
+	if n, err := svc.RevokeOtherSessions(demoted.Token); err != nil || n != 0 {
+		t.Fatalf("RevokeOtherSessions() = %d, %v", n, err)
+	}
+	if _, err := svc.ValidateToken(demoted.Token); err != nil {
+		t.Fatalf("expected the calling session to survive, got %v", err)
+	}
+
+	now = now.Add(11 * time.Minute)
+	if err := svc.RevokeSessionByID(demoted.ID); err != nil {
+		t.Fatalf("RevokeSessionByID() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(demoted.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected revoked session denied, got %v", err)
+	}
+}
+
+func TestAccessTokenKeyRotation(t *testing.T) {
+	users := NewInMemoryUserStore()
+	now := time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC)
+	svc := newAccessTokenTestService(t, users, nil, JWTConfig{Algorithm: "EdDSA", Issuer: "mcs", KeyRotation: time.Hour}, &now)
+	_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+	jwks := func() jwkSet {
+		t.Helper()
+		b, err := svc.JWKS()
+		if err != nil {
+			t.Fatalf("JWKS() error: %v", err)
+		}
+		var set jwkSet
+		if err := json.Unmarshal(b, &set); err != nil {
+			t.Fatalf("decode JWKS: %v", err)
+		}
+		return set
+	}
+	set := jwks()
+	if len(set.Keys) != 2 || set.Keys[0].Kty != "OKP" || set.Keys[0].Crv != "Ed25519" || set.Keys[0].Use != "sig" || set.Keys[0].Alg != "EdDSA" {
+		t.Fatalf("unexpected initial JWKS %+v", set)
+	}
+	next := set.Keys[0].Kid
+
+	now = now.Add(58 * time.Minute)
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	header, _, input, sig, err := parseJWT(session.Token)
+	if err != nil {
+		t.Fatalf("parseJWT() error: %v", err)
+	}
+	if header.Kid != set.Keys[1].Kid || header.Typ != accessTokenJWTType {
+		t.Fatalf("expected token signed by the current key, got %+v", header)
+	}
+	pub, err := set.Keys[1].publicKey()
+	if err != nil {
+		t.Fatalf("publicKey() error: %v", err)
+	}
+	if err := verifyJWTSignature(header.Alg, pub, input, sig); err != nil {
+		t.Fatalf("expected the published key to verify the token: %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	set = jwks()
+	if len(set.Keys) != 3 || set.Keys[1].Kid != next {
+		t.Fatalf("expected the published next key to take over, got %+v", set)
+	}
+	if _, err := svc.ValidateToken(session.Token); err != nil {
+		t.Fatalf("expected token signed before rotation to stay valid, got %v", err)
+	}
+	rotated, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if header, _, _, _, _ := parseJWT(rotated.Token); header.Kid != next {
+		t.Fatalf("expected new tokens signed by %s, got %s", next, header.Kid)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if set = jwks(); len(set.Keys) != jwtKeyRingSize {
+		t.Fatalf("expected at most %d keys, got %d", jwtKeyRingSize, len(set.Keys))
+	}
+}
+
+func TestAccessTokenKeyFileLockAndReloadLimit(t *testing.T) {
+	users := NewInMemoryUserStore()
+	now := time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC)
+	cfg := JWTConfig{Algorithm: "EdDSA", Issuer: "mcs", KeyRotation: time.Hour, KeyFile: filepath.Join(t.TempDir(), "jwt-keys.json")}
+	svc := newAccessTokenTestService(t, users, nil, cfg, &now)
+	other := newAccessTokenTestService(t, users, nil, cfg, &now)
+	_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	lock := cfg.KeyFile + ".lock"
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatalf("expected the rotation lock to be released, got %v", err)
+	}
+
+	// A lock left behind by an instance that died while rotating is broken.
+	if err := os.WriteFile(lock, nil, 0o600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+	stale := time.Now().Add(-2 * jwtKeyLockStale)
+	if err := os.Chtimes(lock, stale, stale); err != nil {
+		t.Fatalf("age lock: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := other.JWKS(); err != nil {
+		t.Fatalf("expected rotation to break a stale lock, got %v", err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Fatalf("expected the rotation lock to be released, got %v", err)
+	}
+	rotated, err := other.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(rotated.Token); err != nil {
+		t.Fatalf("expected tokens signed after the other instance rotated to validate, got %v", err)
+	}
+
+	// Unknown key IDs re-read the key file at most once per interval.
+	parts := strings.SplitN(session.Token, ".", 2)
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"forged","typ":"at+jwt"}`)) + "." + parts[1]
+	if _, err := svc.jwt.verify(forged, now); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Fatalf("expected an unknown key id, got %v", err)
+	}
+	if err := os.WriteFile(cfg.KeyFile, []byte("not json"), 0o600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	if _, err := svc.jwt.verify(forged, now.Add(time.Second)); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Fatalf("expected the key file not to be re-read within the interval, got %v", err)
+	}
+	if _, err := svc.jwt.verify(forged, now.Add(jwtKeyReloadInterval)); err == nil || !strings.Contains(err.Error(), "decode jwt key file") {
+		t.Fatalf("expected the key file to be re-read after the interval, got %v", err)
+	}
+}
+
+func TestAccessTokensDisabled(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if svc.JWTEnabled() {
+		t.Fatalf("expected signed access tokens off by default")
+	}
+	if _, err := svc.JWKS(); !errors.Is(err, ErrJWTDisabled) {
+		t.Fatalf("expected ErrJWTDisabled, got %v", err)
+	}
+	for _, cfg := range []JWTConfig{
+		{Algorithm: "RS256", Issuer: "mcs"},
+		{Algorithm: "EdDSA"},
+		{Algorithm: "EdDSA", Issuer: "mcs", TTL: time.Hour, KeyRotation: time.Minute},
+	} {
+		if _, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, JWT: &cfg}); err == nil {
+			t.Fatalf("expected invalid config %+v rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newAccountStatusTestService(t *testing.T) (*Service, User, *time.Time) {
+	t.Helper()
+	svc, _, now := newTestService(t, ServiceConfig{})
+	u, err := svc.CreateUser("alice", "Password123!x", "", []string{"operator"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	return svc, u, now
+}
+
+func TestDisabledAccountCannotSignIn(t *testing.T) {
+	svc, u, now := newAccountStatusTestService(t)
+	if u.CreatedAt == nil || !u.CreatedAt.Equal(*now) || u.Disabled {
+		t.Fatalf("unexpected new user: %+v", u)
+	}
+
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if stored, _ := svc.GetUser(u.ID); stored.LastLoginAt == nil || !stored.LastLoginAt.Equal(*now) {
+		t.Fatalf("expected last login to be recorded, got %v", stored.LastLoginAt)
+	}
+	_, rawToken, err := svc.CreateAPIToken(u.ID, "deploy", nil, 0)
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error: %v", err)
+	}
+
+	disabled, err := svc.SetUserStatus(u.ID, true, nil)
+	if err != nil || !disabled.Disabled {
+		t.Fatalf("SetUserStatus() = %+v, %v", disabled, err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected disabling to revoke sessions, got %v", err)
+	}
+	if _, err := svc.Refresh(session.RefreshToken, ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected refresh to fail, got %v", err)
+	}
+	if _, err := svc.ValidateToken(rawToken); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected api token to be rejected, got %v", err)
+	}
+	if _, err := svc.Login("alice", "Password123!x", ClientInfo{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+	if _, err := svc.Login("alice", "wrong-password", ClientInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected a wrong password to stay indistinguishable, got %v", err)
+	}
+
+	if _, err := svc.SetUserStatus(u.ID, false, nil); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(rawToken); err != nil {
+		t.Fatalf("expected api token to work again, got %v", err)
+	}
+	if _, err := svc.Login("alice", "Password123!x", ClientInfo{}); err != nil {
+		t.Fatalf("Login() after enabling error: %v", err)
+	}
+}
+
+func TestAccountExpiry(t *testing.T) {
+	svc, u, now := newAccountStatusTestService(t)
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	expiry := now.Add(30 * time.Minute)
+	if _, err := svc.SetUserStatus(u.ID, false, &expiry); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	sess, err := svc.ValidateToken(session.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if !sess.AbsoluteExpiresAt.Equal(expiry) {
+		t.Fatalf("expected existing session to end at the account expiry, got %v", sess.AbsoluteExpiresAt)
+	}
+	fresh, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if !fresh.AbsoluteExpiresAt.Equal(expiry) || fresh.ExpiresAt.After(expiry) {
+		t.Fatalf("expected new session capped at the account expiry, got %v", fresh.AbsoluteExpiresAt)
+	}
+
+	*now = expiry.Add(time.Second)
+	if _, err := svc.ValidateToken(fresh.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected session to end with the account, got %v", err)
+	}
+	if _, err := svc.Login("alice", "Password123!x", ClientInfo{}); !errors.Is(err, ErrAccountExpired) {
+		t.Fatalf("expected ErrAccountExpired, got %v", err)
+	}
+	if _, err := svc.SetUserStatus(u.ID, false, nil); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	if _, err := svc.Login("alice", "Password123!x", ClientInfo{}); err != nil {
+		t.Fatalf("Login() after clearing the expiry error: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAPITokenNotFound = errors.New("api token not found")
+
+// APITokenStore persists API token metadata keyed by ID. Only the keyed hash
+// of the secret is stored; GetByHash is the lookup used on every request.
+type APITokenStore interface {
+	Create(t APIToken) error
+	GetByHash(hash string) (APIToken, error)
+	List() ([]APIToken, error)
+	Delete(id string) error
+	TouchLastUsed(id string, at time.Time) error
+}
+
+type InMemoryAPITokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]APIToken
+}
+
+func NewInMemoryAPITokenStore() *InMemoryAPITokenStore {
+	return &InMemoryAPITokenStore{tokens: make(map[string]APIToken)}
+}
+
+func (s *InMemoryAPITokenStore) Create(t APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.ID] = t
+	return nil
+}
+
+func (s *InMemoryAPITokenStore) GetByHash(hash string) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return findAPITokenByHash(s.tokens, hash)
+}
+
+func (s *InMemoryAPITokenStore) List() ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedAPITokens(s.tokens), nil
+}
+
+func (s *InMemoryAPITokenStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[id]; !ok {
+		return ErrAPITokenNotFound
+	}
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *InMemoryAPITokenStore) TouchLastUsed(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrAPITokenNotFound
+	}
+	t.LastUsedAt = &at
+	s.tokens[id] = t
+	return nil
+}
+
+// fileAPITokenRecord exists because APIToken hides TokenHash from JSON.
+type fileAPITokenRecord struct {
+	APIToken
+	TokenHash string `json:"token_hash"`
+}
+
+type FileAPITokenStore struct {
+	path string
+
+	mu     sync.RWMutex
+	tokens map[string]APIToken
+}
+
+func NewFileAPITokenStore(path string) (*FileAPITokenStore, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("api token state file path is required")
+	}
+	s := &FileAPITokenStore{path: path, tokens: make(map[string]APIToken)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAPITokenStore) Create(t APIToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.ID] = t
+	if err := s.persistLocked(); err != nil {
+		delete(s.tokens, t.ID)
+		return err
+	}
+	return nil
+}
+
+func (s *FileAPITokenStore) GetByHash(hash string) (APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return findAPITokenByHash(s.tokens, hash)
+}
+
+func (s *FileAPITokenStore) List() ([]APIToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedAPITokens(s.tokens), nil
+}
+
+func (s *FileAPITokenStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrAPITokenNotFound
+	}
+	delete(s.tokens, id)
+	if err := s.persistLocked(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	return nil
+}
+
+func (s *FileAPITokenStore) TouchLastUsed(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrAPITokenNotFound
+	}
+	prev := t
+	t.LastUsedAt = &at
+	s.tokens[id] = t
+	if err := s.persistLocked(); err != nil {
+		s.tokens[id] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *FileAPITokenStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read api token file: %w", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var decoded []fileAPITokenRecord
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return fmt.Errorf("decode api token file: %w", err)
+	}
+	for _, rec := range decoded {
+		t := rec.APIToken
+		t.TokenHash = rec.TokenHash
+		s.tokens[t.ID] = t
+	}
+	return nil
+}
+
+func (s *FileAPITokenStore) persistLocked() error {
+	out := make([]fileAPITokenRecord, 0, len(s.tokens))
+	for _, t := range sortedAPITokens(s.tokens) {
+		out = append(out, fileAPITokenRecord{APIToken: t, TokenHash: t.TokenHash})
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode api token file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir api token dir: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0o600); err != nil {
+		return fmt.Errorf("write api token file: %w", err)
+	}
+	return nil
+}
+
+type PostgresAPITokenStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAPITokenStore(db *sql.DB) (*PostgresAPITokenStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database is required")
+	}
+	s := &PostgresAPITokenStore{db: db}
+	if err := s.ensureSchema(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PostgresAPITokenStore) ensureSchema() error {
+	const q = `
+CREATE TABLE IF NOT EXISTS auth_api_tokens (
+	id TEXT PRIMARY KEY,
+	name TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	username TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes JSONB NOT NULL DEFAULT '[]'::jsonb,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NULL,
+	last_used_at TIMESTAMPTZ NULL
+)`
+	if _, err := s.db.Exec(q); err != nil {
+		return fmt.Errorf("ensure auth_api_tokens schema: %w", err)
+	}
+	return nil
+}
+
+const apiTokenSelectColumns = `id, name, user_id, username, token_hash, scopes, created_at, expires_at, last_used_at`
+
+func (s *PostgresAPITokenStore) Create(t APIToken) error {
+	scopesJSON, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return fmt.Errorf("encode api token scopes: %w", err)
+	}
+	const q = `
+INSERT INTO auth_api_tokens (id, name, user_id, username, token_hash, scopes, created_at, expires_at, last_used_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULL)`
+	if _, err := s.db.Exec(q, t.ID, t.Name, t.UserID, t.Username, t.TokenHash, scopesJSON, t.CreatedAt, nullTime(t.ExpiresAt)); err != nil {
+		return fmt.Errorf("insert api token: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresAPITokenStore) GetByHash(hash string) (APIToken, error) {
+	row := s.db.QueryRow(`SELECT `+apiTokenSelectColumns+` FROM auth_api_tokens WHERE token_hash = $1`, hash)
+	t, err := scanAPIToken(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return APIToken{}, ErrAPITokenNotFound
+		}
+		return APIToken{}, fmt.Errorf("query api token: %w", err)
+	}
+	return t, nil
+}
+
+func (s *PostgresAPITokenStore) List() ([]APIToken, error) {
+	rows, err := s.db.Query(`SELECT ` + apiTokenSelectColumns + ` FROM auth_api_tokens ORDER BY created_at ASC, id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]APIToken, 0)
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+		out = append(out, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate api tokens: %w", err)
+	}
+	return out, nil
+}
+
+func (s *PostgresAPITokenStore) Delete(id string) error {
+	res, err := s.db.Exec(`DELETE FROM auth_api_tokens WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete api token rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+func (s *PostgresAPITokenStore) TouchLastUsed(id string, at time.Time) error {
+	if _, err := s.db.Exec(`UPDATE auth_api_tokens SET last_used_at = $2 WHERE id = $1`, id, at); err != nil {
+		return fmt.Errorf("update api token last used: %w", err)
+	}
+	return nil
+}
+
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var t APIToken
+	var scopesJSON []byte
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.Name, &t.UserID, &t.Username, &t.TokenHash, &scopesJSON, &t.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+		return APIToken{}, err
+	}
+	if len(scopesJSON) > 0 {
+		if err := json.Unmarshal(scopesJSON, &t.Scopes); err != nil {
+			return APIToken{}, fmt.Errorf("decode api token scopes: %w", err)
+		}
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	return t, nil
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+func findAPITokenByHash(tokens map[string]APIToken, hash string) (APIToken, error) {
+	for _, t := range tokens {
+		if t.TokenHash == hash {
+			return t, nil
+		}
+	}
+	return APIToken{}, ErrAPITokenNotFound
+}
+
+func sortedAPITokens(tokens map[string]APIToken) []APIToken {
+	out := make([]APIToken, 0, len(tokens))
+	for _, t := range tokens {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFileAPITokenStorePersistsHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	store, err := NewFileAPITokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileAPITokenStore() error: %v", err)
+	}
+	if err := store.Create(APIToken{ID: "t1", Name: "deploy", UserID: "u1", Username: "ci", Scopes: []string{"admin"}, CreatedAt: now, TokenHash: "h1"}); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+	if err := store.TouchLastUsed("t1", now.Add(time.Minute)); err != nil {
+		t.Fatalf("TouchLastUsed() error: %v", err)
+	}
+
+	reloaded, err := NewFileAPITokenStore(path)
+	if err != nil {
+		t.Fatalf("NewFileAPITokenStore() reload error: %v", err)
+	}
+	got, err := reloaded.GetByHash("h1")
+	if err != nil {
+		t.Fatalf("GetByHash() error: %v", err)
+	}
+	if got.ID != "t1" || got.LastUsedAt == nil || !got.LastUsedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected reloaded token: %+v", got)
+	}
+	if err := reloaded.Delete("t1"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if err := reloaded.Delete("t1"); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected ErrAPITokenNotFound, got %v", err)
+	}
+}
+
+func TestPostgresAPITokenStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_api_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresAPITokenStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresAPITokenStore() error: %v", err)
+	}
+
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("SELECT id, name, .* FROM auth_api_tokens WHERE token_hash = \\$1").
+		WithArgs("h1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "user_id", "username", "token_hash", "scopes", "created_at", "expires_at", "last_used_at"}).
+			AddRow("t1", "deploy", "u1", "ci", "h1", []byte(`["admin"]`), now, now.Add(time.Hour), nil))
+	got, err := store.GetByHash("h1")
+	if err != nil {
+		t.Fatalf("GetByHash() error: %v", err)
+	}
+	if got.ID != "t1" || len(got.Scopes) != 1 || got.ExpiresAt == nil || got.LastUsedAt != nil {
+		t.Fatalf("unexpected token: %+v", got)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_api_tokens WHERE id = \\$1").
+		WithArgs("missing").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.Delete("missing"); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected ErrAPITokenNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
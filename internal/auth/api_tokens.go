@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidAPIToken = errors.New("invalid api token request")
+
+const (
+	apiTokenPrefix        = "mcs_pat_"
+	apiTokenByteCount     = 32
+	maxAPITokenNameLength = 64
+	// apiTokenTouchInterval bounds how often last-used timestamps are written
+	// back, so that busy automation does not turn every request into a write.
+	apiTokenTouchInterval = time.Minute
+)
+
+// APIToken is a long-lived bearer credential owned by a user. Scopes are role
+// names; the token acts with the intersection of its scopes and the owner's
+// current roles, so removing a role from the owner also narrows its tokens.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	UserID     string     `json:"user_id"`
+	Username   string     `json:"username"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	TokenHash  string     `json:"-"`
+}
+
+// CreateAPIToken issues a token for userID. An empty scope list grants all of
+// the user's roles; otherwise every scope must be a role the user holds. A
+// zero ttl creates a token that never expires. The plaintext token is only
+// returned here.
+func (s *Service) CreateAPIToken(userID, name string, scopes []string, ttl time.Duration) (APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxAPITokenNameLength {
+		return APIToken{}, "", fmt.Errorf("%w: name must be 1-%d characters", ErrInvalidAPIToken, maxAPITokenNameLength)
+	}
+	if ttl < 0 {
+		return APIToken{}, "", fmt.Errorf("%w: expiry must not be negative", ErrInvalidAPIToken)
+	}
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	scopes = normalizeRoles(scopes)
+	for _, scope := range scopes {
+		if !containsString(u.Roles, scope) {
+			return APIToken{}, "", fmt.Errorf("%w: scope %q is not a role of the user", ErrInvalidAPIToken, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = normalizeRoles(u.Roles)
+	}
+
+	secret, err := generateToken(apiTokenByteCount)
+	if err != nil {
+		return APIToken{}, "", fmt.Errorf("generate api token: %w", err)
+	}
+	raw := apiTokenPrefix + secret
+	now := s.nowFunc()
+	t := APIToken{
+		ID:        mustID(16),
+		Name:      name,
+		UserID:    u.ID,
+		Username:  u.Username,
+		Scopes:    scopes,
+		CreatedAt: now,
+		TokenHash: s.hashAPIToken(raw),
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		t.ExpiresAt = &expiresAt
+	}
+	if err := s.apiTokens.Create(t); err != nil {
+		return APIToken{}, "", fmt.Errorf("store api token: %w", err)
+	}
+	return t, raw, nil
+}
+
+// ListAPITokens returns the tokens owned by userID, or every token when
+// userID is empty.
+func (s *Service) ListAPITokens(userID string) ([]APIToken, error) {
+	tokens, err := s.apiTokens.List()
+	if err != nil {
+		return nil, err
+	}
+	if userID == "" {
+		return tokens, nil
+	}
+	out := make([]APIToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.UserID == userID {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// RevokeAPIToken deletes a token. A non-empty ownerID restricts revocation to
+// that user's tokens; admins pass an empty ownerID.
+func (s *Service) RevokeAPIToken(id, ownerID string) error {
+	if ownerID != "" {
+		tokens, err := s.ListAPITokens(ownerID)
+		if err != nil {
+			return err
+		}
+		owned := false
+		for _, t := range tokens {
+			if t.ID == id {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			return ErrAPITokenNotFound
+		}
+	}
+	return s.apiTokens.Delete(id)
+}
+
+func (s *Service) revokeUserAPITokens(userID string) error {
+	tokens, err := s.ListAPITokens(userID)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := s.apiTokens.Delete(t.ID); err != nil && !errors.Is(err, ErrAPITokenNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateAPIToken resolves a presented API token into a Session so that
+// callers of ValidateToken need not distinguish the two credential types.
+func (s *Service) validateAPIToken(raw string) (Session, error) {
+	t, err := s.apiTokens.GetByHash(s.hashAPIToken(raw))
+	if err != nil {
+		return Session{}, ErrInvalidToken
+	}
+	now := s.nowFunc()
+	if t.ExpiresAt != nil && now.After(*t.ExpiresAt) {
+		return Session{}, ErrInvalidToken
+	}
+	u, err := s.users.GetByID(t.UserID)
+	if err != nil || s.checkAccountActive(u) != nil {
+		return Session{}, ErrInvalidToken
+	}
+	roles := make([]string, 0, len(t.Scopes))
+	for _, scope := range t.Scopes {
+		if containsString(u.Roles, scope) {
+			roles = append(roles, scope)
+		}
+	}
+	sort.Strings(roles)
+
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= apiTokenTouchInterval {
+		// Best effort: a failed write must not reject an otherwise valid token.
+		_ = s.apiTokens.TouchLastUsed(t.ID, now)
+	}
+
+	expiresAt := now.Add(s.ttl)
+	if t.ExpiresAt != nil {
+		expiresAt = *t.ExpiresAt
+	}
+	return Session{
+		ID:         t.ID,
+		Token:      raw,
+		UserID:     u.ID,
+		Username:   u.Username,
+		Roles:      roles,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  expiresAt,
+		APITokenID: t.ID,
+	}, nil
+}
+
+// hashAPIToken is keyed with the pepper so that a leaked token table cannot
+// be checked against guessed tokens without the server secret. API tokens
+// carry 256 bits of entropy, so a fast MAC is sufficient.
+func (s *Service) hashAPIToken(raw string) string {
+	return s.keyedHash("api-token", raw)
+}
+
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
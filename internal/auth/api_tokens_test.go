@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	store := NewInMemoryUserStore()
+	tokens := NewInMemoryAPITokenStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute, APITokens: tokens})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	svc.nowFunc = func() time.Time { return now }
+
+	u, err := svc.CreateUser("ci-bot", "Password123!x", "", []string{"admin", "operator"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+
+	if _, _, err := svc.CreateAPIToken(u.ID, "deploy", []string{"auditor"}, 0); !errors.Is(err, ErrInvalidAPIToken) {
+		t.Fatalf("expected ErrInvalidAPIToken for scope outside user roles, got %v", err)
+	}
+	if _, _, err := svc.CreateAPIToken(u.ID, " ", nil, 0); !errors.Is(err, ErrInvalidAPIToken) {
+		t.Fatalf("expected ErrInvalidAPIToken for empty name, got %v", err)
+	}
+
+	created, raw, err := svc.CreateAPIToken(u.ID, "deploy", []string{"Operator"}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error: %v", err)
+	}
+	if !strings.HasPrefix(raw, apiTokenPrefix) || created.ExpiresAt == nil {
+		t.Fatalf("unexpected token %q / %+v", raw, created)
+	}
+	stored, _ := tokens.List()
+	if len(stored) != 1 || stored[0].TokenHash == "" || strings.Contains(stored[0].TokenHash, raw) {
+		t.Fatalf("expected only a hash to be stored, got %+v", stored)
+	}
+
+	session, err := svc.ValidateToken(raw)
+	if err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if session.APITokenID != created.ID || len(session.Roles) != 1 || session.Roles[0] != "operator" {
+		t.Fatalf("unexpected api token session: %+v", session)
+	}
+	listed, _ := svc.ListAPITokens(u.ID)
+	if len(listed) != 1 || listed[0].LastUsedAt == nil || !listed[0].LastUsedAt.Equal(now) {
+		t.Fatalf("expected last used to be recorded, got %+v", listed)
+	}
+
+	// Dropping the role from the user narrows the token immediately.
+	if _, err := svc.UpdateUser(u.ID, "ci-bot", "", []string{"admin"}); err != nil {
+		t.Fatalf("UpdateUser() error: %v", err)
+	}
+	session, err = svc.ValidateToken(raw)
+	if err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if len(session.Roles) != 0 {
+		t.Fatalf("expected no effective roles, got %v", session.Roles)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := svc.ValidateToken(raw); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected expired token to be rejected, got %v", err)
+	}
+
+	other, err := svc.CreateUser("alice", "Password123!x", "", nil)
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	if err := svc.RevokeAPIToken(created.ID, other.ID); !errors.Is(err, ErrAPITokenNotFound) {
+		t.Fatalf("expected other users to be unable to revoke, got %v", err)
+	}
+	if err := svc.RevokeAPIToken(created.ID, u.ID); err != nil {
+		t.Fatalf("RevokeAPIToken() error: %v", err)
+	}
+	if listed, _ := svc.ListAPITokens(""); len(listed) != 0 {
+		t.Fatalf("expected no tokens after revoke, got %+v", listed)
+	}
+}
+
+func TestDeleteUserRevokesAPITokens(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	u, err := svc.CreateUser("ci-bot", "Password123!x", "", []string{"admin"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	_, raw, err := svc.CreateAPIToken(u.ID, "deploy", nil, 0)
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error: %v", err)
+	}
+	if err := svc.DeleteUser(u.ID); err != nil {
+		t.Fatalf("DeleteUser() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(raw); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected token of deleted user to be rejected, got %v", err)
+	}
+	if listed, _ := svc.ListAPITokens(""); len(listed) != 0 {
+		t.Fatalf("expected tokens to be removed with the user, got %+v", listed)
+	}
+}
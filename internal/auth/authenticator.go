@@ -0,0 +1,16 @@
+package auth
+
+// Authenticator verifies a username and password against an external
+// directory. It returns ErrInvalidCredentials when the directory rejects the
+// credentials and any other error when the directory cannot be reached.
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (ExternalIdentity, error)
+}
+
+type ExternalIdentity struct {
+	// Subject identifies the user stably within the directory.
+	Subject  string
+	Username string
+	Roles    []string
+}
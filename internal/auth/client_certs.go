@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrClientCertDisabled = errors.New("client certificate authentication not configured")
+	ErrInvalidClientCert  = errors.New("client certificate does not name a user")
+)
+
+const clientCertProvider = "mtls"
+
+// ClientCertConfig maps client certificates, already verified by TLS against
+// the configured client CA, to MCS users. UsernameFrom picks the identity:
+// "cn" (subject common name), "dns", "uri" or "email" (first SAN of that
+// kind). RoleMap keys are matched case-insensitively against the subject's
+// organizational units and the username; DefaultRoles apply when nothing
+// maps.
+type ClientCertConfig struct {
+	UsernameFrom string
+	RoleMap      map[string]string
+	DefaultRoles []string
+}
+
+func (c ClientCertConfig) validate() error {
+	switch c.UsernameFrom {
+	case "cn", "dns", "uri", "email":
+		return nil
+	}
+	return fmt.Errorf("client certificate username source must be cn, dns, uri or email")
+}
+
+func (s *Service) ClientCertEnabled() bool {
+	return s.clientCerts != nil
+}
+
+// AuthenticateClientCertificate returns a session for the user named by a
+// verified client certificate, provisioning the user on first use. The
+// session is not stored and lasts as long as the request; it carries the
+// certificate's SHA-256 fingerprint in ClientCertificate.
+func (s *Service) AuthenticateClientCertificate(cert *x509.Certificate, client ClientInfo) (Session, error) {
+	if s.clientCerts == nil {
+		return Session{}, ErrClientCertDisabled
+	}
+	username := s.clientCertUsername(cert)
+	if username == "" {
+		return Session{}, ErrInvalidClientCert
+	}
+	// The subject is the identity rather than the certificate, so that a
+	// renewed certificate keeps the same user.
+	u, err := s.provisionExternalUser(clientCertProvider, s.clientCerts.UsernameFrom+":"+username, username, s.clientCertRoles(cert, username))
+	if errors.Is(err, ErrExternalAccountConflict) || errors.Is(err, ErrInvalidUserInput) {
+		return Session{}, fmt.Errorf("%w: %v", ErrInvalidClientCert, err)
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if err := s.checkAccountActive(u); err != nil {
+		return Session{}, err
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	notAfter := capToAccountExpiry(u, cert.NotAfter)
+	return Session{
+		ID:                "mtls-" + fingerprint[:16],
+		UserID:            u.ID,
+		Username:          u.Username,
+		Roles:             append([]string(nil), u.Roles...),
+		CreatedAt:         cert.NotBefore,
+		ExpiresAt:         notAfter,
+		AbsoluteExpiresAt: notAfter,
+		LastSeenAt:        s.nowFunc(),
+		ClientIP:          client.IP,
+		UserAgent:         truncateUserAgent(client.UserAgent),
+		ClientCertificate: fingerprint,
+	}, nil
+}
+
+func (s *Service) clientCertUsername(cert *x509.Certificate) string {
+	switch s.clientCerts.UsernameFrom {
+	case "cn":
+		return strings.TrimSpace(cert.Subject.CommonName)
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			return strings.ToLower(cert.DNSNames[0])
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			return strings.ToLower(cert.EmailAddresses[0])
+		}
+	}
+	return ""
+}
+
+func (s *Service) clientCertRoles(cert *x509.Certificate, username string) []string {
+	var roles []string
+	for _, key := range append([]string{username}, cert.Subject.OrganizationalUnit...) {
+		if role, ok := lookupFold(s.clientCerts.RoleMap, key); ok {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = s.clientCerts.DefaultRoles
+	}
+	return normalizeRoles(roles)
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestClientCert(t *testing.T, subject pkix.Name, dnsNames ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestAuthenticateClientCertificate(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, ClientCerts: &ClientCertConfig{
+		UsernameFrom: "cn",
+		RoleMap:      map[string]string{"Test Nodes": "operator", "node-admin": "admin"},
+		DefaultRoles: []string{"viewer"},
+	}})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+	cert := newTestClientCert(t, pkix.Name{CommonName: "node-17", OrganizationalUnit: []string{"Test Nodes"}})
+	session, err := svc.AuthenticateClientCertificate(cert, ClientInfo{IP: "10.0.0.17"})
+	if err != nil {
+		t.Fatalf("AuthenticateClientCertificate() error: %v", err)
+	}
+	if session.Username != "node-17" || !slices.Equal(session.Roles, []string{"operator"}) || session.ClientCertificate == "" || session.Token != "" {
+		t.Fatalf("unexpected certificate session %+v", session)
+	}
+	u, err := svc.GetUser(session.UserID)
+	if err != nil || u.AuthProvider != clientCertProvider || u.ExternalSubject != "cn:node-17" {
+		t.Fatalf("expected a provisioned mtls user, got %+v, %v", u, err)
+	}
+
+	renewed := newTestClientCert(t, pkix.Name{CommonName: "node-17"})
+	again, err := svc.AuthenticateClientCertificate(renewed, ClientInfo{})
+	if err != nil {
+		t.Fatalf("AuthenticateClientCertificate() with renewed certificate error: %v", err)
+	}
+	if again.UserID != session.UserID || again.ClientCertificate == session.ClientCertificate || !slices.Equal(again.Roles, []string{"viewer"}) {
+		t.Fatalf("expected the renewed certificate to map to the same user with default roles, got %+v", again)
+	}
+
+	if _, err := svc.AuthenticateClientCertificate(newTestClientCert(t, pkix.Name{CommonName: "admin"}), ClientInfo{}); !errors.Is(err, ErrInvalidClientCert) {
+		t.Fatalf("expected a certificate naming a local account rejected, got %v", err)
+	}
+	if _, err := svc.AuthenticateClientCertificate(newTestClientCert(t, pkix.Name{}), ClientInfo{}); !errors.Is(err, ErrInvalidClientCert) {
+		t.Fatalf("expected a certificate without a common name rejected, got %v", err)
+	}
+
+	if _, err := svc.SetUserStatus(session.UserID, true, nil); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	if _, err := svc.AuthenticateClientCertificate(renewed, ClientInfo{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+}
+
+func TestClientCertificateUsernameFromSAN(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, ClientCerts: &ClientCertConfig{
+		UsernameFrom: "dns",
+		RoleMap:      map[string]string{"ci.example.com": "operator"},
+	}})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	session, err := svc.AuthenticateClientCertificate(newTestClientCert(t, pkix.Name{CommonName: "ignored"}, "CI.example.com"), ClientInfo{})
+	if err != nil {
+		t.Fatalf("AuthenticateClientCertificate() error: %v", err)
+	}
+	if session.Username != "ci.example.com" || !slices.Equal(session.Roles, []string{"operator"}) {
+		t.Fatalf("unexpected certificate session %+v", session)
+	}
+	if _, err := svc.AuthenticateClientCertificate(newTestClientCert(t, pkix.Name{CommonName: "no-san"}), ClientInfo{}); !errors.Is(err, ErrInvalidClientCert) {
+		t.Fatalf("expected a certificate without a DNS SAN rejected, got %v", err)
+	}
+
+	if _, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, ClientCerts: &ClientCertConfig{UsernameFrom: "serial"}}); err == nil {
+		t.Fatalf("expected an unknown username source rejected")
+	}
+	plain, _ := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour})
+	if plain.ClientCertEnabled() {
+		t.Fatalf("expected client certificates off by default")
+	}
+	if _, err := plain.AuthenticateClientCertificate(newTestClientCert(t, pkix.Name{CommonName: "node-1"}), ClientInfo{}); !errors.Is(err, ErrClientCertDisabled) {
+		t.Fatalf("expected ErrClientCertDisabled, got %v", err)
+	}
+}
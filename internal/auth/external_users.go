@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrExternalAccountConflict = errors.New("username belongs to a different account")
+
+// externalPasswordHash marks accounts that authenticate only through an
+// external identity provider. It never matches any password.
+const externalPasswordHash = "!external"
+
+// provisionExternalUser creates the user on first login and keeps roles in
+// sync with the identity provider afterwards, including those of sessions
+// the user already holds. An existing account is only reused when it was
+// provisioned by the same provider for the same subject, so an IdP user
+// cannot take over a local account that shares the name. An account
+// provisioned over SCIM is reused when its external ID is the subject, and
+// keeps the roles its SCIM groups grant.
+func (s *Service) provisionExternalUser(provider, subject, username string, roles []string) (User, error) {
+	if err := validateUsername(username); err != nil {
+		return User{}, err
+	}
+	u, err := s.users.GetByUsername(username)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		id, err := generateToken(16)
+		if err != nil {
+			return User{}, fmt.Errorf("generate user id: %w", err)
+		}
+		u = User{
+			ID:              id,
+			Username:        username,
+			PasswordHash:    externalPasswordHash,
+			Roles:           roles,
+			AuthProvider:    provider,
+			ExternalSubject: subject,
+		}
+	case err != nil:
+		return User{}, fmt.Errorf("load user: %w", err)
+	case u.AuthProvider == scimProvider && u.ExternalSubject != "" && u.ExternalSubject == subject:
+		return u, nil
+	case u.AuthProvider != provider || u.ExternalSubject != subject:
+		return User{}, ErrExternalAccountConflict
+	case slices.Equal(u.Roles, roles):
+		return u, nil
+	default:
+		u.Roles = roles
+		if err := s.users.Put(u); err != nil {
+			return User{}, fmt.Errorf("store user: %w", err)
+		}
+		if err := s.syncUserSessions(u); err != nil {
+			return User{}, fmt.Errorf("update sessions: %w", err)
+		}
+		return u, nil
+	}
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store user: %w", err)
+	}
+	return u, nil
+}
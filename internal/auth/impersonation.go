@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrImpersonationNotAllowed = errors.New("impersonation not allowed")
+	ErrNotImpersonating        = errors.New("session is not an impersonation session")
+)
+
+const defaultImpersonationTTL = 30 * time.Minute
+
+// Impersonate issues a session that acts as targetID on behalf of the admin
+// holding token. The session cannot be refreshed, lasts at most the
+// impersonation TTL and never outlives the admin's own session. Acting as a
+// user holding any permission the actor lacks needs PermUserImpersonateAdmin,
+// and impersonation sessions and API tokens cannot start another
+// impersonation.
+func (s *Service) Impersonate(token, targetID string, client ClientInfo) (Session, error) {
+	actor, err := s.ValidateToken(token)
+	if err != nil {
+		return Session{}, err
+	}
+	if actor.ImpersonatorID != "" || actor.APITokenID != "" || actor.UserID == targetID {
+		return Session{}, ErrImpersonationNotAllowed
+	}
+	perms, err := s.Permissions(actor.Roles)
+	if err != nil {
+		return Session{}, err
+	}
+	if !containsString(perms, PermUserImpersonate) {
+		return Session{}, ErrImpersonationNotAllowed
+	}
+	target, err := s.users.GetByID(targetID)
+	if err != nil {
+		return Session{}, err
+	}
+	targetPerms, err := s.Permissions(target.Roles)
+	if err != nil {
+		return Session{}, err
+	}
+	if !containsAll(perms, targetPerms) && !containsString(perms, PermUserImpersonateAdmin) {
+		return Session{}, ErrImpersonationNotAllowed
+	}
+	if err := s.checkAccountActive(target); err != nil {
+		return Session{}, err
+	}
+
+	raw, err := generateToken(32)
+	if err != nil {
+		return Session{}, fmt.Errorf("generate token: %w", err)
+	}
+	now := s.nowFunc()
+	absoluteExpiresAt := now.Add(s.impersonationTTL)
+	if actor.AbsoluteExpiresAt.Before(absoluteExpiresAt) {
+		absoluteExpiresAt = actor.AbsoluteExpiresAt
+	}
+	absoluteExpiresAt = capToAccountExpiry(target, absoluteExpiresAt)
+	session := Session{
+		ID:                mustID(16),
+		Token:             raw,
+		UserID:            target.ID,
+		Username:          target.Username,
+		Roles:             append([]string(nil), target.Roles...),
+		CreatedAt:         now,
+		ExpiresAt:         s.idleDeadline(now, absoluteExpiresAt),
+		AbsoluteExpiresAt: absoluteExpiresAt,
+		LastSeenAt:        now,
+		ClientIP:          client.IP,
+		UserAgent:         truncateUserAgent(client.UserAgent),
+
+		ImpersonatorID:       actor.UserID,
+		ImpersonatorUsername: actor.Username,
+	}
+	stored := session
+	stored.Token = ""
+	if err := s.sessions.Create(s.hashSessionToken(raw), stored); err != nil {
+		return Session{}, fmt.Errorf("store session: %w", err)
+	}
+	s.pruneSessions(now)
+	return session, nil
+}
+
+// EndImpersonation revokes an impersonation session and returns it. The
+// admin's own session is unaffected.
+func (s *Service) EndImpersonation(token string) (Session, error) {
+	session, err := s.ValidateToken(token)
+	if err != nil {
+		return Session{}, err
+	}
+	if session.ImpersonatorID == "" {
+		return Session{}, ErrNotImpersonating
+	}
+	if err := s.deleteSession(s.hashSessionToken(token), session.ID); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// containsAll reports whether have includes every value of want.
+func containsAll(have, want []string) bool {
+	for _, v := range want {
+		if !containsString(have, v) {
+			return false
+		}
+	}
+	return true
+}
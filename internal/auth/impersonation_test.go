@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestImpersonation(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	now := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	svc.nowFunc = func() time.Time { return now }
+	if _, err := svc.CreateRole("support", "", []string{PermUserImpersonate}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+	boss, _ := svc.CreateUser("boss", "Password123!x", "", []string{AdminRole})
+	if _, err := svc.CreateRole("deployer", "", []string{PermMigrationApply}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+	helper, _ := svc.CreateUser("helper", "Password123!x", "", []string{"support", "operator"})
+	ops, _ := svc.CreateUser("ops", "Password123!x", "", []string{"operator"})
+	deployer, _ := svc.CreateUser("deployer", "Password123!x", "", []string{"operator", "deployer"})
+
+	helperSession, err := svc.Login("helper", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	// boss and deployer hold permissions helper lacks.
+	for _, target := range []string{boss.ID, deployer.ID, helper.ID} {
+		if _, err := svc.Impersonate(helperSession.Token, target, ClientInfo{}); !errors.Is(err, ErrImpersonationNotAllowed) {
+			t.Fatalf("Impersonate(%s) expected ErrImpersonationNotAllowed, got %v", target, err)
+		}
+	}
+	if _, err := svc.Impersonate(helperSession.Token, "missing", ClientInfo{}); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	imp, err := svc.Impersonate(helperSession.Token, ops.ID, ClientInfo{IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Impersonate() error: %v", err)
+	}
+	if imp.UserID != ops.ID || imp.ImpersonatorID != helper.ID || imp.ImpersonatorUsername != "helper" || imp.RefreshToken != "" {
+		t.Fatalf("unexpected impersonation session %+v", imp)
+	}
+	if !imp.AbsoluteExpiresAt.Equal(now.Add(defaultImpersonationTTL)) {
+		t.Fatalf("expected impersonation to end after the ttl, got %v", imp.AbsoluteExpiresAt)
+	}
+	sess, err := svc.ValidateToken(imp.Token)
+	if err != nil || sess.Username != "ops" || sess.ImpersonatorID != helper.ID {
+		t.Fatalf("ValidateToken() = %+v, %v", sess, err)
+	}
+	if _, err := svc.Impersonate(imp.Token, boss.ID, ClientInfo{}); !errors.Is(err, ErrImpersonationNotAllowed) {
+		t.Fatalf("expected nested impersonation to fail, got %v", err)
+	}
+	if _, err := svc.EndImpersonation(helperSession.Token); !errors.Is(err, ErrNotImpersonating) {
+		t.Fatalf("expected ErrNotImpersonating, got %v", err)
+	}
+
+	now = now.Add(defaultImpersonationTTL + time.Second)
+	if _, err := svc.ValidateToken(imp.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected impersonation to expire, got %v", err)
+	}
+	if _, err := svc.ValidateToken(helperSession.Token); err != nil {
+		t.Fatalf("expected the admin session to outlive the impersonation, got %v", err)
+	}
+
+	imp, err = svc.Impersonate(helperSession.Token, ops.ID, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Impersonate() error: %v", err)
+	}
+	if ended, err := svc.EndImpersonation(imp.Token); err != nil || ended.ID != imp.ID {
+		t.Fatalf("EndImpersonation() = %+v, %v", ended, err)
+	}
+	if _, err := svc.ValidateToken(imp.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ended impersonation to be revoked, got %v", err)
+	}
+	if _, err := svc.ValidateToken(helperSession.Token); err != nil {
+		t.Fatalf("expected ending impersonation to keep the admin session, got %v", err)
+	}
+
+	imp, err = svc.Impersonate(helperSession.Token, ops.ID, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Impersonate() error: %v", err)
+	}
+	if err := svc.RevokeUserSessions(helper.ID); err != nil {
+		t.Fatalf("RevokeUserSessions() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(imp.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected revoking the admin to end the impersonation, got %v", err)
+	}
+
+	bossSession, err := svc.Login("boss", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if _, err := svc.Impersonate(bossSession.Token, helper.ID, ClientInfo{}); err != nil {
+		t.Fatalf("expected admin to impersonate, got %v", err)
+	}
+	if _, err := svc.SetUserStatus(ops.ID, true, nil); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	if _, err := svc.Impersonate(bossSession.Token, ops.ID, ClientInfo{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	ldapProviderName       = "ldap"
+	defaultLDAPTimeout     = 10 * time.Second
+	defaultLDAPUserFilter  = "(uid=%s)"
+	defaultLDAPUserAttr    = "uid"
+	defaultLDAPGroupsAttr  = "memberOf"
+	ldapSearchSizeLimit    = 2
+	ldapSearchTimeLimitSec = 10
+)
+
+type LDAPConfig struct {
+	// URL is ldap://host[:port] or ldaps://host[:port].
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACertFile         string
+	// BindDN and BindPassword identify the service account used to search
+	// for the user entry. Both empty means an anonymous search.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter must contain one %s, replaced by the escaped username.
+	UserFilter        string
+	UsernameAttribute string
+	GroupAttribute    string
+	// RoleMap keys are matched case-insensitively against each group DN and
+	// against the group's leading RDN value (usually its CN).
+	RoleMap      map[string]string
+	DefaultRoles []string
+	Timeout      time.Duration
+}
+
+// ldapConn is the subset of *ldap.Conn used for authentication.
+type ldapConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPAuthenticator verifies credentials with search-then-bind: a service
+// account locates the user entry and the user's own password is then checked
+// by binding as that entry.
+type LDAPAuthenticator struct {
+	cfg       LDAPConfig
+	tlsConfig *tls.Config
+	dial      func() (ldapConn, error)
+}
+
+func NewLDAPAuthenticator(cfg LDAPConfig) (*LDAPAuthenticator, error) {
+	u, err := url.Parse(strings.TrimSpace(cfg.URL))
+	if err != nil || u.Host == "" || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return nil, fmt.Errorf("ldap url must be ldap://host or ldaps://host")
+	}
+	if u.Scheme == "ldaps" && cfg.StartTLS {
+		return nil, fmt.Errorf("ldap starttls cannot be combined with ldaps")
+	}
+	if strings.TrimSpace(cfg.BaseDN) == "" {
+		return nil, fmt.Errorf("ldap base dn is required")
+	}
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = defaultLDAPUserFilter
+	}
+	if strings.Count(cfg.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("ldap user filter must contain exactly one %%s")
+	}
+	if cfg.UsernameAttribute == "" {
+		cfg.UsernameAttribute = defaultLDAPUserAttr
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = defaultLDAPGroupsAttr
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultLDAPTimeout
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ldap ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ldap ca file contains no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	a := &LDAPAuthenticator{cfg: cfg, tlsConfig: tlsConfig}
+	a.dial = func() (ldapConn, error) {
+		conn, err := ldap.DialURL(u.String(),
+			ldap.DialWithDialer(&net.Dialer{Timeout: cfg.Timeout}),
+			ldap.DialWithTLSConfig(tlsConfig))
+		if err != nil {
+			return nil, err
+		}
+		conn.SetTimeout(cfg.Timeout)
+		return conn, nil
+	}
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return ldapProviderName
+}
+
+func (a *LDAPAuthenticator) Authenticate(username, password string) (ExternalIdentity, error) {
+	// An empty password would be an unauthenticated bind, which many servers
+	// accept as success.
+	if username == "" || password == "" {
+		return ExternalIdentity{}, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return ExternalIdentity{}, fmt.Errorf("connect to ldap: %w", err)
+	}
+	defer conn.Close()
+
+	if a.cfg.StartTLS {
+		if err := conn.StartTLS(a.tlsConfig); err != nil {
+			return ExternalIdentity{}, fmt.Errorf("ldap starttls: %w", err)
+		}
+	}
+	if a.cfg.BindDN != "" {
+		if err := conn.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+			return ExternalIdentity{}, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.cfg.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		ldapSearchSizeLimit,
+		ldapSearchTimeLimitSec,
+		false,
+		fmt.Sprintf(a.cfg.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.cfg.UsernameAttribute, a.cfg.GroupAttribute},
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return ExternalIdentity{}, fmt.Errorf("ldap user search: %w", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return ExternalIdentity{}, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return ExternalIdentity{}, ErrInvalidCredentials
+		}
+		return ExternalIdentity{}, fmt.Errorf("ldap user bind: %w", err)
+	}
+
+	name := strings.TrimSpace(entry.GetAttributeValue(a.cfg.UsernameAttribute))
+	if name == "" {
+		name = username
+	}
+	return ExternalIdentity{
+		Subject:  strings.ToLower(entry.DN),
+		Username: name,
+		Roles:    a.mapRoles(entry.GetAttributeValues(a.cfg.GroupAttribute)),
+	}, nil
+}
+
+func (a *LDAPAuthenticator) mapRoles(groups []string) []string {
+	var roles []string
+	for _, group := range groups {
+		if role, ok := lookupFold(a.cfg.RoleMap, group); ok {
+			roles = append(roles, role)
+			continue
+		}
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			if role, ok := lookupFold(a.cfg.RoleMap, dn.RDNs[0].Attributes[0].Value); ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		roles = a.cfg.DefaultRoles
+	}
+	return normalizeRoles(roles)
+}
+
+func lookupFold(m map[string]string, key string) (string, bool) {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type fakeLDAPConn struct {
+	startTLS bool
+	binds    []string
+	filter   string
+	entries  []*ldap.Entry
+	password string
+}
+
+func (c *fakeLDAPConn) StartTLS(*tls.Config) error { c.startTLS = true; return nil }
+func (c *fakeLDAPConn) Close() error               { return nil }
+func (c *fakeLDAPConn) Bind(username, password string) error {
+	c.binds = append(c.binds, username)
+	if username == "cn=svc,dc=example,dc=com" && password == "svc-pass" {
+		return nil
+	}
+	if password == c.password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.filter = req.Filter
+	return &ldap.SearchResult{Entries: c.entries}, nil
+}
+
+func newTestLDAPAuthenticator(t *testing.T, conn *fakeLDAPConn) *LDAPAuthenticator {
+	t.Helper()
+	a, err := NewLDAPAuthenticator(LDAPConfig{
+		URL:          "ldap://ldap.example.com",
+		StartTLS:     true,
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-pass",
+		BaseDN:       "dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		RoleMap: map[string]string{
+			"CN=MCS Admins,OU=Groups,DC=example,DC=com": "admin",
+			"mcs-ops": "operator",
+		},
+		DefaultRoles: []string{"viewer"},
+	})
+	if err != nil {
+		t.Fatalf("NewLDAPAuthenticator() error: %v", err)
+	}
+	a.dial = func() (ldapConn, error) { return conn, nil }
+	return a
+}
+
+func TestLDAPAuthenticatorSearchThenBind(t *testing.T) {
+	conn := &fakeLDAPConn{
+		password: "dir-pass",
+		entries: []*ldap.Entry{ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":      {"alice"},
+			"memberOf": {"cn=mcs admins,ou=groups,dc=example,dc=com", "cn=mcs-ops,ou=groups,dc=example,dc=com", "cn=other,dc=example,dc=com"},
+		})},
+	}
+	a := newTestLDAPAuthenticator(t, conn)
+
+	id, err := a.Authenticate("alice*)(uid=*", "dir-pass")
+	if err != nil {
+		t.Fatalf("Authenticate() error: %v", err)
+	}
+	if conn.filter != `(&(objectClass=person)(uid=alice\2a\29\28uid=\2a))` {
+		t.Fatalf("expected escaped filter, got %q", conn.filter)
+	}
+	if !conn.startTLS || len(conn.binds) != 2 || conn.binds[1] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("expected starttls, service bind and user bind, got tls=%v binds=%v", conn.startTLS, conn.binds)
+	}
+	if id.Username != "alice" || id.Subject != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("unexpected identity: %+v", id)
+	}
+	if len(id.Roles) != 2 || id.Roles[0] != "admin" || id.Roles[1] != "operator" {
+		t.Fatalf("unexpected roles: %v", id.Roles)
+	}
+
+	if _, err := a.Authenticate("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := a.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected empty password to be rejected before binding, got %v", err)
+	}
+	conn.entries = nil
+	if _, err := a.Authenticate("nobody", "dir-pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials for unknown user, got %v", err)
+	}
+}
+
+func TestNewLDAPAuthenticatorValidatesConfig(t *testing.T) {
+	cases := []LDAPConfig{
+		{URL: "http://ldap.example.com", BaseDN: "dc=example"},
+		{URL: "ldaps://ldap.example.com", StartTLS: true, BaseDN: "dc=example"},
+		{URL: "ldap://ldap.example.com"},
+		{URL: "ldap://ldap.example.com", BaseDN: "dc=example", UserFilter: "(uid=*)"},
+	}
+	for i, cfg := range cases {
+		if _, err := NewLDAPAuthenticator(cfg); err == nil {
+			t.Fatalf("case %d: expected config error", i)
+		}
+	}
+}
+
+type fakeAuthenticator struct {
+	calls int
+	err   error
+	id    ExternalIdentity
+}
+
+func (f *fakeAuthenticator) Name() string { return "ldap" }
+func (f *fakeAuthenticator) Authenticate(username, password string) (ExternalIdentity, error) {
+	f.calls++
+	if f.err != nil {
+		return ExternalIdentity{}, f.err
+	}
+	if password != "dir-pass" {
+		return ExternalIdentity{}, ErrInvalidCredentials
+	}
+	return f.id, nil
+}
+
+func TestLoginWithDirectoryAndLocalFallback(t *testing.T) {
+	store := NewInMemoryUserStore()
+	dir := &fakeAuthenticator{id: ExternalIdentity{Subject: "uid=alice,dc=example", Username: "alice", Roles: []string{"operator"}}}
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, Authenticator: dir})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	_ = store.Put(User{ID: "u-admin", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+
+	session, err := svc.Login("Alice", "dir-pass", ClientInfo{})
+	if err != nil {
+		t.Fatalf("directory Login() error: %v", err)
+	}
+	if session.Username != "alice" || len(session.Roles) != 1 || session.Roles[0] != "operator" {
+		t.Fatalf("unexpected directory session: %+v", session)
+	}
+	if u, _ := store.GetByUsername("alice"); u.AuthProvider != "ldap" {
+		t.Fatalf("expected provisioned ldap user, got %+v", u)
+	}
+
+	// The directory is down: local accounts still work and never reach it.
+	dir.err = errors.New("connection refused")
+	dir.calls = 0
+	if _, err := svc.Login("admin", "secret123", ClientInfo{}); err != nil {
+		t.Fatalf("local fallback Login() error: %v", err)
+	}
+	if dir.calls != 0 {
+		t.Fatalf("expected local account not to be delegated to the directory")
+	}
+	if _, err := svc.Login("alice", "dir-pass", ClientInfo{}); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected directory outage to surface as an error, got %v", err)
+	}
+
+	// A directory user with a local account's name cannot log in as it.
+	dir.err = nil
+	dir.id = ExternalIdentity{Subject: "uid=admin,dc=example", Username: "admin"}
+	if _, err := svc.Login("ADMIN", "dir-pass", ClientInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
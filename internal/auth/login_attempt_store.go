@@ -0,0 +1,364 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLoginAttemptNotFound = errors.New("login attempt record not found")
+
+// LoginAttempt tracks recent failed logins for one throttle key, either
+// "username:<name>" or "ip:<addr>".
+type LoginAttempt struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	BlockedUntil  time.Time `json:"blocked_until"`
+	Locked        bool      `json:"locked"`
+}
+
+// LoginAttemptStore persists failure counters so every replica applies the
+// same throttling. RecordFailure must apply next atomically with respect to
+// other writers of the same key.
+type LoginAttemptStore interface {
+	Get(key string) (LoginAttempt, bool, error)
+	List() ([]LoginAttempt, error)
+	RecordFailure(key string, next func(LoginAttempt) LoginAttempt) (LoginAttempt, error)
+	Delete(key string) error
+	DeleteExpired(before time.Time) error
+}
+
+type InMemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+func NewInMemoryLoginAttemptStore() *InMemoryLoginAttemptStore {
+	return &InMemoryLoginAttemptStore{attempts: make(map[string]LoginAttempt)}
+}
+
+func (s *InMemoryLoginAttemptStore) Get(key string) (LoginAttempt, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attempts[key]
+	return a, ok, nil
+}
+
+func (s *InMemoryLoginAttemptStore) List() ([]LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedLoginAttempts(s.attempts), nil
+}
+
+func (s *InMemoryLoginAttemptStore) RecordFailure(key string, next func(LoginAttempt) LoginAttempt) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.attempts[key]
+	if !ok {
+		current = LoginAttempt{Key: key}
+	}
+	updated := next(current)
+	updated.Key = key
+	s.attempts[key] = updated
+	return updated, nil
+}
+
+func (s *InMemoryLoginAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attempts[key]; !ok {
+		return ErrLoginAttemptNotFound
+	}
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *InMemoryLoginAttemptStore) DeleteExpired(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruneLoginAttempts(s.attempts, before)
+	return nil
+}
+
+// FileLoginAttemptStore rereads the state file on every operation so that
+// processes sharing the file see each other's counters.
+type FileLoginAttemptStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileLoginAttemptStore(path string) (*FileLoginAttemptStore, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("login attempt state file path is required")
+	}
+	return &FileLoginAttemptStore{path: path}, nil
+}
+
+func (s *FileLoginAttemptStore) Get(key string) (LoginAttempt, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.load()
+	if err != nil {
+		return LoginAttempt{}, false, err
+	}
+	a, ok := attempts[key]
+	return a, ok, nil
+}
+
+func (s *FileLoginAttemptStore) List() ([]LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return sortedLoginAttempts(attempts), nil
+}
+
+func (s *FileLoginAttemptStore) RecordFailure(key string, next func(LoginAttempt) LoginAttempt) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.load()
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+	current, ok := attempts[key]
+	if !ok {
+		current = LoginAttempt{Key: key}
+	}
+	updated := next(current)
+	updated.Key = key
+	attempts[key] = updated
+	if err := s.save(attempts); err != nil {
+		return LoginAttempt{}, err
+	}
+	return updated, nil
+}
+
+func (s *FileLoginAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := attempts[key]; !ok {
+		return ErrLoginAttemptNotFound
+	}
+	delete(attempts, key)
+	return s.save(attempts)
+}
+
+func (s *FileLoginAttemptStore) DeleteExpired(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts, err := s.load()
+	if err != nil {
+		return err
+	}
+	if pruneLoginAttempts(attempts, before) == 0 {
+		return nil
+	}
+	return s.save(attempts)
+}
+
+func (s *FileLoginAttemptStore) load() (map[string]LoginAttempt, error) {
+	out := make(map[string]LoginAttempt)
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return out, nil
+		}
+		return nil, fmt.Errorf("read login attempt file: %w", err)
+	}
+	if len(b) == 0 {
+		return out, nil
+	}
+	var decoded []LoginAttempt
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return nil, fmt.Errorf("decode login attempt file: %w", err)
+	}
+	for _, a := range decoded {
+		out[a.Key] = a
+	}
+	return out, nil
+}
+
+func (s *FileLoginAttemptStore) save(attempts map[string]LoginAttempt) error {
+	b, err := json.MarshalIndent(sortedLoginAttempts(attempts), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode login attempt file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir login attempt dir: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0o600); err != nil {
+		return fmt.Errorf("write login attempt file: %w", err)
+	}
+	return nil
+}
+
+type PostgresLoginAttemptStore struct {
+	db *sql.DB
+}
+
+func NewPostgresLoginAttemptStore(db *sql.DB) (*PostgresLoginAttemptStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database is required")
+	}
+	s := &PostgresLoginAttemptStore{db: db}
+	if err := s.ensureSchema(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PostgresLoginAttemptStore) ensureSchema() error {
+	const q = `
+CREATE TABLE IF NOT EXISTS auth_login_attempts (
+	key TEXT PRIMARY KEY,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMPTZ NOT NULL,
+	blocked_until TIMESTAMPTZ NOT NULL,
+	locked BOOLEAN NOT NULL DEFAULT FALSE
+)`
+	if _, err := s.db.Exec(q); err != nil {
+		return fmt.Errorf("ensure auth_login_attempts schema: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresLoginAttemptStore) Get(key string) (LoginAttempt, bool, error) {
+	const q = `
+SELECT key, failures, last_failure_at, blocked_until, locked
+FROM auth_login_attempts
+WHERE key = $1`
+	var a LoginAttempt
+	err := s.db.QueryRow(q, key).Scan(&a.Key, &a.Failures, &a.LastFailureAt, &a.BlockedUntil, &a.Locked)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LoginAttempt{}, false, nil
+		}
+		return LoginAttempt{}, false, fmt.Errorf("query login attempt: %w", err)
+	}
+	return a, true, nil
+}
+
+func (s *PostgresLoginAttemptStore) List() ([]LoginAttempt, error) {
+	const q = `
+SELECT key, failures, last_failure_at, blocked_until, locked
+FROM auth_login_attempts
+ORDER BY key ASC`
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, fmt.Errorf("query login attempts: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]LoginAttempt, 0)
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.Key, &a.Failures, &a.LastFailureAt, &a.BlockedUntil, &a.Locked); err != nil {
+			return nil, fmt.Errorf("scan login attempt: %w", err)
+		}
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate login attempts: %w", err)
+	}
+	return out, nil
+}
+
+// RecordFailure inserts a placeholder row if needed and then locks it, so
+// concurrent replicas serialize on the same key instead of losing updates.
+func (s *PostgresLoginAttemptStore) RecordFailure(key string, next func(LoginAttempt) LoginAttempt) (LoginAttempt, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return LoginAttempt{}, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	const insertQ = `
+INSERT INTO auth_login_attempts (key, failures, last_failure_at, blocked_until, locked)
+VALUES ($1, 0, 'epoch', 'epoch', FALSE)
+ON CONFLICT (key) DO NOTHING`
+	if _, err := tx.Exec(insertQ, key); err != nil {
+		return LoginAttempt{}, fmt.Errorf("insert login attempt: %w", err)
+	}
+
+	const selectQ = `
+SELECT key, failures, last_failure_at, blocked_until, locked
+FROM auth_login_attempts
+WHERE key = $1
+FOR UPDATE`
+	var current LoginAttempt
+	if err := tx.QueryRow(selectQ, key).Scan(&current.Key, &current.Failures, &current.LastFailureAt, &current.BlockedUntil, &current.Locked); err != nil {
+		return LoginAttempt{}, fmt.Errorf("lock login attempt: %w", err)
+	}
+
+	updated := next(current)
+	updated.Key = key
+	const updateQ = `
+UPDATE auth_login_attempts
+SET failures = $2, last_failure_at = $3, blocked_until = $4, locked = $5
+WHERE key = $1`
+	if _, err := tx.Exec(updateQ, key, updated.Failures, updated.LastFailureAt, updated.BlockedUntil, updated.Locked); err != nil {
+		return LoginAttempt{}, fmt.Errorf("update login attempt: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return LoginAttempt{}, fmt.Errorf("commit login attempt tx: %w", err)
+	}
+	return updated, nil
+}
+
+func (s *PostgresLoginAttemptStore) Delete(key string) error {
+	res, err := s.db.Exec(`DELETE FROM auth_login_attempts WHERE key = $1`, key)
+	if err != nil {
+		return fmt.Errorf("delete login attempt: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete login attempt rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrLoginAttemptNotFound
+	}
+	return nil
+}
+
+func (s *PostgresLoginAttemptStore) DeleteExpired(before time.Time) error {
+	const q = `DELETE FROM auth_login_attempts WHERE last_failure_at < $1 AND blocked_until < $1`
+	if _, err := s.db.Exec(q, before); err != nil {
+		return fmt.Errorf("delete expired login attempts: %w", err)
+	}
+	return nil
+}
+
+func sortedLoginAttempts(attempts map[string]LoginAttempt) []LoginAttempt {
+	out := make([]LoginAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		out = append(out, a)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func pruneLoginAttempts(attempts map[string]LoginAttempt, before time.Time) int {
+	removed := 0
+	for key, a := range attempts {
+		if a.LastFailureAt.Before(before) && a.BlockedUntil.Before(before) {
+			delete(attempts, key)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func incrementFailure(at time.Time) func(LoginAttempt) LoginAttempt {
+	return func(a LoginAttempt) LoginAttempt {
+		a.Failures++
+		a.LastFailureAt = at
+		a.BlockedUntil = at.Add(time.Minute)
+		return a
+	}
+}
+
+func TestFileLoginAttemptStoreSharedAcrossInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "attempts.json")
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	a, _ := NewFileLoginAttemptStore(path)
+	b, _ := NewFileLoginAttemptStore(path)
+
+	if _, err := a.RecordFailure("username:admin", incrementFailure(now)); err != nil {
+		t.Fatalf("RecordFailure() error: %v", err)
+	}
+	got, err := b.RecordFailure("username:admin", incrementFailure(now))
+	if err != nil {
+		t.Fatalf("RecordFailure() error: %v", err)
+	}
+	if got.Failures != 2 {
+		t.Fatalf("expected second instance to see first failure, got %d", got.Failures)
+	}
+
+	if err := a.DeleteExpired(now.Add(time.Hour)); err != nil {
+		t.Fatalf("DeleteExpired() error: %v", err)
+	}
+	if _, ok, _ := b.Get("username:admin"); ok {
+		t.Fatalf("expected expired record to be pruned")
+	}
+	if err := b.Delete("username:admin"); !errors.Is(err, ErrLoginAttemptNotFound) {
+		t.Fatalf("expected ErrLoginAttemptNotFound, got %v", err)
+	}
+}
+
+func TestPostgresLoginAttemptStoreRecordFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_login_attempts").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresLoginAttemptStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresLoginAttemptStore() error: %v", err)
+	}
+
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO auth_login_attempts").WithArgs("ip:10.0.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT key, failures, last_failure_at, blocked_until, locked FROM auth_login_attempts WHERE key = \\$1 FOR UPDATE").
+		WithArgs("ip:10.0.0.1").
+		WillReturnRows(sqlmock.NewRows([]string{"key", "failures", "last_failure_at", "blocked_until", "locked"}).
+			AddRow("ip:10.0.0.1", 2, now.Add(-time.Minute), now.Add(-time.Minute), false))
+	mock.ExpectExec("UPDATE auth_login_attempts").
+		WithArgs("ip:10.0.0.1", 3, now, now.Add(time.Minute), false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	got, err := store.RecordFailure("ip:10.0.0.1", incrementFailure(now))
+	if err != nil {
+		t.Fatalf("RecordFailure() error: %v", err)
+	}
+	if got.Failures != 3 {
+		t.Fatalf("expected 3 failures, got %d", got.Failures)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_login_attempts WHERE key = \\$1").WithArgs("ip:10.0.0.1").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.Delete("ip:10.0.0.1"); !errors.Is(err, ErrLoginAttemptNotFound) {
+		t.Fatalf("expected ErrLoginAttemptNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLoginThrottled = errors.New("too many login attempts")
+	ErrAccountLocked  = errors.New("account temporarily locked")
+)
+
+const (
+	usernameThrottlePrefix = "username:"
+	ipThrottlePrefix       = "ip:"
+	loginAttemptPruneEvery = time.Minute
+)
+
+// ThrottleConfig controls login failure backoff and lockout. Failures beyond
+// BackoffAfter block further attempts for BackoffBase, doubling per failure
+// up to BackoffMax. A username reaching LockoutThreshold, or a client IP
+// reaching IPThreshold, is blocked for LockoutDuration. Counters reset after
+// FailureWindow without failures.
+type ThrottleConfig struct {
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	IPThreshold      int
+	BackoffAfter     int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	FailureWindow    time.Duration
+}
+
+var DefaultThrottleConfig = ThrottleConfig{
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+	IPThreshold:      50,
+	BackoffAfter:     3,
+	BackoffBase:      time.Second,
+	BackoffMax:       time.Minute,
+	FailureWindow:    15 * time.Minute,
+}
+
+func (c ThrottleConfig) validate() error {
+	if c.LockoutThreshold <= 0 || c.IPThreshold <= 0 {
+		return fmt.Errorf("lockout thresholds must be > 0")
+	}
+	if c.BackoffAfter < 0 {
+		return fmt.Errorf("backoff free attempts must be >= 0")
+	}
+	if c.LockoutDuration <= 0 || c.BackoffBase <= 0 || c.BackoffMax < c.BackoffBase || c.FailureWindow <= 0 {
+		return fmt.Errorf("throttle durations must be > 0 and backoff max must be >= backoff base")
+	}
+	return nil
+}
+
+// LoginBlockedError is returned by Login when a username or client IP is
+// currently blocked. It matches ErrAccountLocked for username lockouts and
+// ErrLoginThrottled otherwise.
+type LoginBlockedError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginBlockedError) Error() string {
+	if e.Locked {
+		return ErrAccountLocked.Error()
+	}
+	return ErrLoginThrottled.Error()
+}
+
+func (e *LoginBlockedError) Is(target error) bool {
+	if e.Locked {
+		return target == ErrAccountLocked
+	}
+	return target == ErrLoginThrottled
+}
+
+func usernameThrottleKey(username string) string {
+	return usernameThrottlePrefix + strings.ToLower(strings.TrimSpace(username))
+}
+
+func ipThrottleKey(clientIP string) string {
+	return ipThrottlePrefix + clientIP
+}
+
+func (s *Service) loginThrottleKeys(username, clientIP string) []string {
+	keys := []string{usernameThrottleKey(username)}
+	if clientIP = strings.TrimSpace(clientIP); clientIP != "" {
+		keys = append(keys, ipThrottleKey(clientIP))
+	}
+	return keys
+}
+
+// checkLoginAllowed returns a *LoginBlockedError when any key is blocked.
+// A username lockout takes precedence so the caller can report it as such.
+func (s *Service) checkLoginAllowed(keys []string) error {
+	now := s.nowFunc()
+	var blocked *LoginBlockedError
+	for _, key := range keys {
+		a, ok, err := s.attempts.Get(key)
+		if err != nil {
+			return fmt.Errorf("load login attempts: %w", err)
+		}
+		if !ok || !now.Before(a.BlockedUntil) {
+			continue
+		}
+		locked := a.Locked && strings.HasPrefix(key, usernameThrottlePrefix)
+		retry := a.BlockedUntil.Sub(now)
+		if blocked == nil || (locked && !blocked.Locked) || (locked == blocked.Locked && retry > blocked.RetryAfter) {
+			blocked = &LoginBlockedError{RetryAfter: retry, Locked: locked}
+		}
+	}
+	if blocked != nil {
+		return blocked
+	}
+	return nil
+}
+
+func (s *Service) recordLoginFailure(keys []string) error {
+	now := s.nowFunc()
+	for _, key := range keys {
+		threshold := s.throttle.LockoutThreshold
+		if strings.HasPrefix(key, ipThrottlePrefix) {
+			threshold = s.throttle.IPThreshold
+		}
+		_, err := s.attempts.RecordFailure(key, func(a LoginAttempt) LoginAttempt {
+			if now.Sub(a.LastFailureAt) > s.throttle.FailureWindow {
+				a.Failures = 0
+				a.Locked = false
+			}
+			a.Failures++
+			a.LastFailureAt = now
+			a.BlockedUntil = now.Add(s.loginBackoff(a.Failures, threshold))
+			a.Locked = a.Failures >= threshold
+			return a
+		})
+		if err != nil {
+			return fmt.Errorf("record login failure: %w", err)
+		}
+	}
+	s.pruneLoginAttempts(now)
+	return nil
+}
+
+func (s *Service) loginBackoff(failures, threshold int) time.Duration {
+	if failures >= threshold {
+		return s.throttle.LockoutDuration
+	}
+	excess := failures - s.throttle.BackoffAfter
+	if excess <= 0 {
+		return 0
+	}
+	delay := s.throttle.BackoffBase
+	for i := 1; i < excess && delay < s.throttle.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > s.throttle.BackoffMax {
+		delay = s.throttle.BackoffMax
+	}
+	return delay
+}
+
+// clearUsernameFailures resets the username counter after a successful login.
+// The IP counter is left to expire so that one valid account cannot be used
+// to reset throttling for password guessing against others.
+func (s *Service) clearUsernameFailures(username string) {
+	_ = s.attempts.Delete(usernameThrottleKey(username))
+}
+
+func (s *Service) pruneLoginAttempts(now time.Time) {
+	s.pruneMu.Lock()
+	if now.Sub(s.lastPrune) < loginAttemptPruneEvery {
+		s.pruneMu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	s.pruneMu.Unlock()
+	_ = s.attempts.DeleteExpired(now.Add(-s.throttle.FailureWindow))
+}
+
+// ListLoginAttempts returns counters that are still within the failure window
+// or currently blocking logins.
+func (s *Service) ListLoginAttempts() ([]LoginAttempt, error) {
+	attempts, err := s.attempts.List()
+	if err != nil {
+		return nil, err
+	}
+	now := s.nowFunc()
+	out := make([]LoginAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		if now.Sub(a.LastFailureAt) > s.throttle.FailureWindow && !now.Before(a.BlockedUntil) {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func (s *Service) ClearLoginAttempts(key string) error {
+	return s.attempts.Delete(key)
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoffAndLockout(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{Throttle: ThrottleConfig{
+		LockoutThreshold: 4,
+		LockoutDuration:  10 * time.Minute,
+		IPThreshold:      100,
+		BackoffAfter:     1,
+		BackoffBase:      time.Second,
+		BackoffMax:       time.Minute,
+		FailureWindow:    time.Hour,
+	}})
+
+	if _, err := svc.Login("admin", "wrong", ClientInfo{IP: "10.0.0.1"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := svc.Login("admin", "wrong", ClientInfo{IP: "10.0.0.1"}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+
+	// Second failure exceeds the free allowance: even the right password is refused.
+	_, err := svc.Login("admin", "secret123", ClientInfo{IP: "10.0.0.1"})
+	var blocked *LoginBlockedError
+	if !errors.As(err, &blocked) || !errors.Is(err, ErrLoginThrottled) || blocked.RetryAfter != time.Second {
+		t.Fatalf("expected 1s throttle, got %v", err)
+	}
+
+	*now = now.Add(time.Second)
+	_, _ = svc.Login("Admin", "wrong", ClientInfo{IP: "10.0.0.2"})
+	*now = now.Add(2 * time.Second)
+	_, _ = svc.Login("admin", "wrong", ClientInfo{IP: "10.0.0.3"})
+
+	_, err = svc.Login("admin", "secret123", ClientInfo{IP: "10.0.0.4"})
+	if !errors.As(err, &blocked) || !errors.Is(err, ErrAccountLocked) || blocked.RetryAfter != 10*time.Minute {
+		t.Fatalf("expected 10m account lockout, got %v", err)
+	}
+
+	if err := svc.ClearLoginAttempts("username:admin"); err != nil {
+		t.Fatalf("ClearLoginAttempts() error: %v", err)
+	}
+	if _, err := svc.Login("admin", "secret123", ClientInfo{IP: "10.0.0.4"}); err != nil {
+		t.Fatalf("expected login after clearing lockout, got %v", err)
+	}
+	if _, ok, _ := svc.attempts.Get("username:admin"); ok {
+		t.Fatalf("expected successful login to reset username counter")
+	}
+}
+
+func TestLoginIPThrottleAcrossUsernames(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{Throttle: ThrottleConfig{
+		LockoutThreshold: 100,
+		LockoutDuration:  5 * time.Minute,
+		IPThreshold:      3,
+		BackoffAfter:     10,
+		BackoffBase:      time.Second,
+		BackoffMax:       time.Minute,
+		FailureWindow:    time.Hour,
+	}})
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		_, _ = svc.Login(name, "wrong", ClientInfo{IP: "192.0.2.9"})
+	}
+	_, err := svc.Login("admin", "secret123", ClientInfo{IP: "192.0.2.9"})
+	if !errors.Is(err, ErrLoginThrottled) {
+		t.Fatalf("expected IP throttle, got %v", err)
+	}
+	if _, err := svc.Login("admin", "secret123", ClientInfo{IP: "192.0.2.10"}); err != nil {
+		t.Fatalf("expected other IPs to be unaffected, got %v", err)
+	}
+
+	attempts, err := svc.ListLoginAttempts()
+	if err != nil {
+		t.Fatalf("ListLoginAttempts() error: %v", err)
+	}
+	if len(attempts) != 4 {
+		t.Fatalf("expected 3 username and 1 ip counters, got %+v", attempts)
+	}
+
+	*now = now.Add(2 * time.Hour)
+	attempts, _ = svc.ListLoginAttempts()
+	if len(attempts) != 0 {
+		t.Fatalf("expected counters outside the failure window to be hidden, got %+v", attempts)
+	}
+}
+
+func TestLoginFailureWindowResetsCounter(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{Throttle: ThrottleConfig{
+		LockoutThreshold: 2,
+		LockoutDuration:  time.Minute,
+		IPThreshold:      100,
+		BackoffAfter:     5,
+		BackoffBase:      time.Second,
+		BackoffMax:       time.Second,
+		FailureWindow:    10 * time.Minute,
+	}})
+
+	_, _ = svc.Login("admin", "wrong", ClientInfo{})
+	*now = now.Add(11 * time.Minute)
+	_, _ = svc.Login("admin", "wrong", ClientInfo{})
+	if _, err := svc.Login("admin", "secret123", ClientInfo{}); err != nil {
+		t.Fatalf("expected counter to reset after quiet window, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpStub is a minimal in-process SMTP server that accepts every message
+// and records it. It does not offer STARTTLS or AUTH.
+type smtpStub struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	mail []stubMail
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	st := &smtpStub{ln: ln}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go st.serve(conn)
+		}
+	}()
+	return st
+}
+
+func (st *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 stub ESMTP")
+	var cur stubMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-stub")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(cmd, "HELO"), cmd == "NOOP", cmd == "RSET":
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			cur = stubMail{From: smtpPath(line)}
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			cur.To = append(cur.To, smtpPath(line))
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			cur.Data = data.String()
+			st.mu.Lock()
+			st.mail = append(st.mail, cur)
+			st.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+// smtpPath returns the address between the angle brackets of a MAIL FROM or
+// RCPT TO command, ignoring parameters such as BODY=8BITMIME.
+func smtpPath(line string) string {
+	start, end := strings.Index(line, "<"), strings.Index(line, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return line[start+1 : end]
+}
+
+func (st *smtpStub) messages() []stubMail {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]stubMail(nil), st.mail...)
+}
+
+func (st *smtpStub) config(tlsMode string) SMTPConfig {
+	return SMTPConfig{Host: "127.0.0.1", Port: st.ln.Addr().(*net.TCPAddr).Port, From: "MCS <noreply@example.com>", TLS: tlsMode, Timeout: 5 * time.Second}
+}
+
+func TestSMTPMailerSendsToStub(t *testing.T) {
+	st := newSMTPStub(t)
+	m, err := NewSMTPMailer(st.config("none"))
+	if err != nil {
+		t.Fatalf("NewSMTPMailer() error: %v", err)
+	}
+	if err := m.Send("alice@example.com", "Password reset", "line one\nline two"); err != nil {
+		t.Fatalf("Send() error: %v", err)
+	}
+
+	got := st.messages()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(got))
+	}
+	msg := got[0]
+	if msg.From != "noreply@example.com" || len(msg.To) != 1 || msg.To[0] != "alice@example.com" {
+		t.Fatalf("unexpected envelope: %+v", msg)
+	}
+	for _, want := range []string{"Subject: Password reset\r\n", "To: alice@example.com\r\n", "\r\n\r\nline one\r\nline two\r\n"} {
+		if !strings.Contains(msg.Data, want) {
+			t.Fatalf("expected message to contain %q, got %q", want, msg.Data)
+		}
+	}
+
+	if err := m.Send("alice@example.com", "evil\r\nBcc: x@example.com", "body"); err == nil {
+		t.Fatalf("expected header injection to be rejected")
+	}
+}
+
+func TestSMTPMailerRequiresStartTLS(t *testing.T) {
+	st := newSMTPStub(t)
+	m, err := NewSMTPMailer(st.config("starttls"))
+	if err != nil {
+		t.Fatalf("NewSMTPMailer() error: %v", err)
+	}
+	if err := m.Send("alice@example.com", "hi", "body"); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected missing STARTTLS to fail, got %v", err)
+	}
+	if len(st.messages()) != 0 {
+		t.Fatalf("expected nothing delivered without TLS")
+	}
+}
+
+func TestNewSMTPMailerValidatesConfig(t *testing.T) {
+	for name, cfg := range map[string]SMTPConfig{
+		"missing host": {Port: 25, From: "a@example.com"},
+		"bad port":     {Host: "mail", From: "a@example.com"},
+		"bad from":     {Host: "mail", Port: 25, From: "not an address"},
+		"bad tls":      {Host: "mail", Port: 25, From: "a@example.com", TLS: "ssl"},
+	} {
+		if _, err := NewSMTPMailer(cfg); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
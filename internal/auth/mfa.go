@@ -0,0 +1,433 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMFARequired           = errors.New("mfa required")
+	ErrInvalidMFAChallenge   = errors.New("invalid or expired mfa challenge")
+	ErrInvalidMFACode        = errors.New("invalid mfa code")
+	ErrMFAAlreadyEnabled     = errors.New("mfa already enabled")
+	ErrMFAEnrollmentNotBegun = errors.New("mfa enrollment not started")
+	ErrLoginSessionRequired  = errors.New("a login session is required")
+)
+
+const (
+	defaultMFAIssuer      = "modern-mcs"
+	mfaChallengeTTL       = 5 * time.Minute
+	mfaChallengeMaxTries  = 5
+	recoveryCodeCount     = 10
+	recoveryCodeByteCount = 5
+)
+
+// MFAChallenge is the intermediate state between a successful password check
+// and an issued Session for users that must present a second factor.
+type MFAChallenge struct {
+	Token              string
+	UserID             string
+	Username           string
+	EnrollmentRequired bool
+	ExpiresAt          time.Time
+	// WebAuthn is set when the user can answer with a registered
+	// credential instead of a code.
+	WebAuthn bool
+
+	pendingSecret string
+	failures      int
+}
+
+// MFARequiredError is returned by Login and CompleteOIDCLogin when the first
+// factor was accepted but a second factor is still needed. It matches
+// ErrMFARequired with errors.Is.
+type MFARequiredError struct {
+	Challenge MFAChallenge
+}
+
+func (e *MFARequiredError) Error() string {
+	return ErrMFARequired.Error()
+}
+
+func (e *MFARequiredError) Is(target error) bool {
+	return target == ErrMFARequired
+}
+
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type MFAStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"`
+	EnrollmentPending      bool `json:"enrollment_pending"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+func (s *Service) mfaRequired(u User) (bool, error) {
+	if u.MFAEnabled || len(u.WebAuthnCredentials) > 0 {
+		return true, nil
+	}
+	return s.roleRequiresMFA(u.Roles)
+}
+
+func (s *Service) roleRequiresMFA(roles []string) (bool, error) {
+	required, err := s.mfaPolicy.RequiredRoles()
+	if err != nil {
+		return false, fmt.Errorf("load mfa policy: %w", err)
+	}
+	for _, want := range required {
+		for _, have := range roles {
+			if strings.EqualFold(strings.TrimSpace(have), want) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) newMFAChallenge(u User) (MFAChallenge, error) {
+	token, err := generateToken(32)
+	if err != nil {
+		return MFAChallenge{}, fmt.Errorf("generate mfa challenge token: %w", err)
+	}
+	now := s.nowFunc()
+	challenge := MFAChallenge{
+		Token:              token,
+		UserID:             u.ID,
+		Username:           u.Username,
+		EnrollmentRequired: !u.MFAEnabled && len(u.WebAuthnCredentials) == 0,
+		WebAuthn:           len(u.WebAuthnCredentials) > 0,
+		ExpiresAt:          now.Add(mfaChallengeTTL),
+	}
+	s.pruneSessions(now)
+	if err := s.sessions.CreateMFAChallenge(s.hashMFAChallengeToken(token), challenge); err != nil {
+		return MFAChallenge{}, fmt.Errorf("store mfa challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+func (s *Service) lookupMFAChallenge(token string) (MFAChallenge, error) {
+	c, err := s.sessions.GetMFAChallenge(s.hashMFAChallengeToken(token))
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	if s.nowFunc().After(c.ExpiresAt) {
+		return MFAChallenge{}, ErrInvalidMFAChallenge
+	}
+	c.Token = token
+	return c, nil
+}
+
+// recordMFAChallengeFailure counts a wrong answer against the challenge and
+// against the same username and IP throttle keys as a wrong password, so
+// fresh challenges cannot be used to keep guessing codes.
+func (s *Service) recordMFAChallengeFailure(c MFAChallenge, client ClientInfo) error {
+	key := s.hashMFAChallengeToken(c.Token)
+	failures, err := s.sessions.RecordMFAChallengeFailure(key)
+	if err == nil && failures >= mfaChallengeMaxTries {
+		_, _ = s.sessions.TakeMFAChallenge(key)
+	}
+	return s.recordLoginFailure(s.loginThrottleKeys(c.Username, client.IP))
+}
+
+// lookupMFAChallengeFor is lookupMFAChallenge for an answer from client; it
+// refuses answers while the username or IP is throttled.
+func (s *Service) lookupMFAChallengeFor(token string, client ClientInfo) (MFAChallenge, error) {
+	c, err := s.lookupMFAChallenge(token)
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	if err := s.checkLoginAllowed(s.loginThrottleKeys(c.Username, client.IP)); err != nil {
+		return MFAChallenge{}, err
+	}
+	return c, nil
+}
+
+// takeMFAChallenge consumes an answered challenge. Only one of several
+// requests answering it at once gets it, so a challenge yields one session.
+func (s *Service) takeMFAChallenge(token string) error {
+	_, err := s.sessions.TakeMFAChallenge(s.hashMFAChallengeToken(token))
+	return err
+}
+
+func (s *Service) hashMFAChallengeToken(token string) string {
+	return s.keyedHash("mfa-challenge", token)
+}
+
+// BeginChallengeEnrollment issues a TOTP secret for a user whose role requires
+// MFA but who has not enrolled yet. The secret only becomes active once
+// CompleteMFAChallenge verifies a code generated from it.
+func (s *Service) BeginChallengeEnrollment(mfaToken string) (MFAEnrollment, error) {
+	c, err := s.lookupMFAChallenge(mfaToken)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	if !c.EnrollmentRequired {
+		return MFAEnrollment{}, ErrMFAAlreadyEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return MFAEnrollment{}, fmt.Errorf("generate totp secret: %w", err)
+	}
+
+	if err := s.sessions.SetMFAChallengeSecret(s.hashMFAChallengeToken(mfaToken), secret); err != nil {
+		return MFAEnrollment{}, err
+	}
+	return MFAEnrollment{Secret: secret, OTPAuthURI: totpURI(s.mfaIssuer, c.Username, secret)}, nil
+}
+
+// CompleteMFAChallenge verifies a TOTP or recovery code against a pending
+// challenge and issues the session. When the challenge was an enrollment, the
+// freshly generated recovery codes are returned as well.
+func (s *Service) CompleteMFAChallenge(mfaToken, code string, client ClientInfo) (Session, []string, error) {
+	c, err := s.lookupMFAChallengeFor(mfaToken, client)
+	if err != nil {
+		return Session{}, nil, err
+	}
+	u, err := s.users.GetByID(c.UserID)
+	if err != nil {
+		return Session{}, nil, ErrInvalidMFAChallenge
+	}
+
+	var recoveryCodes []string
+	if c.EnrollmentRequired {
+		if c.pendingSecret == "" {
+			return Session{}, nil, ErrMFAEnrollmentNotBegun
+		}
+		step, ok := verifyTOTP(c.pendingSecret, code, s.nowFunc(), 0)
+		if !ok {
+			if err := s.recordMFAChallengeFailure(c, client); err != nil {
+				return Session{}, nil, err
+			}
+			return Session{}, nil, ErrInvalidMFACode
+		}
+		if err := s.takeMFAChallenge(mfaToken); err != nil {
+			return Session{}, nil, err
+		}
+		u, recoveryCodes, err = s.activateTOTP(u, c.pendingSecret, step)
+		if err != nil {
+			return Session{}, nil, err
+		}
+	} else {
+		ok, err := s.verifySecondFactor(u, code)
+		if err != nil {
+			return Session{}, nil, err
+		}
+		if !ok {
+			if err := s.recordMFAChallengeFailure(c, client); err != nil {
+				return Session{}, nil, err
+			}
+			return Session{}, nil, ErrInvalidMFACode
+		}
+		if err := s.takeMFAChallenge(mfaToken); err != nil {
+			return Session{}, nil, err
+		}
+	}
+
+	session, err := s.completeLogin(u, client)
+	if err != nil {
+		return Session{}, nil, err
+	}
+	return session, recoveryCodes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code and consumes it with a conditional store write, so concurrent requests
+// cannot both spend the same code.
+func (s *Service) verifySecondFactor(u User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	// Users whose only factor is a WebAuthn credential have no TOTP secret,
+	// and codes derived from an empty key must not pass.
+	if u.TOTPSecret != "" {
+		if step, ok := verifyTOTP(u.TOTPSecret, code, s.nowFunc(), u.TOTPLastStep); ok {
+			advanced, err := s.users.AdvanceTOTPStep(u.ID, step)
+			if err != nil {
+				return false, fmt.Errorf("store mfa state: %w", err)
+			}
+			return advanced, nil
+		}
+	}
+	candidate := s.hashRecoveryCode(code)
+	for _, h := range u.RecoveryCodeHashes {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(h)) == 1 {
+			taken, err := s.users.TakeRecoveryCode(u.ID, h)
+			if err != nil {
+				return false, fmt.Errorf("store mfa state: %w", err)
+			}
+			return taken, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) MFAStatus(token string) (MFAStatus, error) {
+	session, err := s.ValidateToken(token)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return MFAStatus{}, ErrInvalidToken
+	}
+	required, err := s.roleRequiresMFA(u.Roles)
+	if err != nil {
+		return MFAStatus{}, err
+	}
+	return MFAStatus{
+		Enabled:                u.MFAEnabled,
+		Required:               required,
+		EnrollmentPending:      u.TOTPPendingSecret != "",
+		RecoveryCodesRemaining: len(u.RecoveryCodeHashes),
+	}, nil
+}
+
+// BeginMFAEnrollment starts self-service enrollment for the session's user.
+// Impersonation sessions and API tokens cannot enroll a second factor.
+func (s *Service) BeginMFAEnrollment(token string) (MFAEnrollment, error) {
+	session, err := s.loginSession(token)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return MFAEnrollment{}, ErrInvalidToken
+	}
+	if u.MFAEnabled {
+		return MFAEnrollment{}, ErrMFAAlreadyEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return MFAEnrollment{}, fmt.Errorf("generate totp secret: %w", err)
+	}
+	u.TOTPPendingSecret = secret
+	if err := s.users.Put(u); err != nil {
+		return MFAEnrollment{}, fmt.Errorf("store pending totp secret: %w", err)
+	}
+	return MFAEnrollment{Secret: secret, OTPAuthURI: totpURI(s.mfaIssuer, u.Username, secret)}, nil
+}
+
+// ConfirmMFAEnrollment activates the pending secret once the user proves they
+// can generate codes from it, and returns one-time recovery codes.
+func (s *Service) ConfirmMFAEnrollment(token, code string) ([]string, error) {
+	session, err := s.loginSession(token)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if u.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if u.TOTPPendingSecret == "" {
+		return nil, ErrMFAEnrollmentNotBegun
+	}
+	step, ok := verifyTOTP(u.TOTPPendingSecret, code, s.nowFunc(), 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+	_, recoveryCodes, err := s.activateTOTP(u, u.TOTPPendingSecret, step)
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// loginSession validates token and refuses impersonation and API token
+// sessions, which must not change the user's own credentials.
+func (s *Service) loginSession(token string) (Session, error) {
+	session, err := s.ValidateToken(token)
+	if err != nil {
+		return Session{}, err
+	}
+	if session.ImpersonatorID != "" || session.APITokenID != "" {
+		return Session{}, ErrLoginSessionRequired
+	}
+	return session, nil
+}
+
+func (s *Service) activateTOTP(u User, secret string, step int64) (User, []string, error) {
+	codes, hashes, err := s.generateRecoveryCodes()
+	if err != nil {
+		return User{}, nil, err
+	}
+	u.MFAEnabled = true
+	u.TOTPSecret = secret
+	u.TOTPPendingSecret = ""
+	u.TOTPLastStep = step
+	u.RecoveryCodeHashes = hashes
+	if err := s.users.Put(u); err != nil {
+		return User{}, nil, fmt.Errorf("store mfa enrollment: %w", err)
+	}
+	return u, codes, nil
+}
+
+// ResetUserMFA clears a user's enrollment, including registered WebAuthn
+// credentials, so they can enroll again, e.g. after losing their
+// authenticator device.
+func (s *Service) ResetUserMFA(userID string) error {
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+	u.MFAEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPPendingSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodeHashes = nil
+	u.WebAuthnCredentials = nil
+	if err := s.users.Put(u); err != nil {
+		return fmt.Errorf("store mfa reset: %w", err)
+	}
+	if err := s.sessions.DeleteUserMFAChallenges(userID); err != nil {
+		return fmt.Errorf("delete mfa challenges: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) MFARequiredRoles() ([]string, error) {
+	roles, err := s.mfaPolicy.RequiredRoles()
+	if err != nil {
+		return nil, fmt.Errorf("load mfa policy: %w", err)
+	}
+	return normalizeRoles(roles), nil
+}
+
+func (s *Service) SetMFARequiredRoles(roles []string) error {
+	if err := s.mfaPolicy.SetRequiredRoles(normalizeRoles(roles)); err != nil {
+		return fmt.Errorf("store mfa policy: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := generateSalt(recoveryCodeByteCount)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		enc := hex.EncodeToString(raw)
+		code := enc[:5] + "-" + enc[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, s.hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// Recovery codes carry 40 bits of entropy and are single-use, so a peppered
+// SHA-256 is sufficient; a slow KDF would only add latency to each attempt.
+func (s *Service) hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	sum := sha256.Sum256([]byte(s.pepper + ":recovery:" + code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MFAPolicyStore persists the set of roles whose members must use MFA.
+type MFAPolicyStore interface {
+	RequiredRoles() ([]string, error)
+	SetRequiredRoles(roles []string) error
+}
+
+type InMemoryMFAPolicyStore struct {
+	mu    sync.RWMutex
+	roles []string
+}
+
+func NewInMemoryMFAPolicyStore() *InMemoryMFAPolicyStore {
+	return &InMemoryMFAPolicyStore{}
+}
+
+func (s *InMemoryMFAPolicyStore) RequiredRoles() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.roles...), nil
+}
+
+func (s *InMemoryMFAPolicyStore) SetRequiredRoles(roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles = append([]string(nil), roles...)
+	return nil
+}
+
+type FileMFAPolicyStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileMFAPolicyStore(path string) (*FileMFAPolicyStore, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("mfa policy state file path is required")
+	}
+	return &FileMFAPolicyStore{path: path}, nil
+}
+
+type fileMFAPolicy struct {
+	RequiredRoles []string `json:"required_roles"`
+}
+
+func (s *FileMFAPolicyStore) RequiredRoles() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read mfa policy file: %w", err)
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var decoded fileMFAPolicy
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return nil, fmt.Errorf("decode mfa policy file: %w", err)
+	}
+	return decoded.RequiredRoles, nil
+}
+
+func (s *FileMFAPolicyStore) SetRequiredRoles(roles []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.MarshalIndent(fileMFAPolicy{RequiredRoles: roles}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode mfa policy file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir mfa policy dir: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0o644); err != nil {
+		return fmt.Errorf("write mfa policy file: %w", err)
+	}
+	return nil
+}
+
+type PostgresMFAPolicyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresMFAPolicyStore(db *sql.DB) (*PostgresMFAPolicyStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database is required")
+	}
+	s := &PostgresMFAPolicyStore{db: db}
+	if err := s.ensureSchema(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PostgresMFAPolicyStore) ensureSchema() error {
+	const q = `
+CREATE TABLE IF NOT EXISTS auth_mfa_required_roles (
+	role TEXT PRIMARY KEY
+)`
+	if _, err := s.db.Exec(q); err != nil {
+		return fmt.Errorf("ensure auth_mfa_required_roles schema: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresMFAPolicyStore) RequiredRoles() ([]string, error) {
+	rows, err := s.db.Query(`SELECT role FROM auth_mfa_required_roles ORDER BY role ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query mfa required roles: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]string, 0)
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, fmt.Errorf("scan mfa required role: %w", err)
+		}
+		out = append(out, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate mfa required roles: %w", err)
+	}
+	return out, nil
+}
+
+func (s *PostgresMFAPolicyStore) SetRequiredRoles(roles []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM auth_mfa_required_roles`); err != nil {
+		return fmt.Errorf("clear mfa required roles: %w", err)
+	}
+	for _, role := range roles {
+		if _, err := tx.Exec(`INSERT INTO auth_mfa_required_roles (role) VALUES ($1)`, role); err != nil {
+			return fmt.Errorf("insert mfa required role: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit mfa policy tx: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFileMFAPolicyStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mfa_policy.json")
+	store, err := NewFileMFAPolicyStore(path)
+	if err != nil {
+		t.Fatalf("NewFileMFAPolicyStore() error: %v", err)
+	}
+	roles, err := store.RequiredRoles()
+	if err != nil || len(roles) != 0 {
+		t.Fatalf("expected empty policy, got %v (%v)", roles, err)
+	}
+	if err := store.SetRequiredRoles([]string{"admin"}); err != nil {
+		t.Fatalf("SetRequiredRoles() error: %v", err)
+	}
+
+	store2, _ := NewFileMFAPolicyStore(path)
+	roles, err = store2.RequiredRoles()
+	if err != nil {
+		t.Fatalf("RequiredRoles() error: %v", err)
+	}
+	if len(roles) != 1 || roles[0] != "admin" {
+		t.Fatalf("unexpected roles: %v", roles)
+	}
+}
+
+func TestPostgresMFAPolicyStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_mfa_required_roles").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresMFAPolicyStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresMFAPolicyStore() error: %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM auth_mfa_required_roles").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO auth_mfa_required_roles").WithArgs("admin").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := store.SetRequiredRoles([]string{"admin"}); err != nil {
+		t.Fatalf("SetRequiredRoles() error: %v", err)
+	}
+
+	mock.ExpectQuery("SELECT role FROM auth_mfa_required_roles").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin"))
+	roles, err := store.RequiredRoles()
+	if err != nil {
+		t.Fatalf("RequiredRoles() error: %v", err)
+	}
+	if len(roles) != 1 || roles[0] != "admin" {
+		t.Fatalf("unexpected roles: %v", roles)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func currentCode(t *testing.T, secret string, now time.Time) string {
+	t.Helper()
+	code, err := totpCode(secret, totpStep(now))
+	if err != nil {
+		t.Fatalf("totpCode() error: %v", err)
+	}
+	return code
+}
+
+func TestSelfEnrollmentThenTwoStepLogin(t *testing.T) {
+	svc, store, now := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	enrollment, err := svc.BeginMFAEnrollment(session.Token)
+	if err != nil {
+		t.Fatalf("BeginMFAEnrollment() error: %v", err)
+	}
+	if _, err := svc.ConfirmMFAEnrollment(session.Token, "000000"); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("expected ErrInvalidMFACode, got %v", err)
+	}
+	recovery, err := svc.ConfirmMFAEnrollment(session.Token, currentCode(t, enrollment.Secret, *now))
+	if err != nil {
+		t.Fatalf("ConfirmMFAEnrollment() error: %v", err)
+	}
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(recovery))
+	}
+
+	_, err = svc.Login("admin", "secret123", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) || !errors.Is(err, ErrMFARequired) {
+		t.Fatalf("expected MFARequiredError, got %v", err)
+	}
+	if mfaErr.Challenge.EnrollmentRequired {
+		t.Fatalf("expected verification challenge, not enrollment")
+	}
+
+	// The code used to confirm enrollment cannot be replayed.
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, enrollment.Secret, *now), ClientInfo{}); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("expected replayed code to fail, got %v", err)
+	}
+	*now = now.Add(totpPeriod * time.Second)
+	sess, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, enrollment.Secret, *now), ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteMFAChallenge() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(sess.Token); err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, "x", ClientInfo{}); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected challenge to be single-use, got %v", err)
+	}
+
+	// Recovery codes work once.
+	_, err = svc.Login("admin", "secret123", ClientInfo{})
+	errors.As(err, &mfaErr)
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, recovery[0], ClientInfo{}); err != nil {
+		t.Fatalf("CompleteMFAChallenge() with recovery code error: %v", err)
+	}
+	u, _ := store.GetByUsername("admin")
+	if len(u.RecoveryCodeHashes) != recoveryCodeCount-1 {
+		t.Fatalf("expected recovery code to be consumed, %d remain", len(u.RecoveryCodeHashes))
+	}
+	_, err = svc.Login("admin", "secret123", ClientInfo{})
+	errors.As(err, &mfaErr)
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, recovery[0], ClientInfo{}); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("expected reused recovery code to fail, got %v", err)
+	}
+}
+
+func TestRoleRequiredMFAEnrollsDuringLogin(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+	if err := svc.SetMFARequiredRoles([]string{"Admin"}); err != nil {
+		t.Fatalf("SetMFARequiredRoles() error: %v", err)
+	}
+
+	_, err := svc.Login("admin", "secret123", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) || !mfaErr.Challenge.EnrollmentRequired {
+		t.Fatalf("expected enrollment challenge, got %v", err)
+	}
+	token := mfaErr.Challenge.Token
+	if _, _, err := svc.CompleteMFAChallenge(token, "123456", ClientInfo{}); !errors.Is(err, ErrMFAEnrollmentNotBegun) {
+		t.Fatalf("expected ErrMFAEnrollmentNotBegun, got %v", err)
+	}
+	enrollment, err := svc.BeginChallengeEnrollment(token)
+	if err != nil {
+		t.Fatalf("BeginChallengeEnrollment() error: %v", err)
+	}
+	_, recovery, err := svc.CompleteMFAChallenge(token, currentCode(t, enrollment.Secret, *now), ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteMFAChallenge() error: %v", err)
+	}
+	if len(recovery) == 0 {
+		t.Fatalf("expected recovery codes on enrollment")
+	}
+
+	if err := svc.ResetUserMFA("u-1"); err != nil {
+		t.Fatalf("ResetUserMFA() error: %v", err)
+	}
+	_, err = svc.Login("admin", "secret123", ClientInfo{})
+	if !errors.As(err, &mfaErr) || !mfaErr.Challenge.EnrollmentRequired {
+		t.Fatalf("expected re-enrollment after reset, got %v", err)
+	}
+}
+
+func TestMFAChallengeExpiresAndLimitsAttempts(t *testing.T) {
+	svc, store, now := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+	u, _ := store.GetByUsername("admin")
+	secret, _ := generateTOTPSecret()
+	u.MFAEnabled = true
+	u.TOTPSecret = secret
+	_ = store.Put(u)
+
+	_, err := svc.Login("admin", "secret123", ClientInfo{})
+	var mfaErr *MFARequiredError
+	errors.As(err, &mfaErr)
+	for i := 0; i < mfaChallengeMaxTries; i++ {
+		_, _, _ = svc.CompleteMFAChallenge(mfaErr.Challenge.Token, "000000", ClientInfo{})
+		*now = now.Add(5 * time.Second)
+	}
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, secret, *now), ClientInfo{}); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected challenge to be dropped after repeated failures, got %v", err)
+	}
+
+	_, err = svc.Login("admin", "secret123", ClientInfo{})
+	errors.As(err, &mfaErr)
+	*now = now.Add(mfaChallengeTTL + time.Second)
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, secret, *now), ClientInfo{}); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected expired challenge to fail, got %v", err)
+	}
+}
+
+func TestMFAFailuresCountAgainstLoginThrottle(t *testing.T) {
+	svc, store, now := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+	u, _ := store.GetByUsername("admin")
+	secret, _ := generateTOTPSecret()
+	u.MFAEnabled = true
+	u.TOTPSecret = secret
+	_ = store.Put(u)
+	client := ClientInfo{IP: "198.51.100.7"}
+
+	failures := func(key string) int {
+		a, _, _ := svc.attempts.Get(key)
+		return a.Failures
+	}
+	for i := 0; i < DefaultThrottleConfig.BackoffAfter; i++ {
+		_, err := svc.Login("admin", "secret123", client)
+		var mfaErr *MFARequiredError
+		if !errors.As(err, &mfaErr) {
+			t.Fatalf("Login() expected MFARequiredError, got %v", err)
+		}
+		if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, "000000", client); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("expected ErrInvalidMFACode, got %v", err)
+		}
+	}
+	if got := failures(usernameThrottleKey("admin")); got != DefaultThrottleConfig.BackoffAfter {
+		t.Fatalf("expected the password step to keep %d username failures, got %d", DefaultThrottleConfig.BackoffAfter, got)
+	}
+	if got := failures(ipThrottleKey(client.IP)); got != DefaultThrottleConfig.BackoffAfter {
+		t.Fatalf("expected %d ip failures, got %d", DefaultThrottleConfig.BackoffAfter, got)
+	}
+
+	_, err := svc.Login("admin", "secret123", client)
+	var mfaErr *MFARequiredError
+	errors.As(err, &mfaErr)
+	_, _, _ = svc.CompleteMFAChallenge(mfaErr.Challenge.Token, "000000", client)
+	var blocked *LoginBlockedError
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, secret, *now), client); !errors.As(err, &blocked) {
+		t.Fatalf("expected a throttled answer, got %v", err)
+	}
+
+	*now = now.Add(time.Minute)
+	if _, _, err := svc.CompleteMFAChallenge(mfaErr.Challenge.Token, currentCode(t, secret, *now), client); err != nil {
+		t.Fatalf("CompleteMFAChallenge() error: %v", err)
+	}
+	if got := failures(usernameThrottleKey("admin")); got != 0 {
+		t.Fatalf("expected a full login to clear username failures, got %d", got)
+	}
+}
+
+func TestSecondFactorSpentOnceByConcurrentRequests(t *testing.T) {
+	svc, store, now := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+	u, _ := store.GetByUsername("admin")
+	secret, _ := generateTOTPSecret()
+	u, recovery, err := svc.activateTOTP(u, secret, 0)
+	if err != nil {
+		t.Fatalf("activateTOTP() error: %v", err)
+	}
+
+	// Both requests read the user before either records the spent factor.
+	for _, code := range []string{currentCode(t, secret, *now), recovery[0]} {
+		if ok, err := svc.verifySecondFactor(u, code); err != nil || !ok {
+			t.Fatalf("verifySecondFactor(%s) first use = %v, %v", code, ok, err)
+		}
+		if ok, err := svc.verifySecondFactor(u, code); err != nil || ok {
+			t.Fatalf("verifySecondFactor(%s) second use = %v, %v", code, ok, err)
+		}
+	}
+	got, _ := store.GetByID(u.ID)
+	if got.TOTPLastStep != totpStep(*now) || len(got.RecoveryCodeHashes) != recoveryCodeCount-1 {
+		t.Fatalf("unexpected stored mfa state: step %d, %d recovery codes", got.TOTPLastStep, len(got.RecoveryCodeHashes))
+	}
+}
+
+func TestMFAChallengeSharedAcrossReplicasAndSingleUse(t *testing.T) {
+	users := NewInMemoryUserStore()
+	sessions := NewInMemorySessionStore()
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	cfg := ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute, SessionStore: sessions}
+	replicaA, err := NewService(users, cfg)
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	replicaB, err := NewService(users, cfg)
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	replicaA.nowFunc = func() time.Time { return now }
+	replicaB.nowFunc = func() time.Time { return now }
+	secret, _ := generateTOTPSecret()
+	_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, replicaA, "secret123"), Roles: []string{"admin"}, MFAEnabled: true, TOTPSecret: secret})
+
+	_, err = replicaA.Login("admin", "secret123", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) {
+		t.Fatalf("expected MFARequiredError, got %v", err)
+	}
+	stored, _ := sessions.List()
+	if len(stored) != 0 || len(sessions.challenges) != 1 {
+		t.Fatalf("expected only the challenge to be stored, got %d sessions, %d challenges", len(stored), len(sessions.challenges))
+	}
+	for key := range sessions.challenges {
+		if key == mfaErr.Challenge.Token {
+			t.Fatalf("expected the challenge to be stored under its token hash")
+		}
+	}
+
+	code := currentCode(t, secret, now)
+	if _, _, err := replicaB.CompleteMFAChallenge(mfaErr.Challenge.Token, code, ClientInfo{}); err != nil {
+		t.Fatalf("expected the challenge issued by replica A to complete on replica B, got %v", err)
+	}
+	if _, _, err := replicaA.CompleteMFAChallenge(mfaErr.Challenge.Token, code, ClientInfo{}); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected a completed challenge to be consumed, got %v", err)
+	}
+
+	_, err = replicaA.Login("admin", "secret123", ClientInfo{})
+	errors.As(err, &mfaErr)
+	now = now.Add(mfaChallengeTTL + time.Second)
+	if err := sessions.DeleteExpired(now); err != nil || len(sessions.challenges) != 0 {
+		t.Fatalf("expected DeleteExpired to drop the expired challenge, got %d left, %v", len(sessions.challenges), err)
+	}
+}
+
+func TestMFAEnrollmentRequiresLoginSession(t *testing.T) {
+	svc, _, _ := newTestService(t, ServiceConfig{SessionTTL: time.Minute})
+	ops, err := svc.CreateUser("ops", "Password123!x", "", []string{"operator"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	admin, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	imp, err := svc.Impersonate(admin.Token, ops.ID, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Impersonate() error: %v", err)
+	}
+	_, apiToken, err := svc.CreateAPIToken("u-1", "deploy", nil, 0)
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error: %v", err)
+	}
+
+	for _, token := range []string{imp.Token, apiToken} {
+		if _, err := svc.BeginMFAEnrollment(token); !errors.Is(err, ErrLoginSessionRequired) {
+			t.Fatalf("BeginMFAEnrollment() expected ErrLoginSessionRequired, got %v", err)
+		}
+		if _, err := svc.ConfirmMFAEnrollment(token, "000000"); !errors.Is(err, ErrLoginSessionRequired) {
+			t.Fatalf("ConfirmMFAEnrollment() expected ErrLoginSessionRequired, got %v", err)
+		}
+	}
+	if u, _ := svc.users.GetByID(ops.ID); u.TOTPPendingSecret != "" {
+		t.Fatalf("impersonation session must not start enrollment")
+	}
+}
@@ -0,0 +1,433 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOIDCDisabled     = errors.New("oidc login is not configured")
+	ErrInvalidOIDCState = errors.New("invalid or expired oidc state")
+	ErrInvalidIDToken   = errors.New("invalid id token")
+	// ErrTooManyOIDCLogins is returned by BeginOIDCLogin when
+	// maxOIDCLogins logins are already pending.
+	ErrTooManyOIDCLogins = errors.New("too many pending oidc logins")
+)
+
+const (
+	oidcProviderName    = "oidc"
+	oidcStateTTL        = 10 * time.Minute
+	oidcClockSkew       = time.Minute
+	oidcJWKSMinRefresh  = time.Minute
+	oidcHTTPTimeout     = 10 * time.Second
+	defaultOIDCUsername = "preferred_username"
+	// maxOIDCLogins bounds the logins pending in the session store, so that
+	// unauthenticated begin requests cannot grow it without limit.
+	maxOIDCLogins = 10000
+)
+
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// UsernameClaim names the ID token claim used as the MCS username.
+	UsernameClaim string
+	// RoleClaim names a string or string-array claim whose values are
+	// translated to MCS roles through RoleMap. Unmapped values are ignored;
+	// DefaultRoles apply when nothing maps.
+	RoleClaim    string
+	RoleMap      map[string]string
+	DefaultRoles []string
+	HTTPClient   *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCPendingLogin is an authorization request waiting for the issuer's
+// callback.
+type OIDCPendingLogin struct {
+	verifier  string
+	nonce     string
+	expiresAt time.Time
+}
+
+// oidcProvider caches the issuer's discovery document and signing keys.
+// In-flight authorization requests live in the session store, keyed by state
+// hash.
+type oidcProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func newOIDCProvider(cfg OIDCConfig) (*oidcProvider, error) {
+	cfg.IssuerURL = strings.TrimRight(strings.TrimSpace(cfg.IssuerURL), "/")
+	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc issuer url, client id, and redirect url are required")
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = defaultOIDCUsername
+	}
+	hasOpenID := false
+	for _, scope := range cfg.Scopes {
+		if scope == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: oidcHTTPTimeout}
+	}
+	return &oidcProvider{
+		cfg:    cfg,
+		client: client,
+		keys:   make(map[string]crypto.PublicKey),
+	}, nil
+}
+
+func (s *Service) OIDCEnabled() bool {
+	return s.oidc != nil
+}
+
+// BeginOIDCLogin returns the issuer authorization URL the browser should be
+// sent to and the state it carries. The nonce and PKCE verifier are kept in
+// the session store until the callback arrives. Callers should bind the state
+// to the browser, so that a callback started elsewhere is refused.
+func (s *Service) BeginOIDCLogin(ctx context.Context) (authURL, state string, err error) {
+	if s.oidc == nil {
+		return "", "", ErrOIDCDisabled
+	}
+	disc, err := s.oidc.getDiscovery(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	state, err = generateToken(24)
+	if err != nil {
+		return "", "", fmt.Errorf("generate oidc state: %w", err)
+	}
+	nonce, err := generateToken(24)
+	if err != nil {
+		return "", "", fmt.Errorf("generate oidc nonce: %w", err)
+	}
+	verifierBytes, err := generateSalt(32)
+	if err != nil {
+		return "", "", fmt.Errorf("generate pkce verifier: %w", err)
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(verifierBytes)
+
+	now := s.nowFunc()
+	s.pruneSessions(now)
+	pending := OIDCPendingLogin{verifier: verifier, nonce: nonce, expiresAt: now.Add(oidcStateTTL)}
+	if err := s.sessions.CreateOIDCLogin(s.hashOIDCState(state), pending, maxOIDCLogins); err != nil {
+		if errors.Is(err, ErrTooManyOIDCLogins) {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("store oidc login: %w", err)
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", s.oidc.cfg.ClientID)
+	q.Set("redirect_uri", s.oidc.cfg.RedirectURL)
+	q.Set("scope", strings.Join(s.oidc.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(disc.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return disc.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// CompleteOIDCLogin exchanges the authorization code, verifies the ID token
+// and provisions or updates the matching user. Local factors apply as for a
+// password login: when the user has TOTP or passkeys enrolled, or a role
+// requires MFA, it returns *MFARequiredError instead of a session, whatever
+// factors the identity provider checked.
+func (s *Service) CompleteOIDCLogin(ctx context.Context, state, code string, client ClientInfo) (Session, error) {
+	if s.oidc == nil {
+		return Session{}, ErrOIDCDisabled
+	}
+	if state == "" {
+		return Session{}, ErrInvalidOIDCState
+	}
+	pending, err := s.sessions.TakeOIDCLogin(s.hashOIDCState(state))
+	if err != nil {
+		return Session{}, err
+	}
+	if s.nowFunc().After(pending.expiresAt) {
+		return Session{}, ErrInvalidOIDCState
+	}
+	if code == "" {
+		return Session{}, ErrInvalidOIDCState
+	}
+
+	rawIDToken, err := s.oidc.exchangeCode(ctx, code, pending.verifier)
+	if err != nil {
+		return Session{}, err
+	}
+	claims, err := s.oidc.verifyIDToken(ctx, rawIDToken, pending.nonce, s.nowFunc())
+	if err != nil {
+		return Session{}, err
+	}
+
+	subject := claimString(claims, "sub")
+	username := strings.TrimSpace(claimString(claims, s.oidc.cfg.UsernameClaim))
+	if subject == "" || username == "" {
+		return Session{}, fmt.Errorf("%w: missing sub or %s claim", ErrInvalidIDToken, s.oidc.cfg.UsernameClaim)
+	}
+	u, err := s.provisionExternalUser(oidcProviderName, subject, username, s.oidc.mapRoles(claims))
+	if err != nil {
+		return Session{}, err
+	}
+	mfaNeeded, err := s.mfaRequired(u)
+	if err != nil {
+		return Session{}, err
+	}
+	if mfaNeeded {
+		challenge, err := s.newMFAChallenge(u)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, &MFARequiredError{Challenge: challenge}
+	}
+	return s.completeLogin(u, client)
+}
+
+func (s *Service) hashOIDCState(state string) string {
+	return s.keyedHash("oidc-state", state)
+}
+
+func (p *oidcProvider) mapRoles(claims map[string]any) []string {
+	var roles []string
+	if p.cfg.RoleClaim != "" {
+		for _, v := range claimStrings(claims, p.cfg.RoleClaim) {
+			if role, ok := p.cfg.RoleMap[v]; ok {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if len(roles) == 0 {
+		roles = p.cfg.DefaultRoles
+	}
+	return normalizeRoles(roles)
+}
+
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	if p.discovery != nil {
+		d := p.discovery
+		p.mu.Unlock()
+		return d, nil
+	}
+	p.mu.Unlock()
+
+	var disc oidcDiscovery
+	if err := p.getJSON(ctx, p.cfg.IssuerURL+"/.well-known/openid-configuration", &disc); err != nil {
+		return nil, fmt.Errorf("fetch oidc discovery: %w", err)
+	}
+	if strings.TrimRight(disc.Issuer, "/") != p.cfg.IssuerURL {
+		return nil, fmt.Errorf("oidc discovery issuer %q does not match %q", disc.Issuer, p.cfg.IssuerURL)
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery document is incomplete")
+	}
+
+	p.mu.Lock()
+	p.discovery = &disc
+	p.mu.Unlock()
+	return &disc, nil
+}
+
+func (p *oidcProvider) exchangeCode(ctx context.Context, code, verifier string) (string, error) {
+	disc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, disc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("build token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", fmt.Errorf("read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", fmt.Errorf("decode token response: %w", err)
+	}
+	if tokenResp.IDToken == "" {
+		return "", fmt.Errorf("%w: token response has no id_token", ErrInvalidIDToken)
+	}
+	return tokenResp.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string, now time.Time) (map[string]any, error) {
+	header, claims, signingInput, sig, err := parseJWT(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	key, err := p.signingKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, signingInput, sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if strings.TrimRight(claimString(claims, "iss"), "/") != p.cfg.IssuerURL {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidIDToken)
+	}
+	audiences := claimStrings(claims, "aud")
+	audOK := false
+	for _, aud := range audiences {
+		if aud == p.cfg.ClientID {
+			audOK = true
+		}
+	}
+	if !audOK {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIDToken)
+	}
+	if len(audiences) > 1 && claimString(claims, "azp") != p.cfg.ClientID {
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidIDToken)
+	}
+	exp, ok := claimUnix(claims, "exp")
+	if !ok || now.Add(-oidcClockSkew).Unix() >= exp {
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidIDToken)
+	}
+	if iat, ok := claimUnix(claims, "iat"); ok && iat > now.Add(oidcClockSkew).Unix() {
+		return nil, fmt.Errorf("%w: token issued in the future", ErrInvalidIDToken)
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// signingKey looks up kid in the cached JWKS, refetching it when the key is
+// unknown so issuer key rotation is picked up without a restart.
+func (p *oidcProvider) signingKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.lookupKeyLocked(kid)
+	stale := time.Since(p.keysFetchedAt) >= oidcJWKSMinRefresh
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidIDToken, kid)
+	}
+
+	disc, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set jwkSet
+	if err := p.getJSON(ctx, disc.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetch oidc jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	key, ok = p.lookupKeyLocked(kid)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) lookupKeyLocked(kid string) (crypto.PublicKey, bool) {
+	if key, ok := p.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, target string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubIssuer is a minimal OIDC provider: discovery, JWKS and a token endpoint
+// that signs whatever claims the test sets for the next exchange.
+type stubIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]any
+
+	challenge string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error: %v", err)
+	}
+	st := &stubIssuer{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 st.server.URL,
+			"authorization_endpoint": st.server.URL + "/authorize",
+			"token_endpoint":         st.server.URL + "/token",
+			"jwks_uri":               st.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "mcs" || pass != "client-secret" {
+			http.Error(w, "bad client", http.StatusUnauthorized)
+			return
+		}
+		if r.Form.Get("code") != "auth-code" || pkceChallenge(r.Form.Get("code_verifier")) != st.challenge {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": st.sign(st.claims), "token_type": "Bearer"})
+	})
+	st.server = httptest.NewServer(mux)
+	t.Cleanup(st.server.Close)
+	return st
+}
+
+func (st *stubIssuer) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, st.key, crypto.SHA256, digest[:])
+	if err != nil {
+		st.t.Fatalf("sign id token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newOIDCTestService(t *testing.T, st *stubIssuer) (*Service, *InMemoryUserStore) {
+	t.Helper()
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		OIDC: &OIDCConfig{
+			IssuerURL:    st.server.URL,
+			ClientID:     "mcs",
+			ClientSecret: "client-secret",
+			RedirectURL:  "https://mcs.example.com/v1/auth/oidc/callback",
+			RoleClaim:    "groups",
+			RoleMap:      map[string]string{"mcs-admins": "admin"},
+			DefaultRoles: []string{"viewer"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	return svc, store
+}
+
+func beginOIDC(t *testing.T, svc *Service, st *stubIssuer) (state, nonce string) {
+	t.Helper()
+	authURL, state, err := svc.BeginOIDCLogin(context.Background())
+	if err != nil {
+		t.Fatalf("BeginOIDCLogin() error: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse auth url: %v", err)
+	}
+	q := u.Query()
+	if !strings.HasPrefix(authURL, st.server.URL+"/authorize?") || q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "mcs" || q.Get("state") != state {
+		t.Fatalf("unexpected authorization url: %s", authURL)
+	}
+	st.challenge = q.Get("code_challenge")
+	return state, q.Get("nonce")
+}
+
+func (st *stubIssuer) idClaims(nonce string, extra map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":                st.server.URL,
+		"aud":                "mcs",
+		"sub":                "idp-123",
+		"preferred_username": "alice",
+		"nonce":              nonce,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+func TestOIDCLoginProvisionsAndMapsRoles(t *testing.T) {
+	st := newStubIssuer(t)
+	svc, store := newOIDCTestService(t, st)
+
+	state, nonce := beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, map[string]any{"groups": []string{"mcs-admins", "other"}})
+	session, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteOIDCLogin() error: %v", err)
+	}
+	if session.Username != "alice" || len(session.Roles) != 1 || session.Roles[0] != "admin" {
+		t.Fatalf("unexpected session: %+v", session)
+	}
+	u, err := store.GetByUsername("alice")
+	if err != nil {
+		t.Fatalf("expected provisioned user: %v", err)
+	}
+	if u.AuthProvider != "oidc" || u.ExternalSubject != "idp-123" {
+		t.Fatalf("unexpected provisioned user: %+v", u)
+	}
+	if _, err := svc.Login("alice", "", ClientInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected external user to have no local password, got %v", err)
+	}
+
+	// State is single-use.
+	if _, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("expected ErrInvalidOIDCState, got %v", err)
+	}
+
+	// Roles follow the IdP on the next login.
+	state, nonce = beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, nil)
+	session, err = svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteOIDCLogin() error: %v", err)
+	}
+	if len(session.Roles) != 1 || session.Roles[0] != "viewer" {
+		t.Fatalf("expected default role after group removal, got %v", session.Roles)
+	}
+}
+
+func TestOIDCLoginRejectsBadTokens(t *testing.T) {
+	st := newStubIssuer(t)
+	svc, store := newOIDCTestService(t, st)
+
+	cases := map[string]map[string]any{
+		"nonce":    {"nonce": "other"},
+		"audience": {"aud": "someone-else"},
+		"expired":  {"exp": time.Now().Add(-time.Hour).Unix()},
+		"issuer":   {"iss": "https://evil.example.com"},
+	}
+	for name, override := range cases {
+		state, nonce := beginOIDC(t, svc, st)
+		st.claims = st.idClaims(nonce, override)
+		if _, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); !errors.Is(err, ErrInvalidIDToken) {
+			t.Fatalf("%s: expected ErrInvalidIDToken, got %v", name, err)
+		}
+	}
+
+	// A local account with the same name is never taken over.
+	_ = store.Put(User{ID: "u-local", Username: "alice", PasswordHash: "x", Roles: []string{"admin"}})
+	state, nonce := beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, nil)
+	if _, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); !errors.Is(err, ErrExternalAccountConflict) {
+		t.Fatalf("expected ErrExternalAccountConflict, got %v", err)
+	}
+}
+
+func TestOIDCLoginAppliesLocalMFA(t *testing.T) {
+	st := newStubIssuer(t)
+	svc, _ := newOIDCTestService(t, st)
+	if err := svc.SetMFARequiredRoles([]string{"admin"}); err != nil {
+		t.Fatalf("SetMFARequiredRoles() error: %v", err)
+	}
+
+	state, nonce := beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, map[string]any{"groups": []string{"mcs-admins"}})
+	_, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) {
+		t.Fatalf("expected an mfa challenge, got %v", err)
+	}
+	if mfaErr.Challenge.Username != "alice" || !mfaErr.Challenge.EnrollmentRequired {
+		t.Fatalf("unexpected challenge: %+v", mfaErr.Challenge)
+	}
+
+	state, nonce = beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, nil)
+	if _, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); err != nil {
+		t.Fatalf("expected roles without an mfa requirement to sign in, got %v", err)
+	}
+}
+
+func TestOIDCPendingLoginsSharedAcrossInstancesAndBounded(t *testing.T) {
+	st := newStubIssuer(t)
+	svc, store := newOIDCTestService(t, st)
+	other, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		SessionStore:   svc.sessions,
+		OIDC:           &OIDCConfig{IssuerURL: st.server.URL, ClientID: "mcs", ClientSecret: "client-secret", RedirectURL: "https://mcs.example.com/v1/auth/oidc/callback"},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+
+	state, nonce := beginOIDC(t, svc, st)
+	st.claims = st.idClaims(nonce, nil)
+	if _, err := other.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); err != nil {
+		t.Fatalf("CompleteOIDCLogin() on another instance error: %v", err)
+	}
+	if _, err := svc.CompleteOIDCLogin(context.Background(), state, "auth-code", ClientInfo{}); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("expected the state to be used up on every instance, got %v", err)
+	}
+
+	sessions := NewInMemorySessionStore()
+	now := time.Now()
+	p := OIDCPendingLogin{verifier: "v", nonce: "n", expiresAt: now}
+	if err := sessions.CreateOIDCLogin("s1", p, 1); err != nil {
+		t.Fatalf("CreateOIDCLogin() error: %v", err)
+	}
+	if err := sessions.CreateOIDCLogin("s2", p, 1); !errors.Is(err, ErrTooManyOIDCLogins) {
+		t.Fatalf("expected ErrTooManyOIDCLogins, got %v", err)
+	}
+	_ = sessions.DeleteExpired(now.Add(time.Second))
+	if err := sessions.CreateOIDCLogin("s2", p, 1); err != nil {
+		t.Fatalf("expected expired logins to free the cap, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	argon2Version  = argon2.Version
+
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+)
+
+// HashParams controls the Argon2id cost of newly hashed passwords.
+// Stored hashes carry their own parameters, so changing these only affects
+// hashes created (or upgraded on login) after the change.
+type HashParams struct {
+	MemoryKiB   uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultHashParams follows the OWASP baseline recommendation for Argon2id.
+var DefaultHashParams = HashParams{
+	MemoryKiB:   19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+}
+
+func (p HashParams) validate() error {
+	if p.MemoryKiB < 8*uint32(p.Parallelism) {
+		return fmt.Errorf("password hash memory must be >= 8 KiB per lane")
+	}
+	if p.Iterations == 0 {
+		return fmt.Errorf("password hash iterations must be > 0")
+	}
+	if p.Parallelism == 0 {
+		return fmt.Errorf("password hash parallelism must be > 0")
+	}
+	return nil
+}
+
+// encodeArgon2id produces a self-describing hash in the PHC string format:
+// $argon2id$v=19$m=<kib>,t=<iterations>,p=<lanes>$<salt>$<key>
+func encodeArgon2id(params HashParams, salt, key []byte) string {
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix,
+		argon2Version,
+		params.MemoryKiB,
+		params.Iterations,
+		params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+}
+
+func decodeArgon2id(encoded string) (HashParams, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return HashParams{}, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return HashParams{}, nil, nil, fmt.Errorf("parse argon2id version: %w", err)
+	}
+	if version != argon2Version {
+		return HashParams{}, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var params HashParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Iterations, &params.Parallelism); err != nil {
+		return HashParams{}, nil, nil, fmt.Errorf("parse argon2id params: %w", err)
+	}
+	if err := params.validate(); err != nil {
+		return HashParams{}, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return HashParams{}, nil, nil, fmt.Errorf("decode argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return HashParams{}, nil, nil, fmt.Errorf("decode argon2id key: %w", err)
+	}
+	if len(key) == 0 {
+		return HashParams{}, nil, nil, fmt.Errorf("empty argon2id key")
+	}
+	return params, salt, key, nil
+}
+
+func (s *Service) derivePasswordKey(password string, salt []byte, params HashParams, keyLen uint32) []byte {
+	return argon2.IDKey([]byte(s.pepper+":"+password), salt, params.Iterations, params.MemoryKiB, params.Parallelism, keyLen)
+}
+
+// legacyHashPassword is the original unsalted format (hex SHA-256 over
+// pepper:password). It is only used to verify and upgrade existing hashes.
+func (s *Service) legacyHashPassword(password string) string {
+	sum := sha256.Sum256([]byte(s.pepper + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isLegacyPasswordHash(storedHash string) bool {
+	return !strings.HasPrefix(storedHash, "$")
+}
+
+func (s *Service) verifyArgon2id(password, storedHash string) bool {
+	params, salt, key, err := decodeArgon2id(storedHash)
+	if err != nil {
+		return false
+	}
+	candidate := s.derivePasswordKey(password, salt, params, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+// needsRehash reports whether storedHash should be replaced with a hash
+// produced by the current parameters.
+func (s *Service) needsRehash(storedHash string) bool {
+	if isLegacyPasswordHash(storedHash) {
+		return true
+	}
+	params, _, key, err := decodeArgon2id(storedHash)
+	if err != nil {
+		return true
+	}
+	return params != s.hashParams || len(key) != passwordKeyLength
+}
+
+func generateSalt(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashPasswordArgon2idFormat(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+
+	h1 := mustHashPassword(t, svc, "secret123")
+	h2 := mustHashPassword(t, svc, "secret123")
+	if !strings.HasPrefix(h1, "$argon2id$v=19$m=19456,t=2,p=1$") {
+		t.Fatalf("unexpected hash format: %q", h1)
+	}
+	if h1 == h2 {
+		t.Fatalf("expected per-hash salt to produce distinct hashes")
+	}
+	if !svc.VerifyPassword("secret123", h1) || !svc.VerifyPassword("secret123", h2) {
+		t.Fatalf("expected both hashes to verify")
+	}
+	if svc.VerifyPassword("wrong", h1) {
+		t.Fatalf("expected wrong password to fail verification")
+	}
+	if svc.VerifyPassword("secret123", "$argon2id$garbage") {
+		t.Fatalf("expected malformed hash to fail verification")
+	}
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	legacy := svc.legacyHashPassword("secret123")
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: legacy, Roles: []string{"admin"}})
+
+	if _, err := svc.Login("admin", "secret123", ClientInfo{}); err != nil {
+		t.Fatalf("Login() with legacy hash error: %v", err)
+	}
+
+	u, _ := store.GetByUsername("admin")
+	if u.PasswordHash == legacy || !strings.HasPrefix(u.PasswordHash, argon2idPrefix) {
+		t.Fatalf("expected legacy hash to be upgraded, got %q", u.PasswordHash)
+	}
+	if _, err := svc.Login("admin", "secret123", ClientInfo{}); err != nil {
+		t.Fatalf("Login() with upgraded hash error: %v", err)
+	}
+}
+
+func TestLoginRehashesOnParamChange(t *testing.T) {
+	store := NewInMemoryUserStore()
+	weak, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Minute,
+		HashParams:     HashParams{MemoryKiB: 64, Iterations: 1, Parallelism: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	old := mustHashPassword(t, weak, "secret123")
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: old, Roles: []string{"admin"}})
+
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if _, err := svc.Login("admin", "secret123", ClientInfo{}); err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	u, _ := store.GetByUsername("admin")
+	if u.PasswordHash == old || svc.needsRehash(u.PasswordHash) {
+		t.Fatalf("expected hash to be upgraded to current params, got %q", u.PasswordHash)
+	}
+}
+
+func TestNewServiceRejectsInvalidHashParams(t *testing.T) {
+	_, err := NewService(NewInMemoryUserStore(), ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Minute,
+		HashParams:     HashParams{MemoryKiB: 64, Iterations: 0, Parallelism: 1},
+	})
+	if err == nil {
+		t.Fatalf("expected error for zero iterations")
+	}
+}
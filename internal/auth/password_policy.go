@@ -0,0 +1,318 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const maxPasswordHistory = 24
+
+// PasswordRejectReason tells clients why a new password was refused.
+type PasswordRejectReason string
+
+const (
+	PasswordTooShort         PasswordRejectReason = "too_short"
+	PasswordTooLong          PasswordRejectReason = "too_long"
+	PasswordEdgeWhitespace   PasswordRejectReason = "edge_whitespace"
+	PasswordMissingUppercase PasswordRejectReason = "missing_uppercase"
+	PasswordMissingLowercase PasswordRejectReason = "missing_lowercase"
+	PasswordMissingDigit     PasswordRejectReason = "missing_digit"
+	PasswordMissingSymbol    PasswordRejectReason = "missing_symbol"
+	PasswordReused           PasswordRejectReason = "reused"
+	PasswordBreached         PasswordRejectReason = "breached"
+)
+
+// PasswordPolicyError is returned for passwords that fail the policy. It
+// matches ErrWeakPassword with errors.Is.
+type PasswordPolicyError struct {
+	Reason PasswordRejectReason
+	Detail string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, e.Detail)
+}
+
+func (e *PasswordPolicyError) Is(target error) bool {
+	return target == ErrWeakPassword
+}
+
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// MaxAge forces a change once a password is older; zero disables expiry.
+	MaxAge time.Duration
+	// History is how many of the most recent passwords, the current one
+	// included, cannot be chosen again; zero disables the check.
+	History int
+	// BreachedHashFile lists SHA-1 hashes of breached passwords, one per
+	// line as uppercase or lowercase hex, optionally followed by ":count".
+	// Lines must be sorted by hash, as in the ordered-by-hash Pwned
+	// Passwords download, because the file is binary searched on disk.
+	BreachedHashFile string
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:     minPasswordLength,
+	MaxLength:     maxPasswordLength,
+	RequireUpper:  true,
+	RequireLower:  true,
+	RequireDigit:  true,
+	RequireSymbol: true,
+}
+
+func (p PasswordPolicy) validateConfig() error {
+	if p.MinLength < 8 {
+		return fmt.Errorf("password min length must be >= 8")
+	}
+	if p.MaxLength < p.MinLength || p.MaxLength > 1024 {
+		return fmt.Errorf("password max length must be between min length and 1024")
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("password max age must not be negative")
+	}
+	if p.History < 0 || p.History > maxPasswordHistory {
+		return fmt.Errorf("password history must be between 0 and %d", maxPasswordHistory)
+	}
+	return nil
+}
+
+// check applies the composition rules. Reuse and breach checks need more
+// than the password and are done by Service.checkNewPassword.
+func (p PasswordPolicy) check(password string) error {
+	if strings.TrimSpace(password) != password {
+		return &PasswordPolicyError{Reason: PasswordEdgeWhitespace, Detail: "password must not start or end with whitespace"}
+	}
+	if len(password) < p.MinLength {
+		return &PasswordPolicyError{Reason: PasswordTooShort, Detail: fmt.Sprintf("password must be at least %d characters", p.MinLength)}
+	}
+	if len(password) > p.MaxLength {
+		return &PasswordPolicyError{Reason: PasswordTooLong, Detail: fmt.Sprintf("password must be at most %d characters", p.MaxLength)}
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+	switch {
+	case p.RequireUpper && !hasUpper:
+		return &PasswordPolicyError{Reason: PasswordMissingUppercase, Detail: "password must contain an uppercase letter"}
+	case p.RequireLower && !hasLower:
+		return &PasswordPolicyError{Reason: PasswordMissingLowercase, Detail: "password must contain a lowercase letter"}
+	case p.RequireDigit && !hasDigit:
+		return &PasswordPolicyError{Reason: PasswordMissingDigit, Detail: "password must contain a digit"}
+	case p.RequireSymbol && !hasSymbol:
+		return &PasswordPolicyError{Reason: PasswordMissingSymbol, Detail: "password must contain a symbol"}
+	}
+	return nil
+}
+
+// checkNewPassword validates a password about to be set for u. Pass a zero
+// User for accounts that do not exist yet.
+func (s *Service) checkNewPassword(u User, password string) error {
+	if err := s.policy.check(password); err != nil {
+		return err
+	}
+	if s.breached != nil {
+		found, err := s.breached.contains(password)
+		if err != nil {
+			return fmt.Errorf("check breached passwords: %w", err)
+		}
+		if found {
+			return &PasswordPolicyError{Reason: PasswordBreached, Detail: "password appears in a list of breached passwords"}
+		}
+	}
+	if s.policy.History > 0 && u.PasswordHash != "" {
+		previous := append([]string{u.PasswordHash}, u.PasswordHistory...)
+		if len(previous) > s.policy.History {
+			previous = previous[:s.policy.History]
+		}
+		for _, h := range previous {
+			if s.VerifyPassword(password, h) {
+				return &PasswordPolicyError{Reason: PasswordReused, Detail: fmt.Sprintf("password must differ from the last %d passwords", s.policy.History)}
+			}
+		}
+	}
+	return nil
+}
+
+// setPassword stores a new hash for u, remembering the old one for the
+// history check. The caller writes u back to the store.
+func (s *Service) setPassword(u *User, password string) error {
+	newHash, err := s.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if s.policy.History > 1 && u.PasswordHash != "" && u.PasswordHash != externalPasswordHash {
+		history := append([]string{u.PasswordHash}, u.PasswordHistory...)
+		if len(history) > s.policy.History-1 {
+			history = history[:s.policy.History-1]
+		}
+		u.PasswordHistory = history
+	} else {
+		u.PasswordHistory = nil
+	}
+	now := s.nowFunc()
+	u.PasswordHash = newHash
+	u.PasswordChangedAt = &now
+	u.MustChangePassword = false
+	return nil
+}
+
+// passwordChangeRequired reports whether u must choose a new password before
+// using the API. Accounts that predate change tracking start their expiry
+// clock at their next login rather than expiring straight away.
+func (s *Service) passwordChangeRequired(u User) bool {
+	if u.AuthProvider != "" {
+		return false
+	}
+	if u.MustChangePassword {
+		return true
+	}
+	if s.policy.MaxAge <= 0 || u.PasswordChangedAt == nil {
+		return false
+	}
+	return s.nowFunc().Sub(*u.PasswordChangedAt) >= s.policy.MaxAge
+}
+
+// startPasswordClock records a change time for accounts that predate
+// tracking, so that expiry counts from their first login afterwards. A failed
+// write is retried on the next login.
+func (s *Service) startPasswordClock(u User) User {
+	if u.PasswordChangedAt != nil {
+		return u
+	}
+	stamped := u
+	now := s.nowFunc()
+	stamped.PasswordChangedAt = &now
+	if err := s.users.Put(stamped); err != nil {
+		return u
+	}
+	return stamped
+}
+
+// breachedPasswords looks passwords up in a sorted file of SHA-1 hashes
+// without loading it, since full breach corpora run to tens of gigabytes.
+type breachedPasswords struct {
+	f    *os.File
+	size int64
+}
+
+func openBreachedPasswords(path string) (*breachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open breached password file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("stat breached password file: %w", err)
+	}
+	b := &breachedPasswords{f: f, size: info.Size()}
+	if b.size > 0 {
+		first, _, err := b.lineAt(0)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		if len(breachedHashKey(first)) != sha1.Size*2 {
+			_ = f.Close()
+			return nil, fmt.Errorf("breached password file must contain one SHA-1 hex hash per line")
+		}
+	}
+	return b, nil
+}
+
+func (b *breachedPasswords) contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	want := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// Search the lines whose first byte lies in [lo, hi).
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, start, end, err := b.lineFrom(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		switch key := breachedHashKey(line); {
+		case key == want:
+			return true, nil
+		case key < want:
+			lo = end
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the first line starting at or after off, with the
+// offsets of its first byte and of the byte after its newline.
+func (b *breachedPasswords) lineFrom(off int64) (string, int64, int64, error) {
+	start := off
+	if off > 0 {
+		_, end, err := b.lineAt(off - 1)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		start = end
+	}
+	if start >= b.size {
+		return "", b.size, b.size, nil
+	}
+	line, end, err := b.lineAt(start)
+	return line, start, end, err
+}
+
+// lineAt reads from off up to and including the next newline and returns the
+// text before it and the offset after it.
+func (b *breachedPasswords) lineAt(off int64) (string, int64, error) {
+	var line []byte
+	buf := make([]byte, 128)
+	for {
+		n, err := b.f.ReadAt(buf, off+int64(len(line)))
+		if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+			line = append(line, buf[:i]...)
+			return string(line), off + int64(len(line)) + 1, nil
+		}
+		line = append(line, buf[:n]...)
+		if err == io.EOF {
+			return string(line), off + int64(len(line)), nil
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("read breached password file: %w", err)
+		}
+	}
+}
+
+func breachedHashKey(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(strings.TrimSpace(line))
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordPolicyReasons(t *testing.T) {
+	for password, want := range map[string]PasswordRejectReason{
+		" Password123!x":         PasswordEdgeWhitespace,
+		"Pw1!":                   PasswordTooShort,
+		"password123!x":          PasswordMissingUppercase,
+		"PASSWORD123!X":          PasswordMissingLowercase,
+		"Passwordabc!x":          PasswordMissingDigit,
+		"Password1234x":          PasswordMissingSymbol,
+		strings.Repeat("A", 129): PasswordTooLong,
+	} {
+		err := DefaultPasswordPolicy.check(password)
+		var policyErr *PasswordPolicyError
+		if !errors.As(err, &policyErr) || policyErr.Reason != want {
+			t.Fatalf("check(%q) = %v, want reason %s", password, err, want)
+		}
+		if !errors.Is(err, ErrWeakPassword) {
+			t.Fatalf("expected policy errors to match ErrWeakPassword")
+		}
+	}
+	if err := DefaultPasswordPolicy.check("Password123!x"); err != nil {
+		t.Fatalf("check() error: %v", err)
+	}
+
+	relaxed := PasswordPolicy{MinLength: 8, MaxLength: 64, RequireLower: true}
+	if err := relaxed.check("lowercase only"); err != nil {
+		t.Fatalf("relaxed check() error: %v", err)
+	}
+}
+
+func TestBreachedPasswordFile(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte{byte(i), byte(i >> 8), 'x'})
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":3")
+	}
+	for _, pw := range []string{"Breached123!x", "Summer2024!!x"} {
+		sum := sha1.Sum([]byte(pw))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":12")
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")), 0o600); err != nil {
+		t.Fatalf("write breached file: %v", err)
+	}
+
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Minute,
+		PasswordPolicy: PasswordPolicy{MinLength: 12, MaxLength: 128, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true, BreachedHashFile: path},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	for _, pw := range []string{"Breached123!x", "Summer2024!!x"} {
+		var policyErr *PasswordPolicyError
+		if _, err := svc.CreateUser("u"+pw[:4], pw, "", nil); !errors.As(err, &policyErr) || policyErr.Reason != PasswordBreached {
+			t.Fatalf("CreateUser(%q) = %v, want breached", pw, err)
+		}
+	}
+	if _, err := svc.CreateUser("alice", "NotInTheList9!", "", nil); err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	_ = os.WriteFile(bad, []byte("password\n"), 0o600)
+	if _, err := openBreachedPasswords(bad); err == nil {
+		t.Fatalf("expected a file without SHA-1 hashes to be rejected")
+	}
+}
+
+func TestPasswordHistoryRejectsReuse(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		PasswordPolicy: PasswordPolicy{MinLength: 12, MaxLength: 128, History: 3},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	created, err := svc.CreateUser("alice", "first-password", "", nil)
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	session, err := svc.Login("alice", "first-password", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	current := "first-password"
+	for _, next := range []string{"second-password", "third-password"} {
+		if err := svc.ChangePassword(session.Token, current, next); err != nil {
+			t.Fatalf("ChangePassword(%q) error: %v", next, err)
+		}
+		current = next
+	}
+	for _, reused := range []string{"first-password", "second-password", "third-password"} {
+		var policyErr *PasswordPolicyError
+		if err := svc.ChangePassword(session.Token, current, reused); !errors.As(err, &policyErr) || policyErr.Reason != PasswordReused {
+			t.Fatalf("ChangePassword(%q) = %v, want reused", reused, err)
+		}
+	}
+	if err := svc.ResetUserPassword(created.ID, "second-password"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("expected admin reset to honour history, got %v", err)
+	}
+
+	if err := svc.ChangePassword(session.Token, current, "fourth-password"); err != nil {
+		t.Fatalf("ChangePassword() error: %v", err)
+	}
+	if err := svc.ChangePassword(session.Token, "fourth-password", "first-password"); err != nil {
+		t.Fatalf("expected a password older than the history depth to be allowed, got %v", err)
+	}
+	u, _ := store.GetByID(created.ID)
+	if len(u.PasswordHistory) != 2 {
+		t.Fatalf("expected history trimmed to 2 earlier hashes, got %d", len(u.PasswordHistory))
+	}
+}
+
+func TestExpiredPasswordRequiresChange(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		PasswordPolicy: PasswordPolicy{MinLength: 12, MaxLength: 128, MaxAge: 30 * 24 * time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	svc.nowFunc = func() time.Time { return now }
+	_ = store.Put(User{ID: "u-1", Username: "alice", PasswordHash: mustHashPassword(t, svc, "first-password")})
+
+	session, err := svc.Login("alice", "first-password", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if session.PasswordChangeRequired {
+		t.Fatalf("accounts without a change date must not expire straight away")
+	}
+	if u, _ := store.GetByID("u-1"); u.PasswordChangedAt == nil || !u.PasswordChangedAt.Equal(now) {
+		t.Fatalf("expected login to start the password clock, got %v", u.PasswordChangedAt)
+	}
+
+	now = now.Add(31 * 24 * time.Hour)
+	session, err = svc.Login("alice", "first-password", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if !session.PasswordChangeRequired {
+		t.Fatalf("expected expired password to restrict the session")
+	}
+	if err := svc.ChangePassword(session.Token, "first-password", "second-password"); err != nil {
+		t.Fatalf("ChangePassword() error: %v", err)
+	}
+	validated, err := svc.ValidateToken(session.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if validated.PasswordChangeRequired {
+		t.Fatalf("expected the restriction to be lifted after changing the password")
+	}
+}
+
+func TestMustChangePasswordFlag(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	_ = store.Put(User{ID: "bootstrap-admin", Username: "admin", PasswordHash: mustHashPassword(t, svc, "admin123"), Roles: []string{"admin"}, MustChangePassword: true})
+
+	session, err := svc.Login("admin", "admin123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if !session.PasswordChangeRequired {
+		t.Fatalf("expected flagged user to get a restricted session")
+	}
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+	if !refreshed.PasswordChangeRequired {
+		t.Fatalf("expected refreshing to keep the restriction")
+	}
+
+	if err := svc.ChangePassword(refreshed.Token, "admin123", "Password123!x"); err != nil {
+		t.Fatalf("ChangePassword() error: %v", err)
+	}
+	if u, _ := store.GetByID("bootstrap-admin"); u.MustChangePassword {
+		t.Fatalf("expected the flag to be cleared by the change")
+	}
+	if validated, err := svc.ValidateToken(refreshed.Token); err != nil || validated.PasswordChangeRequired {
+		t.Fatalf("ValidateToken() = %+v, %v", validated, err)
+	}
+	if session, err := svc.Login("admin", "Password123!x", ClientInfo{}); err != nil || session.PasswordChangeRequired {
+		t.Fatalf("Login() = %+v, %v", session, err)
+	}
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrPasswordResetDisabled = errors.New("password reset is not configured")
+	ErrInvalidResetToken     = errors.New("invalid or expired password reset token")
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	passwordResetByteCount  = 32
+	// passwordResetResendAfter stops repeated requests from flooding a
+	// user's mailbox; the outstanding link stays valid meanwhile.
+	passwordResetResendAfter = time.Minute
+)
+
+// RequestPasswordReset mails a single-use reset link to the user's address.
+// It returns nil without sending anything when the account does not exist,
+// has no email address or is managed by an external provider, so that the
+// result never reveals whether an account exists.
+func (s *Service) RequestPasswordReset(username string) error {
+	if s.mailer == nil {
+		return ErrPasswordResetDisabled
+	}
+	u, err := s.users.GetByUsername(strings.TrimSpace(username))
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return err
+	}
+	if u.AuthProvider != "" || u.Email == "" {
+		return nil
+	}
+	now := s.nowFunc()
+	if u.PasswordResetExpiresAt != nil {
+		issuedAt := u.PasswordResetExpiresAt.Add(-s.resetTTL)
+		if now.Sub(issuedAt) < passwordResetResendAfter {
+			return nil
+		}
+	}
+
+	secret, err := generateToken(passwordResetByteCount)
+	if err != nil {
+		return fmt.Errorf("generate password reset token: %w", err)
+	}
+	token := u.ID + "." + secret
+	expiresAt := now.Add(s.resetTTL)
+	u.PasswordResetHash = s.hashResetToken(token)
+	u.PasswordResetExpiresAt = &expiresAt
+	if err := s.users.Put(u); err != nil {
+		return fmt.Errorf("store password reset token: %w", err)
+	}
+
+	body := fmt.Sprintf("A password reset was requested for the account %q.\n\n"+
+		"Open the link below within %d minutes to choose a new password:\n\n%s\n\n"+
+		"If you did not ask for this, ignore this message; your password stays unchanged.\n",
+		u.Username, int(s.resetTTL/time.Minute), s.passwordResetLink(token))
+	if err := s.mailer.Send(u.Email, "Password reset", body); err != nil {
+		// Drop the unsent token so the next request is not throttled.
+		u.PasswordResetHash = ""
+		u.PasswordResetExpiresAt = nil
+		_ = s.users.Put(u)
+		return fmt.Errorf("send password reset mail: %w", err)
+	}
+	return nil
+}
+
+// ConfirmPasswordReset sets a new password with a token from
+// RequestPasswordReset and returns the affected user. The token is consumed
+// on success, and the user's
+// sessions are revoked because whoever held them may be who the reset is
+// locking out.
+func (s *Service) ConfirmPasswordReset(token, newPassword string) (User, error) {
+	if err := s.policy.check(newPassword); err != nil {
+		return User{}, err
+	}
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return User{}, ErrInvalidResetToken
+	}
+	u, err := s.users.GetByID(token[:i])
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return User{}, ErrInvalidResetToken
+		}
+		return User{}, err
+	}
+	if u.AuthProvider != "" || u.PasswordResetHash == "" || u.PasswordResetExpiresAt == nil {
+		return User{}, ErrInvalidResetToken
+	}
+	if subtle.ConstantTimeCompare([]byte(s.hashResetToken(token)), []byte(u.PasswordResetHash)) != 1 {
+		return User{}, ErrInvalidResetToken
+	}
+	if s.nowFunc().After(*u.PasswordResetExpiresAt) {
+		return User{}, ErrInvalidResetToken
+	}
+
+	if err := s.checkNewPassword(u, newPassword); err != nil {
+		return User{}, err
+	}
+	if err := s.setPassword(&u, newPassword); err != nil {
+		return User{}, err
+	}
+	u.PasswordResetHash = ""
+	u.PasswordResetExpiresAt = nil
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store updated password: %w", err)
+	}
+	s.clearUsernameFailures(u.Username)
+	return u, s.RevokeUserSessions(u.ID)
+}
+
+// PasswordResetEnabled reports whether a mailer is configured.
+func (s *Service) PasswordResetEnabled() bool {
+	return s.mailer != nil
+}
+
+func (s *Service) passwordResetLink(token string) string {
+	u := *s.resetURL
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (s *Service) hashResetToken(token string) string {
+	return s.keyedHash("password-reset", token)
+}
+
+func parsePasswordResetURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("password reset url must be an absolute http or https url")
+	}
+	return u, nil
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var resetLinkPattern = regexp.MustCompile(`https://mcs\.example\.com/reset\?token=(\S+)`)
+
+func newPasswordResetTestService(t *testing.T) (*Service, *smtpStub, *time.Time) {
+	t.Helper()
+	st := newSMTPStub(t)
+	mailer, err := NewSMTPMailer(st.config("none"))
+	if err != nil {
+		t.Fatalf("NewSMTPMailer() error: %v", err)
+	}
+	svc, store, now := newTestService(t, ServiceConfig{
+		Mailer:           mailer,
+		PasswordResetURL: "https://mcs.example.com/reset",
+		PasswordResetTTL: 15 * time.Minute,
+	})
+	_ = store.Put(User{ID: "u-2", Username: "alice", Email: "alice@example.com", PasswordHash: mustHashPassword(t, svc, "Password123!x")})
+	_ = store.Put(User{ID: "u-3", Username: "nomail", PasswordHash: mustHashPassword(t, svc, "Password123!x")})
+	return svc, st, now
+}
+
+func mailedResetToken(t *testing.T, msg stubMail) string {
+	t.Helper()
+	m := resetLinkPattern.FindStringSubmatch(msg.Data)
+	if m == nil {
+		t.Fatalf("no reset link in message: %q", msg.Data)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatalf("decode token: %v", err)
+	}
+	return token
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	svc, st, now := newPasswordResetTestService(t)
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	for _, username := range []string{"nobody", "nomail"} {
+		if err := svc.RequestPasswordReset(username); err != nil {
+			t.Fatalf("RequestPasswordReset(%q) must not reveal the account, got %v", username, err)
+		}
+	}
+	if err := svc.RequestPasswordReset("alice"); err != nil {
+		t.Fatalf("RequestPasswordReset() error: %v", err)
+	}
+	*now = now.Add(10 * time.Second)
+	if err := svc.RequestPasswordReset("alice"); err != nil {
+		t.Fatalf("repeated RequestPasswordReset() error: %v", err)
+	}
+	msgs := st.messages()
+	if len(msgs) != 1 || msgs[0].To[0] != "alice@example.com" {
+		t.Fatalf("expected one mail to alice, got %+v", msgs)
+	}
+	token := mailedResetToken(t, msgs[0])
+
+	u, _ := svc.users.GetByID("u-2")
+	if u.PasswordResetHash == "" || u.PasswordResetHash == token {
+		t.Fatalf("expected only a hash of the token to be stored")
+	}
+
+	if _, err := svc.ConfirmPasswordReset(token, "weak"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("expected ErrWeakPassword, got %v", err)
+	}
+	if _, err := svc.ConfirmPasswordReset(token+"0", "NewPassword456?"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected tampered token to fail, got %v", err)
+	}
+	if u, err := svc.ConfirmPasswordReset(token, "NewPassword456?"); err != nil || u.Username != "alice" || u.PasswordResetHash != "" {
+		t.Fatalf("ConfirmPasswordReset() = %+v, %v", u, err)
+	}
+	if _, err := svc.ConfirmPasswordReset(token, "OtherPassword789!"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected reset token to be single-use, got %v", err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected existing sessions to be revoked, got %v", err)
+	}
+	if _, err := svc.Login("alice", "NewPassword456?", ClientInfo{}); err != nil {
+		t.Fatalf("Login() with new password error: %v", err)
+	}
+}
+
+func TestPasswordResetTokenExpires(t *testing.T) {
+	svc, st, now := newPasswordResetTestService(t)
+	if err := svc.RequestPasswordReset("alice"); err != nil {
+		t.Fatalf("RequestPasswordReset() error: %v", err)
+	}
+	token := mailedResetToken(t, st.messages()[0])
+
+	*now = now.Add(16 * time.Minute)
+	if _, err := svc.ConfirmPasswordReset(token, "NewPassword456?"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected expired token to fail, got %v", err)
+	}
+	if err := svc.RequestPasswordReset("alice"); err != nil {
+		t.Fatalf("RequestPasswordReset() error: %v", err)
+	}
+	if len(st.messages()) != 2 {
+		t.Fatalf("expected a new mail once the old link expired")
+	}
+	if _, err := svc.ConfirmPasswordReset(token, "NewPassword456?"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Fatalf("expected superseded token to fail, got %v", err)
+	}
+	if _, err := svc.ConfirmPasswordReset(mailedResetToken(t, st.messages()[1]), "NewPassword456?"); err != nil {
+		t.Fatalf("ConfirmPasswordReset() with new token error: %v", err)
+	}
+}
+
+func TestPasswordResetDisabledWithoutMailer(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if err := svc.RequestPasswordReset("alice"); !errors.Is(err, ErrPasswordResetDisabled) {
+		t.Fatalf("expected ErrPasswordResetDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// RoleStore persists custom role definitions. The built-in admin role is not
+// stored; Service resolves it itself.
+type RoleStore interface {
+	Get(name string) (Role, error)
+	List() ([]Role, error)
+	Put(role Role) error
+	Delete(name string) error
+}
+
+type InMemoryRoleStore struct {
+	mu    sync.RWMutex
+	roles map[string]Role
+}
+
+func NewInMemoryRoleStore() *InMemoryRoleStore {
+	return &InMemoryRoleStore{roles: make(map[string]Role)}
+}
+
+func (s *InMemoryRoleStore) Get(name string) (Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.roles[name]
+	if !ok {
+		return Role{}, ErrRoleNotFound
+	}
+	return r, nil
+}
+
+func (s *InMemoryRoleStore) List() ([]Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedRoles(s.roles), nil
+}
+
+func (s *InMemoryRoleStore) Put(role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roles[role.Name] = role
+	return nil
+}
+
+func (s *InMemoryRoleStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[name]; !ok {
+		return ErrRoleNotFound
+	}
+	delete(s.roles, name)
+	return nil
+}
+
+type FileRoleStore struct {
+	path string
+
+	mu    sync.RWMutex
+	roles map[string]Role
+}
+
+func NewFileRoleStore(path string) (*FileRoleStore, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("role state file path is required")
+	}
+	s := &FileRoleStore{path: path, roles: make(map[string]Role)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileRoleStore) Get(name string) (Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.roles[name]
+	if !ok {
+		return Role{}, ErrRoleNotFound
+	}
+	return r, nil
+}
+
+func (s *FileRoleStore) List() ([]Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedRoles(s.roles), nil
+}
+
+func (s *FileRoleStore) Put(role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, existed := s.roles[role.Name]
+	s.roles[role.Name] = role
+	if err := s.persistLocked(); err != nil {
+		if existed {
+			s.roles[role.Name] = prev
+		} else {
+			delete(s.roles, role.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoleStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.roles[name]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	delete(s.roles, name)
+	if err := s.persistLocked(); err != nil {
+		s.roles[name] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *FileRoleStore) load() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read role file: %w", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var decoded []Role
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return fmt.Errorf("decode role file: %w", err)
+	}
+	for _, r := range decoded {
+		s.roles[r.Name] = r
+	}
+	return nil
+}
+
+func (s *FileRoleStore) persistLocked() error {
+	b, err := json.MarshalIndent(sortedRoles(s.roles), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode role file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir role dir: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0o644); err != nil {
+		return fmt.Errorf("write role file: %w", err)
+	}
+	return nil
+}
+
+type PostgresRoleStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRoleStore(db *sql.DB) (*PostgresRoleStore, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database is required")
+	}
+	s := &PostgresRoleStore{db: db}
+	if err := s.ensureSchema(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PostgresRoleStore) ensureSchema() error {
+	const q = `
+CREATE TABLE IF NOT EXISTS auth_roles (
+	name TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	permissions JSONB NOT NULL DEFAULT '[]'::jsonb
+)`
+	if _, err := s.db.Exec(q); err != nil {
+		return fmt.Errorf("ensure auth_roles schema: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresRoleStore) Get(name string) (Role, error) {
+	row := s.db.QueryRow(`SELECT name, description, permissions FROM auth_roles WHERE name = $1`, name)
+	r, err := scanRole(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Role{}, ErrRoleNotFound
+		}
+		return Role{}, fmt.Errorf("query role: %w", err)
+	}
+	return r, nil
+}
+
+func (s *PostgresRoleStore) List() ([]Role, error) {
+	rows, err := s.db.Query(`SELECT name, description, permissions FROM auth_roles ORDER BY name ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("query roles: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]Role, 0)
+	for rows.Next() {
+		r, err := scanRole(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan role: %w", err)
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate roles: %w", err)
+	}
+	return out, nil
+}
+
+func (s *PostgresRoleStore) Put(role Role) error {
+	permsJSON, err := json.Marshal(role.Permissions)
+	if err != nil {
+		return fmt.Errorf("encode role permissions: %w", err)
+	}
+	const q = `
+INSERT INTO auth_roles (name, description, permissions)
+VALUES ($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET
+	description = EXCLUDED.description,
+	permissions = EXCLUDED.permissions`
+	if _, err := s.db.Exec(q, role.Name, role.Description, permsJSON); err != nil {
+		return fmt.Errorf("upsert role: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresRoleStore) Delete(name string) error {
+	res, err := s.db.Exec(`DELETE FROM auth_roles WHERE name = $1`, name)
+	if err != nil {
+		return fmt.Errorf("delete role: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete role rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func scanRole(row rowScanner) (Role, error) {
+	var r Role
+	var permsJSON []byte
+	if err := row.Scan(&r.Name, &r.Description, &permsJSON); err != nil {
+		return Role{}, err
+	}
+	if len(permsJSON) > 0 {
+		if err := json.Unmarshal(permsJSON, &r.Permissions); err != nil {
+			return Role{}, fmt.Errorf("decode role permissions: %w", err)
+		}
+	}
+	return r, nil
+}
+
+func sortedRoles(roles map[string]Role) []Role {
+	out := make([]Role, 0, len(roles))
+	for _, r := range roles {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
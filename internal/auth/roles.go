@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidRole  = errors.New("invalid role")
+	ErrRoleExists   = errors.New("role already exists")
+	ErrRoleInUse    = errors.New("role is assigned to users")
+	ErrRoleReserved = errors.New("role is built in")
+)
+
+const (
+	PermSQLProfileRead  = "sqlprofile:read"
+	PermSQLProfileWrite = "sqlprofile:write"
+	PermMigrationRead   = "migration:read"
+	PermMigrationApply  = "migration:apply"
+	PermSessionRead     = "session:read"
+	PermSessionRevoke   = "session:revoke"
+	PermUserRead        = "user:read"
+	PermUserWrite       = "user:write"
+	PermRoleRead        = "role:read"
+	PermRoleWrite       = "role:write"
+	PermLockoutRead     = "lockout:read"
+	PermLockoutClear    = "lockout:clear"
+	PermAPITokenRead    = "apitoken:read"
+	PermAPITokenRevoke  = "apitoken:revoke"
+	PermMFAPolicyManage = "mfa:manage"
+	// PermUserImpersonate allows acting as another user; acting as a user
+	// with any permission the actor lacks also needs PermUserImpersonateAdmin.
+	PermUserImpersonate      = "user:impersonate"
+	PermUserImpersonateAdmin = "user:impersonate_admin"
+)
+
+// AdminRole is built in and always grants every permission, so deployments
+// that predate custom roles keep working unchanged.
+const AdminRole = "admin"
+
+const maxRoleNameLength = 64
+
+var allPermissions = []string{
+	PermSQLProfileRead,
+	PermSQLProfileWrite,
+	PermMigrationRead,
+	PermMigrationApply,
+	PermSessionRead,
+	PermSessionRevoke,
+	PermUserRead,
+	PermUserWrite,
+	PermRoleRead,
+	PermRoleWrite,
+	PermLockoutRead,
+	PermLockoutClear,
+	PermAPITokenRead,
+	PermAPITokenRevoke,
+	PermMFAPolicyManage,
+	PermUserImpersonate,
+	PermUserImpersonateAdmin,
+}
+
+// Role is a named set of permissions. Users reference roles by name; a role
+// name without a definition grants nothing.
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	BuiltIn     bool     `json:"built_in"`
+}
+
+func AllPermissions() []string {
+	return append([]string(nil), allPermissions...)
+}
+
+func adminRoleDefinition() Role {
+	return Role{
+		Name:        AdminRole,
+		Description: "Full access",
+		Permissions: AllPermissions(),
+		BuiltIn:     true,
+	}
+}
+
+// Permissions resolves the union of permissions granted by roles. Unknown
+// role names contribute nothing.
+func (s *Service) Permissions(roles []string) ([]string, error) {
+	granted := make(map[string]struct{})
+	for _, name := range normalizeRoles(roles) {
+		if name == AdminRole {
+			return AllPermissions(), nil
+		}
+		r, err := s.roles.Get(name)
+		if err != nil {
+			if errors.Is(err, ErrRoleNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		for _, p := range r.Permissions {
+			granted[p] = struct{}{}
+		}
+	}
+	out := make([]string, 0, len(granted))
+	for p := range granted {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (s *Service) ListRoles() ([]Role, error) {
+	roles, err := s.roles.List()
+	if err != nil {
+		return nil, err
+	}
+	return append([]Role{adminRoleDefinition()}, roles...), nil
+}
+
+func (s *Service) GetRole(name string) (Role, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == AdminRole {
+		return adminRoleDefinition(), nil
+	}
+	return s.roles.Get(name)
+}
+
+func (s *Service) CreateRole(name, description string, permissions []string) (Role, error) {
+	r, err := newRole(name, description, permissions)
+	if err != nil {
+		return Role{}, err
+	}
+	if _, err := s.roles.Get(r.Name); err == nil {
+		return Role{}, ErrRoleExists
+	} else if !errors.Is(err, ErrRoleNotFound) {
+		return Role{}, fmt.Errorf("check existing role: %w", err)
+	}
+	if err := s.roles.Put(r); err != nil {
+		return Role{}, fmt.Errorf("store role: %w", err)
+	}
+	return r, nil
+}
+
+func (s *Service) UpdateRole(name, description string, permissions []string) (Role, error) {
+	r, err := newRole(name, description, permissions)
+	if err != nil {
+		return Role{}, err
+	}
+	if _, err := s.roles.Get(r.Name); err != nil {
+		return Role{}, err
+	}
+	if err := s.roles.Put(r); err != nil {
+		return Role{}, fmt.Errorf("store role: %w", err)
+	}
+	return r, nil
+}
+
+// DeleteRole refuses to remove a role that users still hold, so that
+// deleting a role never silently strips access from accounts.
+func (s *Service) DeleteRole(name string) error {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == AdminRole {
+		return ErrRoleReserved
+	}
+	if _, err := s.roles.Get(name); err != nil {
+		return err
+	}
+	users, err := s.users.List()
+	if err != nil {
+		return fmt.Errorf("list users: %w", err)
+	}
+	for _, u := range users {
+		if containsString(u.Roles, name) {
+			return ErrRoleInUse
+		}
+	}
+	return s.roles.Delete(name)
+}
+
+func newRole(name, description string, permissions []string) (Role, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if err := validateRoleName(name); err != nil {
+		return Role{}, err
+	}
+	perms := make([]string, 0, len(permissions))
+	seen := make(map[string]struct{}, len(permissions))
+	for _, p := range permissions {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if !containsString(allPermissions, p) {
+			return Role{}, fmt.Errorf("%w: unknown permission %q", ErrInvalidRole, p)
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		perms = append(perms, p)
+	}
+	sort.Strings(perms)
+	return Role{Name: name, Description: strings.TrimSpace(description), Permissions: perms}, nil
+}
+
+func validateRoleName(name string) error {
+	if name == "" || len(name) > maxRoleNameLength {
+		return fmt.Errorf("%w: name must be 1-%d characters", ErrInvalidRole, maxRoleNameLength)
+	}
+	if name == AdminRole {
+		return ErrRoleReserved
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("%w: name may only contain a-z, 0-9, '-', '_' and '.'", ErrInvalidRole)
+		}
+	}
+	return nil
+}
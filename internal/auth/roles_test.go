@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRolePermissions(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+
+	perms, err := svc.Permissions([]string{"Admin"})
+	if err != nil || len(perms) != len(allPermissions) {
+		t.Fatalf("expected admin to hold every permission, got %v (%v)", perms, err)
+	}
+	if perms, _ := svc.Permissions([]string{"undefined"}); len(perms) != 0 {
+		t.Fatalf("expected undefined role to grant nothing, got %v", perms)
+	}
+
+	if _, err := svc.CreateRole("admin", "", nil); !errors.Is(err, ErrRoleReserved) {
+		t.Fatalf("expected ErrRoleReserved, got %v", err)
+	}
+	if _, err := svc.CreateRole("ops", "", []string{"sqlprofile:delete"}); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("expected ErrInvalidRole for unknown permission, got %v", err)
+	}
+	if _, err := svc.CreateRole("has space", "", nil); !errors.Is(err, ErrInvalidRole) {
+		t.Fatalf("expected ErrInvalidRole for bad name, got %v", err)
+	}
+	if _, err := svc.CreateRole(" Ops ", "Operators", []string{PermSQLProfileWrite, PermSQLProfileRead, PermSQLProfileRead}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+	if _, err := svc.CreateRole("ops", "", nil); !errors.Is(err, ErrRoleExists) {
+		t.Fatalf("expected ErrRoleExists, got %v", err)
+	}
+	if _, err := svc.CreateRole("auditor", "", []string{PermSessionRead, PermSQLProfileRead}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+
+	perms, err = svc.Permissions([]string{"ops", "auditor"})
+	if err != nil {
+		t.Fatalf("Permissions() error: %v", err)
+	}
+	want := []string{PermSessionRead, PermSQLProfileRead, PermSQLProfileWrite}
+	if len(perms) != len(want) {
+		t.Fatalf("expected %v, got %v", want, perms)
+	}
+	for i := range want {
+		if perms[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, perms)
+		}
+	}
+
+	roles, _ := svc.ListRoles()
+	if len(roles) != 3 || roles[0].Name != AdminRole || !roles[0].BuiltIn {
+		t.Fatalf("expected built-in admin first, got %+v", roles)
+	}
+
+	if _, err := svc.CreateUser("alice", "Password123!x", "", []string{"ops"}); err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	if err := svc.DeleteRole("ops"); !errors.Is(err, ErrRoleInUse) {
+		t.Fatalf("expected ErrRoleInUse, got %v", err)
+	}
+	if err := svc.DeleteRole("admin"); !errors.Is(err, ErrRoleReserved) {
+		t.Fatalf("expected ErrRoleReserved, got %v", err)
+	}
+	if err := svc.DeleteRole("auditor"); err != nil {
+		t.Fatalf("DeleteRole() error: %v", err)
+	}
+	if _, err := svc.UpdateRole("auditor", "", nil); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("expected ErrRoleNotFound, got %v", err)
+	}
+}
+
+func TestFileRoleStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	store, err := NewFileRoleStore(path)
+	if err != nil {
+		t.Fatalf("NewFileRoleStore() error: %v", err)
+	}
+	if err := store.Put(Role{Name: "ops", Permissions: []string{PermSQLProfileRead}}); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+
+	reloaded, err := NewFileRoleStore(path)
+	if err != nil {
+		t.Fatalf("NewFileRoleStore() reload error: %v", err)
+	}
+	r, err := reloaded.Get("ops")
+	if err != nil || len(r.Permissions) != 1 {
+		t.Fatalf("unexpected reloaded role %+v (%v)", r, err)
+	}
+	if err := reloaded.Delete("missing"); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("expected ErrRoleNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrSCIMDisabled = errors.New("scim not configured")
+
+// scimProvider marks accounts created over SCIM. They have no local password
+// and sign in through the configured identity provider, while their roles
+// stay managed by SCIM group membership.
+const scimProvider = "scim"
+
+// ProvisionedUser holds the attributes of a user that the identity provider
+// manages over SCIM.
+type ProvisionedUser struct {
+	Username   string
+	ExternalID string
+	Email      string
+	Active     bool
+}
+
+func (s *Service) SCIMEnabled() bool {
+	return s.scimTokenHash != nil
+}
+
+// AuthenticateSCIM reports whether token is the configured SCIM bearer token.
+func (s *Service) AuthenticateSCIM(token string) bool {
+	if s.scimTokenHash == nil || token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(sum[:], s.scimTokenHash) == 1
+}
+
+// ProvisionUser creates an account for a user pushed by the identity
+// provider. The account has no password and no roles until SCIM groups
+// assign them.
+func (s *Service) ProvisionUser(p ProvisionedUser) (User, error) {
+	if s.scimTokenHash == nil {
+		return User{}, ErrSCIMDisabled
+	}
+	p, err := normalizeProvisionedUser(p)
+	if err != nil {
+		return User{}, err
+	}
+	if _, err := s.users.GetByUsername(p.Username); err == nil {
+		return User{}, ErrUsernameTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return User{}, fmt.Errorf("check existing user: %w", err)
+	}
+
+	id, err := generateToken(16)
+	if err != nil {
+		return User{}, fmt.Errorf("generate user id: %w", err)
+	}
+	now := s.nowFunc()
+	u := User{
+		ID:              id,
+		Username:        p.Username,
+		PasswordHash:    externalPasswordHash,
+		Roles:           []string{},
+		Email:           p.Email,
+		Disabled:        !p.Active,
+		CreatedAt:       &now,
+		UpdatedAt:       &now,
+		AuthProvider:    scimProvider,
+		ExternalSubject: p.ExternalID,
+	}
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store user: %w", err)
+	}
+	return u, nil
+}
+
+// ListProvisionedUsers returns the accounts created over SCIM. Local and
+// other external accounts are invisible to the identity provider.
+func (s *Service) ListProvisionedUsers() ([]User, error) {
+	if s.scimTokenHash == nil {
+		return nil, ErrSCIMDisabled
+	}
+	users, err := s.users.List()
+	if err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	return slices.DeleteFunc(users, func(u User) bool { return u.AuthProvider != scimProvider }), nil
+}
+
+// GetProvisionedUser returns an account created over SCIM, and
+// ErrUserNotFound for any other account.
+func (s *Service) GetProvisionedUser(id string) (User, error) {
+	if s.scimTokenHash == nil {
+		return User{}, ErrSCIMDisabled
+	}
+	u, err := s.users.GetByID(id)
+	if err != nil {
+		return User{}, err
+	}
+	if u.AuthProvider != scimProvider {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// UpdateProvisionedUser applies the identity provider's view of a user to an
+// account created over SCIM. Deactivating the account revokes its sessions.
+func (s *Service) UpdateProvisionedUser(id string, p ProvisionedUser) (User, error) {
+	if s.scimTokenHash == nil {
+		return User{}, ErrSCIMDisabled
+	}
+	p, err := normalizeProvisionedUser(p)
+	if err != nil {
+		return User{}, err
+	}
+	u, err := s.GetProvisionedUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	renamed := u.Username != p.Username
+	if renamed {
+		if err := s.users.Rename(u.ID, p.Username); err != nil {
+			return User{}, err
+		}
+		u.Username = p.Username
+	}
+	if u.Email != p.Email {
+		u.Email = p.Email
+		u.PasswordResetHash = ""
+		u.PasswordResetExpiresAt = nil
+	}
+	u.ExternalSubject = p.ExternalID
+	u.Disabled = !p.Active
+	now := s.nowFunc()
+	u.UpdatedAt = &now
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store user: %w", err)
+	}
+	if u.Disabled {
+		return u, s.RevokeUserSessions(u.ID)
+	}
+	if renamed {
+		if err := s.syncUserSessions(u); err != nil {
+			return User{}, fmt.Errorf("update sessions: %w", err)
+		}
+	}
+	return u, nil
+}
+
+// DeprovisionUser disables an account created over SCIM and revokes its
+// sessions and API tokens. The account is kept, so that its audit trail
+// still names it.
+func (s *Service) DeprovisionUser(id string) (User, error) {
+	u, err := s.GetProvisionedUser(id)
+	if err != nil {
+		return User{}, err
+	}
+	if !u.Disabled {
+		u.Disabled = true
+		now := s.nowFunc()
+		u.UpdatedAt = &now
+		if err := s.users.Put(u); err != nil {
+			return User{}, fmt.Errorf("store user: %w", err)
+		}
+	}
+	if err := s.revokeUserAPITokens(u.ID); err != nil {
+		return User{}, err
+	}
+	return u, s.RevokeUserSessions(u.ID)
+}
+
+// ReplaceRoleMembers makes userIDs the exact set of SCIM accounts holding the
+// role. Other holders of the role keep it.
+func (s *Service) ReplaceRoleMembers(name string, userIDs []string) error {
+	name, err := s.provisionedRoleName(name)
+	if err != nil {
+		return err
+	}
+	users, err := s.ListProvisionedUsers()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(users))
+	for _, u := range users {
+		known[u.ID] = true
+	}
+	want := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		if !known[id] {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, id)
+		}
+		want[id] = true
+	}
+	for _, u := range users {
+		if want[u.ID] {
+			err = s.grantRole(u, name)
+		} else {
+			err = s.withdrawRole(u, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangeRoleMembers grants the role to the SCIM accounts in add and withdraws
+// it from those in remove. Removing a user that does not hold the role, or
+// that is not a SCIM account, is a no-op.
+func (s *Service) ChangeRoleMembers(name string, add, remove []string) error {
+	name, err := s.provisionedRoleName(name)
+	if err != nil {
+		return err
+	}
+	grant := make([]User, 0, len(add))
+	for _, id := range add {
+		u, err := s.GetProvisionedUser(id)
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, id)
+		}
+		grant = append(grant, u)
+	}
+	for _, u := range grant {
+		if err := s.grantRole(u, name); err != nil {
+			return err
+		}
+	}
+	for _, id := range remove {
+		u, err := s.GetProvisionedUser(id)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.withdrawRole(u, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteProvisionedRole withdraws the role from its SCIM holders and deletes
+// it. Unlike DeleteRole it does not refuse a role held by SCIM accounts,
+// because the identity provider owns their membership, but it does refuse
+// one that other accounts hold.
+func (s *Service) DeleteProvisionedRole(name string) error {
+	name, err := s.provisionedRoleName(name)
+	if err != nil {
+		return err
+	}
+	if name == AdminRole {
+		return ErrRoleReserved
+	}
+	users, err := s.users.List()
+	if err != nil {
+		return fmt.Errorf("list users: %w", err)
+	}
+	for _, u := range users {
+		if u.AuthProvider != scimProvider && containsString(u.Roles, name) {
+			return ErrRoleInUse
+		}
+	}
+	if err := s.ReplaceRoleMembers(name, nil); err != nil {
+		return err
+	}
+	return s.roles.Delete(name)
+}
+
+// ListProvisionedRoles lists the roles SCIM may manage as groups: all of
+// them, except admin unless SCIMAllowAdminRole is set.
+func (s *Service) ListProvisionedRoles() ([]Role, error) {
+	if s.scimTokenHash == nil {
+		return nil, ErrSCIMDisabled
+	}
+	roles, err := s.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+	if !s.scimAllowAdmin {
+		roles = slices.DeleteFunc(roles, func(r Role) bool { return r.Name == AdminRole })
+	}
+	return roles, nil
+}
+
+// GetProvisionedRole returns a role SCIM may manage, answering
+// ErrRoleNotFound for admin unless SCIMAllowAdminRole is set.
+func (s *Service) GetProvisionedRole(name string) (Role, error) {
+	if s.scimTokenHash == nil {
+		return Role{}, ErrSCIMDisabled
+	}
+	r, err := s.GetRole(name)
+	if err != nil {
+		return Role{}, err
+	}
+	if r.Name == AdminRole && !s.scimAllowAdmin {
+		return Role{}, ErrRoleNotFound
+	}
+	return r, nil
+}
+
+func (s *Service) provisionedRoleName(name string) (string, error) {
+	r, err := s.GetProvisionedRole(name)
+	if err != nil {
+		return "", err
+	}
+	return r.Name, nil
+}
+
+func (s *Service) grantRole(u User, role string) error {
+	if containsString(u.Roles, role) {
+		return nil
+	}
+	return s.setUserRoles(u, append(slices.Clone(u.Roles), role))
+}
+
+func (s *Service) withdrawRole(u User, role string) error {
+	if !containsString(u.Roles, role) {
+		return nil
+	}
+	return s.setUserRoles(u, slices.DeleteFunc(slices.Clone(u.Roles), func(r string) bool { return r == role }))
+}
+
+func (s *Service) setUserRoles(u User, roles []string) error {
+	u.Roles = roles
+	now := s.nowFunc()
+	u.UpdatedAt = &now
+	if err := s.users.Put(u); err != nil {
+		return fmt.Errorf("store user: %w", err)
+	}
+	if err := s.syncUserSessions(u); err != nil {
+		return fmt.Errorf("update sessions: %w", err)
+	}
+	return nil
+}
+
+func normalizeProvisionedUser(p ProvisionedUser) (ProvisionedUser, error) {
+	p.Username = strings.TrimSpace(p.Username)
+	if err := validateUsername(p.Username); err != nil {
+		return ProvisionedUser{}, err
+	}
+	p.Email = strings.TrimSpace(p.Email)
+	if err := validateEmail(p.Email); err != nil {
+		return ProvisionedUser{}, err
+	}
+	p.ExternalID = strings.TrimSpace(p.ExternalID)
+	return p, nil
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSCIMProvisioning(t *testing.T) {
+	dir := &fakeAuthenticator{id: ExternalIdentity{Subject: "uid=carol,dc=example", Username: "carol", Roles: []string{"viewer"}}}
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, Authenticator: dir, SCIMToken: "scim-secret"})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if !svc.SCIMEnabled() || !svc.AuthenticateSCIM("scim-secret") || svc.AuthenticateSCIM("scim-secreT") || svc.AuthenticateSCIM("") {
+		t.Fatalf("unexpected SCIM token check")
+	}
+	if _, err := svc.CreateRole("operator", "", []string{PermSQLProfileRead}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+
+	carol, err := svc.ProvisionUser(ProvisionedUser{Username: "carol", ExternalID: "uid=carol,dc=example", Email: "carol@example.com", Active: true})
+	if err != nil {
+		t.Fatalf("ProvisionUser() error: %v", err)
+	}
+	if carol.AuthProvider != scimProvider || carol.ExternalSubject != "uid=carol,dc=example" || len(carol.Roles) != 0 {
+		t.Fatalf("unexpected provisioned user %+v", carol)
+	}
+	if _, err := svc.ProvisionUser(ProvisionedUser{Username: "carol", Active: true}); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	if _, err := svc.ProvisionUser(ProvisionedUser{Username: "bad name", Active: true}); !errors.Is(err, ErrInvalidUserInput) {
+		t.Fatalf("expected ErrInvalidUserInput, got %v", err)
+	}
+	if err := svc.ChangeRoleMembers("operator", []string{carol.ID, "missing"}, nil); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if u, _ := svc.GetUser(carol.ID); len(u.Roles) != 0 {
+		t.Fatalf("expected a failed change to grant nothing, got %v", u.Roles)
+	}
+	if err := svc.ChangeRoleMembers("operator", []string{carol.ID}, nil); err != nil {
+		t.Fatalf("ChangeRoleMembers() error: %v", err)
+	}
+
+	// A directory entry whose subject is not the external ID cannot take
+	// the account over.
+	if _, err := svc.ProvisionUser(ProvisionedUser{Username: "erin", ExternalID: "okta-erin", Active: true}); err != nil {
+		t.Fatalf("ProvisionUser() error: %v", err)
+	}
+	dir.id = ExternalIdentity{Subject: "uid=erin,dc=example", Username: "erin"}
+	if _, err := svc.Login("erin", "dir-pass", ClientInfo{}); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
+	}
+	dir.id = ExternalIdentity{Subject: "uid=carol,dc=example", Username: "carol", Roles: []string{"viewer"}}
+
+	// The directory signs carol in, but SCIM keeps managing the roles.
+	session, err := svc.Login("carol", "dir-pass", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if !slices.Equal(session.Roles, []string{"operator"}) {
+		t.Fatalf("expected SCIM roles on the session, got %v", session.Roles)
+	}
+	if u, _ := svc.GetUser(carol.ID); u.AuthProvider != scimProvider {
+		t.Fatalf("expected the account to stay SCIM managed, got %+v", u)
+	}
+
+	if err := svc.ReplaceRoleMembers("operator", nil); err != nil {
+		t.Fatalf("ReplaceRoleMembers() error: %v", err)
+	}
+	if sess, err := svc.ValidateToken(session.Token); err != nil || len(sess.Roles) != 0 {
+		t.Fatalf("expected removal from the group to reach the session, got %+v, %v", sess, err)
+	}
+
+	updated, err := svc.UpdateProvisionedUser(carol.ID, ProvisionedUser{Username: "carol.b", ExternalID: "uid=carol,dc=example", Active: true})
+	if err != nil {
+		t.Fatalf("UpdateProvisionedUser() error: %v", err)
+	}
+	if updated.Username != "carol.b" || updated.ExternalSubject != "uid=carol,dc=example" || updated.Email != "" {
+		t.Fatalf("unexpected updated user %+v", updated)
+	}
+	if sess, err := svc.ValidateToken(session.Token); err != nil || sess.Username != "carol.b" {
+		t.Fatalf("expected rename to reach the session, got %+v, %v", sess, err)
+	}
+	if _, err := svc.UpdateProvisionedUser(carol.ID, ProvisionedUser{Username: "carol.b", ExternalID: "uid=carol,dc=example", Active: false}); err != nil {
+		t.Fatalf("UpdateProvisionedUser() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected deprovisioning to revoke sessions, got %v", err)
+	}
+	dir.id.Username = "carol.b"
+	if _, err := svc.Login("carol.b", "dir-pass", ClientInfo{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+
+	if err := svc.ChangeRoleMembers("operator", []string{carol.ID}, nil); err != nil {
+		t.Fatalf("ChangeRoleMembers() error: %v", err)
+	}
+	if err := svc.DeleteProvisionedRole("operator"); err != nil {
+		t.Fatalf("DeleteProvisionedRole() error: %v", err)
+	}
+	if u, _ := svc.GetUser(carol.ID); len(u.Roles) != 0 {
+		t.Fatalf("expected deleting the group to withdraw the role, got %v", u.Roles)
+	}
+	if _, err := svc.GetRole("operator"); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("expected ErrRoleNotFound, got %v", err)
+	}
+	if err := svc.DeleteProvisionedRole(AdminRole); !errors.Is(err, ErrRoleNotFound) {
+		t.Fatalf("expected ErrRoleNotFound, got %v", err)
+	}
+}
+
+func TestSCIMAdminRoleNeedsOptIn(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, SCIMToken: "scim-secret", SCIMAllowAdminRole: allow})
+		if err != nil {
+			t.Fatalf("NewService() error: %v", err)
+		}
+		carol, err := svc.ProvisionUser(ProvisionedUser{Username: "carol", Active: true})
+		if err != nil {
+			t.Fatalf("ProvisionUser() error: %v", err)
+		}
+
+		roles, err := svc.ListProvisionedRoles()
+		if err != nil {
+			t.Fatalf("ListProvisionedRoles() error: %v", err)
+		}
+		listed := slices.ContainsFunc(roles, func(r Role) bool { return r.Name == AdminRole })
+		_, getErr := svc.GetProvisionedRole(AdminRole)
+		grantErr := svc.ChangeRoleMembers(AdminRole, []string{carol.ID}, nil)
+		replaceErr := svc.ReplaceRoleMembers(AdminRole, []string{carol.ID})
+		u, _ := svc.GetUser(carol.ID)
+
+		if !allow {
+			if listed || !errors.Is(getErr, ErrRoleNotFound) || !errors.Is(grantErr, ErrRoleNotFound) || !errors.Is(replaceErr, ErrRoleNotFound) || len(u.Roles) != 0 {
+				t.Fatalf("admin reachable over SCIM by default: listed=%v get=%v grant=%v replace=%v roles=%v", listed, getErr, grantErr, replaceErr, u.Roles)
+			}
+			continue
+		}
+		if !listed || getErr != nil || grantErr != nil || replaceErr != nil || !slices.Equal(u.Roles, []string{AdminRole}) {
+			t.Fatalf("admin not grantable with SCIMAllowAdminRole: listed=%v get=%v grant=%v replace=%v roles=%v", listed, getErr, grantErr, replaceErr, u.Roles)
+		}
+		if err := svc.DeleteProvisionedRole(AdminRole); !errors.Is(err, ErrRoleReserved) {
+			t.Fatalf("expected ErrRoleReserved, got %v", err)
+		}
+	}
+}
+
+func TestSCIMLeavesOtherAccountsAlone(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour, SCIMToken: "scim-secret"})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if _, err := svc.CreateRole("operator", "", []string{PermSQLProfileRead}); err != nil {
+		t.Fatalf("CreateRole() error: %v", err)
+	}
+	local, err := svc.CreateUser("dave", "Password123!x", "dave@example.com", []string{"operator"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	carol, err := svc.ProvisionUser(ProvisionedUser{Username: "carol", Active: true})
+	if err != nil {
+		t.Fatalf("ProvisionUser() error: %v", err)
+	}
+
+	if users, err := svc.ListProvisionedUsers(); err != nil || len(users) != 1 || users[0].ID != carol.ID {
+		t.Fatalf("ListProvisionedUsers() = %+v, %v", users, err)
+	}
+	if _, err := svc.GetProvisionedUser(local.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := svc.UpdateProvisionedUser(local.ID, ProvisionedUser{Username: "mallory", Active: false}); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := svc.DeprovisionUser(local.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if err := svc.ChangeRoleMembers("operator", []string{local.ID}, nil); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if err := svc.ReplaceRoleMembers("operator", []string{carol.ID}); err != nil {
+		t.Fatalf("ReplaceRoleMembers() error: %v", err)
+	}
+	if err := svc.ChangeRoleMembers("operator", nil, []string{local.ID}); err != nil {
+		t.Fatalf("ChangeRoleMembers() error: %v", err)
+	}
+	if err := svc.DeleteProvisionedRole("operator"); !errors.Is(err, ErrRoleInUse) {
+		t.Fatalf("expected ErrRoleInUse, got %v", err)
+	}
+	if u, _ := svc.GetUser(local.ID); u.Username != "dave" || u.Disabled || !slices.Equal(u.Roles, []string{"operator"}) {
+		t.Fatalf("expected the local account to be untouched, got %+v", u)
+	}
+
+	carolSession, err := svc.issueSession(carol, ClientInfo{})
+	if err != nil {
+		t.Fatalf("issueSession() error: %v", err)
+	}
+	gone, err := svc.DeprovisionUser(carol.ID)
+	if err != nil || !gone.Disabled {
+		t.Fatalf("DeprovisionUser() = %+v, %v", gone, err)
+	}
+	if _, err := svc.ValidateToken(carolSession.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected deprovisioning to revoke sessions, got %v", err)
+	}
+	if u, err := svc.GetUser(carol.ID); err != nil || !u.Disabled || !slices.Equal(u.Roles, []string{"operator"}) {
+		t.Fatalf("expected the account to be kept disabled, got %+v, %v", u, err)
+	}
+}
+
+func TestSCIMDisabled(t *testing.T) {
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if svc.SCIMEnabled() || svc.AuthenticateSCIM("") {
+		t.Fatalf("expected SCIM to be off without a token")
+	}
+	if _, err := svc.ProvisionUser(ProvisionedUser{Username: "dave", Active: true}); !errors.Is(err, ErrSCIMDisabled) {
+		t.Fatalf("expected ErrSCIMDisabled, got %v", err)
+	}
+}
@@ -1,19 +1,18 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
-	"unicode"
 )
 
 var (
@@ -25,25 +24,95 @@ var (
 const (
 	minPasswordLength = 12
 	maxPasswordLength = 128
+	sessionPruneEvery = time.Minute
+	// sessionTouchInterval bounds how often activity is written back, so that
+	// an active session does not turn every request into a store write.
+	sessionTouchInterval      = time.Minute
+	defaultSessionMaxLifetime = 12 * time.Hour
+	maxUserAgentLength        = 512
 )
 
 type Service struct {
-	users        UserStore
-	pepper       string
-	ttl          time.Duration
-	nowFunc      func() time.Time
-	stateFile    string
-	sessionStore SessionStore
-
-	sessMu   sync.RWMutex
-	sessions map[string]Session
+	users         UserStore
+	pepper        string
+	hashParams    HashParams
+	ttl           time.Duration
+	maxLifetime   time.Duration
+	nowFunc       func() time.Time
+	sessions      SessionStore
+	mfaIssuer     string
+	mfaPolicy     MFAPolicyStore
+	attempts      LoginAttemptStore
+	throttle      ThrottleConfig
+	oidc          *oidcProvider
+	webauthn      *webauthnRelyingParty
+	clientCerts   *ClientCertConfig
+	authenticator Authenticator
+	apiTokens     APITokenStore
+	roles         RoleStore
+	mailer        Mailer
+	resetURL      *url.URL
+	resetTTL      time.Duration
+	policy        PasswordPolicy
+	breached      *breachedPasswords
+	// endSessionOnPasswordChange also signs out the session that changed
+	// the password; the user's other sessions always end.
+	endSessionOnPasswordChange bool
+	impersonationTTL           time.Duration
+	// scimTokenHash is the SHA-256 of the SCIM bearer token, nil when SCIM
+	// is off.
+	scimTokenHash  []byte
+	scimAllowAdmin bool
+	// jwt signs access tokens as JWTs; nil keeps them opaque.
+	jwt *jwtIssuer
+
+	pruneMu          sync.Mutex
+	lastPrune        time.Time
+	lastSessionPrune time.Time
 }
 
 type ServiceConfig struct {
-	PasswordPepper   string
-	SessionTTL       time.Duration
-	SessionStateFile string
-	SessionStore     SessionStore
+	PasswordPepper     string
+	HashParams         HashParams
+	SessionTTL         time.Duration
+	SessionMaxLifetime time.Duration
+	SessionStateFile   string
+	SessionStore       SessionStore
+	MFAIssuer          string
+	MFAPolicyStore     MFAPolicyStore
+	LoginAttempts      LoginAttemptStore
+	Throttle           ThrottleConfig
+	OIDC               *OIDCConfig
+	WebAuthn           *WebAuthnConfig
+	Authenticator      Authenticator
+	APITokens          APITokenStore
+	Roles              RoleStore
+	// Mailer enables self-service password reset. PasswordResetURL is the
+	// page that receives the token as its "token" query parameter.
+	Mailer           Mailer
+	PasswordResetURL string
+	PasswordResetTTL time.Duration
+	// PasswordPolicy applies to every password set through the service; the
+	// zero value selects DefaultPasswordPolicy.
+	PasswordPolicy PasswordPolicy
+	// EndSessionOnPasswordChange makes ChangePassword sign out the calling
+	// session too instead of keeping it.
+	EndSessionOnPasswordChange bool
+	// ImpersonationTTL bounds impersonation sessions; zero selects 30
+	// minutes.
+	ImpersonationTTL time.Duration
+	// SCIMToken enables SCIM provisioning for clients that present it as a
+	// bearer token.
+	SCIMToken string
+	// SCIMAllowAdminRole lets SCIM groups grant the built-in admin role.
+	// Without it the admin group is invisible to SCIM.
+	SCIMAllowAdminRole bool
+	// JWT makes sessions carry signed, short-lived JWT access tokens that
+	// are validated without a session store lookup per request; revoked
+	// sessions reach other instances through a deny-list in the store.
+	JWT *JWTConfig
+	// ClientCerts enables AuthenticateClientCertificate.
+	ClientCerts *ClientCertConfig
 }
 
 func NewService(userStore UserStore, cfg ServiceConfig) (*Service, error) {
@@ -56,108 +125,412 @@ func NewService(userStore UserStore, cfg ServiceConfig) (*Service, error) {
 	if cfg.SessionTTL <= 0 {
 		return nil, fmt.Errorf("session TTL must be > 0")
 	}
-
-	return &Service{
-		users:        userStore,
-		pepper:       cfg.PasswordPepper,
-		ttl:          cfg.SessionTTL,
-		nowFunc:      time.Now,
-		stateFile:    cfg.SessionStateFile,
-		sessionStore: cfg.SessionStore,
-		sessions:     make(map[string]Session),
-		sessMu:       sync.RWMutex{},
-	}, nil
+	maxLifetime := cfg.SessionMaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = defaultSessionMaxLifetime
+	}
+	if maxLifetime < cfg.SessionTTL {
+		return nil, fmt.Errorf("session max lifetime must be >= session TTL")
+	}
+	hashParams := cfg.HashParams
+	if hashParams == (HashParams{}) {
+		hashParams = DefaultHashParams
+	}
+	if err := hashParams.validate(); err != nil {
+		return nil, err
+	}
+	mfaIssuer := strings.TrimSpace(cfg.MFAIssuer)
+	if mfaIssuer == "" {
+		mfaIssuer = defaultMFAIssuer
+	}
+	mfaPolicy := cfg.MFAPolicyStore
+	if mfaPolicy == nil {
+		mfaPolicy = NewInMemoryMFAPolicyStore()
+	}
+	throttle := cfg.Throttle
+	if throttle == (ThrottleConfig{}) {
+		throttle = DefaultThrottleConfig
+	}
+	if err := throttle.validate(); err != nil {
+		return nil, err
+	}
+	attempts := cfg.LoginAttempts
+	if attempts == nil {
+		attempts = NewInMemoryLoginAttemptStore()
+	}
+	apiTokens := cfg.APITokens
+	if apiTokens == nil {
+		apiTokens = NewInMemoryAPITokenStore()
+	}
+	roles := cfg.Roles
+	if roles == nil {
+		roles = NewInMemoryRoleStore()
+	}
+	var resetURL *url.URL
+	resetTTL := cfg.PasswordResetTTL
+	if cfg.Mailer != nil {
+		u, err := parsePasswordResetURL(cfg.PasswordResetURL)
+		if err != nil {
+			return nil, err
+		}
+		resetURL = u
+		if resetTTL == 0 {
+			resetTTL = defaultPasswordResetTTL
+		}
+		if resetTTL < passwordResetResendAfter {
+			return nil, fmt.Errorf("password reset TTL must be >= %s", passwordResetResendAfter)
+		}
+	}
+	impersonationTTL := cfg.ImpersonationTTL
+	if impersonationTTL == 0 {
+		impersonationTTL = defaultImpersonationTTL
+	}
+	if impersonationTTL < 0 {
+		return nil, fmt.Errorf("impersonation TTL must be > 0")
+	}
+	policy := cfg.PasswordPolicy
+	if policy == (PasswordPolicy{}) {
+		policy = DefaultPasswordPolicy
+	}
+	if err := policy.validateConfig(); err != nil {
+		return nil, err
+	}
+	var breached *breachedPasswords
+	if policy.BreachedHashFile != "" {
+		b, err := openBreachedPasswords(policy.BreachedHashFile)
+		if err != nil {
+			return nil, err
+		}
+		breached = b
+	}
+	var oidc *oidcProvider
+	if cfg.OIDC != nil {
+		p, err := newOIDCProvider(*cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		oidc = p
+	}
+	var webauthn *webauthnRelyingParty
+	if cfg.WebAuthn != nil {
+		rp, err := newWebAuthnRelyingParty(*cfg.WebAuthn)
+		if err != nil {
+			return nil, err
+		}
+		webauthn = rp
+	}
+	var scimTokenHash []byte
+	if cfg.SCIMToken != "" {
+		sum := sha256.Sum256([]byte(cfg.SCIMToken))
+		scimTokenHash = sum[:]
+	}
+	var jwt *jwtIssuer
+	if cfg.JWT != nil {
+		j, err := newJWTIssuer(*cfg.JWT)
+		if err != nil {
+			return nil, err
+		}
+		jwt = j
+	}
+	var clientCerts *ClientCertConfig
+	if cfg.ClientCerts != nil {
+		if err := cfg.ClientCerts.validate(); err != nil {
+			return nil, err
+		}
+		c := *cfg.ClientCerts
+		clientCerts = &c
+	}
+
+	s := &Service{
+		users:         userStore,
+		pepper:        cfg.PasswordPepper,
+		hashParams:    hashParams,
+		ttl:           cfg.SessionTTL,
+		maxLifetime:   maxLifetime,
+		nowFunc:       time.Now,
+		sessions:      cfg.SessionStore,
+		mfaIssuer:     mfaIssuer,
+		mfaPolicy:     mfaPolicy,
+		attempts:      attempts,
+		throttle:      throttle,
+		oidc:          oidc,
+		webauthn:      webauthn,
+		clientCerts:   clientCerts,
+		authenticator: cfg.Authenticator,
+		apiTokens:     apiTokens,
+		roles:         roles,
+		mailer:        cfg.Mailer,
+		resetURL:      resetURL,
+		resetTTL:      resetTTL,
+		policy:        policy,
+		breached:      breached,
+
+		endSessionOnPasswordChange: cfg.EndSessionOnPasswordChange,
+		impersonationTTL:           impersonationTTL,
+		scimTokenHash:              scimTokenHash,
+		scimAllowAdmin:             cfg.SCIMAllowAdminRole,
+		jwt:                        jwt,
+	}
+	// Sessions are keyed by token hash, so the file store needs the service
+	// pepper to convert state files written before hashing.
+	if s.sessions == nil {
+		if cfg.SessionStateFile != "" {
+			fs, err := newFileSessionStore(cfg.SessionStateFile, s.hashSessionToken)
+			if err != nil {
+				return nil, err
+			}
+			s.sessions = fs
+		} else {
+			s.sessions = NewInMemorySessionStore()
+		}
+	}
+	return s, nil
 }
 
-func (s *Service) HashPassword(password string) string {
-	sum := sha256.Sum256([]byte(s.pepper + ":" + password))
-	return hex.EncodeToString(sum[:])
+func (s *Service) HashPassword(password string) (string, error) {
+	salt, err := generateSalt(passwordSaltLength)
+	if err != nil {
+		return "", fmt.Errorf("generate password salt: %w", err)
+	}
+	key := s.derivePasswordKey(password, salt, s.hashParams, passwordKeyLength)
+	return encodeArgon2id(s.hashParams, salt, key), nil
 }
 
 func (s *Service) VerifyPassword(password, storedHash string) bool {
-	candidate := s.HashPassword(password)
-	return subtle.ConstantTimeCompare([]byte(candidate), []byte(storedHash)) == 1
+	if storedHash == externalPasswordHash {
+		return false
+	}
+	if isLegacyPasswordHash(storedHash) {
+		candidate := s.legacyHashPassword(password)
+		return subtle.ConstantTimeCompare([]byte(candidate), []byte(storedHash)) == 1
+	}
+	return s.verifyArgon2id(password, storedHash)
 }
 
-func (s *Service) Login(username, password string) (Session, error) {
+// Login verifies credentials for a request from client. client.IP may be
+// empty, in which case only the per-username counter applies.
+func (s *Service) Login(username, password string, client ClientInfo) (Session, error) {
+	keys := s.loginThrottleKeys(username, client.IP)
+	if err := s.checkLoginAllowed(keys); err != nil {
+		return Session{}, err
+	}
+
+	u, err := s.authenticate(username, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		if err := s.recordLoginFailure(keys); err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if err := s.checkAccountActive(u); err != nil {
+		return Session{}, err
+	}
+
+	mfaNeeded, err := s.mfaRequired(u)
+	if err != nil {
+		return Session{}, err
+	}
+	if mfaNeeded {
+		challenge, err := s.newMFAChallenge(u)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, &MFARequiredError{Challenge: challenge}
+	}
+	return s.completeLogin(u, client)
+}
+
+// authenticate checks the password locally for local accounts and through the
+// configured Authenticator for everyone else. Local accounts are never
+// delegated, so the bootstrap admin keeps working when the directory is down
+// and a directory entry cannot take over a local name.
+func (s *Service) authenticate(username, password string) (User, error) {
 	u, err := s.users.GetByUsername(username)
+	if err == nil && u.AuthProvider == "" {
+		if !s.VerifyPassword(password, u.PasswordHash) {
+			return User{}, ErrInvalidCredentials
+		}
+		return s.startPasswordClock(s.upgradePasswordHash(u, password)), nil
+	}
+	if s.authenticator == nil {
+		return User{}, ErrInvalidCredentials
+	}
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return User{}, ErrInvalidCredentials
+	}
+	if err == nil && u.AuthProvider != s.authenticator.Name() && u.AuthProvider != scimProvider {
+		return User{}, ErrInvalidCredentials
+	}
+
+	identity, err := s.authenticator.Authenticate(username, password)
 	if err != nil {
-		return Session{}, ErrInvalidCredentials
+		if errors.Is(err, ErrInvalidCredentials) {
+			return User{}, ErrInvalidCredentials
+		}
+		return User{}, fmt.Errorf("%s authentication: %w", s.authenticator.Name(), err)
 	}
+	u, err = s.provisionExternalUser(s.authenticator.Name(), identity.Subject, identity.Username, identity.Roles)
+	if errors.Is(err, ErrExternalAccountConflict) || errors.Is(err, ErrInvalidUserInput) {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, err
+}
 
-	if !s.VerifyPassword(password, u.PasswordHash) {
-		return Session{}, ErrInvalidCredentials
+// issueSession signs u in after its credentials have been verified.
+func (s *Service) issueSession(u User, client ClientInfo) (Session, error) {
+	if err := s.checkAccountActive(u); err != nil {
+		return Session{}, err
+	}
+	now := s.nowFunc()
+	session, err := s.startSession(u, client, mustID(16), now, now.Add(s.maxLifetime))
+	if err != nil {
+		return Session{}, err
 	}
+	// Best effort: the sign-in succeeded even if the time is not recorded.
+	_ = s.users.TouchLastLogin(u.ID, now)
+	return session, nil
+}
 
+// completeLogin issues the session once every factor has been verified and
+// only then resets the username's failure counter.
+func (s *Service) completeLogin(u User, client ClientInfo) (Session, error) {
+	session, err := s.issueSession(u, client)
+	if err != nil {
+		return Session{}, err
+	}
+	s.clearUsernameFailures(u.Username)
+	return session, nil
+}
+
+// startSession stores a new session with fresh access and refresh tokens.
+// Refreshed sessions pass on the family, creation time and absolute deadline
+// of the session they replace. No session outlives the account's expiry.
+func (s *Service) startSession(u User, client ClientInfo, familyID string, createdAt, absoluteExpiresAt time.Time) (Session, error) {
+	absoluteExpiresAt = capToAccountExpiry(u, absoluteExpiresAt)
 	token, err := generateToken(32)
 	if err != nil {
 		return Session{}, fmt.Errorf("generate token: %w", err)
 	}
+	refreshToken, err := generateToken(32)
+	if err != nil {
+		return Session{}, fmt.Errorf("generate refresh token: %w", err)
+	}
 
 	now := s.nowFunc()
 	session := Session{
-		ID:        mustID(16),
-		Token:     token,
-		UserID:    u.ID,
-		Username:  u.Username,
-		Roles:     append([]string(nil), u.Roles...),
-		CreatedAt: now,
-		ExpiresAt: now.Add(s.ttl),
-	}
-
-	s.sessMu.Lock()
-	s.sessions[token] = session
-	if err := s.persistSessionsLocked(); err != nil {
-		delete(s.sessions, token)
-		s.sessMu.Unlock()
-		return Session{}, err
+		ID:                     mustID(16),
+		Token:                  token,
+		UserID:                 u.ID,
+		Username:               u.Username,
+		Roles:                  append([]string(nil), u.Roles...),
+		CreatedAt:              createdAt,
+		ExpiresAt:              s.idleDeadline(now, absoluteExpiresAt),
+		AbsoluteExpiresAt:      absoluteExpiresAt,
+		LastSeenAt:             now,
+		FamilyID:               familyID,
+		RefreshToken:           refreshToken,
+		RefreshHash:            s.hashRefreshToken(refreshToken),
+		ClientIP:               client.IP,
+		UserAgent:              truncateUserAgent(client.UserAgent),
+		PasswordChangeRequired: s.passwordChangeRequired(u),
+	}
+
+	stored := session
+	stored.Token = ""
+	stored.RefreshToken = ""
+	// With signed access tokens the record stays keyed by the opaque token,
+	// which is never handed out.
+	if s.jwt != nil {
+		session.Token, session.ExpiresAt, err = s.signAccessToken(session)
+		if err != nil {
+			return Session{}, fmt.Errorf("sign access token: %w", err)
+		}
+	}
+	if err := s.sessions.Create(s.hashSessionToken(token), stored); err != nil {
+		return Session{}, fmt.Errorf("store session: %w", err)
 	}
-	s.sessMu.Unlock()
+	s.pruneSessions(now)
 
 	return session, nil
 }
 
+// ValidateToken accepts a session until it has been idle for the session TTL
+// or reaches its absolute deadline. Activity pushes the idle deadline out.
+// Signed access tokens are checked on their own and last until they expire
+// or their session is put on the deny-list.
 func (s *Service) ValidateToken(token string) (Session, error) {
-	s.sessMu.RLock()
-	session, ok := s.sessions[token]
-	s.sessMu.RUnlock()
-	if !ok {
-		return Session{}, ErrInvalidToken
+	if isAPIToken(token) {
+		return s.validateAPIToken(token)
+	}
+	if s.jwt != nil && isJWT(token) {
+		return s.validateAccessToken(token)
 	}
 
-	if s.nowFunc().After(session.ExpiresAt) {
-		s.sessMu.Lock()
-		delete(s.sessions, token)
-		_ = s.persistSessionsLocked()
-		s.sessMu.Unlock()
+	key := s.hashSessionToken(token)
+	session, err := s.sessions.Get(key)
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return Session{}, ErrInvalidToken
+		}
+		return Session{}, err
+	}
+	session = withSessionDefaults(session)
+
+	now := s.nowFunc()
+	if now.After(session.AbsoluteExpiresAt) {
+		_ = s.sessions.Delete(key)
 		return Session{}, ErrInvalidToken
 	}
+	// An idle session is kept until its absolute deadline so that its refresh
+	// token still works.
+	if session.RotatedAt != nil || now.After(session.ExpiresAt) {
+		return Session{}, ErrInvalidToken
+	}
+
+	if now.Sub(session.LastSeenAt) >= s.touchInterval() {
+		session.LastSeenAt = now
+		session.ExpiresAt = s.idleDeadline(now, session.AbsoluteExpiresAt)
+		// Best effort: a failed write only means the session slides less.
+		_ = s.sessions.Update(key, session)
+	}
 
+	session.Token = token
 	return session, nil
 }
 
+// Logout ends the session and every session in its refresh family, so that
+// the refresh token issued with it cannot be used afterwards.
 func (s *Service) Logout(token string) error {
-	s.sessMu.Lock()
-	defer s.sessMu.Unlock()
-	if _, ok := s.sessions[token]; !ok {
-		return ErrInvalidToken
-	}
-	delete(s.sessions, token)
-	if err := s.persistSessionsLocked(); err != nil {
+	key, session, err := s.storedSession(token)
+	if err != nil {
 		return err
 	}
-	return nil
+	if session.FamilyID == "" {
+		return s.deleteSession(key, session.ID)
+	}
+	return s.revokeSessionFamily(session.FamilyID)
 }
 
+// ChangePassword sets a new password for the session's user and signs out
+// the user's other sessions, and the calling one too when configured. Policy
+// failures are returned as *PasswordPolicyError. Changing an expired or
+// flagged password lifts the restriction on the session used to do it.
 func (s *Service) ChangePassword(token, currentPassword, newPassword string) error {
-	if err := validatePasswordPolicy(newPassword); err != nil {
-		return ErrWeakPassword
+	if err := s.policy.check(newPassword); err != nil {
+		return err
 	}
 
 	session, err := s.ValidateToken(token)
 	if err != nil {
 		return err
 	}
+	key, stored, err := s.storedSession(token)
+	if err != nil {
+		return err
+	}
 
 	user, err := s.users.GetByUsername(session.Username)
 	if err != nil {
@@ -166,170 +539,236 @@ func (s *Service) ChangePassword(token, currentPassword, newPassword string) err
 	if !s.VerifyPassword(currentPassword, user.PasswordHash) {
 		return ErrInvalidCredentials
 	}
-	user.PasswordHash = s.HashPassword(newPassword)
+	if err := s.checkNewPassword(user, newPassword); err != nil {
+		return err
+	}
+	if err := s.setPassword(&user, newPassword); err != nil {
+		return err
+	}
 	if err := s.users.Put(user); err != nil {
 		return fmt.Errorf("store updated password: %w", err)
 	}
+	if s.endSessionOnPasswordChange {
+		return s.RevokeUserSessions(user.ID)
+	}
+	if _, err := s.revokeUserSessionsExcept(user.ID, key, stored.FamilyID); err != nil {
+		return fmt.Errorf("revoke other sessions: %w", err)
+	}
+	// A signed access token keeps its restriction until it is refreshed.
+	if stored.PasswordChangeRequired {
+		stored.PasswordChangeRequired = false
+		if err := s.sessions.Update(key, stored); err != nil {
+			return fmt.Errorf("update session: %w", err)
+		}
+	}
 	return nil
 }
 
-func validatePasswordPolicy(password string) error {
-	if strings.TrimSpace(password) != password {
-		return ErrWeakPassword
-	}
-	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
-		return ErrWeakPassword
+// upgradePasswordHash replaces legacy or outdated hashes after a successful
+// login. Failures are ignored: the old hash still verifies, so the upgrade is
+// simply retried on the next login.
+func (s *Service) upgradePasswordHash(u User, password string) User {
+	if !s.needsRehash(u.PasswordHash) {
+		return u
 	}
-
-	var hasUpper, hasLower, hasDigit, hasSpecial bool
-	for _, r := range password {
-		switch {
-		case unicode.IsUpper(r):
-			hasUpper = true
-		case unicode.IsLower(r):
-			hasLower = true
-		case unicode.IsDigit(r):
-			hasDigit = true
-		case unicode.IsPunct(r) || unicode.IsSymbol(r):
-			hasSpecial = true
-		}
+	newHash, err := s.HashPassword(password)
+	if err != nil {
+		return u
 	}
-	if !hasUpper || !hasLower || !hasDigit || !hasSpecial {
-		return ErrWeakPassword
+	upgraded := u
+	upgraded.PasswordHash = newHash
+	if err := s.users.Put(upgraded); err != nil {
+		return u
 	}
-	return nil
+	return upgraded
 }
 
-func (s *Service) ListSessions() []Session {
+// ListSessions returns sessions that can still be used or refreshed,
+// including idle ones.
+func (s *Service) ListSessions() ([]Session, error) {
 	now := s.nowFunc()
+	s.pruneSessions(now)
 
-	s.sessMu.Lock()
-	defer s.sessMu.Unlock()
+	sessions, err := s.sessions.List()
+	if err != nil {
+		return nil, err
+	}
+	return liveSessions(sessions, now), nil
+}
 
-	out := make([]Session, 0, len(s.sessions))
-	dirty := false
-	for token, sess := range s.sessions {
-		if now.After(sess.ExpiresAt) {
-			delete(s.sessions, token)
-			dirty = true
+func liveSessions(sessions map[string]Session, now time.Time) []Session {
+	out := make([]Session, 0, len(sessions))
+	for _, sess := range sessions {
+		sess = withSessionDefaults(sess)
+		if sess.RotatedAt != nil || now.After(sess.AbsoluteExpiresAt) {
 			continue
 		}
 		out = append(out, sess)
 	}
-	if dirty {
-		_ = s.persistSessionsLocked()
-	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
 	return out
 }
 
-func (s *Service) ListSessionViews() []SessionView {
-	sessions := s.ListSessions()
+func (s *Service) ListSessionViews() ([]SessionView, error) {
+	sessions, err := s.ListSessions()
+	if err != nil {
+		return nil, err
+	}
 	out := make([]SessionView, 0, len(sessions))
 	for _, sess := range sessions {
-		out = append(out, SessionView{
-			ID:        sess.ID,
-			UserID:    sess.UserID,
-			Username:  sess.Username,
-			Roles:     append([]string(nil), sess.Roles...),
-			CreatedAt: sess.CreatedAt,
-			ExpiresAt: sess.ExpiresAt,
-		})
+		out = append(out, sessionView(sess))
 	}
-	return out
+	return out, nil
 }
 
-func (s *Service) RevokeToken(token string) error {
-	s.sessMu.Lock()
-	defer s.sessMu.Unlock()
-	if _, ok := s.sessions[token]; !ok {
-		return ErrInvalidToken
+func sessionView(sess Session) SessionView {
+	return SessionView{
+		ID:                sess.ID,
+		UserID:            sess.UserID,
+		Username:          sess.Username,
+		Roles:             append([]string(nil), sess.Roles...),
+		CreatedAt:         sess.CreatedAt,
+		LastSeenAt:        sess.LastSeenAt,
+		ExpiresAt:         sess.ExpiresAt,
+		AbsoluteExpiresAt: sess.AbsoluteExpiresAt,
+		ClientIP:          sess.ClientIP,
+		UserAgent:         sess.UserAgent,
+
+		ImpersonatorID:       sess.ImpersonatorID,
+		ImpersonatorUsername: sess.ImpersonatorUsername,
 	}
-	delete(s.sessions, token)
-	if err := s.persistSessionsLocked(); err != nil {
-		return err
-	}
-	return nil
 }
 
+func (s *Service) RevokeToken(token string) error {
+	return s.Logout(token)
+}
+
+// RevokeSessionByID also revokes the sessions refreshed from the same login.
 func (s *Service) RevokeSessionByID(sessionID string) error {
-	s.sessMu.Lock()
-	defer s.sessMu.Unlock()
-
-	foundToken := ""
-	for token, sess := range s.sessions {
-		if sess.ID == sessionID {
-			foundToken = token
-			break
-		}
-	}
-	if foundToken == "" {
+	key, sess, err := s.sessions.GetByID(sessionID)
+	if errors.Is(err, ErrSessionNotFound) || (err == nil && sess.RotatedAt != nil) {
 		return ErrInvalidToken
 	}
-	delete(s.sessions, foundToken)
-	if err := s.persistSessionsLocked(); err != nil {
+	if err != nil {
 		return err
 	}
-	return nil
+	if sess.FamilyID == "" {
+		return s.deleteSession(key, sess.ID)
+	}
+	return s.revokeSessionFamily(sess.FamilyID)
 }
 
-func (s *Service) LoadSessionState() error {
-	if s.sessionStore != nil {
-		state, err := s.sessionStore.Load()
-		if err != nil {
-			return fmt.Errorf("load session state: %w", err)
-		}
-		s.sessMu.Lock()
-		s.sessions = state
-		s.sessMu.Unlock()
-		return nil
+// ListUserSessionViews lists userID's sessions and marks the one with ID
+// currentID, so a user can recognise the device they are using.
+func (s *Service) ListUserSessionViews(userID, currentID string) ([]SessionView, error) {
+	sessions, err := s.sessions.ListByUser(userID)
+	if err != nil {
+		return nil, err
 	}
-
-	if s.stateFile == "" {
-		return nil
+	out := []SessionView{}
+	for _, sess := range liveSessions(sessions, s.nowFunc()) {
+		view := sessionView(sess)
+		view.Current = sess.ID == currentID
+		out = append(out, view)
 	}
-	b, err := os.ReadFile(s.stateFile)
+	return out, nil
+}
+
+// RevokeOtherSessions ends every session of the token's user except the
+// token's own, together with the sessions it was refreshed from. It returns
+// how many live sessions were ended.
+func (s *Service) RevokeOtherSessions(token string) (int, error) {
+	current, err := s.ValidateToken(token)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("read session state: %w", err)
+		return 0, err
 	}
-	if len(b) == 0 {
-		return nil
-	}
-	state := make(map[string]Session)
-	if err := json.Unmarshal(b, &state); err != nil {
-		return fmt.Errorf("decode session state: %w", err)
+	key, stored, err := s.storedSession(token)
+	if err != nil {
+		return 0, err
 	}
+	return s.revokeUserSessionsExcept(current.UserID, key, stored.FamilyID)
+}
 
-	s.sessMu.Lock()
-	s.sessions = state
-	s.sessMu.Unlock()
+// LoadSessionState reads the session state file when file persistence is
+// used. Other stores are consulted on every request and need no loading.
+func (s *Service) LoadSessionState() error {
+	if fs, ok := s.sessions.(*fileSessionStore); ok {
+		return fs.load()
+	}
 	return nil
 }
 
-func (s *Service) persistSessionsLocked() error {
-	if s.sessionStore != nil {
-		if err := s.sessionStore.Save(s.sessions); err != nil {
-			return fmt.Errorf("save session state: %w", err)
+func (s *Service) deleteSession(key, sessionID string) error {
+	if err := s.sessions.Delete(key); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return ErrInvalidToken
 		}
-		return nil
+		return err
+	}
+	return s.denyAccessTokens(sessionID)
+}
+
+// pruneSessions drops expired sessions at most once per sessionPruneEvery so
+// that abandoned sessions do not accumulate in the store.
+func (s *Service) pruneSessions(now time.Time) {
+	s.pruneMu.Lock()
+	if now.Sub(s.lastSessionPrune) < sessionPruneEvery {
+		s.pruneMu.Unlock()
+		return
+	}
+	s.lastSessionPrune = now
+	s.pruneMu.Unlock()
+	_ = s.sessions.DeleteExpired(now)
+}
+
+// hashSessionToken derives the key sessions are stored under. Session tokens
+// carry 256 bits of entropy, so a keyed MAC is enough to make a leaked state
+// file or table useless without the pepper.
+func (s *Service) hashSessionToken(token string) string {
+	return s.keyedHash("session", token)
+}
+
+// idleDeadline is when a session last active at now stops being accepted.
+func (s *Service) idleDeadline(now, absoluteExpiresAt time.Time) time.Time {
+	deadline := now.Add(s.ttl)
+	if deadline.After(absoluteExpiresAt) {
+		return absoluteExpiresAt
 	}
+	return deadline
+}
 
-	if s.stateFile == "" {
-		return nil
+// truncateUserAgent bounds what a client can make us store per session.
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxUserAgentLength {
+		return ua
 	}
-	if err := os.MkdirAll(filepath.Dir(s.stateFile), 0o755); err != nil {
-		return fmt.Errorf("mkdir session state dir: %w", err)
+	return strings.ToValidUTF8(ua[:maxUserAgentLength], "")
+}
+
+// touchInterval keeps the write-back delay small relative to short TTLs.
+func (s *Service) touchInterval() time.Duration {
+	if d := s.ttl / 10; d < sessionTouchInterval {
+		return d
 	}
-	b, err := json.MarshalIndent(s.sessions, "", "  ")
-	if err != nil {
-		return fmt.Errorf("encode session state: %w", err)
+	return sessionTouchInterval
+}
+
+// withSessionDefaults fills in the fields that sessions stored before sliding
+// expiry lack: they end at their original expiry and cannot be refreshed.
+func withSessionDefaults(sess Session) Session {
+	if sess.AbsoluteExpiresAt.IsZero() {
+		sess.AbsoluteExpiresAt = sess.ExpiresAt
 	}
-	if err := os.WriteFile(s.stateFile, b, 0o644); err != nil {
-		return fmt.Errorf("write session state: %w", err)
+	if sess.LastSeenAt.IsZero() {
+		sess.LastSeenAt = sess.CreatedAt
 	}
-	return nil
+	return sess
+}
+
+func (s *Service) keyedHash(purpose, value string) string {
+	mac := hmac.New(sha256.New, []byte(s.pepper))
+	mac.Write([]byte(purpose + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func generateToken(n int) (string, error) {
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,13 +20,13 @@ func TestLoginAndValidateToken(t *testing.T) {
 	if err := store.Put(User{
 		ID:           "u-1",
 		Username:     "admin",
-		PasswordHash: svc.HashPassword("secret123"),
+		PasswordHash: mustHashPassword(t, svc, "secret123"),
 		Roles:        []string{"admin"},
 	}); err != nil {
 		t.Fatalf("store.Put() error: %v", err)
 	}
 
-	session, err := svc.Login("admin", "secret123")
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
@@ -48,9 +49,9 @@ func TestLoginInvalidCredentials(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("secret123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
 
-	_, err = svc.Login("admin", "badpass")
+	_, err = svc.Login("admin", "badpass", ClientInfo{})
 	if !errors.Is(err, ErrInvalidCredentials) {
 		t.Fatalf("expected ErrInvalidCredentials, got %v", err)
 	}
@@ -66,8 +67,8 @@ func TestExpiredToken(t *testing.T) {
 	fakeNow := time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC)
 	svc.nowFunc = func() time.Time { return fakeNow }
 
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("secret123"), Roles: []string{"admin"}})
-	session, err := svc.Login("admin", "secret123")
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
@@ -85,9 +86,9 @@ func TestLogoutRevokesToken(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("secret123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
 
-	session, err := svc.Login("admin", "secret123")
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
@@ -102,6 +103,71 @@ func TestLogoutRevokesToken(t *testing.T) {
 	}
 }
 
+func TestSharedSessionStoreAcrossServices(t *testing.T) {
+	users := NewInMemoryUserStore()
+	sessions := NewInMemorySessionStore()
+	cfg := ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute, SessionStore: sessions}
+	replicaA, err := NewService(users, cfg)
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	replicaB, err := NewService(users, cfg)
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	_ = users.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, replicaA, "secret123"), Roles: []string{"admin"}})
+
+	session, err := replicaA.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if _, err := replicaB.ValidateToken(session.Token); err != nil {
+		t.Fatalf("expected session issued by replica A to be valid on replica B, got %v", err)
+	}
+	if err := replicaB.Logout(session.Token); err != nil {
+		t.Fatalf("Logout() error: %v", err)
+	}
+	if _, err := replicaA.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected logout on replica B to revoke the session on replica A, got %v", err)
+	}
+}
+
+func TestInMemorySessionStoreTargetedDeletes(t *testing.T) {
+	store := NewInMemorySessionStore()
+	for key, sess := range map[string]Session{
+		"a1": {ID: "s-a1", UserID: "u-1", FamilyID: "fam-a"},
+		"a2": {ID: "s-a2", UserID: "u-1", FamilyID: "fam-a"},
+		"b1": {ID: "s-b1", UserID: "u-1", FamilyID: "fam-b"},
+		"c1": {ID: "s-c1", UserID: "u-1", FamilyID: "fam-c"},
+		"d1": {ID: "s-d1", UserID: "u-2", FamilyID: "fam-d", ImpersonatorID: "u-1"},
+		"e1": {ID: "s-e1", UserID: "u-2", FamilyID: "fam-e"},
+	} {
+		if err := store.Create(key, sess); err != nil {
+			t.Fatalf("Create() error: %v", err)
+		}
+	}
+
+	ids, err := store.DeleteFamily("fam-a")
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("DeleteFamily() = %v, %v", ids, err)
+	}
+	if ids, _ := store.DeleteFamily(""); len(ids) != 0 {
+		t.Fatalf("expected an empty family to delete nothing, got %v", ids)
+	}
+
+	deleted, err := store.DeleteUserSessions("u-1", "b1", "fam-c")
+	if err != nil || len(deleted) != 1 || deleted[0].ID != "s-d1" {
+		t.Fatalf("DeleteUserSessions() = %+v, %v", deleted, err)
+	}
+	left, _ := store.List()
+	if len(left) != 3 || left["b1"].ID == "" || left["c1"].ID == "" || left["e1"].ID == "" {
+		t.Fatalf("unexpected remaining sessions %+v", left)
+	}
+	if byUser, _ := store.ListByUser("u-2"); len(byUser) != 1 {
+		t.Fatalf("ListByUser() = %+v", byUser)
+	}
+}
+
 func TestSessionStatePersistence(t *testing.T) {
 	stateFile := filepath.Join(t.TempDir(), "auth_sessions.json")
 
@@ -114,9 +180,9 @@ func TestSessionStatePersistence(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("secret123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
 
-	session, err := svc.Login("admin", "secret123")
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
@@ -125,12 +191,18 @@ func TestSessionStatePersistence(t *testing.T) {
 	if err != nil {
 		t.Fatalf("read session state file: %v", err)
 	}
-	var decoded map[string]Session
+	if strings.Contains(string(raw), session.Token) {
+		t.Fatalf("expected raw token to be absent from session state file")
+	}
+	var decoded sessionStateFile
 	if err := json.Unmarshal(raw, &decoded); err != nil {
 		t.Fatalf("decode session state file: %v", err)
 	}
-	if _, ok := decoded[session.Token]; !ok {
-		t.Fatalf("expected token %s in session state file", session.Token)
+	if _, ok := decoded.Sessions[svc.hashSessionToken(session.Token)]; !ok {
+		t.Fatalf("expected token hash in session state file")
+	}
+	if info, err := os.Stat(stateFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected session state file mode 0600, got %v (%v)", info.Mode().Perm(), err)
 	}
 
 	store2 := NewInMemoryUserStore()
@@ -150,6 +222,48 @@ func TestSessionStatePersistence(t *testing.T) {
 	}
 }
 
+func TestLegacySessionStateIsConverted(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "auth_sessions.json")
+	legacy := map[string]map[string]any{
+		"rawtoken123": {
+			"ID":        "sid-1",
+			"Token":     "rawtoken123",
+			"UserID":    "u-1",
+			"Username":  "admin",
+			"Roles":     []string{"admin"},
+			"CreatedAt": time.Now(),
+			"ExpiresAt": time.Now().Add(time.Hour),
+		},
+	}
+	b, _ := json.Marshal(legacy)
+	if err := os.WriteFile(stateFile, b, 0o644); err != nil {
+		t.Fatalf("write legacy state: %v", err)
+	}
+
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{
+		PasswordPepper:   "pepper",
+		SessionTTL:       time.Minute,
+		SessionStateFile: stateFile,
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	if err := svc.LoadSessionState(); err != nil {
+		t.Fatalf("LoadSessionState() error: %v", err)
+	}
+	sess, err := svc.ValidateToken("rawtoken123")
+	if err != nil || sess.ID != "sid-1" {
+		t.Fatalf("expected legacy session to survive conversion, got %+v (%v)", sess, err)
+	}
+	raw, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read session state file: %v", err)
+	}
+	if strings.Contains(string(raw), "rawtoken123") {
+		t.Fatalf("expected converted state file to drop raw tokens, got %s", raw)
+	}
+}
+
 func TestChangePassword(t *testing.T) {
 	store := NewInMemoryUserStore()
 	svc, err := NewService(store, ServiceConfig{
@@ -159,9 +273,9 @@ func TestChangePassword(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("oldpass123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "oldpass123"), Roles: []string{"admin"}})
 
-	session, err := svc.Login("admin", "oldpass123")
+	session, err := svc.Login("admin", "oldpass123", ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
@@ -170,16 +284,58 @@ func TestChangePassword(t *testing.T) {
 		t.Fatalf("ChangePassword() error: %v", err)
 	}
 
-	_, err = svc.Login("admin", "oldpass123")
+	_, err = svc.Login("admin", "oldpass123", ClientInfo{})
 	if !errors.Is(err, ErrInvalidCredentials) {
 		t.Fatalf("expected old password to fail after change, got %v", err)
 	}
 
-	if _, err := svc.Login("admin", "NewPassword123!"); err != nil {
+	if _, err := svc.Login("admin", "NewPassword123!", ClientInfo{}); err != nil {
 		t.Fatalf("expected login with new password to succeed, got %v", err)
 	}
 }
 
+func TestChangePasswordRevokesOtherSessions(t *testing.T) {
+	for _, endCurrent := range []bool{false, true} {
+		store := NewInMemoryUserStore()
+		svc, err := NewService(store, ServiceConfig{
+			PasswordPepper:             "pepper",
+			SessionTTL:                 time.Minute,
+			EndSessionOnPasswordChange: endCurrent,
+		})
+		if err != nil {
+			t.Fatalf("NewService() error: %v", err)
+		}
+		_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "oldpass123"), Roles: []string{"admin"}})
+
+		first, err := svc.Login("admin", "oldpass123", ClientInfo{})
+		if err != nil {
+			t.Fatalf("Login() error: %v", err)
+		}
+		current, err := svc.Login("admin", "oldpass123", ClientInfo{})
+		if err != nil {
+			t.Fatalf("Login() error: %v", err)
+		}
+		current, err = svc.Refresh(current.RefreshToken, ClientInfo{})
+		if err != nil {
+			t.Fatalf("Refresh() error: %v", err)
+		}
+
+		if err := svc.ChangePassword(current.Token, "oldpass123", "NewPassword123!"); err != nil {
+			t.Fatalf("ChangePassword() error: %v", err)
+		}
+		if _, err := svc.ValidateToken(first.Token); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected other sessions to be revoked, got %v", err)
+		}
+		_, err = svc.ValidateToken(current.Token)
+		if endCurrent && !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("expected the calling session to end too, got %v", err)
+		}
+		if !endCurrent && err != nil {
+			t.Fatalf("expected the calling session to be kept, got %v", err)
+		}
+	}
+}
+
 func TestChangePasswordWeakRejected(t *testing.T) {
 	store := NewInMemoryUserStore()
 	svc, err := NewService(store, ServiceConfig{
@@ -189,8 +345,8 @@ func TestChangePasswordWeakRejected(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("oldpass123"), Roles: []string{"admin"}})
-	session, _ := svc.Login("admin", "oldpass123")
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "oldpass123"), Roles: []string{"admin"}})
+	session, _ := svc.Login("admin", "oldpass123", ClientInfo{})
 
 	err = svc.ChangePassword(session.Token, "oldpass123", "short")
 	if !errors.Is(err, ErrWeakPassword) {
@@ -207,11 +363,14 @@ func TestListAndRevokeSessions(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewService() error: %v", err)
 	}
-	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: svc.HashPassword("secret123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
 
-	s1, _ := svc.Login("admin", "secret123")
-	s2, _ := svc.Login("admin", "secret123")
-	list := svc.ListSessions()
+	s1, _ := svc.Login("admin", "secret123", ClientInfo{})
+	s2, _ := svc.Login("admin", "secret123", ClientInfo{})
+	list, err := svc.ListSessions()
+	if err != nil {
+		t.Fatalf("ListSessions() error: %v", err)
+	}
 	if len(list) < 2 {
 		t.Fatalf("expected at least 2 sessions, got %d", len(list))
 	}
@@ -226,3 +385,91 @@ func TestListAndRevokeSessions(t *testing.T) {
 		t.Fatalf("expected second token still valid, got %v", err)
 	}
 }
+
+func TestOwnSessionsAndRevokeOthers(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-2", Username: "ops", PasswordHash: mustHashPassword(t, svc, "secret123")})
+
+	laptop, _ := svc.Login("admin", "secret123", ClientInfo{IP: "192.0.2.1", UserAgent: "Firefox"})
+	phone, _ := svc.Login("admin", "secret123", ClientInfo{IP: "192.0.2.2", UserAgent: "Safari"})
+	other, _ := svc.Login("ops", "secret123", ClientInfo{})
+	current, err := svc.Refresh(laptop.RefreshToken, ClientInfo{IP: "192.0.2.3", UserAgent: "Firefox"})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+
+	views, err := svc.ListUserSessionViews("u-1", current.ID)
+	if err != nil {
+		t.Fatalf("ListUserSessionViews() error: %v", err)
+	}
+	if len(views) != 2 {
+		t.Fatalf("expected 2 live sessions for u-1, got %+v", views)
+	}
+	for _, v := range views {
+		switch v.ID {
+		case current.ID:
+			if !v.Current || v.ClientIP != "192.0.2.3" || v.UserAgent != "Firefox" {
+				t.Fatalf("unexpected current session view: %+v", v)
+			}
+		case phone.ID:
+			if v.Current || v.ClientIP != "192.0.2.2" || v.UserAgent != "Safari" {
+				t.Fatalf("unexpected phone session view: %+v", v)
+			}
+		default:
+			t.Fatalf("unexpected session %+v", v)
+		}
+	}
+
+	revoked, err := svc.RevokeOtherSessions(current.Token)
+	if err != nil || revoked != 1 {
+		t.Fatalf("RevokeOtherSessions() = %d, %v", revoked, err)
+	}
+	if _, err := svc.ValidateToken(phone.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected other device signed out, got %v", err)
+	}
+	if _, err := svc.ValidateToken(current.Token); err != nil {
+		t.Fatalf("expected current session kept, got %v", err)
+	}
+	if _, err := svc.ValidateToken(other.Token); err != nil {
+		t.Fatalf("expected other users' sessions kept, got %v", err)
+	}
+}
+
+func mustHashPassword(t *testing.T, svc *Service, password string) string {
+	t.Helper()
+	hash, err := svc.HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword() error: %v", err)
+	}
+	return hash
+}
+
+// newTestService returns a service over a fresh in-memory store holding the
+// account "admin" (ID "u-1", password "secret123"), with its clock stopped at
+// 2026-02-16 12:00 UTC. PasswordPepper and SessionTTL default when unset.
+func newTestService(t *testing.T, cfg ServiceConfig) (*Service, *InMemoryUserStore, *time.Time) {
+	t.Helper()
+	if cfg.PasswordPepper == "" {
+		cfg.PasswordPepper = "pepper"
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = time.Hour
+	}
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, cfg)
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	svc.nowFunc = func() time.Time { return now }
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: mustHashPassword(t, svc, "secret123"), Roles: []string{"admin"}})
+	return svc, store, &now
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again. The whole session family has been revoked by
+// the time it is returned, since either the client or an attacker holds a
+// stolen copy.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Refresh exchanges a refresh token for a new session with new access and
+// refresh tokens. The old refresh token is spent; the new session keeps the
+// absolute deadline of the original login, so refreshing cannot keep a
+// session alive indefinitely. The new session records client as the one
+// holding it.
+func (s *Service) Refresh(refreshToken string, client ClientInfo) (Session, error) {
+	if refreshToken == "" {
+		return Session{}, ErrInvalidToken
+	}
+	key, old, err := s.sessions.GetByRefreshHash(s.hashRefreshToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return Session{}, ErrInvalidToken
+		}
+		return Session{}, err
+	}
+	old = withSessionDefaults(old)
+
+	now := s.nowFunc()
+	if now.After(old.AbsoluteExpiresAt) {
+		return Session{}, ErrInvalidToken
+	}
+	if old.RotatedAt != nil {
+		return Session{}, s.refreshReused(old.FamilyID)
+	}
+	u, err := s.users.GetByID(old.UserID)
+	if err != nil || s.checkAccountActive(u) != nil {
+		return Session{}, ErrInvalidToken
+	}
+	if err := s.sessions.MarkRotated(key, now); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			// A concurrent request spent the token first.
+			return Session{}, s.refreshReused(old.FamilyID)
+		}
+		return Session{}, fmt.Errorf("rotate refresh token: %w", err)
+	}
+	if err := s.denyAccessTokens(old.ID); err != nil {
+		return Session{}, err
+	}
+	return s.startSession(u, client, old.FamilyID, old.CreatedAt, old.AbsoluteExpiresAt)
+}
+
+func (s *Service) refreshReused(familyID string) error {
+	if err := s.revokeSessionFamily(familyID); err != nil {
+		return fmt.Errorf("revoke session family: %w", err)
+	}
+	return ErrRefreshTokenReused
+}
+
+// revokeSessionFamily deletes every session sharing familyID, including the
+// records kept for rotated refresh tokens.
+func (s *Service) revokeSessionFamily(familyID string) error {
+	ids, err := s.sessions.DeleteFamily(familyID)
+	if err != nil {
+		return err
+	}
+	return s.denyAccessTokens(ids...)
+}
+
+func (s *Service) hashRefreshToken(token string) string {
+	return s.keyedHash("refresh", token)
+}
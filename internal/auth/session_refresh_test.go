@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSlidingSessionExpiry(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{SessionTTL: 10 * time.Minute, SessionMaxLifetime: 30 * time.Minute})
+	start := *now
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	for _, offset := range []time.Duration{8 * time.Minute, 16 * time.Minute, 24 * time.Minute} {
+		*now = start.Add(offset)
+		if _, err := svc.ValidateToken(session.Token); err != nil {
+			t.Fatalf("expected active session valid at +%s, got %v", offset, err)
+		}
+	}
+
+	*now = start.Add(31 * time.Minute)
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected session invalid past max lifetime, got %v", err)
+	}
+}
+
+func TestIdleSessionExpires(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{SessionTTL: 10 * time.Minute, SessionMaxLifetime: 30 * time.Minute})
+	start := *now
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	*now = start.Add(11 * time.Minute)
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected idle session invalid, got %v", err)
+	}
+
+	views, err := svc.ListSessionViews()
+	if err != nil {
+		t.Fatalf("ListSessionViews() error: %v", err)
+	}
+	if len(views) != 1 || !views[0].LastSeenAt.Equal(start) || !views[0].AbsoluteExpiresAt.Equal(start.Add(30*time.Minute)) {
+		t.Fatalf("expected idle session listed with last activity, got %+v", views)
+	}
+
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() of idle session error: %v", err)
+	}
+	if !refreshed.AbsoluteExpiresAt.Equal(session.AbsoluteExpiresAt) {
+		t.Fatalf("expected refresh to keep absolute deadline %s, got %s", session.AbsoluteExpiresAt, refreshed.AbsoluteExpiresAt)
+	}
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	svc, _, now := newTestService(t, ServiceConfig{SessionTTL: 10 * time.Minute, SessionMaxLifetime: 30 * time.Minute})
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if session.RefreshToken == "" {
+		t.Fatalf("expected refresh token on login")
+	}
+
+	*now = now.Add(5 * time.Minute)
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+	if refreshed.Token == session.Token || refreshed.RefreshToken == session.RefreshToken {
+		t.Fatalf("expected new access and refresh tokens")
+	}
+	if refreshed.FamilyID != session.FamilyID {
+		t.Fatalf("expected refreshed session in the same family")
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected old access token invalid after refresh, got %v", err)
+	}
+	if _, err := svc.ValidateToken(refreshed.Token); err != nil {
+		t.Fatalf("expected new access token valid, got %v", err)
+	}
+
+	*now = now.Add(26 * time.Minute)
+	if _, err := svc.Refresh(refreshed.RefreshToken, ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected refresh past max lifetime to fail, got %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	svc, _, _ := newTestService(t, ServiceConfig{SessionTTL: 10 * time.Minute, SessionMaxLifetime: 30 * time.Minute})
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	other, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+	if _, err := svc.Refresh(session.RefreshToken, ClientInfo{}); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if _, err := svc.ValidateToken(refreshed.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected family revoked after reuse, got %v", err)
+	}
+	if _, err := svc.Refresh(refreshed.RefreshToken, ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected refreshed token revoked after reuse, got %v", err)
+	}
+	if _, err := svc.ValidateToken(other.Token); err != nil {
+		t.Fatalf("expected unrelated session untouched, got %v", err)
+	}
+}
+
+func TestLogoutRevokesRefreshToken(t *testing.T) {
+	svc, _, _ := newTestService(t, ServiceConfig{SessionTTL: 10 * time.Minute, SessionMaxLifetime: 30 * time.Minute})
+	session, err := svc.Login("admin", "secret123", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	if err := svc.Logout(session.Token); err != nil {
+		t.Fatalf("Logout() error: %v", err)
+	}
+	if _, err := svc.Refresh(session.RefreshToken, ClientInfo{}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected refresh after logout to fail, got %v", err)
+	}
+}
@@ -0,0 +1,566 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionStore persists sessions keyed by token hash, never by raw token.
+// Service calls it on every request, so a shared store such as Postgres is
+// enough for several replicas to see each other's sessions. Pending MFA
+// challenges are kept alongside for the same reason, keyed the same way.
+type SessionStore interface {
+	Create(tokenHash string, sess Session) error
+	Get(tokenHash string) (Session, error)
+	GetByRefreshHash(refreshHash string) (string, Session, error)
+	GetByID(sessionID string) (string, Session, error)
+	Update(tokenHash string, sess Session) error
+	// MarkRotated records that the session's refresh token has been used. It
+	// returns ErrSessionNotFound if the session is gone or already rotated, so
+	// that two concurrent refreshes cannot both succeed.
+	MarkRotated(tokenHash string, at time.Time) error
+	Delete(tokenHash string) error
+	// DeleteFamily deletes every session refreshed from the same login,
+	// rotated records included, and returns their IDs.
+	DeleteFamily(familyID string) ([]string, error)
+	// DeleteUserSessions deletes the sessions of userID and those it started
+	// as impersonator, except the one stored under keepKey and the family
+	// keepFamily, and returns them. Empty keep values keep nothing.
+	DeleteUserSessions(userID, keepKey, keepFamily string) ([]Session, error)
+	// DeleteExpired removes expired sessions, MFA challenges, WebAuthn
+	// ceremonies, OIDC logins and deny-list entries.
+	DeleteExpired(now time.Time) error
+	List() (map[string]Session, error)
+	ListByUser(userID string) (map[string]Session, error)
+
+	CreateMFAChallenge(tokenHash string, c MFAChallenge) error
+	// GetMFAChallenge and the other challenge methods return
+	// ErrInvalidMFAChallenge for a challenge that is not stored.
+	GetMFAChallenge(tokenHash string) (MFAChallenge, error)
+	SetMFAChallengeSecret(tokenHash, secret string) error
+	// RecordMFAChallengeFailure counts a wrong answer and returns the total.
+	RecordMFAChallengeFailure(tokenHash string) (int, error)
+	// TakeMFAChallenge deletes the challenge and returns it, so that of two
+	// concurrent callers only one gets it.
+	TakeMFAChallenge(tokenHash string) (MFAChallenge, error)
+	DeleteUserMFAChallenges(userID string) error
+
+	// CreateWebAuthnCeremony stores a ceremony unless limit of them are
+	// already stored, in which case it returns ErrTooManyWebAuthnCeremonies.
+	CreateWebAuthnCeremony(challengeHash string, c WebAuthnCeremony, limit int) error
+	// TakeWebAuthnCeremony deletes the ceremony and returns it, or
+	// ErrInvalidWebAuthnCeremony when it is not stored.
+	TakeWebAuthnCeremony(challengeHash string) (WebAuthnCeremony, error)
+
+	// CreateOIDCLogin stores a pending login unless limit of them are
+	// already stored, in which case it returns ErrTooManyOIDCLogins.
+	CreateOIDCLogin(stateHash string, p OIDCPendingLogin, limit int) error
+	// TakeOIDCLogin deletes the pending login and returns it, or
+	// ErrInvalidOIDCState when it is not stored.
+	TakeOIDCLogin(stateHash string) (OIDCPendingLogin, error)
+
+	// DenyAccessTokens rejects the signed access tokens issued for the
+	// sessions until the given time, when the last of them has expired.
+	DenyAccessTokens(sessionIDs []string, until time.Time) error
+	// DeniedAccessTokens returns the deny-list entries still in force.
+	DeniedAccessTokens(now time.Time) (map[string]time.Time, error)
+}
+
+type InMemorySessionStore struct {
+	mu         sync.RWMutex
+	sessions   map[string]Session
+	challenges map[string]MFAChallenge
+	ceremonies map[string]WebAuthnCeremony
+	oidcLogins map[string]OIDCPendingLogin
+	denied     map[string]time.Time
+}
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{
+		sessions:   make(map[string]Session),
+		challenges: make(map[string]MFAChallenge),
+		ceremonies: make(map[string]WebAuthnCeremony),
+		oidcLogins: make(map[string]OIDCPendingLogin),
+		denied:     make(map[string]time.Time),
+	}
+}
+
+func (s *InMemorySessionStore) Create(tokenHash string, sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[tokenHash] = sess
+	return nil
+}
+
+func (s *InMemorySessionStore) Get(tokenHash string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[tokenHash]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+func (s *InMemorySessionStore) GetByRefreshHash(refreshHash string) (string, Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if refreshHash == "" {
+		return "", Session{}, ErrSessionNotFound
+	}
+	for key, sess := range s.sessions {
+		if sess.RefreshHash == refreshHash {
+			return key, sess, nil
+		}
+	}
+	return "", Session{}, ErrSessionNotFound
+}
+
+func (s *InMemorySessionStore) GetByID(sessionID string) (string, Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, sess := range s.sessions {
+		if sess.ID == sessionID {
+			return key, sess, nil
+		}
+	}
+	return "", Session{}, ErrSessionNotFound
+}
+
+func (s *InMemorySessionStore) Update(tokenHash string, sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[tokenHash]; !ok {
+		return ErrSessionNotFound
+	}
+	s.sessions[tokenHash] = sess
+	return nil
+}
+
+func (s *InMemorySessionStore) MarkRotated(tokenHash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[tokenHash]
+	if !ok || sess.RotatedAt != nil {
+		return ErrSessionNotFound
+	}
+	sess.RotatedAt = &at
+	s.sessions[tokenHash] = sess
+	return nil
+}
+
+func (s *InMemorySessionStore) Delete(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[tokenHash]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func (s *InMemorySessionStore) DeleteFamily(familyID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	if familyID == "" {
+		return ids, nil
+	}
+	for key, sess := range s.sessions {
+		if sess.FamilyID == familyID {
+			ids = append(ids, sess.ID)
+			delete(s.sessions, key)
+		}
+	}
+	return ids, nil
+}
+
+func (s *InMemorySessionStore) DeleteUserSessions(userID, keepKey, keepFamily string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []Session
+	for key, sess := range s.sessions {
+		if sess.UserID != userID && sess.ImpersonatorID != userID {
+			continue
+		}
+		if (keepKey != "" && key == keepKey) || (keepFamily != "" && sess.FamilyID == keepFamily) {
+			continue
+		}
+		deleted = append(deleted, sess)
+		delete(s.sessions, key)
+	}
+	return deleted, nil
+}
+
+func (s *InMemorySessionStore) DeleteExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, sess := range s.sessions {
+		if now.After(sess.retainUntil()) {
+			delete(s.sessions, key)
+		}
+	}
+	for key, c := range s.challenges {
+		if now.After(c.ExpiresAt) {
+			delete(s.challenges, key)
+		}
+	}
+	for key, c := range s.ceremonies {
+		if now.After(c.expiresAt) {
+			delete(s.ceremonies, key)
+		}
+	}
+	for key, p := range s.oidcLogins {
+		if now.After(p.expiresAt) {
+			delete(s.oidcLogins, key)
+		}
+	}
+	for id, until := range s.denied {
+		if now.After(until) {
+			delete(s.denied, id)
+		}
+	}
+	return nil
+}
+
+func (s *InMemorySessionStore) List() (map[string]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]Session, len(s.sessions))
+	for key, sess := range s.sessions {
+		out[key] = sess
+	}
+	return out, nil
+}
+
+func (s *InMemorySessionStore) ListByUser(userID string) (map[string]Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]Session)
+	for key, sess := range s.sessions {
+		if sess.UserID == userID {
+			out[key] = sess
+		}
+	}
+	return out, nil
+}
+
+func (s *InMemorySessionStore) CreateMFAChallenge(tokenHash string, c MFAChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Token = ""
+	s.challenges[tokenHash] = c
+	return nil
+}
+
+func (s *InMemorySessionStore) GetMFAChallenge(tokenHash string) (MFAChallenge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.challenges[tokenHash]
+	if !ok {
+		return MFAChallenge{}, ErrInvalidMFAChallenge
+	}
+	return c, nil
+}
+
+func (s *InMemorySessionStore) SetMFAChallengeSecret(tokenHash, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[tokenHash]
+	if !ok {
+		return ErrInvalidMFAChallenge
+	}
+	c.pendingSecret = secret
+	s.challenges[tokenHash] = c
+	return nil
+}
+
+func (s *InMemorySessionStore) RecordMFAChallengeFailure(tokenHash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[tokenHash]
+	if !ok {
+		return 0, ErrInvalidMFAChallenge
+	}
+	c.failures++
+	s.challenges[tokenHash] = c
+	return c.failures, nil
+}
+
+func (s *InMemorySessionStore) TakeMFAChallenge(tokenHash string) (MFAChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[tokenHash]
+	if !ok {
+		return MFAChallenge{}, ErrInvalidMFAChallenge
+	}
+	delete(s.challenges, tokenHash)
+	return c, nil
+}
+
+func (s *InMemorySessionStore) DeleteUserMFAChallenges(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, c := range s.challenges {
+		if c.UserID == userID {
+			delete(s.challenges, key)
+		}
+	}
+	return nil
+}
+
+func (s *InMemorySessionStore) CreateWebAuthnCeremony(challengeHash string, c WebAuthnCeremony, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ceremonies) >= limit {
+		return ErrTooManyWebAuthnCeremonies
+	}
+	s.ceremonies[challengeHash] = c
+	return nil
+}
+
+func (s *InMemorySessionStore) TakeWebAuthnCeremony(challengeHash string) (WebAuthnCeremony, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.ceremonies[challengeHash]
+	if !ok {
+		return WebAuthnCeremony{}, ErrInvalidWebAuthnCeremony
+	}
+	delete(s.ceremonies, challengeHash)
+	return c, nil
+}
+
+func (s *InMemorySessionStore) CreateOIDCLogin(stateHash string, p OIDCPendingLogin, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.oidcLogins) >= limit {
+		return ErrTooManyOIDCLogins
+	}
+	s.oidcLogins[stateHash] = p
+	return nil
+}
+
+func (s *InMemorySessionStore) TakeOIDCLogin(stateHash string) (OIDCPendingLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.oidcLogins[stateHash]
+	if !ok {
+		return OIDCPendingLogin{}, ErrInvalidOIDCState
+	}
+	delete(s.oidcLogins, stateHash)
+	return p, nil
+}
+
+func (s *InMemorySessionStore) DenyAccessTokens(sessionIDs []string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range sessionIDs {
+		if until.After(s.denied[id]) {
+			s.denied[id] = until
+		}
+	}
+	return nil
+}
+
+func (s *InMemorySessionStore) DeniedAccessTokens(now time.Time) (map[string]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]time.Time)
+	for id, until := range s.denied {
+		if !now.After(until) {
+			out[id] = until
+		}
+	}
+	return out, nil
+}
+
+// retainUntil is how long a stored session is kept. Refresh tokens and the
+// records of rotated ones stay useful until the absolute deadline; sessions
+// written before sliding expiry only have ExpiresAt.
+func (s Session) retainUntil() time.Time {
+	if s.AbsoluteExpiresAt.IsZero() {
+		return s.ExpiresAt
+	}
+	return s.AbsoluteExpiresAt
+}
+
+// sessionStateVersion marks session state files keyed by token hash. Files
+// without a version predate hashing and are keyed by the raw token.
+const sessionStateVersion = 2
+
+type sessionStateFile struct {
+	Version  int                `json:"version"`
+	Sessions map[string]Session `json:"sessions"`
+}
+
+// fileSessionStore keeps sessions in memory and rewrites the state file on
+// every change. It is meant for single-instance deployments; use Postgres to
+// share sessions between replicas. MFA challenges, WebAuthn ceremonies and
+// the access token deny-list only matter for minutes and are not written to
+// the file.
+type fileSessionStore struct {
+	*InMemorySessionStore
+	path string
+	// legacyKey converts the raw-token keys of pre-hashing state files.
+	legacyKey func(token string) string
+
+	fileMu sync.Mutex
+}
+
+func newFileSessionStore(path string, legacyKey func(token string) string) (*fileSessionStore, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, fmt.Errorf("session state file path is required")
+	}
+	return &fileSessionStore{InMemorySessionStore: NewInMemorySessionStore(), path: path, legacyKey: legacyKey}, nil
+}
+
+func (s *fileSessionStore) Create(tokenHash string, sess Session) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.InMemorySessionStore.Create(tokenHash, sess); err != nil {
+		return err
+	}
+	if err := s.persistLocked(); err != nil {
+		_ = s.InMemorySessionStore.Delete(tokenHash)
+		return err
+	}
+	return nil
+}
+
+func (s *fileSessionStore) Update(tokenHash string, sess Session) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.InMemorySessionStore.Update(tokenHash, sess); err != nil {
+		return err
+	}
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) MarkRotated(tokenHash string, at time.Time) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.InMemorySessionStore.MarkRotated(tokenHash, at); err != nil {
+		return err
+	}
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) Delete(tokenHash string) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if err := s.InMemorySessionStore.Delete(tokenHash); err != nil {
+		return err
+	}
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) DeleteFamily(familyID string) ([]string, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	ids, err := s.InMemorySessionStore.DeleteFamily(familyID)
+	if err != nil || len(ids) == 0 {
+		return ids, err
+	}
+	return ids, s.persistLocked()
+}
+
+func (s *fileSessionStore) DeleteUserSessions(userID, keepKey, keepFamily string) ([]Session, error) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	deleted, err := s.InMemorySessionStore.DeleteUserSessions(userID, keepKey, keepFamily)
+	if err != nil || len(deleted) == 0 {
+		return deleted, err
+	}
+	return deleted, s.persistLocked()
+}
+
+func (s *fileSessionStore) DeleteExpired(now time.Time) error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	before := s.count()
+	if err := s.InMemorySessionStore.DeleteExpired(now); err != nil {
+		return err
+	}
+	if s.count() == before {
+		return nil
+	}
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// load replaces the in-memory state with the file contents. Older files are
+// a bare map keyed by raw token; their keys are converted and the file is
+// rewritten straight away so the raw tokens leave the disk.
+func (s *fileSessionStore) load() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read session state: %w", err)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var decoded sessionStateFile
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return fmt.Errorf("decode session state: %w", err)
+	}
+	if decoded.Version == sessionStateVersion {
+		if decoded.Sessions == nil {
+			decoded.Sessions = make(map[string]Session)
+		}
+		s.mu.Lock()
+		s.sessions = decoded.Sessions
+		s.mu.Unlock()
+		return nil
+	}
+
+	legacy := make(map[string]Session)
+	if err := json.Unmarshal(b, &legacy); err != nil {
+		return fmt.Errorf("decode legacy session state: %w", err)
+	}
+	state := make(map[string]Session, len(legacy))
+	for token, sess := range legacy {
+		state[s.legacyKey(token)] = sess
+	}
+	s.mu.Lock()
+	s.sessions = state
+	s.mu.Unlock()
+	if err := s.persistLocked(); err != nil {
+		return fmt.Errorf("convert legacy session state: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSessionStore) persistLocked() error {
+	sessions, _ := s.InMemorySessionStore.List()
+	b, err := json.MarshalIndent(sessionStateFile{Version: sessionStateVersion, Sessions: sessions}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode session state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return fmt.Errorf("mkdir session state dir: %w", err)
+	}
+	if err := os.WriteFile(s.path, b, 0o600); err != nil {
+		return fmt.Errorf("write session state: %w", err)
+	}
+	return nil
+}
@@ -3,14 +3,11 @@ package auth
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 )
 
-type SessionStore interface {
-	Load() (map[string]Session, error)
-	Save(sessions map[string]Session) error
-}
-
 type PostgresSessionStore struct {
 	db *sql.DB
 }
@@ -29,76 +26,481 @@ func NewPostgresSessionStore(db *sql.DB) (*PostgresSessionStore, error) {
 func (s *PostgresSessionStore) ensureSchema() error {
 	const q = `
 CREATE TABLE IF NOT EXISTS auth_sessions (
-	token TEXT PRIMARY KEY,
+	token_hash TEXT PRIMARY KEY,
 	session_id TEXT NOT NULL UNIQUE,
 	user_id TEXT NOT NULL,
 	username TEXT NOT NULL,
 	roles JSONB NOT NULL DEFAULT '[]'::jsonb,
 	created_at TIMESTAMPTZ NOT NULL,
 	expires_at TIMESTAMPTZ NOT NULL
+);
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS absolute_expires_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS refresh_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS password_change_required BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS impersonator_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS impersonator_username TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS auth_sessions_refresh_hash_idx ON auth_sessions (refresh_hash);
+CREATE INDEX IF NOT EXISTS auth_sessions_family_id_idx ON auth_sessions (family_id);
+CREATE INDEX IF NOT EXISTS auth_sessions_user_id_idx ON auth_sessions (user_id);
+CREATE INDEX IF NOT EXISTS auth_sessions_impersonator_id_idx ON auth_sessions (impersonator_id) WHERE impersonator_id <> '';
+CREATE TABLE IF NOT EXISTS auth_mfa_challenges (
+	token_hash TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	username TEXT NOT NULL,
+	enrollment_required BOOLEAN NOT NULL DEFAULT FALSE,
+	webauthn BOOLEAN NOT NULL DEFAULT FALSE,
+	pending_secret TEXT NOT NULL DEFAULT '',
+	failures INTEGER NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS auth_mfa_challenges_user_id_idx ON auth_mfa_challenges (user_id);
+CREATE TABLE IF NOT EXISTS auth_webauthn_ceremonies (
+	challenge_hash TEXT PRIMARY KEY,
+	kind TEXT NOT NULL,
+	user_id TEXT NOT NULL DEFAULT '',
+	mfa_token_hash TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS auth_oidc_logins (
+	state_hash TEXT PRIMARY KEY,
+	verifier TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS auth_denied_access_tokens (
+	session_id TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
 )`
 	if _, err := s.db.Exec(q); err != nil {
 		return fmt.Errorf("ensure auth_sessions schema: %w", err)
 	}
+	// Tables created before token hashing hold raw tokens in a "token"
+	// column. Converting them would need the pepper inside the database, so
+	// those rows are dropped and users sign in again once.
+	const upgrade = `
+DO $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'auth_sessions' AND column_name = 'token'
+	) THEN
+		DELETE FROM auth_sessions;
+		ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash;
+	END IF;
+END $$`
+	if _, err := s.db.Exec(upgrade); err != nil {
+		return fmt.Errorf("upgrade auth_sessions to hashed tokens: %w", err)
+	}
 	return nil
 }
 
-func (s *PostgresSessionStore) Load() (map[string]Session, error) {
+const sessionSelectColumns = `token_hash, session_id, user_id, username, roles, created_at, expires_at, absolute_expires_at, last_seen_at, family_id, refresh_hash, rotated_at, password_change_required, client_ip, user_agent, impersonator_id, impersonator_username`
+
+func (s *PostgresSessionStore) Create(tokenHash string, sess Session) error {
+	rolesJSON, err := json.Marshal(sess.Roles)
+	if err != nil {
+		return fmt.Errorf("encode session roles: %w", err)
+	}
 	const q = `
-SELECT token, session_id, user_id, username, roles, created_at, expires_at
-FROM auth_sessions`
-	rows, err := s.db.Query(q)
+INSERT INTO auth_sessions (token_hash, session_id, user_id, username, roles, created_at, expires_at, absolute_expires_at, last_seen_at, family_id, refresh_hash, rotated_at, password_change_required, client_ip, user_agent, impersonator_id, impersonator_username)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`
+	if _, err := s.db.Exec(q, tokenHash, sess.ID, sess.UserID, sess.Username, rolesJSON, sess.CreatedAt, sess.ExpiresAt,
+		nullTimeValue(sess.AbsoluteExpiresAt), nullTimeValue(sess.LastSeenAt), sess.FamilyID, sess.RefreshHash, nullTime(sess.RotatedAt),
+		sess.PasswordChangeRequired, sess.ClientIP, sess.UserAgent, sess.ImpersonatorID, sess.ImpersonatorUsername); err != nil {
+		return fmt.Errorf("insert session: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) Get(tokenHash string) (Session, error) {
+	row := s.db.QueryRow(`SELECT `+sessionSelectColumns+` FROM auth_sessions WHERE token_hash = $1`, tokenHash)
+	_, sess, err := scanSession(row)
 	if err != nil {
-		return nil, fmt.Errorf("query sessions: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return Session{}, ErrSessionNotFound
+		}
+		return Session{}, fmt.Errorf("query session: %w", err)
 	}
-	defer rows.Close()
+	return sess, nil
+}
 
-	out := make(map[string]Session)
+func (s *PostgresSessionStore) GetByRefreshHash(refreshHash string) (string, Session, error) {
+	if refreshHash == "" {
+		return "", Session{}, ErrSessionNotFound
+	}
+	row := s.db.QueryRow(`SELECT `+sessionSelectColumns+` FROM auth_sessions WHERE refresh_hash = $1`, refreshHash)
+	tokenHash, sess, err := scanSession(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", Session{}, ErrSessionNotFound
+		}
+		return "", Session{}, fmt.Errorf("query session by refresh token: %w", err)
+	}
+	return tokenHash, sess, nil
+}
+
+func (s *PostgresSessionStore) GetByID(sessionID string) (string, Session, error) {
+	row := s.db.QueryRow(`SELECT `+sessionSelectColumns+` FROM auth_sessions WHERE session_id = $1`, sessionID)
+	tokenHash, sess, err := scanSession(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", Session{}, ErrSessionNotFound
+		}
+		return "", Session{}, fmt.Errorf("query session by id: %w", err)
+	}
+	return tokenHash, sess, nil
+}
+
+func (s *PostgresSessionStore) Update(tokenHash string, sess Session) error {
+	rolesJSON, err := json.Marshal(sess.Roles)
+	if err != nil {
+		return fmt.Errorf("encode session roles: %w", err)
+	}
+	const q = `
+UPDATE auth_sessions
+SET username = $2, roles = $3, expires_at = $4, last_seen_at = $5, password_change_required = $6, absolute_expires_at = $7
+WHERE token_hash = $1`
+	res, err := s.db.Exec(q, tokenHash, sess.Username, rolesJSON, sess.ExpiresAt, nullTimeValue(sess.LastSeenAt), sess.PasswordChangeRequired, sess.AbsoluteExpiresAt)
+	if err != nil {
+		return fmt.Errorf("update session: %w", err)
+	}
+	return sessionRowsAffected(res)
+}
+
+func (s *PostgresSessionStore) MarkRotated(tokenHash string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE auth_sessions SET rotated_at = $2 WHERE token_hash = $1 AND rotated_at IS NULL`, tokenHash, at)
+	if err != nil {
+		return fmt.Errorf("mark session rotated: %w", err)
+	}
+	return sessionRowsAffected(res)
+}
+
+func (s *PostgresSessionStore) Delete(tokenHash string) error {
+	res, err := s.db.Exec(`DELETE FROM auth_sessions WHERE token_hash = $1`, tokenHash)
+	if err != nil {
+		return fmt.Errorf("delete session: %w", err)
+	}
+	return sessionRowsAffected(res)
+}
+
+func (s *PostgresSessionStore) DeleteFamily(familyID string) ([]string, error) {
+	ids := []string{}
+	if familyID == "" {
+		return ids, nil
+	}
+	rows, err := s.db.Query(`DELETE FROM auth_sessions WHERE family_id = $1 RETURNING session_id`, familyID)
+	if err != nil {
+		return nil, fmt.Errorf("delete session family: %w", err)
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var sess Session
-		var rolesJSON []byte
-		if err := rows.Scan(&sess.Token, &sess.ID, &sess.UserID, &sess.Username, &rolesJSON, &sess.CreatedAt, &sess.ExpiresAt); err != nil {
-			return nil, fmt.Errorf("scan session: %w", err)
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan deleted session: %w", err)
 		}
-		if len(rolesJSON) > 0 {
-			if err := json.Unmarshal(rolesJSON, &sess.Roles); err != nil {
-				return nil, fmt.Errorf("decode session roles: %w", err)
-			}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate deleted sessions: %w", err)
+	}
+	return ids, nil
+}
+
+func (s *PostgresSessionStore) DeleteUserSessions(userID, keepKey, keepFamily string) ([]Session, error) {
+	const q = `
+DELETE FROM auth_sessions
+WHERE (user_id = $1 OR impersonator_id = $1) AND token_hash <> $2 AND ($3 = '' OR family_id <> $3)
+RETURNING ` + sessionSelectColumns
+	rows, err := s.db.Query(q, userID, keepKey, keepFamily)
+	if err != nil {
+		return nil, fmt.Errorf("delete user sessions: %w", err)
+	}
+	defer rows.Close()
+	deleted := []Session{}
+	for rows.Next() {
+		_, sess, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan deleted session: %w", err)
 		}
-		out[sess.Token] = sess
+		deleted = append(deleted, sess)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate sessions: %w", err)
+		return nil, fmt.Errorf("iterate deleted sessions: %w", err)
 	}
-	return out, nil
+	return deleted, nil
+}
+
+func (s *PostgresSessionStore) DeleteExpired(now time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM auth_sessions WHERE COALESCE(absolute_expires_at, expires_at) < $1`, now); err != nil {
+		return fmt.Errorf("delete expired sessions: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM auth_mfa_challenges WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("delete expired mfa challenges: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM auth_webauthn_ceremonies WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("delete expired webauthn ceremonies: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM auth_oidc_logins WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("delete expired oidc logins: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM auth_denied_access_tokens WHERE expires_at < $1`, now); err != nil {
+		return fmt.Errorf("delete expired access token denials: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) List() (map[string]Session, error) {
+	return s.querySessions(`SELECT ` + sessionSelectColumns + ` FROM auth_sessions`)
+}
+
+func (s *PostgresSessionStore) ListByUser(userID string) (map[string]Session, error) {
+	return s.querySessions(`SELECT `+sessionSelectColumns+` FROM auth_sessions WHERE user_id = $1`, userID)
 }
 
-func (s *PostgresSessionStore) Save(sessions map[string]Session) error {
-	tx, err := s.db.Begin()
+const mfaChallengeSelectColumns = `user_id, username, enrollment_required, webauthn, pending_secret, failures, expires_at`
+
+func (s *PostgresSessionStore) CreateMFAChallenge(tokenHash string, c MFAChallenge) error {
+	const q = `
+INSERT INTO auth_mfa_challenges (token_hash, user_id, username, enrollment_required, webauthn, pending_secret, failures, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	if _, err := s.db.Exec(q, tokenHash, c.UserID, c.Username, c.EnrollmentRequired, c.WebAuthn, c.pendingSecret, c.failures, c.ExpiresAt); err != nil {
+		return fmt.Errorf("insert mfa challenge: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) GetMFAChallenge(tokenHash string) (MFAChallenge, error) {
+	row := s.db.QueryRow(`SELECT `+mfaChallengeSelectColumns+` FROM auth_mfa_challenges WHERE token_hash = $1`, tokenHash)
+	c, err := scanMFAChallenge(row)
 	if err != nil {
-		return fmt.Errorf("begin tx: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return MFAChallenge{}, ErrInvalidMFAChallenge
+		}
+		return MFAChallenge{}, fmt.Errorf("query mfa challenge: %w", err)
 	}
-	defer tx.Rollback()
+	return c, nil
+}
 
-	if _, err := tx.Exec(`DELETE FROM auth_sessions`); err != nil {
-		return fmt.Errorf("clear sessions: %w", err)
+func (s *PostgresSessionStore) SetMFAChallengeSecret(tokenHash, secret string) error {
+	res, err := s.db.Exec(`UPDATE auth_mfa_challenges SET pending_secret = $2 WHERE token_hash = $1`, tokenHash, secret)
+	if err != nil {
+		return fmt.Errorf("update mfa challenge: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update mfa challenge: %w", err)
 	}
+	if n == 0 {
+		return ErrInvalidMFAChallenge
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) RecordMFAChallengeFailure(tokenHash string) (int, error) {
+	var failures int
+	err := s.db.QueryRow(`UPDATE auth_mfa_challenges SET failures = failures + 1 WHERE token_hash = $1 RETURNING failures`, tokenHash).Scan(&failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return 0, fmt.Errorf("record mfa challenge failure: %w", err)
+	}
+	return failures, nil
+}
+
+func (s *PostgresSessionStore) TakeMFAChallenge(tokenHash string) (MFAChallenge, error) {
+	row := s.db.QueryRow(`DELETE FROM auth_mfa_challenges WHERE token_hash = $1 RETURNING `+mfaChallengeSelectColumns, tokenHash)
+	c, err := scanMFAChallenge(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MFAChallenge{}, ErrInvalidMFAChallenge
+		}
+		return MFAChallenge{}, fmt.Errorf("take mfa challenge: %w", err)
+	}
+	return c, nil
+}
+
+func (s *PostgresSessionStore) DeleteUserMFAChallenges(userID string) error {
+	if _, err := s.db.Exec(`DELETE FROM auth_mfa_challenges WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("delete user mfa challenges: %w", err)
+	}
+	return nil
+}
+
+func scanMFAChallenge(row rowScanner) (MFAChallenge, error) {
+	var c MFAChallenge
+	if err := row.Scan(&c.UserID, &c.Username, &c.EnrollmentRequired, &c.WebAuthn, &c.pendingSecret, &c.failures, &c.ExpiresAt); err != nil {
+		return MFAChallenge{}, err
+	}
+	return c, nil
+}
+
+// CreateWebAuthnCeremony counts the stored ceremonies in the same statement
+// as the insert. Concurrent inserts may overshoot limit slightly, which is
+// fine for a bound meant to stop floods.
+func (s *PostgresSessionStore) CreateWebAuthnCeremony(challengeHash string, c WebAuthnCeremony, limit int) error {
+	const q = `
+INSERT INTO auth_webauthn_ceremonies (challenge_hash, kind, user_id, mfa_token_hash, expires_at)
+SELECT $1, $2, $3, $4, $5
+WHERE (SELECT COUNT(*) FROM auth_webauthn_ceremonies) < $6`
+	res, err := s.db.Exec(q, challengeHash, c.kind, c.userID, c.mfaTokenHash, c.expiresAt, limit)
+	if err != nil {
+		return fmt.Errorf("insert webauthn ceremony: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("insert webauthn ceremony: %w", err)
+	}
+	if n == 0 {
+		return ErrTooManyWebAuthnCeremonies
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) TakeWebAuthnCeremony(challengeHash string) (WebAuthnCeremony, error) {
+	var c WebAuthnCeremony
+	err := s.db.QueryRow(`DELETE FROM auth_webauthn_ceremonies WHERE challenge_hash = $1 RETURNING kind, user_id, mfa_token_hash, expires_at`, challengeHash).
+		Scan(&c.kind, &c.userID, &c.mfaTokenHash, &c.expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebAuthnCeremony{}, ErrInvalidWebAuthnCeremony
+		}
+		return WebAuthnCeremony{}, fmt.Errorf("take webauthn ceremony: %w", err)
+	}
+	return c, nil
+}
 
+// CreateOIDCLogin bounds the pending logins like CreateWebAuthnCeremony.
+func (s *PostgresSessionStore) CreateOIDCLogin(stateHash string, p OIDCPendingLogin, limit int) error {
 	const q = `
-INSERT INTO auth_sessions (token, session_id, user_id, username, roles, created_at, expires_at)
-VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	for token, sess := range sessions {
-		rolesJSON, err := json.Marshal(sess.Roles)
+INSERT INTO auth_oidc_logins (state_hash, verifier, nonce, expires_at)
+SELECT $1, $2, $3, $4
+WHERE (SELECT COUNT(*) FROM auth_oidc_logins) < $5`
+	res, err := s.db.Exec(q, stateHash, p.verifier, p.nonce, p.expiresAt, limit)
+	if err != nil {
+		return fmt.Errorf("insert oidc login: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("insert oidc login: %w", err)
+	}
+	if n == 0 {
+		return ErrTooManyOIDCLogins
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) TakeOIDCLogin(stateHash string) (OIDCPendingLogin, error) {
+	var p OIDCPendingLogin
+	err := s.db.QueryRow(`DELETE FROM auth_oidc_logins WHERE state_hash = $1 RETURNING verifier, nonce, expires_at`, stateHash).
+		Scan(&p.verifier, &p.nonce, &p.expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OIDCPendingLogin{}, ErrInvalidOIDCState
+		}
+		return OIDCPendingLogin{}, fmt.Errorf("take oidc login: %w", err)
+	}
+	return p, nil
+}
+
+func (s *PostgresSessionStore) DenyAccessTokens(sessionIDs []string, until time.Time) error {
+	const q = `
+INSERT INTO auth_denied_access_tokens (session_id, expires_at) VALUES ($1, $2)
+ON CONFLICT (session_id) DO UPDATE SET expires_at = GREATEST(auth_denied_access_tokens.expires_at, EXCLUDED.expires_at)`
+	for _, id := range sessionIDs {
+		if _, err := s.db.Exec(q, id, until); err != nil {
+			return fmt.Errorf("deny access tokens: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) DeniedAccessTokens(now time.Time) (map[string]time.Time, error) {
+	rows, err := s.db.Query(`SELECT session_id, expires_at FROM auth_denied_access_tokens WHERE expires_at >= $1`, now)
+	if err != nil {
+		return nil, fmt.Errorf("query access token denials: %w", err)
+	}
+	defer rows.Close()
+	out := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var until time.Time
+		if err := rows.Scan(&id, &until); err != nil {
+			return nil, fmt.Errorf("scan access token denial: %w", err)
+		}
+		out[id] = until
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate access token denials: %w", err)
+	}
+	return out, nil
+}
+
+func (s *PostgresSessionStore) querySessions(q string, args ...any) (map[string]Session, error) {
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[string]Session)
+	for rows.Next() {
+		tokenHash, sess, err := scanSession(rows)
 		if err != nil {
-			return fmt.Errorf("encode session roles: %w", err)
+			return nil, fmt.Errorf("scan session: %w", err)
 		}
-		if _, err := tx.Exec(q, token, sess.ID, sess.UserID, sess.Username, rolesJSON, sess.CreatedAt, sess.ExpiresAt); err != nil {
-			return fmt.Errorf("insert session: %w", err)
+		out[tokenHash] = sess
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate sessions: %w", err)
+	}
+	return out, nil
+}
+
+func scanSession(row rowScanner) (string, Session, error) {
+	var tokenHash string
+	var sess Session
+	var rolesJSON []byte
+	var absoluteExpiresAt, lastSeenAt, rotatedAt sql.NullTime
+	if err := row.Scan(&tokenHash, &sess.ID, &sess.UserID, &sess.Username, &rolesJSON, &sess.CreatedAt, &sess.ExpiresAt,
+		&absoluteExpiresAt, &lastSeenAt, &sess.FamilyID, &sess.RefreshHash, &rotatedAt, &sess.PasswordChangeRequired, &sess.ClientIP, &sess.UserAgent,
+		&sess.ImpersonatorID, &sess.ImpersonatorUsername); err != nil {
+		return "", Session{}, err
+	}
+	sess.AbsoluteExpiresAt = absoluteExpiresAt.Time
+	sess.LastSeenAt = lastSeenAt.Time
+	if rotatedAt.Valid {
+		sess.RotatedAt = &rotatedAt.Time
+	}
+	if len(rolesJSON) > 0 {
+		if err := json.Unmarshal(rolesJSON, &sess.Roles); err != nil {
+			return "", Session{}, fmt.Errorf("decode session roles: %w", err)
 		}
 	}
+	return tokenHash, sess, nil
+}
+
+// nullTimeValue stores zero times, as left by sessions written before sliding
+// expiry, as NULL.
+func nullTimeValue(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t, Valid: true}
+}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit session tx: %w", err)
+func sessionRowsAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("session rows affected: %w", err)
+	}
+	if n == 0 {
+		return ErrSessionNotFound
 	}
 	return nil
 }
@@ -1,12 +1,15 @@
 package auth
 
 import (
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
 
+var sessionColumns = []string{"token_hash", "session_id", "user_id", "username", "roles", "created_at", "expires_at", "absolute_expires_at", "last_seen_at", "family_id", "refresh_hash", "rotated_at", "password_change_required", "client_ip", "user_agent", "impersonator_id", "impersonator_username"}
+
 func TestNewPostgresSessionStore(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -15,6 +18,7 @@ func TestNewPostgresSessionStore(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
 
 	_, err = NewPostgresSessionStore(db)
 	if err != nil {
@@ -25,7 +29,7 @@ func TestNewPostgresSessionStore(t *testing.T) {
 	}
 }
 
-func TestPostgresSessionStoreLoadAndSave(t *testing.T) {
+func TestPostgresSessionStoreCreateGetDelete(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("sqlmock.New() error: %v", err)
@@ -33,45 +37,358 @@ func TestPostgresSessionStoreLoadAndSave(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
 	store, err := NewPostgresSessionStore(db)
 	if err != nil {
 		t.Fatalf("NewPostgresSessionStore() error: %v", err)
 	}
 
 	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
-	sessions := map[string]Session{
-		"tok1": {
-			ID:        "sid1",
-			Token:     "tok1",
-			UserID:    "u1",
-			Username:  "admin",
-			Roles:     []string{"admin"},
-			CreatedAt: now,
-			ExpiresAt: now.Add(time.Hour),
-		},
-	}
-
-	mock.ExpectBegin()
-	mock.ExpectExec("DELETE FROM auth_sessions").WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec("INSERT INTO auth_sessions").WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
-
-	if err := store.Save(sessions); err != nil {
-		t.Fatalf("Save() error: %v", err)
-	}
-
-	rows := sqlmock.NewRows([]string{"token", "session_id", "user_id", "username", "roles", "created_at", "expires_at"}).
-		AddRow("tok1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour))
-	mock.ExpectQuery("SELECT token, session_id, user_id, username, roles, created_at, expires_at FROM auth_sessions").
+	sess := Session{
+		ID:                "sid1",
+		UserID:            "u1",
+		Username:          "admin",
+		Roles:             []string{"admin"},
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(time.Hour),
+		AbsoluteExpiresAt: now.Add(12 * time.Hour),
+		LastSeenAt:        now,
+		FamilyID:          "fam1",
+		RefreshHash:       "rhash1",
+		ClientIP:          "192.0.2.1",
+		UserAgent:         "curl/8.0",
+
+		ImpersonatorID:       "u0",
+		ImpersonatorUsername: "support",
+	}
+
+	mock.ExpectExec("INSERT INTO auth_sessions").
+		WithArgs("hash1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour),
+			now.Add(12*time.Hour), now, "fam1", "rhash1", nil, false, "192.0.2.1", "curl/8.0", "u0", "support").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := store.Create("hash1", sess); err != nil {
+		t.Fatalf("Create() error: %v", err)
+	}
+
+	rows := sqlmock.NewRows(sessionColumns).
+		AddRow("hash1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour), now.Add(12*time.Hour), now, "fam1", "rhash1", nil, false, "192.0.2.1", "curl/8.0", "u0", "support")
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE token_hash = \\$1").
+		WithArgs("hash1").
 		WillReturnRows(rows)
+	got, err := store.Get("hash1")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.ID != "sid1" || got.Username != "admin" || len(got.Roles) != 1 || got.FamilyID != "fam1" || got.RotatedAt != nil || got.ClientIP != "192.0.2.1" || got.UserAgent != "curl/8.0" || got.ImpersonatorUsername != "support" {
+		t.Fatalf("unexpected session: %+v", got)
+	}
+
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE refresh_hash = \\$1").
+		WithArgs("rhash1").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).
+			AddRow("hash1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour), now.Add(12*time.Hour), now, "fam1", "rhash1", nil, false, "192.0.2.1", "curl/8.0", "", ""))
+	key, _, err := store.GetByRefreshHash("rhash1")
+	if err != nil || key != "hash1" {
+		t.Fatalf("GetByRefreshHash() = %q, %v", key, err)
+	}
+
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE session_id = \\$1").
+		WithArgs("sid1").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).
+			AddRow("hash1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour), now.Add(12*time.Hour), now, "fam1", "rhash1", nil, false, "192.0.2.1", "curl/8.0", "", ""))
+	if key, got, err := store.GetByID("sid1"); err != nil || key != "hash1" || got.ID != "sid1" {
+		t.Fatalf("GetByID() = %q, %+v, %v", key, got, err)
+	}
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE session_id = \\$1").
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows(sessionColumns))
+	if _, _, err := store.GetByID("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	mock.ExpectExec("UPDATE auth_sessions SET rotated_at = \\$2 WHERE token_hash = \\$1 AND rotated_at IS NULL").
+		WithArgs("hash1", now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.MarkRotated("hash1", now); err != nil {
+		t.Fatalf("MarkRotated() error: %v", err)
+	}
+	mock.ExpectExec("UPDATE auth_sessions SET rotated_at = \\$2 WHERE token_hash = \\$1 AND rotated_at IS NULL").
+		WithArgs("hash1", now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.MarkRotated("hash1", now); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected second MarkRotated to report ErrSessionNotFound, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE token_hash = \\$1").
+		WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows(sessionColumns))
+	if _, err := store.Get("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_sessions WHERE token_hash = \\$1").
+		WithArgs("hash1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.Delete("hash1"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_sessions WHERE token_hash = \\$1").
+		WithArgs("hash1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.Delete("hash1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	mock.ExpectQuery("SELECT token_hash, .+ FROM auth_sessions WHERE user_id = \\$1").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).
+			AddRow("hash1", "sid1", "u1", "admin", []byte(`["admin"]`), now, now.Add(time.Hour), now.Add(12*time.Hour), now, "fam1", "rhash1", nil, false, "192.0.2.1", "curl/8.0", "", ""))
+	if byUser, err := store.ListByUser("u1"); err != nil || byUser["hash1"].ID != "sid1" || len(byUser) != 1 {
+		t.Fatalf("ListByUser() = %+v, %v", byUser, err)
+	}
+
+	mock.ExpectQuery("DELETE FROM auth_sessions WHERE family_id = \\$1 RETURNING session_id").
+		WithArgs("fam1").
+		WillReturnRows(sqlmock.NewRows([]string{"session_id"}).AddRow("sid1").AddRow("sid2"))
+	if ids, err := store.DeleteFamily("fam1"); err != nil || len(ids) != 2 || ids[0] != "sid1" {
+		t.Fatalf("DeleteFamily() = %v, %v", ids, err)
+	}
+
+	mock.ExpectQuery("DELETE FROM auth_sessions\\s+WHERE \\(user_id = \\$1 OR impersonator_id = \\$1\\) AND token_hash <> \\$2 AND \\(\\$3 = '' OR family_id <> \\$3\\)\\s+RETURNING token_hash").
+		WithArgs("u1", "hash2", "").
+		WillReturnRows(sqlmock.NewRows(sessionColumns).
+			AddRow("hash3", "sid3", "u2", "alice", []byte(`[]`), now, now.Add(time.Hour), now.Add(12*time.Hour), now, "fam3", "rhash3", nil, false, "", "", "u1", "admin"))
+	if deleted, err := store.DeleteUserSessions("u1", "hash2", ""); err != nil || len(deleted) != 1 || deleted[0].ID != "sid3" || deleted[0].ImpersonatorID != "u1" {
+		t.Fatalf("DeleteUserSessions() = %+v, %v", deleted, err)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_sessions WHERE COALESCE\\(absolute_expires_at, expires_at\\) < \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("DELETE FROM auth_mfa_challenges WHERE expires_at < \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM auth_webauthn_ceremonies WHERE expires_at < \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM auth_oidc_logins WHERE expires_at < \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM auth_denied_access_tokens WHERE expires_at < \\$1").
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.DeleteExpired(now); err != nil {
+		t.Fatalf("DeleteExpired() error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
+
+func TestPostgresSessionStoreMFAChallenges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresSessionStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresSessionStore() error: %v", err)
+	}
+
+	expires := time.Date(2026, 2, 16, 12, 5, 0, 0, time.UTC)
+	challengeColumns := []string{"user_id", "username", "enrollment_required", "webauthn", "pending_secret", "failures", "expires_at"}
+
+	mock.ExpectExec("INSERT INTO auth_mfa_challenges").
+		WithArgs("chash1", "u1", "admin", true, false, "", 0, expires).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := store.CreateMFAChallenge("chash1", MFAChallenge{Token: "raw", UserID: "u1", Username: "admin", EnrollmentRequired: true, ExpiresAt: expires}); err != nil {
+		t.Fatalf("CreateMFAChallenge() error: %v", err)
+	}
+
+	mock.ExpectExec("UPDATE auth_mfa_challenges SET pending_secret = \\$2 WHERE token_hash = \\$1").
+		WithArgs("chash1", "SECRET").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.SetMFAChallengeSecret("chash1", "SECRET"); err != nil {
+		t.Fatalf("SetMFAChallengeSecret() error: %v", err)
+	}
+
+	mock.ExpectQuery("UPDATE auth_mfa_challenges SET failures = failures \\+ 1 WHERE token_hash = \\$1 RETURNING failures").
+		WithArgs("chash1").
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	if failures, err := store.RecordMFAChallengeFailure("chash1"); err != nil || failures != 1 {
+		t.Fatalf("RecordMFAChallengeFailure() = %d, %v", failures, err)
+	}
+
+	mock.ExpectQuery("SELECT user_id, .+ FROM auth_mfa_challenges WHERE token_hash = \\$1").
+		WithArgs("chash1").
+		WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow("u1", "admin", true, false, "SECRET", 1, expires))
+	got, err := store.GetMFAChallenge("chash1")
+	if err != nil || got.UserID != "u1" || got.pendingSecret != "SECRET" || got.failures != 1 || !got.ExpiresAt.Equal(expires) {
+		t.Fatalf("GetMFAChallenge() = %+v, %v", got, err)
+	}
+
+	mock.ExpectQuery("DELETE FROM auth_mfa_challenges WHERE token_hash = \\$1 RETURNING user_id").
+		WithArgs("chash1").
+		WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow("u1", "admin", true, false, "SECRET", 1, expires))
+	if got, err := store.TakeMFAChallenge("chash1"); err != nil || got.UserID != "u1" {
+		t.Fatalf("TakeMFAChallenge() = %+v, %v", got, err)
+	}
+	mock.ExpectQuery("DELETE FROM auth_mfa_challenges WHERE token_hash = \\$1 RETURNING user_id").
+		WithArgs("chash1").
+		WillReturnRows(sqlmock.NewRows(challengeColumns))
+	if _, err := store.TakeMFAChallenge("chash1"); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected a taken challenge to be gone, got %v", err)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_mfa_challenges WHERE user_id = \\$1").
+		WithArgs("u1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	if err := store.DeleteUserMFAChallenges("u1"); err != nil {
+		t.Fatalf("DeleteUserMFAChallenges() error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
 
-	loaded, err := store.Load()
+func TestPostgresSessionStoreWebAuthnCeremonies(t *testing.T) {
+	db, mock, err := sqlmock.New()
 	if err != nil {
-		t.Fatalf("Load() error: %v", err)
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresSessionStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresSessionStore() error: %v", err)
+	}
+
+	expires := time.Date(2026, 6, 1, 0, 5, 0, 0, time.UTC)
+	c := WebAuthnCeremony{kind: webauthnCeremonyMFA, userID: "u1", mfaTokenHash: "mhash", expiresAt: expires}
+
+	mock.ExpectExec("INSERT INTO auth_webauthn_ceremonies .+ WHERE \\(SELECT COUNT\\(\\*\\) FROM auth_webauthn_ceremonies\\) < \\$6").
+		WithArgs("whash1", "mfa", "u1", "mhash", expires, 2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := store.CreateWebAuthnCeremony("whash1", c, 2); err != nil {
+		t.Fatalf("CreateWebAuthnCeremony() error: %v", err)
+	}
+	mock.ExpectExec("INSERT INTO auth_webauthn_ceremonies").
+		WithArgs("whash2", "mfa", "u1", "mhash", expires, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.CreateWebAuthnCeremony("whash2", c, 2); !errors.Is(err, ErrTooManyWebAuthnCeremonies) {
+		t.Fatalf("expected ErrTooManyWebAuthnCeremonies, got %v", err)
+	}
+
+	ceremonyColumns := []string{"kind", "user_id", "mfa_token_hash", "expires_at"}
+	mock.ExpectQuery("DELETE FROM auth_webauthn_ceremonies WHERE challenge_hash = \\$1 RETURNING kind").
+		WithArgs("whash1").
+		WillReturnRows(sqlmock.NewRows(ceremonyColumns).AddRow("mfa", "u1", "mhash", expires))
+	if got, err := store.TakeWebAuthnCeremony("whash1"); err != nil || got != c {
+		t.Fatalf("TakeWebAuthnCeremony() = %+v, %v", got, err)
 	}
-	if len(loaded) != 1 || loaded["tok1"].ID != "sid1" {
-		t.Fatalf("unexpected loaded sessions: %+v", loaded)
+	mock.ExpectQuery("DELETE FROM auth_webauthn_ceremonies WHERE challenge_hash = \\$1 RETURNING kind").
+		WithArgs("whash1").
+		WillReturnRows(sqlmock.NewRows(ceremonyColumns))
+	if _, err := store.TakeWebAuthnCeremony("whash1"); !errors.Is(err, ErrInvalidWebAuthnCeremony) {
+		t.Fatalf("expected a taken ceremony to be gone, got %v", err)
 	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
+
+func TestPostgresSessionStoreOIDCLogins(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresSessionStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresSessionStore() error: %v", err)
+	}
+
+	expires := time.Date(2026, 6, 1, 0, 10, 0, 0, time.UTC)
+	p := OIDCPendingLogin{verifier: "verifier", nonce: "nonce", expiresAt: expires}
+
+	mock.ExpectExec("INSERT INTO auth_oidc_logins .+ WHERE \\(SELECT COUNT\\(\\*\\) FROM auth_oidc_logins\\) < \\$5").
+		WithArgs("shash1", "verifier", "nonce", expires, 2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if err := store.CreateOIDCLogin("shash1", p, 2); err != nil {
+		t.Fatalf("CreateOIDCLogin() error: %v", err)
+	}
+	mock.ExpectExec("INSERT INTO auth_oidc_logins").
+		WithArgs("shash2", "verifier", "nonce", expires, 2).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.CreateOIDCLogin("shash2", p, 2); !errors.Is(err, ErrTooManyOIDCLogins) {
+		t.Fatalf("expected ErrTooManyOIDCLogins, got %v", err)
+	}
+
+	loginColumns := []string{"verifier", "nonce", "expires_at"}
+	mock.ExpectQuery("DELETE FROM auth_oidc_logins WHERE state_hash = \\$1 RETURNING verifier").
+		WithArgs("shash1").
+		WillReturnRows(sqlmock.NewRows(loginColumns).AddRow("verifier", "nonce", expires))
+	if got, err := store.TakeOIDCLogin("shash1"); err != nil || got != p {
+		t.Fatalf("TakeOIDCLogin() = %+v, %v", got, err)
+	}
+	mock.ExpectQuery("DELETE FROM auth_oidc_logins WHERE state_hash = \\$1 RETURNING verifier").
+		WithArgs("shash1").
+		WillReturnRows(sqlmock.NewRows(loginColumns))
+	if _, err := store.TakeOIDCLogin("shash1"); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Fatalf("expected a taken login to be gone, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
+
+func TestPostgresSessionStoreAccessTokenDenyList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresSessionStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresSessionStore() error: %v", err)
+	}
+
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	until := now.Add(5 * time.Minute)
+	for _, id := range []string{"sid1", "sid2"} {
+		mock.ExpectExec("INSERT INTO auth_denied_access_tokens .+ ON CONFLICT \\(session_id\\) DO UPDATE SET expires_at = GREATEST").
+			WithArgs(id, until).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	if err := store.DenyAccessTokens([]string{"sid1", "sid2"}, until); err != nil {
+		t.Fatalf("DenyAccessTokens() error: %v", err)
+	}
+
+	mock.ExpectQuery("SELECT session_id, expires_at FROM auth_denied_access_tokens WHERE expires_at >= \\$1").
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"session_id", "expires_at"}).AddRow("sid1", until).AddRow("sid2", until))
+	denied, err := store.DeniedAccessTokens(now)
+	if err != nil || len(denied) != 2 || !denied["sid1"].Equal(until) {
+		t.Fatalf("DeniedAccessTokens() = %v, %v", denied, err)
+	}
+
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Fatalf("expectations not met: %v", err)
 	}
@@ -2,14 +2,33 @@ package auth
 
 import (
 	"errors"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 )
 
-var ErrUserNotFound = errors.New("user not found")
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username already taken")
+)
 
 type UserStore interface {
 	GetByUsername(username string) (User, error)
+	GetByID(id string) (User, error)
+	List() ([]User, error)
 	Put(user User) error
+	Rename(id, newUsername string) error
+	Delete(id string) error
+	// TouchLastLogin records a successful sign-in without changing
+	// UpdatedAt.
+	TouchLastLogin(id string, at time.Time) error
+	// AdvanceTOTPStep records step as the last accepted TOTP step only if
+	// it is newer than the stored one, and reports whether it was.
+	AdvanceTOTPStep(id string, step int64) (bool, error)
+	// TakeRecoveryCode removes hash from the user's recovery codes and
+	// reports whether it was still there.
+	TakeRecoveryCode(id, hash string) (bool, error)
 }
 
 type InMemoryUserStore struct {
@@ -32,9 +51,146 @@ func (s *InMemoryUserStore) GetByUsername(username string) (User, error) {
 	return u, nil
 }
 
+func (s *InMemoryUserStore) GetByID(id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return findUserByID(s.users, id)
+}
+
+func (s *InMemoryUserStore) List() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedUsers(s.users), nil
+}
+
 func (s *InMemoryUserStore) Put(user User) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.users[user.Username] = user
+	prev, existed := s.users[user.Username]
+	s.users[user.Username] = stampUser(user, prev, existed, time.Now())
+	return nil
+}
+
+func (s *InMemoryUserStore) Rename(id, newUsername string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return renameUser(s.users, id, newUsername)
+}
+
+func (s *InMemoryUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := findUserByID(s.users, id)
+	if err != nil {
+		return err
+	}
+	delete(s.users, u.Username)
+	return nil
+}
+
+func (s *InMemoryUserStore) TouchLastLogin(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return touchLastLogin(s.users, id, at)
+}
+
+func (s *InMemoryUserStore) AdvanceTOTPStep(id string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return advanceTOTPStep(s.users, id, step)
+}
+
+func (s *InMemoryUserStore) TakeRecoveryCode(id, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return takeRecoveryCode(s.users, id, hash)
+}
+
+func findUserByID(users map[string]User, id string) (User, error) {
+	for _, u := range users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+func sortedUsers(users map[string]User) []User {
+	out := make([]User, 0, len(users))
+	for _, u := range users {
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Username < out[j].Username })
+	return out
+}
+
+func renameUser(users map[string]User, id, newUsername string) error {
+	u, err := findUserByID(users, id)
+	if err != nil {
+		return err
+	}
+	if u.Username == newUsername {
+		return nil
+	}
+	if _, taken := users[newUsername]; taken {
+		return ErrUsernameTaken
+	}
+	delete(users, u.Username)
+	u.Username = newUsername
+	users[newUsername] = u
+	return nil
+}
+
+// stampUser sets the timestamps the store maintains on a user about to be
+// written over prev. Creation and last login times are never taken from the
+// caller for an existing record, so that writing back a stale copy cannot
+// lose a concurrent sign-in.
+func stampUser(u, prev User, existed bool, now time.Time) User {
+	now = now.UTC()
+	if existed {
+		u.CreatedAt = prev.CreatedAt
+		u.LastLoginAt = prev.LastLoginAt
+	} else if u.CreatedAt == nil {
+		u.CreatedAt = &now
+	}
+	u.UpdatedAt = &now
+	return u
+}
+
+func advanceTOTPStep(users map[string]User, id string, step int64) (bool, error) {
+	u, err := findUserByID(users, id)
+	if err != nil {
+		return false, err
+	}
+	if step <= u.TOTPLastStep {
+		return false, nil
+	}
+	u.TOTPLastStep = step
+	users[u.Username] = u
+	return true, nil
+}
+
+func takeRecoveryCode(users map[string]User, id, hash string) (bool, error) {
+	u, err := findUserByID(users, id)
+	if err != nil {
+		return false, err
+	}
+	i := slices.Index(u.RecoveryCodeHashes, hash)
+	if i < 0 {
+		return false, nil
+	}
+	u.RecoveryCodeHashes = slices.Delete(slices.Clone(u.RecoveryCodeHashes), i, i+1)
+	users[u.Username] = u
+	return true, nil
+}
+
+func touchLastLogin(users map[string]User, id string, at time.Time) error {
+	u, err := findUserByID(users, id)
+	if err != nil {
+		return err
+	}
+	at = at.UTC()
+	u.LastLoginAt = &at
+	users[u.Username] = u
 	return nil
 }
@@ -7,8 +7,109 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
+// fileUserRecord is the on-disk shape of a user. User hides PasswordHash from
+// JSON so it never leaks through API responses, so the file store needs its
+// own type to persist it.
+type fileUserRecord struct {
+	ID                 string   `json:"id"`
+	Username           string   `json:"username"`
+	PasswordHash       string   `json:"password_hash"`
+	Roles              []string `json:"roles"`
+	Email              string   `json:"email,omitempty"`
+	MFAEnabled         bool     `json:"mfa_enabled,omitempty"`
+	TOTPSecret         string   `json:"totp_secret,omitempty"`
+	TOTPPendingSecret  string   `json:"totp_pending_secret,omitempty"`
+	TOTPLastStep       int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodeHashes []string `json:"recovery_code_hashes,omitempty"`
+	AuthProvider       string   `json:"auth_provider,omitempty"`
+	ExternalSubject    string   `json:"external_subject,omitempty"`
+
+	PasswordResetHash      string     `json:"password_reset_hash,omitempty"`
+	PasswordResetExpiresAt *time.Time `json:"password_reset_expires_at,omitempty"`
+
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+	PasswordHistory   []string   `json:"password_history,omitempty"`
+
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+
+	Disabled    bool       `json:"disabled,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+
+	WebAuthnCredentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"`
+}
+
+func newFileUserRecord(u User) fileUserRecord {
+	return fileUserRecord{
+		ID:                 u.ID,
+		Username:           u.Username,
+		PasswordHash:       u.PasswordHash,
+		Roles:              u.Roles,
+		Email:              u.Email,
+		MFAEnabled:         u.MFAEnabled,
+		TOTPSecret:         u.TOTPSecret,
+		TOTPPendingSecret:  u.TOTPPendingSecret,
+		TOTPLastStep:       u.TOTPLastStep,
+		RecoveryCodeHashes: u.RecoveryCodeHashes,
+		AuthProvider:       u.AuthProvider,
+		ExternalSubject:    u.ExternalSubject,
+
+		PasswordResetHash:      u.PasswordResetHash,
+		PasswordResetExpiresAt: u.PasswordResetExpiresAt,
+
+		PasswordChangedAt: u.PasswordChangedAt,
+		PasswordHistory:   u.PasswordHistory,
+
+		MustChangePassword: u.MustChangePassword,
+
+		Disabled:    u.Disabled,
+		ExpiresAt:   u.ExpiresAt,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+		LastLoginAt: u.LastLoginAt,
+
+		WebAuthnCredentials: u.WebAuthnCredentials,
+	}
+}
+
+func (r fileUserRecord) user() User {
+	return User{
+		ID:                 r.ID,
+		Username:           r.Username,
+		PasswordHash:       r.PasswordHash,
+		Roles:              r.Roles,
+		Email:              r.Email,
+		MFAEnabled:         r.MFAEnabled,
+		TOTPSecret:         r.TOTPSecret,
+		TOTPPendingSecret:  r.TOTPPendingSecret,
+		TOTPLastStep:       r.TOTPLastStep,
+		RecoveryCodeHashes: r.RecoveryCodeHashes,
+		AuthProvider:       r.AuthProvider,
+		ExternalSubject:    r.ExternalSubject,
+
+		PasswordResetHash:      r.PasswordResetHash,
+		PasswordResetExpiresAt: r.PasswordResetExpiresAt,
+
+		PasswordChangedAt: r.PasswordChangedAt,
+		PasswordHistory:   r.PasswordHistory,
+
+		MustChangePassword: r.MustChangePassword,
+
+		Disabled:    r.Disabled,
+		ExpiresAt:   r.ExpiresAt,
+		CreatedAt:   r.CreatedAt,
+		UpdatedAt:   r.UpdatedAt,
+		LastLoginAt: r.LastLoginAt,
+
+		WebAuthnCredentials: r.WebAuthnCredentials,
+	}
+}
+
 type FileUserStore struct {
 	path string
 
@@ -43,11 +144,110 @@ func (s *FileUserStore) GetByUsername(username string) (User, error) {
 	return u, nil
 }
 
+func (s *FileUserStore) GetByID(id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return findUserByID(s.users, id)
+}
+
+func (s *FileUserStore) List() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return sortedUsers(s.users), nil
+}
+
 func (s *FileUserStore) Put(user User) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.users[user.Username] = user
-	return s.persistLocked()
+	prev, existed := s.users[user.Username]
+	s.users[user.Username] = stampUser(user, prev, existed, time.Now())
+	if err := s.persistLocked(); err != nil {
+		if existed {
+			s.users[user.Username] = prev
+		} else {
+			delete(s.users, user.Username)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) Rename(id, newUsername string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := cloneUsers(s.users)
+	if err := renameUser(s.users, id, newUsername); err != nil {
+		return err
+	}
+	if err := s.persistLocked(); err != nil {
+		s.users = prev
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) TouchLastLogin(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := findUserByID(s.users, id)
+	if err != nil {
+		return err
+	}
+	if err := touchLastLogin(s.users, id, at); err != nil {
+		return err
+	}
+	if err := s.persistLocked(); err != nil {
+		s.users[u.Username] = u
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) AdvanceTOTPStep(id string, step int64) (bool, error) {
+	return s.updateIf(id, func(users map[string]User) (bool, error) {
+		return advanceTOTPStep(users, id, step)
+	})
+}
+
+func (s *FileUserStore) TakeRecoveryCode(id, hash string) (bool, error) {
+	return s.updateIf(id, func(users map[string]User) (bool, error) {
+		return takeRecoveryCode(users, id, hash)
+	})
+}
+
+// updateIf applies a conditional change to id and persists it if one was
+// made, restoring the previous record when the write fails.
+func (s *FileUserStore) updateIf(id string, change func(map[string]User) (bool, error)) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := findUserByID(s.users, id)
+	if err != nil {
+		return false, err
+	}
+	changed, err := change(s.users)
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := s.persistLocked(); err != nil {
+		s.users[u.Username] = u
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *FileUserStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, err := findUserByID(s.users, id)
+	if err != nil {
+		return err
+	}
+	delete(s.users, u.Username)
+	if err := s.persistLocked(); err != nil {
+		s.users[u.Username] = u
+		return err
+	}
+	return nil
 }
 
 func (s *FileUserStore) load() error {
@@ -62,23 +262,23 @@ func (s *FileUserStore) load() error {
 		return nil
 	}
 
-	var decoded []User
+	var decoded []fileUserRecord
 	if err := json.Unmarshal(b, &decoded); err != nil {
 		return fmt.Errorf("decode user store file: %w", err)
 	}
-	for _, u := range decoded {
-		if strings.TrimSpace(u.Username) == "" {
+	for _, rec := range decoded {
+		if strings.TrimSpace(rec.Username) == "" {
 			continue
 		}
-		s.users[u.Username] = u
+		s.users[rec.Username] = rec.user()
 	}
 	return nil
 }
 
 func (s *FileUserStore) persistLocked() error {
-	out := make([]User, 0, len(s.users))
-	for _, u := range s.users {
-		out = append(out, u)
+	out := make([]fileUserRecord, 0, len(s.users))
+	for _, u := range sortedUsers(s.users) {
+		out = append(out, newFileUserRecord(u))
 	}
 
 	b, err := json.MarshalIndent(out, "", "  ")
@@ -88,8 +288,16 @@ func (s *FileUserStore) persistLocked() error {
 	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
 		return fmt.Errorf("mkdir user store dir: %w", err)
 	}
-	if err := os.WriteFile(s.path, b, 0o644); err != nil {
+	if err := os.WriteFile(s.path, b, 0o600); err != nil {
 		return fmt.Errorf("write user store file: %w", err)
 	}
 	return nil
 }
+
+func cloneUsers(src map[string]User) map[string]User {
+	out := make(map[string]User, len(src))
+	for k, v := range src {
+		out[k] = v
+	}
+	return out
+}
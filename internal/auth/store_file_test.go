@@ -1,8 +1,10 @@
 package auth
 
 import (
+	"errors"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFileUserStorePersists(t *testing.T) {
@@ -28,4 +30,115 @@ func TestFileUserStorePersists(t *testing.T) {
 	if got.ID != "u-1" {
 		t.Fatalf("expected id u-1, got %q", got.ID)
 	}
+	if got.CreatedAt == nil || got.UpdatedAt == nil {
+		t.Fatalf("expected the store to stamp creation and update times, got %+v", got)
+	}
+}
+
+func TestFileUserStoreKeepsLastLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() error: %v", err)
+	}
+	stale := User{ID: "u-1", Username: "admin", PasswordHash: "h"}
+	_ = store.Put(stale)
+	created, _ := store.GetByID("u-1")
+
+	loginAt := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.TouchLastLogin("u-1", loginAt); err != nil {
+		t.Fatalf("TouchLastLogin() error: %v", err)
+	}
+	stale.Disabled = true
+	if err := store.Put(stale); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+
+	store2, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() second error: %v", err)
+	}
+	got, _ := store2.GetByID("u-1")
+	if !got.Disabled || got.LastLoginAt == nil || !got.LastLoginAt.Equal(loginAt) || !got.CreatedAt.Equal(*created.CreatedAt) {
+		t.Fatalf("unexpected user after reload: %+v", got)
+	}
+	if err := store2.TouchLastLogin("missing", loginAt); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestFileUserStoreConditionalMFAWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() error: %v", err)
+	}
+	_ = store.Put(User{ID: "u-1", Username: "admin", PasswordHash: "h", TOTPLastStep: 10, RecoveryCodeHashes: []string{"r1", "r2"}})
+
+	if ok, err := store.AdvanceTOTPStep("u-1", 10); err != nil || ok {
+		t.Fatalf("AdvanceTOTPStep() to the same step = %v, %v", ok, err)
+	}
+	if ok, err := store.AdvanceTOTPStep("u-1", 11); err != nil || !ok {
+		t.Fatalf("AdvanceTOTPStep() = %v, %v", ok, err)
+	}
+	if ok, err := store.TakeRecoveryCode("u-1", "r1"); err != nil || !ok {
+		t.Fatalf("TakeRecoveryCode() = %v, %v", ok, err)
+	}
+	if ok, err := store.TakeRecoveryCode("u-1", "r1"); err != nil || ok {
+		t.Fatalf("TakeRecoveryCode() reuse = %v, %v", ok, err)
+	}
+	if _, err := store.AdvanceTOTPStep("missing", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	store2, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() second error: %v", err)
+	}
+	got, _ := store2.GetByID("u-1")
+	if got.TOTPLastStep != 11 || len(got.RecoveryCodeHashes) != 1 || got.RecoveryCodeHashes[0] != "r2" {
+		t.Fatalf("unexpected user after reload: %+v", got)
+	}
+}
+
+func TestFileUserStoreRenameDeleteAndPasswordHashPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	store, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() error: %v", err)
+	}
+	_ = store.Put(User{ID: "u-1", Username: "alice", PasswordHash: "h1", Roles: []string{"admin"}})
+	_ = store.Put(User{ID: "u-2", Username: "bob", PasswordHash: "h2"})
+
+	if err := store.Rename("u-1", "bob"); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	if err := store.Rename("u-1", "carol"); err != nil {
+		t.Fatalf("Rename() error: %v", err)
+	}
+	if err := store.Delete("u-2"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if err := store.Delete("u-2"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound on second delete, got %v", err)
+	}
+
+	store2, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStore() second error: %v", err)
+	}
+	users, err := store2.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(users) != 1 || users[0].Username != "carol" {
+		t.Fatalf("unexpected users after reload: %+v", users)
+	}
+	got, err := store2.GetByID("u-1")
+	if err != nil {
+		t.Fatalf("GetByID() error: %v", err)
+	}
+	if got.PasswordHash != "h1" {
+		t.Fatalf("expected password hash to persist, got %q", got.PasswordHash)
+	}
 }
@@ -6,8 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+const userSelectColumns = `id, username, password_hash, roles, mfa_enabled, totp_secret, totp_pending_secret, totp_last_step, recovery_code_hashes, auth_provider, external_subject, email, password_reset_hash, password_reset_expires_at, password_changed_at, password_history, must_change_password, disabled, expires_at, created_at, updated_at, last_login_at, webauthn_credentials`
+
 type PostgresUserStore struct {
 	db *sql.DB
 }
@@ -32,7 +37,24 @@ CREATE TABLE IF NOT EXISTS auth_users (
 	roles JSONB NOT NULL DEFAULT '[]'::jsonb,
 	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
 	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
-)`
+);
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS mfa_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_pending_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS recovery_code_hashes JSONB NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS auth_provider TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS external_subject TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_reset_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_reset_expires_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_history JSONB NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS webauthn_credentials JSONB NOT NULL DEFAULT '[]'::jsonb`
 	if _, err := s.db.Exec(q); err != nil {
 		return fmt.Errorf("ensure auth_users schema: %w", err)
 	}
@@ -44,21 +66,100 @@ func (s *PostgresUserStore) GetByUsername(username string) (User, error) {
 	if username == "" {
 		return User{}, ErrUserNotFound
 	}
+	q := `SELECT ` + userSelectColumns + ` FROM auth_users WHERE username = $1`
+	return s.getOne(q, username)
+}
 
-	var u User
-	var rolesJSON []byte
-	const q = `SELECT id, username, password_hash, roles FROM auth_users WHERE username = $1`
-	if err := s.db.QueryRow(q, username).Scan(&u.ID, &u.Username, &u.PasswordHash, &rolesJSON); err != nil {
+func (s *PostgresUserStore) GetByID(id string) (User, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return User{}, ErrUserNotFound
+	}
+	q := `SELECT ` + userSelectColumns + ` FROM auth_users WHERE id = $1`
+	return s.getOne(q, id)
+}
+
+func (s *PostgresUserStore) getOne(q string, arg string) (User, error) {
+	u, err := scanUser(s.db.QueryRow(q, arg))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, ErrUserNotFound
 		}
 		return User{}, fmt.Errorf("query auth user: %w", err)
 	}
+	return u, nil
+}
+
+func (s *PostgresUserStore) List() ([]User, error) {
+	q := `SELECT ` + userSelectColumns + ` FROM auth_users ORDER BY username ASC`
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, fmt.Errorf("query auth users: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]User, 0)
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan auth user: %w", err)
+		}
+		out = append(out, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate auth users: %w", err)
+	}
+	return out, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var rolesJSON, recoveryJSON, historyJSON, webauthnJSON []byte
+	var resetExpiresAt, passwordChangedAt, expiresAt, lastLoginAt sql.NullTime
+	var createdAt, updatedAt time.Time
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &rolesJSON, &u.MFAEnabled, &u.TOTPSecret, &u.TOTPPendingSecret, &u.TOTPLastStep, &recoveryJSON, &u.AuthProvider, &u.ExternalSubject,
+		&u.Email, &u.PasswordResetHash, &resetExpiresAt, &passwordChangedAt, &historyJSON, &u.MustChangePassword,
+		&u.Disabled, &expiresAt, &createdAt, &updatedAt, &lastLoginAt, &webauthnJSON); err != nil {
+		return User{}, err
+	}
+	u.CreatedAt = &createdAt
+	u.UpdatedAt = &updatedAt
+	if expiresAt.Valid {
+		u.ExpiresAt = &expiresAt.Time
+	}
+	if lastLoginAt.Valid {
+		u.LastLoginAt = &lastLoginAt.Time
+	}
+	if resetExpiresAt.Valid {
+		u.PasswordResetExpiresAt = &resetExpiresAt.Time
+	}
+	if passwordChangedAt.Valid {
+		u.PasswordChangedAt = &passwordChangedAt.Time
+	}
 	if len(rolesJSON) > 0 {
 		if err := json.Unmarshal(rolesJSON, &u.Roles); err != nil {
 			return User{}, fmt.Errorf("decode roles: %w", err)
 		}
 	}
+	if len(recoveryJSON) > 0 {
+		if err := json.Unmarshal(recoveryJSON, &u.RecoveryCodeHashes); err != nil {
+			return User{}, fmt.Errorf("decode recovery codes: %w", err)
+		}
+	}
+	if len(historyJSON) > 0 {
+		if err := json.Unmarshal(historyJSON, &u.PasswordHistory); err != nil {
+			return User{}, fmt.Errorf("decode password history: %w", err)
+		}
+	}
+	if len(webauthnJSON) > 0 {
+		if err := json.Unmarshal(webauthnJSON, &u.WebAuthnCredentials); err != nil {
+			return User{}, fmt.Errorf("decode webauthn credentials: %w", err)
+		}
+	}
 	return u, nil
 }
 
@@ -72,17 +173,151 @@ func (s *PostgresUserStore) Put(user User) error {
 	if err != nil {
 		return fmt.Errorf("encode roles: %w", err)
 	}
+	recoveryCodes := user.RecoveryCodeHashes
+	if recoveryCodes == nil {
+		recoveryCodes = []string{}
+	}
+	recoveryJSON, err := json.Marshal(recoveryCodes)
+	if err != nil {
+		return fmt.Errorf("encode recovery codes: %w", err)
+	}
+	history := user.PasswordHistory
+	if history == nil {
+		history = []string{}
+	}
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("encode password history: %w", err)
+	}
+	webauthnCreds := user.WebAuthnCredentials
+	if webauthnCreds == nil {
+		webauthnCreds = []WebAuthnCredential{}
+	}
+	webauthnJSON, err := json.Marshal(webauthnCreds)
+	if err != nil {
+		return fmt.Errorf("encode webauthn credentials: %w", err)
+	}
 
 	const q = `
-INSERT INTO auth_users (id, username, password_hash, roles, updated_at)
-VALUES ($1, $2, $3, $4, NOW())
+INSERT INTO auth_users (id, username, password_hash, roles, mfa_enabled, totp_secret, totp_pending_secret, totp_last_step, recovery_code_hashes, auth_provider, external_subject, email, password_reset_hash, password_reset_expires_at, password_changed_at, password_history, must_change_password, disabled, expires_at, created_at, updated_at, webauthn_credentials)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, COALESCE($20, NOW()), NOW(), $21)
 ON CONFLICT (username) DO UPDATE
 SET id = EXCLUDED.id,
 	password_hash = EXCLUDED.password_hash,
 	roles = EXCLUDED.roles,
+	mfa_enabled = EXCLUDED.mfa_enabled,
+	totp_secret = EXCLUDED.totp_secret,
+	totp_pending_secret = EXCLUDED.totp_pending_secret,
+	totp_last_step = EXCLUDED.totp_last_step,
+	recovery_code_hashes = EXCLUDED.recovery_code_hashes,
+	auth_provider = EXCLUDED.auth_provider,
+	external_subject = EXCLUDED.external_subject,
+	email = EXCLUDED.email,
+	password_reset_hash = EXCLUDED.password_reset_hash,
+	password_reset_expires_at = EXCLUDED.password_reset_expires_at,
+	password_changed_at = EXCLUDED.password_changed_at,
+	password_history = EXCLUDED.password_history,
+	must_change_password = EXCLUDED.must_change_password,
+	disabled = EXCLUDED.disabled,
+	expires_at = EXCLUDED.expires_at,
+	webauthn_credentials = EXCLUDED.webauthn_credentials,
 	updated_at = NOW()`
-	if _, err := s.db.Exec(q, user.ID, user.Username, user.PasswordHash, rolesJSON); err != nil {
+	if _, err := s.db.Exec(q, user.ID, user.Username, user.PasswordHash, rolesJSON, user.MFAEnabled, user.TOTPSecret, user.TOTPPendingSecret, user.TOTPLastStep, recoveryJSON, user.AuthProvider, user.ExternalSubject,
+		user.Email, user.PasswordResetHash, nullTime(user.PasswordResetExpiresAt),
+		nullTime(user.PasswordChangedAt), historyJSON, user.MustChangePassword,
+		user.Disabled, nullTime(user.ExpiresAt), nullTime(user.CreatedAt), webauthnJSON); err != nil {
 		return fmt.Errorf("upsert auth user: %w", err)
 	}
 	return nil
 }
+
+func (s *PostgresUserStore) Rename(id, newUsername string) error {
+	newUsername = strings.TrimSpace(newUsername)
+	if id == "" || newUsername == "" {
+		return fmt.Errorf("id and username are required")
+	}
+	const q = `UPDATE auth_users SET username = $2, updated_at = NOW() WHERE id = $1`
+	res, err := s.db.Exec(q, id, newUsername)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrUsernameTaken
+		}
+		return fmt.Errorf("rename auth user: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("read rename affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresUserStore) TouchLastLogin(id string, at time.Time) error {
+	res, err := s.db.Exec(`UPDATE auth_users SET last_login_at = $2 WHERE id = $1`, id, at)
+	if err != nil {
+		return fmt.Errorf("record auth user login: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("read login affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *PostgresUserStore) AdvanceTOTPStep(id string, step int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE auth_users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2`, id, step)
+	if err != nil {
+		return false, fmt.Errorf("advance totp step: %w", err)
+	}
+	return s.conditionalUpdate(res, id)
+}
+
+func (s *PostgresUserStore) TakeRecoveryCode(id, hash string) (bool, error) {
+	res, err := s.db.Exec(`UPDATE auth_users SET recovery_code_hashes = recovery_code_hashes - $2::text WHERE id = $1 AND recovery_code_hashes ? $2::text`, id, hash)
+	if err != nil {
+		return false, fmt.Errorf("take recovery code: %w", err)
+	}
+	return s.conditionalUpdate(res, id)
+}
+
+// conditionalUpdate reports whether a guarded UPDATE of id matched, telling
+// a failed condition apart from a missing user.
+func (s *PostgresUserStore) conditionalUpdate(res sql.Result, id string) (bool, error) {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("read affected rows: %w", err)
+	}
+	if affected > 0 {
+		return true, nil
+	}
+	if _, err := s.GetByID(id); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (s *PostgresUserStore) Delete(id string) error {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return ErrUserNotFound
+	}
+	const q = `DELETE FROM auth_users WHERE id = $1`
+	res, err := s.db.Exec(q, id)
+	if err != nil {
+		return fmt.Errorf("delete auth user: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("read delete affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
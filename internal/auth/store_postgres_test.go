@@ -2,7 +2,9 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 )
@@ -38,7 +40,7 @@ func TestPostgresUserStoreGetByUsernameNotFound(t *testing.T) {
 		t.Fatalf("NewPostgresUserStore() error: %v", err)
 	}
 
-	mock.ExpectQuery("SELECT id, username, password_hash, roles FROM auth_users WHERE username = \\$1").
+	mock.ExpectQuery("SELECT id, username, password_hash, roles, .* FROM auth_users WHERE username = \\$1").
 		WithArgs("missing").
 		WillReturnError(sql.ErrNoRows)
 
@@ -65,7 +67,7 @@ func TestPostgresUserStorePut(t *testing.T) {
 	}
 
 	mock.ExpectExec("INSERT INTO auth_users").
-		WithArgs("u1", "admin", "hash", []byte(`["admin"]`)).
+		WithArgs("u1", "admin", "hash", []byte(`["admin"]`), false, "", "", int64(0), []byte(`[]`), "", "", "", "", nil, nil, []byte(`[]`), false, false, nil, nil, []byte(`[]`)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
 	if err := store.Put(User{
@@ -80,3 +82,108 @@ func TestPostgresUserStorePut(t *testing.T) {
 		t.Fatalf("expectations not met: %v", err)
 	}
 }
+
+func TestPostgresUserStoreGetByIDAndList(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_users").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresUserStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresUserStore() error: %v", err)
+	}
+
+	mock.ExpectQuery("SELECT id, username, password_hash, roles, .* FROM auth_users WHERE id = \\$1").
+		WithArgs("u1").
+		WillReturnRows(userRows().
+			AddRow("u1", "admin", "hash", []byte(`["admin"]`), true, "SECRET", "", int64(7), []byte(`["h1"]`), "", "", "admin@example.com", "", nil, time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), []byte(`["old"]`), true,
+				true, time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC),
+				[]byte(`[{"id":"Y3JlZA","name":"yubikey","public_key":"pQECAyYgAQ==","sign_count":4,"created_at":"2026-01-02T00:00:00Z"}]`)))
+	u, err := store.GetByID("u1")
+	if err != nil {
+		t.Fatalf("GetByID() error: %v", err)
+	}
+	if u.Username != "admin" || len(u.Roles) != 1 || !u.MFAEnabled || u.TOTPLastStep != 7 || len(u.RecoveryCodeHashes) != 1 || u.Email != "admin@example.com" ||
+		u.PasswordChangedAt == nil || len(u.PasswordHistory) != 1 || !u.MustChangePassword ||
+		!u.Disabled || u.ExpiresAt == nil || u.CreatedAt == nil || u.CreatedAt.Year() != 2025 || u.UpdatedAt == nil || u.LastLoginAt == nil ||
+		len(u.WebAuthnCredentials) != 1 || u.WebAuthnCredentials[0].SignCount != 4 || len(u.WebAuthnCredentials[0].PublicKey) == 0 {
+		t.Fatalf("unexpected user: %+v", u)
+	}
+
+	mock.ExpectQuery("SELECT id, username, password_hash, roles, .* FROM auth_users ORDER BY username").
+		WillReturnRows(userRows().
+			AddRow("u1", "admin", "hash", []byte(`["admin"]`), false, "", "", int64(0), []byte(`[]`), "", "", "", "", nil, nil, []byte(`[]`), false, false, nil, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), nil, []byte(`[]`)).
+			AddRow("u2", "ops", "hash2", []byte(`[]`), false, "", "", int64(0), []byte(`[]`), "", "", "", "", nil, nil, []byte(`[]`), false, false, nil, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), nil, []byte(`[]`)))
+	users, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(users))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
+
+func TestPostgresUserStoreRenameAndDelete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("sqlmock.New() error: %v", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS auth_users").WillReturnResult(sqlmock.NewResult(0, 0))
+	store, err := NewPostgresUserStore(db)
+	if err != nil {
+		t.Fatalf("NewPostgresUserStore() error: %v", err)
+	}
+
+	mock.ExpectExec("UPDATE auth_users SET username").
+		WithArgs("u1", "renamed").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.Rename("u1", "renamed"); err != nil {
+		t.Fatalf("Rename() error: %v", err)
+	}
+
+	loginAt := time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("UPDATE auth_users SET last_login_at = \\$2 WHERE id = \\$1").
+		WithArgs("u1", loginAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := store.TouchLastLogin("u1", loginAt); err != nil {
+		t.Fatalf("TouchLastLogin() error: %v", err)
+	}
+
+	mock.ExpectExec("UPDATE auth_users SET totp_last_step = \\$2 WHERE id = \\$1 AND totp_last_step < \\$2").
+		WithArgs("u1", int64(42)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if ok, err := store.AdvanceTOTPStep("u1", 42); err != nil || !ok {
+		t.Fatalf("AdvanceTOTPStep() = %v, %v", ok, err)
+	}
+	mock.ExpectExec("UPDATE auth_users SET recovery_code_hashes = recovery_code_hashes - \\$2::text WHERE id = \\$1 AND recovery_code_hashes \\? \\$2::text").
+		WithArgs("u1", "r1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT .* FROM auth_users WHERE id = \\$1").
+		WithArgs("u1").
+		WillReturnError(sql.ErrNoRows)
+	if _, err := store.TakeRecoveryCode("u1", "r1"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	mock.ExpectExec("DELETE FROM auth_users WHERE id = \\$1").
+		WithArgs("missing").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := store.Delete("missing"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("expectations not met: %v", err)
+	}
+}
+
+func userRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "username", "password_hash", "roles", "mfa_enabled", "totp_secret", "totp_pending_secret", "totp_last_step", "recovery_code_hashes", "auth_provider", "external_subject", "email", "password_reset_hash", "password_reset_expires_at", "password_changed_at", "password_history", "must_change_password", "disabled", "expires_at", "created_at", "updated_at", "last_login_at", "webauthn_credentials"})
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238Vectors(t *testing.T) {
+	// RFC 6238 Appendix B SHA-1 seed, truncated to the 6 digits we issue.
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		got, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode() error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("at %d expected %s, got %s", unix, want, got)
+		}
+	}
+}
+
+func TestVerifyTOTPSkewAndReplay(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatalf("generateTOTPSecret() error: %v", err)
+	}
+	now := time.Date(2026, 2, 16, 12, 0, 0, 0, time.UTC)
+	prev, _ := totpCode(secret, totpStep(now)-1)
+
+	step, ok := verifyTOTP(secret, prev, now, 0)
+	if !ok || step != totpStep(now)-1 {
+		t.Fatalf("expected previous-step code to verify within skew")
+	}
+	if _, ok := verifyTOTP(secret, prev, now, step); ok {
+		t.Fatalf("expected replayed code to be rejected")
+	}
+	old, _ := totpCode(secret, totpStep(now)-3)
+	if _, ok := verifyTOTP(secret, old, now, 0); ok {
+		t.Fatalf("expected code outside skew window to be rejected")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("modern-mcs", "alice", "ABC")
+	if !strings.HasPrefix(uri, "otpauth://totp/modern-mcs:alice?") || !strings.Contains(uri, "secret=ABC") {
+		t.Fatalf("unexpected otpauth uri: %s", uri)
+	}
+}
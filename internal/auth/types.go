@@ -7,23 +7,107 @@ type User struct {
 	Username     string   `json:"username"`
 	PasswordHash string   `json:"-"`
 	Roles        []string `json:"roles"`
+	Email        string   `json:"email,omitempty"`
+
+	// PasswordChangedAt is nil for accounts created before it was tracked.
+	// PasswordHistory holds earlier hashes, newest first, for reuse checks.
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+	PasswordHistory   []string   `json:"-"`
+	// MustChangePassword restricts the user's sessions to changing the
+	// password until they do, as for an expired password.
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+
+	// Disabled accounts cannot sign in, and neither can accounts past
+	// ExpiresAt when it is set.
+	Disabled  bool       `json:"disabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by the store and are nil for
+	// file store accounts that predate them. Signing in does not count as
+	// an update.
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+
+	MFAEnabled         bool     `json:"mfa_enabled"`
+	TOTPSecret         string   `json:"-"`
+	TOTPPendingSecret  string   `json:"-"`
+	TOTPLastStep       int64    `json:"-"`
+	RecoveryCodeHashes []string `json:"-"`
+	// WebAuthnCredentials are the user's passkeys and security keys. Having
+	// one makes it a second factor for password logins.
+	WebAuthnCredentials []WebAuthnCredential `json:"-"`
+
+	// PasswordResetHash is the keyed hash of the single outstanding password
+	// reset token, cleared once the token is used.
+	PasswordResetHash      string     `json:"-"`
+	PasswordResetExpiresAt *time.Time `json:"-"`
+
+	// AuthProvider is empty for local accounts. Externally provisioned users
+	// carry the provider name and the subject it identifies them by.
+	AuthProvider    string `json:"auth_provider,omitempty"`
+	ExternalSubject string `json:"-"`
 }
 
 type Session struct {
-	ID        string
-	Token     string
+	ID string
+	// Token is only populated on sessions returned to callers; stored
+	// sessions are keyed by its hash instead.
+	Token     string `json:"-"`
 	UserID    string
 	Username  string
 	Roles     []string
 	CreatedAt time.Time
-	ExpiresAt time.Time
+	// ExpiresAt is the idle deadline. It slides forward with activity but
+	// never past AbsoluteExpiresAt, which refreshing does not extend either.
+	ExpiresAt         time.Time
+	AbsoluteExpiresAt time.Time
+	LastSeenAt        time.Time
+	// FamilyID is shared by a session and every session obtained from it by
+	// refreshing, so that reuse of a rotated refresh token can revoke them all.
+	FamilyID     string     `json:",omitempty"`
+	RefreshToken string     `json:"-"`
+	RefreshHash  string     `json:",omitempty"`
+	RotatedAt    *time.Time `json:",omitempty"`
+	// APITokenID is set when the session was derived from an API token
+	// rather than issued by Login.
+	APITokenID string `json:",omitempty"`
+	// ClientIP and UserAgent describe the client that signed in or last
+	// refreshed the session.
+	ClientIP  string `json:",omitempty"`
+	UserAgent string `json:",omitempty"`
+	// PasswordChangeRequired limits the session to changing the password,
+	// because it has expired or the user is flagged MustChangePassword.
+	PasswordChangeRequired bool `json:",omitempty"`
+	// ImpersonatorID and ImpersonatorUsername name the admin acting as the
+	// user through an impersonation session.
+	ImpersonatorID       string `json:",omitempty"`
+	ImpersonatorUsername string `json:",omitempty"`
+	// ClientCertificate is the SHA-256 fingerprint of the client
+	// certificate the session was derived from.
+	ClientCertificate string `json:",omitempty"`
 }
 
 type SessionView struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Username  string    `json:"username"`
-	Roles     []string  `json:"roles"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiresAt time.Time `json:"expires_at"`
+	ID                string    `json:"id"`
+	UserID            string    `json:"user_id"`
+	Username          string    `json:"username"`
+	Roles             []string  `json:"roles"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastSeenAt        time.Time `json:"last_seen_at"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	AbsoluteExpiresAt time.Time `json:"absolute_expires_at"`
+	ClientIP          string    `json:"client_ip,omitempty"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	// ImpersonatorID and ImpersonatorUsername are set on impersonation
+	// sessions.
+	ImpersonatorID       string `json:"impersonator_id,omitempty"`
+	ImpersonatorUsername string `json:"impersonator_username,omitempty"`
+	// Current marks the caller's own session in per-user listings.
+	Current bool `json:"current,omitempty"`
+}
+
+// ClientInfo identifies the client a session is issued to.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
 }
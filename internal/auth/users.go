@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidUserInput = errors.New("invalid user input")
+
+const (
+	maxUsernameLength = 64
+	maxEmailLength    = 254
+)
+
+func (s *Service) ListUsers() ([]User, error) {
+	return s.users.List()
+}
+
+func (s *Service) GetUser(id string) (User, error) {
+	return s.users.GetByID(id)
+}
+
+func (s *Service) CreateUser(username, password, email string, roles []string) (User, error) {
+	username = strings.TrimSpace(username)
+	if err := validateUsername(username); err != nil {
+		return User{}, err
+	}
+	email = strings.TrimSpace(email)
+	if err := validateEmail(email); err != nil {
+		return User{}, err
+	}
+	if err := s.checkNewPassword(User{}, password); err != nil {
+		return User{}, err
+	}
+
+	if _, err := s.users.GetByUsername(username); err == nil {
+		return User{}, ErrUsernameTaken
+	} else if !errors.Is(err, ErrUserNotFound) {
+		return User{}, fmt.Errorf("check existing user: %w", err)
+	}
+
+	id, err := generateToken(16)
+	if err != nil {
+		return User{}, fmt.Errorf("generate user id: %w", err)
+	}
+	now := s.nowFunc()
+	u := User{
+		ID:        id,
+		Username:  username,
+		Roles:     normalizeRoles(roles),
+		Email:     email,
+		CreatedAt: &now,
+		UpdatedAt: &now,
+	}
+	if err := s.setPassword(&u, password); err != nil {
+		return User{}, err
+	}
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store user: %w", err)
+	}
+	return u, nil
+}
+
+func (s *Service) UpdateUser(id, username, email string, roles []string) (User, error) {
+	username = strings.TrimSpace(username)
+	if err := validateUsername(username); err != nil {
+		return User{}, err
+	}
+	email = strings.TrimSpace(email)
+	if err := validateEmail(email); err != nil {
+		return User{}, err
+	}
+
+	u, err := s.users.GetByID(id)
+	if err != nil {
+		return User{}, err
+	}
+	before := u
+	if u.Username != username {
+		if err := s.users.Rename(u.ID, username); err != nil {
+			return User{}, err
+		}
+		u.Username = username
+	}
+	u.Roles = normalizeRoles(roles)
+	if u.Email != email {
+		// A reset link mailed to the old address must not outlive the change.
+		u.Email = email
+		u.PasswordResetHash = ""
+		u.PasswordResetExpiresAt = nil
+	}
+	now := s.nowFunc()
+	u.UpdatedAt = &now
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store user: %w", err)
+	}
+	if u.Username != before.Username || !slices.Equal(u.Roles, before.Roles) {
+		if err := s.syncUserSessions(u); err != nil {
+			return User{}, fmt.Errorf("update sessions: %w", err)
+		}
+	}
+	return u, nil
+}
+
+// ResetUserPassword sets a new password chosen by an administrator and signs
+// the user out everywhere.
+func (s *Service) ResetUserPassword(id, newPassword string) error {
+	if err := s.policy.check(newPassword); err != nil {
+		return err
+	}
+	u, err := s.users.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.checkNewPassword(u, newPassword); err != nil {
+		return err
+	}
+	if err := s.setPassword(&u, newPassword); err != nil {
+		return err
+	}
+	if err := s.users.Put(u); err != nil {
+		return fmt.Errorf("store updated password: %w", err)
+	}
+	return s.RevokeUserSessions(u.ID)
+}
+
+func (s *Service) DeleteUser(id string) error {
+	if err := s.users.Delete(id); err != nil {
+		return err
+	}
+	if err := s.revokeUserAPITokens(id); err != nil {
+		return err
+	}
+	return s.RevokeUserSessions(id)
+}
+
+// RevokeUserSessions drops every session belonging to userID, including the
+// impersonation sessions it started.
+func (s *Service) RevokeUserSessions(userID string) error {
+	_, err := s.revokeUserSessionsExcept(userID, "", "")
+	return err
+}
+
+// revokeUserSessionsExcept drops the sessions of userID other than the one
+// stored under keepKey and the rest of keepFamily, whose rotated records
+// must survive for refresh token reuse detection. It returns how many live
+// sessions were dropped.
+func (s *Service) revokeUserSessionsExcept(userID, keepKey, keepFamily string) (int, error) {
+	deleted, err := s.sessions.DeleteUserSessions(userID, keepKey, keepFamily)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	ids := make([]string, 0, len(deleted))
+	for _, sess := range deleted {
+		ids = append(ids, sess.ID)
+		if sess.RotatedAt == nil {
+			revoked++
+		}
+	}
+	return revoked, s.denyAccessTokens(ids...)
+}
+
+// syncUserSessions copies the username and roles of u into its live sessions,
+// so that a demotion takes effect on the next request rather than at expiry
+// and lookups by session username (e.g. ChangePassword) keep working. It also
+// cuts the sessions short at the account's expiry.
+func (s *Service) syncUserSessions(u User) error {
+	sessions, err := s.sessions.ListByUser(u.ID)
+	if err != nil {
+		return err
+	}
+	for key, sess := range sessions {
+		sess.Username = u.Username
+		sess.Roles = append([]string(nil), u.Roles...)
+		sess.AbsoluteExpiresAt = capToAccountExpiry(u, sess.AbsoluteExpiresAt)
+		sess.ExpiresAt = capToAccountExpiry(u, sess.ExpiresAt)
+		if err := s.sessions.Update(key, sess); err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+		// Signed access tokens carry the old roles; deny them so the
+		// client refreshes.
+		if err := s.denyAccessTokens(sess.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("%w: username is required", ErrInvalidUserInput)
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("%w: username must be at most %d characters", ErrInvalidUserInput, maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%w: username must not contain whitespace", ErrInvalidUserInput)
+		}
+	}
+	return nil
+}
+
+// validateEmail accepts an empty address, meaning the user has none.
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if len(email) > maxEmailLength {
+		return fmt.Errorf("%w: email must be at most %d characters", ErrInvalidUserInput, maxEmailLength)
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%w: email must be a plain address such as user@example.com", ErrInvalidUserInput)
+	}
+	return nil
+}
+
+func normalizeRoles(roles []string) []string {
+	out := make([]string, 0, len(roles))
+	seen := make(map[string]struct{}, len(roles))
+	for _, r := range roles {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if r == "" {
+			continue
+		}
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		out = append(out, r)
+	}
+	return out
+}
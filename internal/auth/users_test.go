@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreateUpdateAndDeleteUser(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+
+	created, err := svc.CreateUser(" alice ", "Password123!x", "", []string{"Admin", "admin", " "})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	if created.Username != "alice" || len(created.Roles) != 1 || created.Roles[0] != "admin" {
+		t.Fatalf("unexpected created user: %+v", created)
+	}
+	if _, err := svc.CreateUser("alice", "Password123!x", "", nil); !errors.Is(err, ErrUsernameTaken) {
+		t.Fatalf("expected ErrUsernameTaken, got %v", err)
+	}
+	if _, err := svc.CreateUser("bob", "weak", "", nil); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("expected ErrWeakPassword, got %v", err)
+	}
+	if _, err := svc.CreateUser("has space", "Password123!x", "", nil); !errors.Is(err, ErrInvalidUserInput) {
+		t.Fatalf("expected ErrInvalidUserInput, got %v", err)
+	}
+	if _, err := svc.CreateUser("carol", "Password123!x", "Carol <carol@example.com>", nil); !errors.Is(err, ErrInvalidUserInput) {
+		t.Fatalf("expected ErrInvalidUserInput for display-name email, got %v", err)
+	}
+
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	updated, err := svc.UpdateUser(created.ID, "alice2", " alice@example.com ", []string{"operator"})
+	if err != nil {
+		t.Fatalf("UpdateUser() error: %v", err)
+	}
+	if updated.Username != "alice2" || updated.Roles[0] != "operator" || updated.Email != "alice@example.com" {
+		t.Fatalf("unexpected updated user: %+v", updated)
+	}
+	if _, err := store.GetByUsername("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected old username to be gone, got %v", err)
+	}
+	sess, err := svc.ValidateToken(session.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken() after rename error: %v", err)
+	}
+	if sess.Username != "alice2" {
+		t.Fatalf("expected session username to follow rename, got %q", sess.Username)
+	}
+
+	if err := svc.DeleteUser(created.ID); err != nil {
+		t.Fatalf("DeleteUser() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected deleted user's session to be revoked, got %v", err)
+	}
+	if _, err := svc.GetUser(created.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestResetUserPassword(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	created, err := svc.CreateUser("ops", "Password123!x", "", nil)
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+
+	session, err := svc.Login("ops", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+
+	if err := svc.ResetUserPassword(created.ID, "short"); !errors.Is(err, ErrWeakPassword) {
+		t.Fatalf("expected ErrWeakPassword, got %v", err)
+	}
+	if err := svc.ResetUserPassword(created.ID, "AnotherPass456?"); err != nil {
+		t.Fatalf("ResetUserPassword() error: %v", err)
+	}
+	if _, err := svc.ValidateToken(session.Token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected admin reset to revoke sessions, got %v", err)
+	}
+	if _, err := svc.Login("ops", "AnotherPass456?", ClientInfo{}); err != nil {
+		t.Fatalf("Login() with reset password error: %v", err)
+	}
+}
+
+func TestRoleChangeUpdatesSessions(t *testing.T) {
+	store := NewInMemoryUserStore()
+	svc, err := NewService(store, ServiceConfig{PasswordPepper: "pepper", SessionTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	created, err := svc.CreateUser("alice", "Password123!x", "", []string{"admin"})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	refreshed, err := svc.Refresh(session.RefreshToken, ClientInfo{})
+	if err != nil {
+		t.Fatalf("Refresh() error: %v", err)
+	}
+
+	if _, err := svc.UpdateUser(created.ID, "alice", "", []string{"viewer"}); err != nil {
+		t.Fatalf("UpdateUser() error: %v", err)
+	}
+	sess, err := svc.ValidateToken(refreshed.Token)
+	if err != nil {
+		t.Fatalf("ValidateToken() error: %v", err)
+	}
+	if len(sess.Roles) != 1 || sess.Roles[0] != "viewer" {
+		t.Fatalf("expected demotion to reach the live session, got %v", sess.Roles)
+	}
+	if sess, err := svc.Refresh(refreshed.RefreshToken, ClientInfo{}); err != nil || sess.Roles[0] != "viewer" {
+		t.Fatalf("Refresh() = %v, %v", sess.Roles, err)
+	}
+}
@@ -0,0 +1,755 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWebAuthnDisabled           = errors.New("webauthn is not configured")
+	ErrInvalidWebAuthnCeremony    = errors.New("invalid or expired webauthn ceremony")
+	ErrInvalidWebAuthnResponse    = errors.New("invalid webauthn response")
+	ErrWebAuthnCredentialExists   = errors.New("webauthn credential already registered")
+	ErrWebAuthnCredentialNotFound = errors.New("webauthn credential not found")
+	ErrTooManyWebAuthnCeremonies  = errors.New("too many pending webauthn ceremonies")
+)
+
+const (
+	webauthnCeremonyTTL = 5 * time.Minute
+	// maxWebAuthnCeremonies bounds the ceremonies pending in the session
+	// store, since logins can be begun without authenticating.
+	maxWebAuthnCeremonies = 10000
+	defaultWebAuthnRPName = "modern-mcs"
+	maxWebAuthnCredIDLen  = 1023
+	maxWebAuthnCredName   = 64
+
+	webauthnCeremonyRegister = "register"
+	webauthnCeremonyLogin    = "login"
+	webauthnCeremonyMFA      = "mfa"
+
+	// Authenticator data flags, WebAuthn §6.1.
+	webauthnFlagUserPresent  = 0x01
+	webauthnFlagUserVerified = 0x04
+	webauthnFlagAttestedData = 0x40
+
+	// COSE algorithm identifiers offered to authenticators, most preferred
+	// first.
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// WebAuthnConfig enables passkeys and security keys. RPID is the relying
+// party ID, normally the host name users browse to; Origins lists the exact
+// origins (scheme://host[:port]) the browser may report, and defaults to
+// https://RPID.
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// WebAuthnCredential is a registered passkey or security key. PublicKey is
+// the COSE key the authenticator returned at registration.
+type WebAuthnCredential struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	PublicKey  []byte     `json:"public_key"`
+	SignCount  uint32     `json:"sign_count"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnCreationOptions and WebAuthnRequestOptions are the JSON forms of
+// PublicKeyCredentialCreationOptions and PublicKeyCredentialRequestOptions,
+// with binary values base64url-encoded, as accepted by
+// PublicKeyCredential.parseCreationOptionsFromJSON and
+// parseRequestOptionsFromJSON in the browser.
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     webauthnRP                     `json:"rp"`
+	User                   webauthnUser                   `json:"user"`
+	PubKeyCredParams       []webauthnCredParam            `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	Attestation            string                         `json:"attestation"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection webauthnAuthenticatorSelection `json:"authenticatorSelection"`
+}
+
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type webauthnRP struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type webauthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type webauthnCredParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webauthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnCredentialResponse is the JSON form of the PublicKeyCredential the
+// browser returns (PublicKeyCredential.toJSON). Registration responses carry
+// an attestation object; assertions carry authenticator data, a signature and
+// for discoverable credentials the user handle.
+type WebAuthnCredentialResponse struct {
+	ID       string                        `json:"id"`
+	RawID    string                        `json:"rawId"`
+	Type     string                        `json:"type"`
+	Response WebAuthnAuthenticatorResponse `json:"response"`
+}
+
+type WebAuthnAuthenticatorResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// WebAuthnCeremony is an issued challenge waiting for the authenticator's
+// response. userID is empty for usernameless logins.
+type WebAuthnCeremony struct {
+	kind   string
+	userID string
+	// mfaTokenHash ties an MFA ceremony to its challenge.
+	mfaTokenHash string
+	expiresAt    time.Time
+}
+
+// webauthnRelyingParty holds the relying party settings. In-flight
+// ceremonies live in the session store, keyed by challenge hash.
+type webauthnRelyingParty struct {
+	cfg      WebAuthnConfig
+	rpIDHash [32]byte
+}
+
+func newWebAuthnRelyingParty(cfg WebAuthnConfig) (*webauthnRelyingParty, error) {
+	cfg.RPID = strings.ToLower(strings.TrimSpace(cfg.RPID))
+	if cfg.RPID == "" {
+		return nil, fmt.Errorf("webauthn relying party id is required")
+	}
+	if strings.TrimSpace(cfg.RPName) == "" {
+		cfg.RPName = defaultWebAuthnRPName
+	}
+	origins := make([]string, 0, len(cfg.Origins))
+	for _, o := range cfg.Origins {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	if len(origins) == 0 {
+		origins = []string{"https://" + cfg.RPID}
+	}
+	cfg.Origins = origins
+	return &webauthnRelyingParty{
+		cfg:      cfg,
+		rpIDHash: sha256.Sum256([]byte(cfg.RPID)),
+	}, nil
+}
+
+func (s *Service) WebAuthnEnabled() bool {
+	return s.webauthn != nil
+}
+
+// BeginWebAuthnRegistration issues the options for registering a new
+// credential for the session's user. Attestation is not requested, so any
+// authenticator is accepted and the key is trusted on first use.
+func (s *Service) BeginWebAuthnRegistration(token string) (WebAuthnCreationOptions, error) {
+	if s.webauthn == nil {
+		return WebAuthnCreationOptions{}, ErrWebAuthnDisabled
+	}
+	session, err := s.loginSession(token)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, ErrInvalidToken
+	}
+	challenge, err := s.newWebAuthnCeremony(WebAuthnCeremony{kind: webauthnCeremonyRegister, userID: u.ID})
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+	return WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        webauthnRP{ID: s.webauthn.cfg.RPID, Name: s.webauthn.cfg.RPName},
+		User: webauthnUser{
+			ID:          webauthnUserHandle(u.ID),
+			Name:        u.Username,
+			DisplayName: u.Username,
+		},
+		PubKeyCredParams: []webauthnCredParam{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            webauthnCeremonyTTL.Milliseconds(),
+		Attestation:        "none",
+		ExcludeCredentials: webauthnDescriptors(u.WebAuthnCredentials),
+		AuthenticatorSelection: webauthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+	}, nil
+}
+
+// FinishWebAuthnRegistration verifies the authenticator's response to
+// BeginWebAuthnRegistration and stores the new credential under name.
+func (s *Service) FinishWebAuthnRegistration(token, name string, resp WebAuthnCredentialResponse) (WebAuthnCredential, error) {
+	if s.webauthn == nil {
+		return WebAuthnCredential{}, ErrWebAuthnDisabled
+	}
+	session, err := s.loginSession(token)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	_, clientData, err := s.webauthn.parseClientData(resp.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if _, err := s.takeWebAuthnCeremony(clientData.Challenge, webauthnCeremonyRegister, session.UserID); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	attObj, err := decodeWebAuthnBase64(resp.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("%w: attestation object: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	authData, err := parseNoneAttestation(attObj)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	parsed, err := s.webauthn.parseAuthenticatorData(authData, false)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if parsed.credentialID == nil {
+		return WebAuthnCredential{}, fmt.Errorf("%w: no attested credential data", ErrInvalidWebAuthnResponse)
+	}
+	credID := base64.RawURLEncoding.EncodeToString(parsed.credentialID)
+	if rawID, err := decodeWebAuthnBase64(resp.RawID); err != nil || !bytes.Equal(rawID, parsed.credentialID) {
+		return WebAuthnCredential{}, fmt.Errorf("%w: credential id mismatch", ErrInvalidWebAuthnResponse)
+	}
+
+	users, err := s.users.List()
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("list users: %w", err)
+	}
+	for _, other := range users {
+		for _, c := range other.WebAuthnCredentials {
+			if c.ID == credID {
+				return WebAuthnCredential{}, ErrWebAuthnCredentialExists
+			}
+		}
+	}
+
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return WebAuthnCredential{}, ErrInvalidToken
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "passkey"
+	}
+	if len(name) > maxWebAuthnCredName {
+		name = name[:maxWebAuthnCredName]
+	}
+	cred := WebAuthnCredential{
+		ID:        credID,
+		Name:      name,
+		PublicKey: parsed.publicKey,
+		SignCount: parsed.signCount,
+		CreatedAt: s.nowFunc(),
+	}
+	u.WebAuthnCredentials = append(u.WebAuthnCredentials, cred)
+	if err := s.users.Put(u); err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("store webauthn credential: %w", err)
+	}
+	return cred, nil
+}
+
+// ListWebAuthnCredentials returns the credentials registered by the
+// session's user.
+func (s *Service) ListWebAuthnCredentials(token string) ([]WebAuthnCredential, error) {
+	session, err := s.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	out := append([]WebAuthnCredential{}, u.WebAuthnCredentials...)
+	return out, nil
+}
+
+// DeleteWebAuthnCredential removes one of the session user's credentials.
+// Like registration, it needs a login session.
+func (s *Service) DeleteWebAuthnCredential(token, credentialID string) error {
+	session, err := s.loginSession(token)
+	if err != nil {
+		return err
+	}
+	u, err := s.users.GetByID(session.UserID)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	i := slices.IndexFunc(u.WebAuthnCredentials, func(c WebAuthnCredential) bool { return c.ID == credentialID })
+	if i < 0 {
+		return ErrWebAuthnCredentialNotFound
+	}
+	u.WebAuthnCredentials = slices.Delete(slices.Clone(u.WebAuthnCredentials), i, i+1)
+	if err := s.users.Put(u); err != nil {
+		return fmt.Errorf("store webauthn credentials: %w", err)
+	}
+	return nil
+}
+
+// BeginWebAuthnLogin issues the options for a passwordless login. With a
+// username the user's credentials are listed; without one the authenticator
+// offers its discoverable credentials. The listed credential IDs reveal
+// whether a username has credentials, so callers should rate-limit it.
+func (s *Service) BeginWebAuthnLogin(username string) (WebAuthnRequestOptions, error) {
+	if s.webauthn == nil {
+		return WebAuthnRequestOptions{}, ErrWebAuthnDisabled
+	}
+	ceremony := WebAuthnCeremony{kind: webauthnCeremonyLogin}
+	var allow []WebAuthnCredentialDescriptor
+	if username = strings.TrimSpace(username); username != "" {
+		if u, err := s.users.GetByUsername(username); err == nil {
+			ceremony.userID = u.ID
+			allow = webauthnDescriptors(u.WebAuthnCredentials)
+		} else if !errors.Is(err, ErrUserNotFound) {
+			return WebAuthnRequestOptions{}, err
+		}
+	}
+	challenge, err := s.newWebAuthnCeremony(ceremony)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	return s.webauthnRequestOptions(challenge, allow, "required"), nil
+}
+
+// FinishWebAuthnLogin verifies an assertion for BeginWebAuthnLogin and
+// issues a session. The authenticator must have verified the user (PIN or
+// biometric), so no further factor is asked for.
+func (s *Service) FinishWebAuthnLogin(resp WebAuthnCredentialResponse, client ClientInfo) (Session, error) {
+	if s.webauthn == nil {
+		return Session{}, ErrWebAuthnDisabled
+	}
+	clientDataJSON, clientData, err := s.webauthn.parseClientData(resp.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return Session{}, err
+	}
+	ceremony, err := s.takeWebAuthnCeremony(clientData.Challenge, webauthnCeremonyLogin, "")
+	if err != nil {
+		return Session{}, err
+	}
+	userID := ceremony.userID
+	if resp.Response.UserHandle != "" {
+		handle, err := decodeWebAuthnBase64(resp.Response.UserHandle)
+		if err != nil || (userID != "" && string(handle) != userID) {
+			return Session{}, fmt.Errorf("%w: user handle mismatch", ErrInvalidWebAuthnResponse)
+		}
+		userID = string(handle)
+	}
+	if userID == "" {
+		return Session{}, fmt.Errorf("%w: missing user handle", ErrInvalidWebAuthnResponse)
+	}
+	u, err := s.users.GetByID(userID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return Session{}, ErrWebAuthnCredentialNotFound
+		}
+		return Session{}, err
+	}
+	u, err = s.verifyWebAuthnAssertion(u, resp, clientDataJSON, true)
+	if err != nil {
+		return Session{}, err
+	}
+	return s.issueSession(u, client)
+}
+
+// BeginWebAuthnMFA issues assertion options for a user who passed the
+// password check and holds registered credentials, as an alternative to a
+// TOTP code.
+func (s *Service) BeginWebAuthnMFA(mfaToken string) (WebAuthnRequestOptions, error) {
+	if s.webauthn == nil {
+		return WebAuthnRequestOptions{}, ErrWebAuthnDisabled
+	}
+	c, err := s.lookupMFAChallenge(mfaToken)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	u, err := s.users.GetByID(c.UserID)
+	if err != nil {
+		return WebAuthnRequestOptions{}, ErrInvalidMFAChallenge
+	}
+	if len(u.WebAuthnCredentials) == 0 {
+		return WebAuthnRequestOptions{}, ErrWebAuthnCredentialNotFound
+	}
+	challenge, err := s.newWebAuthnCeremony(WebAuthnCeremony{kind: webauthnCeremonyMFA, userID: u.ID, mfaTokenHash: s.hashMFAChallengeToken(mfaToken)})
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	return s.webauthnRequestOptions(challenge, webauthnDescriptors(u.WebAuthnCredentials), "discouraged"), nil
+}
+
+// CompleteWebAuthnMFA verifies an assertion for BeginWebAuthnMFA and issues
+// the session the MFA challenge was holding back.
+func (s *Service) CompleteWebAuthnMFA(mfaToken string, resp WebAuthnCredentialResponse, client ClientInfo) (Session, error) {
+	if s.webauthn == nil {
+		return Session{}, ErrWebAuthnDisabled
+	}
+	c, err := s.lookupMFAChallengeFor(mfaToken, client)
+	if err != nil {
+		return Session{}, err
+	}
+	clientDataJSON, clientData, err := s.webauthn.parseClientData(resp.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		if err := s.recordMFAChallengeFailure(c, client); err != nil {
+			return Session{}, err
+		}
+		return Session{}, err
+	}
+	ceremony, err := s.takeWebAuthnCeremony(clientData.Challenge, webauthnCeremonyMFA, c.UserID)
+	if err != nil || ceremony.mfaTokenHash != s.hashMFAChallengeToken(mfaToken) {
+		if err := s.recordMFAChallengeFailure(c, client); err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrInvalidWebAuthnCeremony
+	}
+	u, err := s.users.GetByID(c.UserID)
+	if err != nil {
+		return Session{}, ErrInvalidMFAChallenge
+	}
+	u, err = s.verifyWebAuthnAssertion(u, resp, clientDataJSON, false)
+	if err != nil {
+		if err := s.recordMFAChallengeFailure(c, client); err != nil {
+			return Session{}, err
+		}
+		return Session{}, err
+	}
+
+	if err := s.takeMFAChallenge(mfaToken); err != nil {
+		return Session{}, err
+	}
+	return s.completeLogin(u, client)
+}
+
+// verifyWebAuthnAssertion checks an assertion by one of u's credentials and
+// stores the credential's new signature counter. A counter that fails to
+// increase suggests a cloned authenticator and is rejected; authenticators
+// that do not keep a counter always report zero.
+func (s *Service) verifyWebAuthnAssertion(u User, resp WebAuthnCredentialResponse, clientDataJSON []byte, requireUV bool) (User, error) {
+	i := slices.IndexFunc(u.WebAuthnCredentials, func(c WebAuthnCredential) bool { return c.ID == strings.TrimRight(resp.ID, "=") })
+	if i < 0 {
+		return User{}, ErrWebAuthnCredentialNotFound
+	}
+	cred := u.WebAuthnCredentials[i]
+
+	authData, err := decodeWebAuthnBase64(resp.Response.AuthenticatorData)
+	if err != nil {
+		return User{}, fmt.Errorf("%w: authenticator data: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	parsed, err := s.webauthn.parseAuthenticatorData(authData, requireUV)
+	if err != nil {
+		return User{}, err
+	}
+	sig, err := decodeWebAuthnBase64(resp.Response.Signature)
+	if err != nil {
+		return User{}, fmt.Errorf("%w: signature: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(cred.PublicKey, signed, sig); err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	if (parsed.signCount != 0 || cred.SignCount != 0) && parsed.signCount <= cred.SignCount {
+		return User{}, fmt.Errorf("%w: signature counter did not increase", ErrInvalidWebAuthnResponse)
+	}
+
+	now := s.nowFunc()
+	creds := slices.Clone(u.WebAuthnCredentials)
+	creds[i].SignCount = parsed.signCount
+	creds[i].LastUsedAt = &now
+	u.WebAuthnCredentials = creds
+	if err := s.users.Put(u); err != nil {
+		return User{}, fmt.Errorf("store webauthn credential: %w", err)
+	}
+	return u, nil
+}
+
+func (s *Service) webauthnRequestOptions(challenge string, allow []WebAuthnCredentialDescriptor, userVerification string) WebAuthnRequestOptions {
+	return WebAuthnRequestOptions{
+		Challenge:        challenge,
+		RPID:             s.webauthn.cfg.RPID,
+		Timeout:          webauthnCeremonyTTL.Milliseconds(),
+		AllowCredentials: allow,
+		UserVerification: userVerification,
+	}
+}
+
+func (s *Service) newWebAuthnCeremony(c WebAuthnCeremony) (string, error) {
+	raw, err := generateSalt(32)
+	if err != nil {
+		return "", fmt.Errorf("generate webauthn challenge: %w", err)
+	}
+	challenge := base64.RawURLEncoding.EncodeToString(raw)
+	now := s.nowFunc()
+	c.expiresAt = now.Add(webauthnCeremonyTTL)
+	s.pruneSessions(now)
+	if err := s.sessions.CreateWebAuthnCeremony(s.hashWebAuthnChallenge(challenge), c, maxWebAuthnCeremonies); err != nil {
+		if errors.Is(err, ErrTooManyWebAuthnCeremonies) {
+			return "", err
+		}
+		return "", fmt.Errorf("store webauthn ceremony: %w", err)
+	}
+	return challenge, nil
+}
+
+// takeWebAuthnCeremony consumes the ceremony for challenge, so that each
+// challenge can be answered once, also across instances. A non-empty userID
+// must match the user the ceremony was issued to.
+func (s *Service) takeWebAuthnCeremony(challenge, kind, userID string) (WebAuthnCeremony, error) {
+	c, err := s.sessions.TakeWebAuthnCeremony(s.hashWebAuthnChallenge(challenge))
+	if err != nil {
+		return WebAuthnCeremony{}, err
+	}
+	if c.kind != kind || s.nowFunc().After(c.expiresAt) {
+		return WebAuthnCeremony{}, ErrInvalidWebAuthnCeremony
+	}
+	if userID != "" && c.userID != userID {
+		return WebAuthnCeremony{}, ErrInvalidWebAuthnCeremony
+	}
+	return c, nil
+}
+
+func (s *Service) hashWebAuthnChallenge(challenge string) string {
+	return s.keyedHash("webauthn-challenge", challenge)
+}
+
+func (rp *webauthnRelyingParty) parseClientData(encoded, wantType string) ([]byte, webauthnClientData, error) {
+	raw, err := decodeWebAuthnBase64(encoded)
+	if err != nil {
+		return nil, webauthnClientData{}, fmt.Errorf("%w: client data: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	var cd webauthnClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, webauthnClientData{}, fmt.Errorf("%w: client data: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	if cd.Type != wantType {
+		return nil, webauthnClientData{}, fmt.Errorf("%w: unexpected client data type %q", ErrInvalidWebAuthnResponse, cd.Type)
+	}
+	if !slices.Contains(rp.cfg.Origins, cd.Origin) {
+		return nil, webauthnClientData{}, fmt.Errorf("%w: origin %q not allowed", ErrInvalidWebAuthnResponse, cd.Origin)
+	}
+	return raw, cd, nil
+}
+
+type webauthnAuthData struct {
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthenticatorData checks the relying party hash and flags of
+// authenticator data (WebAuthn §6.1) and extracts the attested credential
+// when present.
+func (rp *webauthnRelyingParty) parseAuthenticatorData(data []byte, requireUV bool) (webauthnAuthData, error) {
+	if len(data) < 37 {
+		return webauthnAuthData{}, fmt.Errorf("%w: authenticator data too short", ErrInvalidWebAuthnResponse)
+	}
+	if subtle.ConstantTimeCompare(data[:32], rp.rpIDHash[:]) != 1 {
+		return webauthnAuthData{}, fmt.Errorf("%w: relying party id mismatch", ErrInvalidWebAuthnResponse)
+	}
+	flags := data[32]
+	if flags&webauthnFlagUserPresent == 0 {
+		return webauthnAuthData{}, fmt.Errorf("%w: user not present", ErrInvalidWebAuthnResponse)
+	}
+	if requireUV && flags&webauthnFlagUserVerified == 0 {
+		return webauthnAuthData{}, fmt.Errorf("%w: user not verified", ErrInvalidWebAuthnResponse)
+	}
+	out := webauthnAuthData{signCount: binary.BigEndian.Uint32(data[33:37])}
+	if flags&webauthnFlagAttestedData == 0 {
+		return out, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return webauthnAuthData{}, fmt.Errorf("%w: attested credential data too short", ErrInvalidWebAuthnResponse)
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || idLen > maxWebAuthnCredIDLen || idLen > len(rest) {
+		return webauthnAuthData{}, fmt.Errorf("%w: invalid credential id length", ErrInvalidWebAuthnResponse)
+	}
+	out.credentialID = append([]byte(nil), rest[:idLen]...)
+	rest = rest[idLen:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return webauthnAuthData{}, fmt.Errorf("%w: credential public key: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	out.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+	if _, _, err := parseCOSEKey(out.publicKey); err != nil {
+		return webauthnAuthData{}, fmt.Errorf("%w: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	return out, nil
+}
+
+// parseNoneAttestation returns the authenticator data of an attestation
+// object in the "none" format, the only one accepted since no attestation is
+// requested.
+func parseNoneAttestation(attObj []byte) ([]byte, error) {
+	v, rest, err := decodeCBOR(attObj)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %v", ErrInvalidWebAuthnResponse, err)
+	}
+	m, ok := v.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object is not a map", ErrInvalidWebAuthnResponse)
+	}
+	if format, _ := m["fmt"].(string); format != "none" {
+		return nil, fmt.Errorf("%w: unsupported attestation format %q", ErrInvalidWebAuthnResponse, format)
+	}
+	if stmt, ok := m["attStmt"].(map[any]any); !ok || len(stmt) != 0 {
+		return nil, fmt.Errorf("%w: attestation statement must be empty", ErrInvalidWebAuthnResponse)
+	}
+	authData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrInvalidWebAuthnResponse)
+	}
+	return authData, nil
+}
+
+// parseCOSEKey decodes a COSE_Key (RFC 9053) for one of the algorithms
+// offered at registration and returns the key with its algorithm.
+func parseCOSEKey(encoded []byte) (crypto.PublicKey, int64, error) {
+	v, rest, err := decodeCBOR(encoded)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decode cose key: %w", err)
+	}
+	m, ok := v.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, 0, fmt.Errorf("cose key is not a map")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, fmt.Errorf("invalid p-256 cose key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, fmt.Errorf("p-256 cose key is not on the curve")
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, fmt.Errorf("invalid ed25519 cose key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		exp := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, 0, fmt.Errorf("invalid rsa cose key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported cose key type %d with alg %d", kty, alg)
+}
+
+func verifyCOSESignature(coseKey, signed, sig []byte) error {
+	key, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], sig) {
+			return fmt.Errorf("invalid es256 signature")
+		}
+	case coseAlgEdDSA:
+		if !ed25519.Verify(key.(ed25519.PublicKey), signed, sig) {
+			return fmt.Errorf("invalid eddsa signature")
+		}
+	case coseAlgRS256:
+		if err := rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid rs256 signature")
+		}
+	}
+	return nil
+}
+
+func webauthnDescriptors(creds []WebAuthnCredential) []WebAuthnCredentialDescriptor {
+	out := make([]WebAuthnCredentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		out = append(out, WebAuthnCredentialDescriptor{Type: "public-key", ID: c.ID})
+	}
+	return out
+}
+
+// webauthnUserHandle is the user.id given to authenticators, returned as the
+// user handle of discoverable credentials.
+func webauthnUserHandle(userID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(userID))
+}
+
+// decodeWebAuthnBase64 accepts base64url with or without padding, as
+// browsers and client libraries differ.
+func decodeWebAuthnBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,372 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// softAuthenticator plays the part of a browser and authenticator, using
+// an ES256 key or, with eddsa set, an Ed25519 key.
+type softAuthenticator struct {
+	t         *testing.T
+	rpID      string
+	origin    string
+	eddsa     bool
+	ecKey     *ecdsa.PrivateKey
+	edKey     ed25519.PrivateKey
+	credID    []byte
+	signCount uint32
+	userID    string
+}
+
+func newSoftAuthenticator(t *testing.T, eddsa bool) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{t: t, rpID: "mcs.example.com", origin: "https://mcs.example.com", eddsa: eddsa, credID: make([]byte, 16)}
+	_, _ = rand.Read(a.credID)
+	var err error
+	if eddsa {
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.eddsa {
+		return cborMap(cborInt(1), cborInt(1), cborInt(3), cborInt(coseAlgEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(a.edKey.Public().(ed25519.PublicKey)))
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.ecKey.X.FillBytes(x)
+	a.ecKey.Y.FillBytes(y)
+	return cborMap(cborInt(1), cborInt(2), cborInt(3), cborInt(coseAlgES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y))
+}
+
+func (a *softAuthenticator) clientData(typ, challenge string) []byte {
+	raw, _ := json.Marshal(map[string]any{"type": typ, "challenge": challenge, "origin": a.origin, "crossOrigin": false})
+	return raw
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpHash := sha256.Sum256([]byte(a.rpID))
+	out := append(rpHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(out[33:], a.signCount)
+	return append(out, attested...)
+}
+
+func (a *softAuthenticator) register(opts WebAuthnCreationOptions) WebAuthnCredentialResponse {
+	handle, _ := base64.RawURLEncoding.DecodeString(opts.User.ID)
+	a.userID = string(handle)
+	attested := make([]byte, 16, 64)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, a.coseKey()...)
+	authData := a.authData(webauthnFlagUserPresent|webauthnFlagUserVerified|webauthnFlagAttestedData, attested)
+	attObj := cborMap(cborText("fmt"), cborText("none"), cborText("attStmt"), cborMap(), cborText("authData"), cborBytes(authData))
+	id := base64.RawURLEncoding.EncodeToString(a.credID)
+	return WebAuthnCredentialResponse{ID: id, RawID: id, Type: "public-key", Response: WebAuthnAuthenticatorResponse{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(a.clientData("webauthn.create", opts.Challenge)),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attObj),
+	}}
+}
+
+func (a *softAuthenticator) assert(opts WebAuthnRequestOptions) WebAuthnCredentialResponse {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	authData := a.authData(webauthnFlagUserPresent|webauthnFlagUserVerified, nil)
+	hash := sha256.Sum256(clientData)
+	signed := append(append([]byte(nil), authData...), hash[:]...)
+	var sig []byte
+	if a.eddsa {
+		sig = ed25519.Sign(a.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		var err error
+		if sig, err = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:]); err != nil {
+			a.t.Fatalf("sign: %v", err)
+		}
+	}
+	id := base64.RawURLEncoding.EncodeToString(a.credID)
+	return WebAuthnCredentialResponse{ID: id, RawID: id, Type: "public-key", Response: WebAuthnAuthenticatorResponse{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+		UserHandle:        base64.RawURLEncoding.EncodeToString([]byte(a.userID)),
+	}}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 1<<8:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+}
+
+func cborInt(i int64) []byte {
+	if i < 0 {
+		return cborHead(1, uint64(-1-i))
+	}
+	return cborHead(0, uint64(i))
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, uint64(len(b))), b...) }
+func cborText(s string) []byte  { return append(cborHead(3, uint64(len(s))), s...) }
+
+func cborMap(kv ...[]byte) []byte {
+	out := cborHead(5, uint64(len(kv)/2))
+	for _, item := range kv {
+		out = append(out, item...)
+	}
+	return out
+}
+
+func newWebAuthnTestService(t *testing.T) (*Service, User, *time.Time) {
+	t.Helper()
+	svc, err := NewService(NewInMemoryUserStore(), ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		WebAuthn:       &WebAuthnConfig{RPID: "mcs.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	svc.nowFunc = func() time.Time { return now }
+	u, err := svc.CreateUser("alice", "Password123!x", "", []string{AdminRole})
+	if err != nil {
+		t.Fatalf("CreateUser() error: %v", err)
+	}
+	return svc, u, &now
+}
+
+func registerSoftAuthenticator(t *testing.T, svc *Service, a *softAuthenticator) WebAuthnCredential {
+	t.Helper()
+	session, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	if err != nil {
+		t.Fatalf("Login() error: %v", err)
+	}
+	opts, err := svc.BeginWebAuthnRegistration(session.Token)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration() error: %v", err)
+	}
+	if opts.Attestation != "none" || opts.RP.ID != "mcs.example.com" {
+		t.Fatalf("unexpected creation options %+v", opts)
+	}
+	cred, err := svc.FinishWebAuthnRegistration(session.Token, "laptop", a.register(opts))
+	if err != nil {
+		t.Fatalf("FinishWebAuthnRegistration() error: %v", err)
+	}
+	return cred
+}
+
+func TestWebAuthnPasswordlessLogin(t *testing.T) {
+	svc, u, _ := newWebAuthnTestService(t)
+	a := newSoftAuthenticator(t, false)
+	cred := registerSoftAuthenticator(t, svc, a)
+	if cred.Name != "laptop" || cred.ID != base64.RawURLEncoding.EncodeToString(a.credID) {
+		t.Fatalf("unexpected credential %+v", cred)
+	}
+
+	opts, err := svc.BeginWebAuthnLogin("")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin() error: %v", err)
+	}
+	if opts.UserVerification != "required" || len(opts.AllowCredentials) != 0 {
+		t.Fatalf("unexpected request options %+v", opts)
+	}
+	resp := a.assert(opts)
+	session, err := svc.FinishWebAuthnLogin(resp, ClientInfo{})
+	if err != nil || session.UserID != u.ID {
+		t.Fatalf("FinishWebAuthnLogin() = %+v, %v", session, err)
+	}
+	if _, err := svc.FinishWebAuthnLogin(resp, ClientInfo{}); !errors.Is(err, ErrInvalidWebAuthnCeremony) {
+		t.Fatalf("expected a replayed assertion to fail, got %v", err)
+	}
+	stored, _ := svc.GetUser(u.ID)
+	if stored.WebAuthnCredentials[0].SignCount != 1 || stored.WebAuthnCredentials[0].LastUsedAt == nil {
+		t.Fatalf("expected the sign count to be stored, got %+v", stored.WebAuthnCredentials[0])
+	}
+
+	opts, _ = svc.BeginWebAuthnLogin("alice")
+	if len(opts.AllowCredentials) != 1 {
+		t.Fatalf("expected alice's credential to be allowed, got %+v", opts.AllowCredentials)
+	}
+	a.signCount = 0
+	if _, err := svc.FinishWebAuthnLogin(a.assert(opts), ClientInfo{}); !errors.Is(err, ErrInvalidWebAuthnResponse) {
+		t.Fatalf("expected a stale sign count to be rejected, got %v", err)
+	}
+
+	opts, _ = svc.BeginWebAuthnLogin("")
+	a.signCount = 10
+	a.origin = "https://evil.example.com"
+	if _, err := svc.FinishWebAuthnLogin(a.assert(opts), ClientInfo{}); !errors.Is(err, ErrInvalidWebAuthnResponse) {
+		t.Fatalf("expected a foreign origin to be rejected, got %v", err)
+	}
+	a.origin = "https://mcs.example.com"
+
+	opts, _ = svc.BeginWebAuthnLogin("")
+	if _, err := svc.SetUserStatus(u.ID, true, nil); err != nil {
+		t.Fatalf("SetUserStatus() error: %v", err)
+	}
+	if _, err := svc.FinishWebAuthnLogin(a.assert(opts), ClientInfo{}); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+}
+
+func TestWebAuthnSecondFactor(t *testing.T) {
+	svc, u, now := newWebAuthnTestService(t)
+	a := newSoftAuthenticator(t, true)
+	registerSoftAuthenticator(t, svc, a)
+
+	_, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) || !mfaErr.Challenge.WebAuthn || mfaErr.Challenge.EnrollmentRequired {
+		t.Fatalf("expected a webauthn mfa challenge, got %v", err)
+	}
+	mfaToken := mfaErr.Challenge.Token
+
+	// With no TOTP secret, a code computed from an empty key must not pass.
+	code, _ := totpCode("", totpStep(*now))
+	if _, _, err := svc.CompleteMFAChallenge(mfaToken, code, ClientInfo{}); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("expected ErrInvalidMFACode, got %v", err)
+	}
+
+	opts, err := svc.BeginWebAuthnMFA(mfaToken)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnMFA() error: %v", err)
+	}
+	session, err := svc.CompleteWebAuthnMFA(mfaToken, a.assert(opts), ClientInfo{})
+	if err != nil || session.UserID != u.ID {
+		t.Fatalf("CompleteWebAuthnMFA() = %+v, %v", session, err)
+	}
+	if _, err := svc.BeginWebAuthnMFA(mfaToken); !errors.Is(err, ErrInvalidMFAChallenge) {
+		t.Fatalf("expected the mfa challenge to be used up, got %v", err)
+	}
+
+	creds, err := svc.ListWebAuthnCredentials(session.Token)
+	if err != nil || len(creds) != 1 {
+		t.Fatalf("ListWebAuthnCredentials() = %+v, %v", creds, err)
+	}
+	_, apiToken, err := svc.CreateAPIToken(u.ID, "deploy", nil, 0)
+	if err != nil {
+		t.Fatalf("CreateAPIToken() error: %v", err)
+	}
+	if err := svc.DeleteWebAuthnCredential(apiToken, creds[0].ID); !errors.Is(err, ErrLoginSessionRequired) {
+		t.Fatalf("expected ErrLoginSessionRequired for an api token, got %v", err)
+	}
+	if err := svc.DeleteWebAuthnCredential(session.Token, "missing"); !errors.Is(err, ErrWebAuthnCredentialNotFound) {
+		t.Fatalf("expected ErrWebAuthnCredentialNotFound, got %v", err)
+	}
+	if err := svc.DeleteWebAuthnCredential(session.Token, creds[0].ID); err != nil {
+		t.Fatalf("DeleteWebAuthnCredential() error: %v", err)
+	}
+	if _, err := svc.Login("alice", "Password123!x", ClientInfo{}); err != nil {
+		t.Fatalf("expected password login without a second factor, got %v", err)
+	}
+}
+
+func TestWebAuthnCeremoniesSharedAcrossInstancesAndBounded(t *testing.T) {
+	svc, u, now := newWebAuthnTestService(t)
+	other, err := NewService(svc.users, ServiceConfig{
+		PasswordPepper: "pepper",
+		SessionTTL:     time.Hour,
+		SessionStore:   svc.sessions,
+		WebAuthn:       &WebAuthnConfig{RPID: "mcs.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error: %v", err)
+	}
+	other.nowFunc = func() time.Time { return *now }
+	a := newSoftAuthenticator(t, false)
+	registerSoftAuthenticator(t, svc, a)
+
+	opts, err := svc.BeginWebAuthnLogin("alice")
+	if err != nil {
+		t.Fatalf("BeginWebAuthnLogin() error: %v", err)
+	}
+	resp := a.assert(opts)
+	if session, err := other.FinishWebAuthnLogin(resp, ClientInfo{}); err != nil || session.UserID != u.ID {
+		t.Fatalf("FinishWebAuthnLogin() on another instance = %+v, %v", session, err)
+	}
+	if _, err := svc.FinishWebAuthnLogin(resp, ClientInfo{}); !errors.Is(err, ErrInvalidWebAuthnCeremony) {
+		t.Fatalf("expected the ceremony to be used up on every instance, got %v", err)
+	}
+
+	store := NewInMemorySessionStore()
+	c := WebAuthnCeremony{kind: webauthnCeremonyLogin, expiresAt: *now}
+	if err := store.CreateWebAuthnCeremony("c1", c, 1); err != nil {
+		t.Fatalf("CreateWebAuthnCeremony() error: %v", err)
+	}
+	if err := store.CreateWebAuthnCeremony("c2", c, 1); !errors.Is(err, ErrTooManyWebAuthnCeremonies) {
+		t.Fatalf("expected ErrTooManyWebAuthnCeremonies, got %v", err)
+	}
+	_ = store.DeleteExpired(now.Add(time.Second))
+	if err := store.CreateWebAuthnCeremony("c2", c, 1); err != nil {
+		t.Fatalf("expected expired ceremonies to free the cap, got %v", err)
+	}
+}
+
+func TestWebAuthnRejectsDuplicateCredential(t *testing.T) {
+	svc, _, _ := newWebAuthnTestService(t)
+	a := newSoftAuthenticator(t, false)
+	registerSoftAuthenticator(t, svc, a)
+
+	_, err := svc.Login("alice", "Password123!x", ClientInfo{})
+	var mfaErr *MFARequiredError
+	if !errors.As(err, &mfaErr) {
+		t.Fatalf("expected an mfa challenge, got %v", err)
+	}
+	opts, _ := svc.BeginWebAuthnMFA(mfaErr.Challenge.Token)
+	session, err := svc.CompleteWebAuthnMFA(mfaErr.Challenge.Token, a.assert(opts), ClientInfo{})
+	if err != nil {
+		t.Fatalf("CompleteWebAuthnMFA() error: %v", err)
+	}
+	creation, err := svc.BeginWebAuthnRegistration(session.Token)
+	if err != nil {
+		t.Fatalf("BeginWebAuthnRegistration() error: %v", err)
+	}
+	if len(creation.ExcludeCredentials) != 1 {
+		t.Fatalf("expected the existing credential to be excluded, got %+v", creation.ExcludeCredentials)
+	}
+	if _, err := svc.FinishWebAuthnRegistration(session.Token, "again", a.register(creation)); !errors.Is(err, ErrWebAuthnCredentialExists) {
+		t.Fatalf("expected ErrWebAuthnCredentialExists, got %v", err)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	v, rest, err := decodeCBOR(append(cborMap(cborText("a"), cborInt(-300), cborInt(1), cborBytes([]byte{1, 2})), 0xff))
+	if err != nil {
+		t.Fatalf("decodeCBOR() error: %v", err)
+	}
+	m := v.(map[any]any)
+	if m["a"] != int64(-300) || len(m[int64(1)].([]byte)) != 2 || len(rest) != 1 {
+		t.Fatalf("unexpected decode %v rest %v", m, rest)
+	}
+	for _, bad := range [][]byte{
+		{},
+		{0x5f},             // indefinite byte string
+		{0x59, 0xff, 0xff}, // length beyond the input
+		{0xa2, 0x01, 0x01, 0x01, 0x02},
+		{0xc0, 0x01}, // tags are not used by WebAuthn
+	} {
+		if _, _, err := decodeCBOR(bad); !errors.Is(err, errMalformedCBOR) {
+			t.Fatalf("decodeCBOR(%x) expected errMalformedCBOR, got %v", bad, err)
+		}
+	}
+}
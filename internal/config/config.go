@@ -1,9 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +21,20 @@ type Config struct {
 	MigrationsDir       string
 	MigrationStateFile  string
 	AuditLogFile        string
+	SMTP                SMTPConfig
+}
+
+// SMTPConfig is disabled when Host is empty. TLS is "starttls", "tls" or
+// "none".
+type SMTPConfig struct {
+	Host               string
+	Port               int
+	Username           string
+	Password           string
+	From               string
+	TLS                string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
 }
 
 type HTTPConfig struct {
@@ -23,15 +42,177 @@ type HTTPConfig struct {
 	ReadTimeout     time.Duration
 	WriteTimeout    time.Duration
 	ShutdownTimeout time.Duration
+	TLS             TLSConfig
+	// TrustedProxies are the peers whose X-Forwarded-For and X-Real-IP
+	// headers name the client. Requests from anyone else are attributed to
+	// their own address.
+	TrustedProxies []netip.Prefix
+}
+
+// TLSConfig serves HTTPS when CertFile is set. ClientCAFile additionally
+// lets clients authenticate with certificates issued by that CA. Changed
+// files are picked up without a restart.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	// MinVersion is tls.VersionTLS12 or tls.VersionTLS13. CipherSuites
+	// restricts the TLS 1.2 suites; empty keeps Go's secure defaults.
+	MinVersion   uint16
+	CipherSuites []uint16
+	// RedirectAddr, when set, listens for plain HTTP and redirects every
+	// request to HTTPS.
+	RedirectAddr string
+	// HSTSMaxAge sends Strict-Transport-Security on HTTPS responses; zero
+	// disables it.
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
 }
 
 type AuthConfig struct {
-	BootstrapUsername string
-	BootstrapPassword string
-	PasswordPepper    string
-	SessionTTL        time.Duration
-	SessionStateFile  string
-	UserStateFile     string
+	BootstrapUsername  string
+	BootstrapPassword  string
+	PasswordPepper     string
+	PasswordHash       PasswordHashConfig
+	SessionTTL         time.Duration
+	SessionMaxLifetime time.Duration
+	SessionStateFile   string
+	UserStateFile      string
+	MFAIssuer          string
+	MFAPolicyFile      string
+	LoginThrottle      LoginThrottleConfig
+	LoginAttemptFile   string
+	APITokenFile       string
+	RoleFile           string
+	Cookie             SessionCookieConfig
+	PasswordReset      PasswordResetConfig
+	PasswordPolicy     PasswordPolicyConfig
+	OIDC               OIDCConfig
+	LDAP               LDAPConfig
+	WebAuthn           WebAuthnConfig
+	JWT                JWTConfig
+	ClientCert         ClientCertConfig
+
+	// KeepSessionOnPasswordChange keeps the session that changed its own
+	// password; the user's other sessions are signed out either way.
+	KeepSessionOnPasswordChange bool
+
+	// ImpersonationTTL bounds how long an admin may act as another user.
+	ImpersonationTTL time.Duration
+
+	// SCIMToken is the bearer token identity providers use for SCIM
+	// provisioning; SCIM is off when it is empty.
+	SCIMToken string
+
+	// SCIMAllowAdminRole lets SCIM groups grant the admin role.
+	SCIMAllowAdminRole bool
+}
+
+// SessionCookieConfig lets browsers hold the session in an HttpOnly cookie
+// instead of script-readable storage. SameSite is "strict", "lax" or "none".
+type SessionCookieConfig struct {
+	Enabled  bool
+	Secure   bool
+	SameSite string
+	Domain   string
+}
+
+// PasswordResetConfig applies when SMTP is configured. URL is the frontend
+// page that receives the reset token as its "token" query parameter.
+type PasswordResetConfig struct {
+	URL string
+	TTL time.Duration
+}
+
+// PasswordPolicyConfig governs passwords set by users and administrators.
+// MaxAge and History of zero disable expiry and reuse checks.
+// BreachedFile is an optional sorted list of SHA-1 hashes of breached
+// passwords, such as the Pwned Passwords download ordered by hash.
+type PasswordPolicyConfig struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	MaxAge        time.Duration
+	History       int
+	BreachedFile  string
+}
+
+// LDAPConfig is disabled when URL is empty.
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACertFile         string
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	UsernameAttribute  string
+	GroupAttribute     string
+	RoleMap            map[string]string
+	DefaultRoles       []string
+	Timeout            time.Duration
+}
+
+// WebAuthnConfig is disabled when RPID is empty. Origins defaults to
+// https://RPID.
+type WebAuthnConfig struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// JWTConfig makes sessions use signed JWT access tokens that other services
+// can verify against /.well-known/jwks.json. Algorithm is "EdDSA" or
+// "ES256". Instances behind one load balancer must share KeyFile.
+type JWTConfig struct {
+	Enabled     bool
+	Algorithm   string
+	Issuer      string
+	Audience    string
+	TTL         time.Duration
+	KeyRotation time.Duration
+	KeyFile     string
+}
+
+// ClientCertConfig maps client certificates to users when
+// HTTP_TLS_CLIENT_CA_FILE is set. UsernameFrom is "cn", "dns", "uri" or
+// "email"; RoleMap keys match the subject's OUs or the username.
+type ClientCertConfig struct {
+	UsernameFrom string
+	RoleMap      map[string]string
+	DefaultRoles []string
+}
+
+// OIDCConfig is disabled when IssuerURL is empty.
+type OIDCConfig struct {
+	IssuerURL     string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	UsernameClaim string
+	RoleClaim     string
+	RoleMap       map[string]string
+	DefaultRoles  []string
+}
+
+type LoginThrottleConfig struct {
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	IPThreshold      int
+	BackoffAfter     int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	FailureWindow    time.Duration
+}
+
+type PasswordHashConfig struct {
+	MemoryKiB   int
+	Iterations  int
+	Parallelism int
 }
 
 func Load() (Config, error) {
@@ -41,21 +222,126 @@ func Load() (Config, error) {
 			ReadTimeout:     time.Duration(getEnvInt("HTTP_READ_TIMEOUT_SEC", 10)) * time.Second,
 			WriteTimeout:    time.Duration(getEnvInt("HTTP_WRITE_TIMEOUT_SEC", 15)) * time.Second,
 			ShutdownTimeout: time.Duration(getEnvInt("HTTP_SHUTDOWN_TIMEOUT_SEC", 20)) * time.Second,
+			TLS: TLSConfig{
+				CertFile:     getEnv("HTTP_TLS_CERT_FILE", ""),
+				KeyFile:      getEnv("HTTP_TLS_KEY_FILE", ""),
+				ClientCAFile: getEnv("HTTP_TLS_CLIENT_CA_FILE", ""),
+				RedirectAddr: getEnv("HTTP_REDIRECT_ADDR", ""),
+				HSTSMaxAge:   time.Duration(getEnvInt("HTTP_HSTS_MAX_AGE_SEC", 31536000)) * time.Second,
+
+				HSTSIncludeSubdomains: getEnvBool("HTTP_HSTS_INCLUDE_SUBDOMAINS", false),
+			},
 		},
 		DatabaseURL: getEnv("DATABASE_URL", ""),
 		Auth: AuthConfig{
 			BootstrapUsername: getEnv("AUTH_BOOTSTRAP_USERNAME", "admin"),
 			BootstrapPassword: getEnv("AUTH_BOOTSTRAP_PASSWORD", "admin123"),
 			PasswordPepper:    getEnv("AUTH_PASSWORD_PEPPER", "change-me-in-production"),
-			SessionTTL:        time.Duration(getEnvInt("AUTH_SESSION_TTL_SEC", 3600)) * time.Second,
-			SessionStateFile:  getEnv("AUTH_SESSION_STATE_FILE", "./data/auth_sessions.json"),
-			UserStateFile:     getEnv("AUTH_USER_STATE_FILE", "./data/auth_users.json"),
+			PasswordHash: PasswordHashConfig{
+				MemoryKiB:   getEnvInt("AUTH_PASSWORD_HASH_MEMORY_KIB", 19456),
+				Iterations:  getEnvInt("AUTH_PASSWORD_HASH_ITERATIONS", 2),
+				Parallelism: getEnvInt("AUTH_PASSWORD_HASH_PARALLELISM", 1),
+			},
+			SessionTTL:         time.Duration(getEnvInt("AUTH_SESSION_TTL_SEC", 3600)) * time.Second,
+			SessionMaxLifetime: time.Duration(getEnvInt("AUTH_SESSION_MAX_LIFETIME_SEC", 43200)) * time.Second,
+			SessionStateFile:   getEnv("AUTH_SESSION_STATE_FILE", "./data/auth_sessions.json"),
+			UserStateFile:      getEnv("AUTH_USER_STATE_FILE", "./data/auth_users.json"),
+			MFAIssuer:          getEnv("AUTH_MFA_ISSUER", "modern-mcs"),
+			MFAPolicyFile:      getEnv("AUTH_MFA_POLICY_STATE_FILE", "./data/auth_mfa_policy.json"),
+			LoginThrottle: LoginThrottleConfig{
+				LockoutThreshold: getEnvInt("AUTH_LOCKOUT_THRESHOLD", 10),
+				LockoutDuration:  time.Duration(getEnvInt("AUTH_LOCKOUT_DURATION_SEC", 900)) * time.Second,
+				IPThreshold:      getEnvInt("AUTH_LOGIN_IP_THRESHOLD", 50),
+				BackoffAfter:     getEnvInt("AUTH_LOGIN_BACKOFF_AFTER", 3),
+				BackoffBase:      time.Duration(getEnvInt("AUTH_LOGIN_BACKOFF_BASE_SEC", 1)) * time.Second,
+				BackoffMax:       time.Duration(getEnvInt("AUTH_LOGIN_BACKOFF_MAX_SEC", 60)) * time.Second,
+				FailureWindow:    time.Duration(getEnvInt("AUTH_LOGIN_FAILURE_WINDOW_SEC", 900)) * time.Second,
+			},
+			LoginAttemptFile: getEnv("AUTH_LOGIN_ATTEMPT_STATE_FILE", "./data/auth_login_attempts.json"),
+			APITokenFile:     getEnv("AUTH_API_TOKEN_STATE_FILE", "./data/auth_api_tokens.json"),
+			RoleFile:         getEnv("AUTH_ROLE_STATE_FILE", "./data/auth_roles.json"),
+			Cookie: SessionCookieConfig{
+				Enabled:  getEnvBool("AUTH_COOKIE_SESSIONS", false),
+				Secure:   getEnvBool("AUTH_COOKIE_SECURE", true),
+				SameSite: strings.ToLower(getEnv("AUTH_COOKIE_SAMESITE", "strict")),
+				Domain:   getEnv("AUTH_COOKIE_DOMAIN", ""),
+			},
+			PasswordReset: PasswordResetConfig{
+				URL: getEnv("AUTH_PASSWORD_RESET_URL", ""),
+				TTL: time.Duration(getEnvInt("AUTH_PASSWORD_RESET_TTL_SEC", 1800)) * time.Second,
+			},
+			PasswordPolicy: PasswordPolicyConfig{
+				MinLength:     getEnvInt("AUTH_PASSWORD_MIN_LENGTH", 12),
+				RequireUpper:  getEnvBool("AUTH_PASSWORD_REQUIRE_UPPER", true),
+				RequireLower:  getEnvBool("AUTH_PASSWORD_REQUIRE_LOWER", true),
+				RequireDigit:  getEnvBool("AUTH_PASSWORD_REQUIRE_DIGIT", true),
+				RequireSymbol: getEnvBool("AUTH_PASSWORD_REQUIRE_SYMBOL", true),
+				MaxAge:        time.Duration(getEnvInt("AUTH_PASSWORD_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+				History:       getEnvInt("AUTH_PASSWORD_HISTORY", 0),
+				BreachedFile:  getEnv("AUTH_PASSWORD_BREACHED_FILE", ""),
+			},
+			KeepSessionOnPasswordChange: getEnvBool("AUTH_PASSWORD_CHANGE_KEEP_SESSION", true),
+			ImpersonationTTL:            time.Duration(getEnvInt("AUTH_IMPERSONATION_TTL_SEC", 1800)) * time.Second,
+			SCIMToken:                   getEnv("AUTH_SCIM_TOKEN", ""),
+			SCIMAllowAdminRole:          getEnvBool("AUTH_SCIM_ALLOW_ADMIN_ROLE", false),
+			OIDC: OIDCConfig{
+				IssuerURL:     getEnv("AUTH_OIDC_ISSUER_URL", ""),
+				ClientID:      getEnv("AUTH_OIDC_CLIENT_ID", ""),
+				ClientSecret:  getEnv("AUTH_OIDC_CLIENT_SECRET", ""),
+				RedirectURL:   getEnv("AUTH_OIDC_REDIRECT_URL", ""),
+				Scopes:        getEnvList("AUTH_OIDC_SCOPES", "openid,profile,email"),
+				UsernameClaim: getEnv("AUTH_OIDC_USERNAME_CLAIM", "preferred_username"),
+				RoleClaim:     getEnv("AUTH_OIDC_ROLE_CLAIM", "groups"),
+				DefaultRoles:  getEnvList("AUTH_OIDC_DEFAULT_ROLES", ""),
+			},
+			LDAP: LDAPConfig{
+				URL:                getEnv("AUTH_LDAP_URL", ""),
+				StartTLS:           getEnvBool("AUTH_LDAP_START_TLS", false),
+				InsecureSkipVerify: getEnvBool("AUTH_LDAP_INSECURE_SKIP_VERIFY", false),
+				CACertFile:         getEnv("AUTH_LDAP_CA_FILE", ""),
+				BindDN:             getEnv("AUTH_LDAP_BIND_DN", ""),
+				BindPassword:       getEnv("AUTH_LDAP_BIND_PASSWORD", ""),
+				BaseDN:             getEnv("AUTH_LDAP_BASE_DN", ""),
+				UserFilter:         getEnv("AUTH_LDAP_USER_FILTER", "(uid=%s)"),
+				UsernameAttribute:  getEnv("AUTH_LDAP_USERNAME_ATTRIBUTE", "uid"),
+				GroupAttribute:     getEnv("AUTH_LDAP_GROUP_ATTRIBUTE", "memberOf"),
+				DefaultRoles:       getEnvList("AUTH_LDAP_DEFAULT_ROLES", ""),
+				Timeout:            time.Duration(getEnvInt("AUTH_LDAP_TIMEOUT_SEC", 10)) * time.Second,
+			},
+			WebAuthn: WebAuthnConfig{
+				RPID:    getEnv("AUTH_WEBAUTHN_RP_ID", ""),
+				RPName:  getEnv("AUTH_WEBAUTHN_RP_NAME", "modern-mcs"),
+				Origins: getEnvList("AUTH_WEBAUTHN_ORIGINS", ""),
+			},
+			JWT: JWTConfig{
+				Enabled:     getEnvBool("AUTH_JWT_ENABLED", false),
+				Algorithm:   getEnv("AUTH_JWT_ALG", "EdDSA"),
+				Issuer:      getEnv("AUTH_JWT_ISSUER", "modern-mcs"),
+				Audience:    getEnv("AUTH_JWT_AUDIENCE", ""),
+				TTL:         time.Duration(getEnvInt("AUTH_JWT_TTL_SEC", 300)) * time.Second,
+				KeyRotation: time.Duration(getEnvInt("AUTH_JWT_KEY_ROTATION_SEC", 86400)) * time.Second,
+				KeyFile:     getEnv("AUTH_JWT_KEY_FILE", "./data/auth_jwt_keys.json"),
+			},
+			ClientCert: ClientCertConfig{
+				UsernameFrom: strings.ToLower(getEnv("AUTH_MTLS_USERNAME_FROM", "cn")),
+				DefaultRoles: getEnvList("AUTH_MTLS_DEFAULT_ROLES", ""),
+			},
 		},
 		FrontendDistDir:     getEnv("FRONTEND_DIST_DIR", "./web/dist"),
 		SQLProfileStateFile: getEnv("SQL_PROFILE_STATE_FILE", "./data/sql_profiles.json"),
 		MigrationsDir:       getEnv("MIGRATIONS_DIR", "./migrations"),
 		MigrationStateFile:  getEnv("MIGRATION_STATE_FILE", "./data/migration_state.json"),
 		AuditLogFile:        getEnv("AUDIT_LOG_FILE", "./data/audit.log"),
+		SMTP: SMTPConfig{
+			Host:               getEnv("SMTP_HOST", ""),
+			Port:               getEnvInt("SMTP_PORT", 587),
+			Username:           getEnv("SMTP_USERNAME", ""),
+			Password:           getEnv("SMTP_PASSWORD", ""),
+			From:               getEnv("SMTP_FROM", ""),
+			TLS:                strings.ToLower(getEnv("SMTP_TLS", "starttls")),
+			InsecureSkipVerify: getEnvBool("SMTP_INSECURE_SKIP_VERIFY", false),
+			Timeout:            time.Duration(getEnvInt("SMTP_TIMEOUT_SEC", 10)) * time.Second,
+		},
 	}
 
 	if cfg.HTTP.Addr == "" {
@@ -70,15 +356,204 @@ func Load() (Config, error) {
 	if cfg.Auth.PasswordPepper == "" {
 		return Config{}, fmt.Errorf("AUTH_PASSWORD_PEPPER must not be empty")
 	}
+	if cfg.Auth.PasswordHash.MemoryKiB < 8 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_HASH_MEMORY_KIB must be >= 8")
+	}
+	if cfg.Auth.PasswordHash.Iterations <= 0 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_HASH_ITERATIONS must be > 0")
+	}
+	if cfg.Auth.PasswordHash.Parallelism <= 0 || cfg.Auth.PasswordHash.Parallelism > 255 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_HASH_PARALLELISM must be between 1 and 255")
+	}
 	if cfg.Auth.SessionTTL <= 0 {
 		return Config{}, fmt.Errorf("AUTH_SESSION_TTL_SEC must be > 0")
 	}
+	if cfg.Auth.SessionMaxLifetime < cfg.Auth.SessionTTL {
+		return Config{}, fmt.Errorf("AUTH_SESSION_MAX_LIFETIME_SEC must be >= AUTH_SESSION_TTL_SEC")
+	}
 	if cfg.Auth.SessionStateFile == "" {
 		return Config{}, fmt.Errorf("AUTH_SESSION_STATE_FILE must not be empty")
 	}
 	if cfg.Auth.UserStateFile == "" {
 		return Config{}, fmt.Errorf("AUTH_USER_STATE_FILE must not be empty")
 	}
+	if cfg.Auth.MFAPolicyFile == "" {
+		return Config{}, fmt.Errorf("AUTH_MFA_POLICY_STATE_FILE must not be empty")
+	}
+	if cfg.Auth.LoginThrottle.LockoutThreshold <= 0 {
+		return Config{}, fmt.Errorf("AUTH_LOCKOUT_THRESHOLD must be > 0")
+	}
+	if cfg.Auth.LoginThrottle.LockoutDuration <= 0 {
+		return Config{}, fmt.Errorf("AUTH_LOCKOUT_DURATION_SEC must be > 0")
+	}
+	if cfg.Auth.LoginThrottle.IPThreshold <= 0 {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_IP_THRESHOLD must be > 0")
+	}
+	if cfg.Auth.LoginThrottle.BackoffAfter < 0 {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_BACKOFF_AFTER must be >= 0")
+	}
+	if cfg.Auth.LoginThrottle.BackoffBase <= 0 {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_BACKOFF_BASE_SEC must be > 0")
+	}
+	if cfg.Auth.LoginThrottle.BackoffMax < cfg.Auth.LoginThrottle.BackoffBase {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_BACKOFF_MAX_SEC must be >= AUTH_LOGIN_BACKOFF_BASE_SEC")
+	}
+	if cfg.Auth.LoginThrottle.FailureWindow <= 0 {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_FAILURE_WINDOW_SEC must be > 0")
+	}
+	if cfg.Auth.LoginAttemptFile == "" {
+		return Config{}, fmt.Errorf("AUTH_LOGIN_ATTEMPT_STATE_FILE must not be empty")
+	}
+	if cfg.Auth.APITokenFile == "" {
+		return Config{}, fmt.Errorf("AUTH_API_TOKEN_STATE_FILE must not be empty")
+	}
+	if cfg.Auth.RoleFile == "" {
+		return Config{}, fmt.Errorf("AUTH_ROLE_STATE_FILE must not be empty")
+	}
+	switch cfg.Auth.Cookie.SameSite {
+	case "strict", "lax":
+	case "none":
+		if !cfg.Auth.Cookie.Secure {
+			return Config{}, fmt.Errorf("AUTH_COOKIE_SAMESITE=none requires AUTH_COOKIE_SECURE=true")
+		}
+	default:
+		return Config{}, fmt.Errorf("AUTH_COOKIE_SAMESITE must be strict, lax or none")
+	}
+	if cfg.Auth.ImpersonationTTL < time.Minute {
+		return Config{}, fmt.Errorf("AUTH_IMPERSONATION_TTL_SEC must be >= 60")
+	}
+	if cfg.Auth.SCIMToken != "" && len(cfg.Auth.SCIMToken) < 32 {
+		return Config{}, fmt.Errorf("AUTH_SCIM_TOKEN must be at least 32 characters")
+	}
+	if cfg.Auth.PasswordReset.TTL < time.Minute {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_RESET_TTL_SEC must be >= 60")
+	}
+	if cfg.Auth.PasswordPolicy.MinLength < 8 || cfg.Auth.PasswordPolicy.MinLength > 128 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_MIN_LENGTH must be between 8 and 128")
+	}
+	if cfg.Auth.PasswordPolicy.MaxAge < 0 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_MAX_AGE_DAYS must be >= 0")
+	}
+	if cfg.Auth.PasswordPolicy.History < 0 || cfg.Auth.PasswordPolicy.History > 24 {
+		return Config{}, fmt.Errorf("AUTH_PASSWORD_HISTORY must be between 0 and 24")
+	}
+	if cfg.SMTP.Host != "" {
+		if cfg.SMTP.Port <= 0 || cfg.SMTP.Port > 65535 {
+			return Config{}, fmt.Errorf("SMTP_PORT must be between 1 and 65535")
+		}
+		if cfg.SMTP.From == "" {
+			return Config{}, fmt.Errorf("SMTP_FROM must not be empty when SMTP_HOST is set")
+		}
+		switch cfg.SMTP.TLS {
+		case "starttls", "tls", "none":
+		default:
+			return Config{}, fmt.Errorf("SMTP_TLS must be starttls, tls or none")
+		}
+		if cfg.SMTP.Timeout <= 0 {
+			return Config{}, fmt.Errorf("SMTP_TIMEOUT_SEC must be > 0")
+		}
+		if cfg.Auth.PasswordReset.URL == "" {
+			return Config{}, fmt.Errorf("AUTH_PASSWORD_RESET_URL must not be empty when SMTP_HOST is set")
+		}
+	}
+	roleMap, err := parseKeyValueList(getEnv("AUTH_OIDC_ROLE_MAP", ""), ",")
+	if err != nil {
+		return Config{}, fmt.Errorf("AUTH_OIDC_ROLE_MAP: %w", err)
+	}
+	cfg.Auth.OIDC.RoleMap = roleMap
+	if cfg.Auth.OIDC.IssuerURL != "" {
+		if cfg.Auth.OIDC.ClientID == "" {
+			return Config{}, fmt.Errorf("AUTH_OIDC_CLIENT_ID must not be empty when AUTH_OIDC_ISSUER_URL is set")
+		}
+		if cfg.Auth.OIDC.RedirectURL == "" {
+			return Config{}, fmt.Errorf("AUTH_OIDC_REDIRECT_URL must not be empty when AUTH_OIDC_ISSUER_URL is set")
+		}
+	}
+	// Group DNs contain commas, so LDAP role map entries are separated by ';'.
+	ldapRoleMap, err := parseKeyValueList(getEnv("AUTH_LDAP_ROLE_MAP", ""), ";")
+	if err != nil {
+		return Config{}, fmt.Errorf("AUTH_LDAP_ROLE_MAP: %w", err)
+	}
+	cfg.Auth.LDAP.RoleMap = ldapRoleMap
+	if cfg.Auth.LDAP.URL != "" {
+		if cfg.Auth.LDAP.BaseDN == "" {
+			return Config{}, fmt.Errorf("AUTH_LDAP_BASE_DN must not be empty when AUTH_LDAP_URL is set")
+		}
+		if cfg.Auth.LDAP.Timeout <= 0 {
+			return Config{}, fmt.Errorf("AUTH_LDAP_TIMEOUT_SEC must be > 0")
+		}
+	}
+	for _, origin := range cfg.Auth.WebAuthn.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return Config{}, fmt.Errorf("AUTH_WEBAUTHN_ORIGINS must list origins such as https://mcs.example.com, got %q", origin)
+		}
+	}
+	if len(cfg.Auth.WebAuthn.Origins) > 0 && cfg.Auth.WebAuthn.RPID == "" {
+		return Config{}, fmt.Errorf("AUTH_WEBAUTHN_RP_ID must not be empty when AUTH_WEBAUTHN_ORIGINS is set")
+	}
+	if cfg.Auth.JWT.Enabled {
+		switch cfg.Auth.JWT.Algorithm {
+		case "EdDSA", "ES256":
+		default:
+			return Config{}, fmt.Errorf("AUTH_JWT_ALG must be EdDSA or ES256")
+		}
+		if cfg.Auth.JWT.Issuer == "" {
+			return Config{}, fmt.Errorf("AUTH_JWT_ISSUER must not be empty when AUTH_JWT_ENABLED is set")
+		}
+		if cfg.Auth.JWT.TTL < time.Minute || cfg.Auth.JWT.TTL > time.Hour {
+			return Config{}, fmt.Errorf("AUTH_JWT_TTL_SEC must be between 60 and 3600")
+		}
+		if cfg.Auth.JWT.KeyRotation < time.Hour || cfg.Auth.JWT.KeyRotation < cfg.Auth.JWT.TTL {
+			return Config{}, fmt.Errorf("AUTH_JWT_KEY_ROTATION_SEC must be >= 3600")
+		}
+		if cfg.Auth.JWT.KeyFile == "" {
+			return Config{}, fmt.Errorf("AUTH_JWT_KEY_FILE must not be empty when AUTH_JWT_ENABLED is set")
+		}
+	}
+	if (cfg.HTTP.TLS.CertFile == "") != (cfg.HTTP.TLS.KeyFile == "") {
+		return Config{}, fmt.Errorf("HTTP_TLS_CERT_FILE and HTTP_TLS_KEY_FILE must be set together")
+	}
+	if cfg.HTTP.TLS.ClientCAFile != "" && cfg.HTTP.TLS.CertFile == "" {
+		return Config{}, fmt.Errorf("HTTP_TLS_CLIENT_CA_FILE requires HTTP_TLS_CERT_FILE")
+	}
+	if cfg.HTTP.TLS.RedirectAddr != "" && cfg.HTTP.TLS.CertFile == "" {
+		return Config{}, fmt.Errorf("HTTP_REDIRECT_ADDR requires HTTP_TLS_CERT_FILE")
+	}
+	if cfg.HTTP.TLS.RedirectAddr != "" && cfg.HTTP.TLS.RedirectAddr == cfg.HTTP.Addr {
+		return Config{}, fmt.Errorf("HTTP_REDIRECT_ADDR must differ from HTTP_ADDR")
+	}
+	if cfg.HTTP.TLS.HSTSMaxAge < 0 {
+		return Config{}, fmt.Errorf("HTTP_HSTS_MAX_AGE_SEC must be >= 0")
+	}
+	switch getEnv("HTTP_TLS_MIN_VERSION", "1.2") {
+	case "1.2":
+		cfg.HTTP.TLS.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.HTTP.TLS.MinVersion = tls.VersionTLS13
+	default:
+		return Config{}, fmt.Errorf("HTTP_TLS_MIN_VERSION must be 1.2 or 1.3")
+	}
+	suites, err := parseCipherSuites(getEnvList("HTTP_TLS_CIPHER_SUITES", ""))
+	if err != nil {
+		return Config{}, fmt.Errorf("HTTP_TLS_CIPHER_SUITES: %w", err)
+	}
+	cfg.HTTP.TLS.CipherSuites = suites
+	proxies, err := parsePrefixes(getEnvList("HTTP_TRUSTED_PROXIES", ""))
+	if err != nil {
+		return Config{}, fmt.Errorf("HTTP_TRUSTED_PROXIES: %w", err)
+	}
+	cfg.HTTP.TrustedProxies = proxies
+	switch cfg.Auth.ClientCert.UsernameFrom {
+	case "cn", "dns", "uri", "email":
+	default:
+		return Config{}, fmt.Errorf("AUTH_MTLS_USERNAME_FROM must be cn, dns, uri or email")
+	}
+	mtlsRoleMap, err := parseKeyValueList(getEnv("AUTH_MTLS_ROLE_MAP", ""), ",")
+	if err != nil {
+		return Config{}, fmt.Errorf("AUTH_MTLS_ROLE_MAP: %w", err)
+	}
+	cfg.Auth.ClientCert.RoleMap = mtlsRoleMap
 	if cfg.FrontendDistDir == "" {
 		return Config{}, fmt.Errorf("FRONTEND_DIST_DIR must not be empty")
 	}
@@ -117,3 +592,86 @@ func getEnvInt(key string, fallback int) int {
 	}
 	return n
 }
+
+func getEnvBool(key string, fallback bool) bool {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+// getEnvList splits a comma- or whitespace-separated value.
+func getEnvList(key, fallback string) []string {
+	val := getEnv(key, fallback)
+	return strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// parseCipherSuites accepts the names of the TLS 1.2 suites that crypto/tls
+// considers secure. TLS 1.3 suites are not configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	var out []uint16
+	for _, name := range names {
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name && slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+				id = suite.ID
+			}
+		}
+		if id == 0 {
+			return nil, fmt.Errorf("unknown or insecure TLS 1.2 cipher suite %q", name)
+		}
+		out = append(out, id)
+	}
+	return out, nil
+}
+
+// parsePrefixes accepts CIDR ranges and single addresses, which stand for a
+// range of just that address.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			out = append(out, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+// parseKeyValueList parses "a=x<sep>b=y" into a map. Each entry is split at
+// its last '=' so keys may themselves contain '='.
+func parseKeyValueList(val, sep string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, pair := range strings.Split(val, sep) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", pair)
+		}
+		k, v := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", pair)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
@@ -0,0 +1,85 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	"myconnectionsvr/modern-mcs/internal/auth"
+)
+
+type ClientCertService interface {
+	ClientCertEnabled() bool
+	AuthenticateClientCertificate(cert *x509.Certificate, client auth.ClientInfo) (auth.Session, error)
+}
+
+// clientCertIdentity is the verified client certificate of a request. The
+// user behind it is only looked up, and provisioned on first use, when an
+// endpoint asks for a session; requests that need none, such as health
+// checks and the frontend, cost no store access.
+type clientCertIdentity struct {
+	cert  *x509.Certificate
+	svc   ClientCertService
+	audit AuditLogger
+
+	resolved bool
+	session  auth.Session
+	err      error
+}
+
+type clientCertIdentityKey struct{}
+
+// clientCertMiddleware notes a client certificate that the TLS handshake
+// verified against the client CA, for requireSession to map to an MCS user
+// when the request carries no bearer token. A bearer token or session cookie
+// always wins, so a browser holding a certificate can still sign in as
+// someone else.
+func clientCertMiddleware(next http.Handler, svc ClientCertService, a AuditLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || r.Header.Get("Authorization") != "" || !svc.ClientCertEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := &clientCertIdentity{cert: r.TLS.VerifiedChains[0][0], svc: svc, audit: a}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientCertIdentityKey{}, id)))
+	})
+}
+
+// resolve authenticates the certificate once per request and audits a
+// rejection.
+func (id *clientCertIdentity) resolve(r *http.Request) (auth.Session, error) {
+	if !id.resolved {
+		id.resolved = true
+		id.session, id.err = id.svc.AuthenticateClientCertificate(id.cert, clientInfo(r))
+		if id.err != nil {
+			outcome := inactiveAccountOutcome(id.err)
+			if outcome == "" {
+				outcome = "failed"
+			}
+			auditReq(id.audit, r, id.cert.Subject.String(), "auth.mtls", "", outcome, "", id.err.Error())
+		}
+	}
+	return id.session, id.err
+}
+
+// clientCertSession returns the certificate identity of a request without a
+// bearer token. Under /v1/auth/ only /v1/auth/me accepts it: the rest
+// manages login sessions and credentials, which a certificate does not have.
+func clientCertSession(w http.ResponseWriter, r *http.Request) (auth.Session, bool) {
+	id, ok := r.Context().Value(clientCertIdentityKey{}).(*clientCertIdentity)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return auth.Session{}, false
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/auth/") && r.URL.Path != "/v1/auth/me" {
+		writeError(w, http.StatusUnauthorized, "bearer token required")
+		return auth.Session{}, false
+	}
+	session, err := id.resolve(r)
+	if err != nil {
+		writeDomainError(w, err, "client certificate authentication failed")
+		return auth.Session{}, false
+	}
+	return session, true
+}
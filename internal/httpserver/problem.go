@@ -0,0 +1,136 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"myconnectionsvr/modern-mcs/internal/auth"
+	"myconnectionsvr/modern-mcs/internal/sqlprofile"
+)
+
+const problemContentType = "application/problem+json"
+
+// problem is an RFC 7807 problem details body. Code is the stable,
+// machine-readable identifier that clients branch on; Title is the HTTP
+// status text and Detail a human-readable explanation that may change.
+type problem struct {
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+	// Reason names the password policy rule that failed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// fieldError is a validation problem with one request field.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// domainErrors maps the errors of the services to the status and code of the
+// problem returned for them. An empty detail uses the error text, for errors
+// whose message explains the invalid input.
+var domainErrors = []struct {
+	err    error
+	status int
+	code   string
+	detail string
+}{
+	{auth.ErrInvalidCredentials, http.StatusUnauthorized, "invalid_credentials", "invalid credentials"},
+	{auth.ErrRefreshTokenReused, http.StatusUnauthorized, "invalid_token", "invalid or expired token"},
+	{auth.ErrInvalidToken, http.StatusUnauthorized, "invalid_token", "invalid or expired token"},
+	{auth.ErrAccountDisabled, http.StatusForbidden, "account_disabled", "account disabled"},
+	{auth.ErrAccountExpired, http.StatusForbidden, "account_expired", "account expired"},
+	{auth.ErrWeakPassword, http.StatusBadRequest, "weak_password", "password does not meet policy"},
+	{auth.ErrInvalidResetToken, http.StatusBadRequest, "invalid_reset_token", "invalid or expired reset token"},
+	{auth.ErrInvalidOIDCState, http.StatusBadRequest, "invalid_oidc_state", "invalid or expired oidc state"},
+	{auth.ErrTooManyOIDCLogins, http.StatusServiceUnavailable, "oidc_busy", "too many pending oidc logins"},
+	{auth.ErrInvalidIDToken, http.StatusUnauthorized, "invalid_id_token", "invalid id token"},
+	{auth.ErrExternalAccountConflict, http.StatusConflict, "external_account_conflict", "username belongs to a different account"},
+	{auth.ErrInvalidClientCert, http.StatusUnauthorized, "client_certificate_rejected", "client certificate not accepted"},
+	{auth.ErrInvalidWebAuthnCeremony, http.StatusBadRequest, "invalid_webauthn_ceremony", "invalid or expired webauthn ceremony"},
+	{auth.ErrInvalidWebAuthnResponse, http.StatusBadRequest, "invalid_webauthn_response", "invalid webauthn response"},
+	{auth.ErrWebAuthnCredentialExists, http.StatusConflict, "webauthn_credential_exists", "webauthn credential already registered"},
+	{auth.ErrWebAuthnCredentialNotFound, http.StatusNotFound, "webauthn_credential_not_found", "webauthn credential not found"},
+	{auth.ErrTooManyWebAuthnCeremonies, http.StatusServiceUnavailable, "webauthn_busy", "too many pending webauthn ceremonies"},
+	{auth.ErrInvalidMFAChallenge, http.StatusUnauthorized, "invalid_mfa_challenge", "invalid or expired mfa challenge"},
+	{auth.ErrInvalidMFACode, http.StatusUnauthorized, "invalid_mfa_code", "invalid mfa code"},
+	{auth.ErrMFAEnrollmentNotBegun, http.StatusConflict, "mfa_enrollment_not_started", "mfa enrollment not started"},
+	{auth.ErrMFAAlreadyEnabled, http.StatusConflict, "mfa_already_enabled", "mfa already enabled"},
+	{auth.ErrLoginSessionRequired, http.StatusForbidden, "login_session_required", "a login session is required"},
+	{auth.ErrNotImpersonating, http.StatusBadRequest, "not_impersonating", "session is not impersonating a user"},
+	{auth.ErrImpersonationNotAllowed, http.StatusForbidden, "impersonation_not_allowed", "impersonation not allowed"},
+	{auth.ErrLoginAttemptNotFound, http.StatusNotFound, "lockout_not_found", "lockout not found"},
+	{auth.ErrInvalidAPIToken, http.StatusBadRequest, "invalid_api_token", ""},
+	{auth.ErrAPITokenNotFound, http.StatusNotFound, "api_token_not_found", "api token not found"},
+	{auth.ErrInvalidUserInput, http.StatusBadRequest, "invalid_input", ""},
+	{auth.ErrUserNotFound, http.StatusNotFound, "user_not_found", "user not found"},
+	{auth.ErrUsernameTaken, http.StatusConflict, "username_taken", "username already taken"},
+	{auth.ErrInvalidRole, http.StatusBadRequest, "invalid_role", ""},
+	{auth.ErrRoleNotFound, http.StatusNotFound, "role_not_found", "role not found"},
+	{auth.ErrRoleExists, http.StatusConflict, "role_exists", "role already exists"},
+	{auth.ErrRoleInUse, http.StatusConflict, "role_in_use", "role is assigned to users"},
+	{auth.ErrRoleReserved, http.StatusConflict, "role_reserved", "built-in role cannot be modified"},
+	{sqlprofile.ErrInvalidInput, http.StatusBadRequest, "invalid_input", ""},
+	{sqlprofile.ErrNotFound, http.StatusNotFound, "sql_profile_not_found", "profile not found"},
+}
+
+// writeError answers with a problem whose code is derived from the status,
+// such as "not_found" or "method_not_allowed".
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorCode(w, status, statusCode(status), message)
+}
+
+// writeErrorCode answers with a problem carrying a specific code, for errors
+// that no domain error stands for or whose status depends on the endpoint.
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	writeProblem(w, problem{Status: status, Code: code, Detail: message})
+}
+
+// writeDomainError answers with the problem mapped to err in domainErrors,
+// adding the failed password rule or invalid fields when err carries them.
+// Any other error is a 500 with the fallback message, so that internal error
+// text does not leak.
+func writeDomainError(w http.ResponseWriter, err error, fallback string) {
+	p := problem{Status: http.StatusInternalServerError, Code: statusCode(http.StatusInternalServerError), Detail: fallback}
+	for _, d := range domainErrors {
+		if errors.Is(err, d.err) {
+			p = problem{Status: d.status, Code: d.code, Detail: d.detail}
+			if p.Detail == "" {
+				p.Detail = err.Error()
+			}
+			break
+		}
+	}
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		p.Reason = string(policyErr.Reason)
+		p.Detail = policyErr.Detail
+	}
+	var validationErr *sqlprofile.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, f := range validationErr.Fields {
+			p.Errors = append(p.Errors, fieldError{Field: f.Field, Message: f.Message})
+		}
+	}
+	writeProblem(w, p)
+}
+
+// writeProblem fills in the title and, via the response header that
+// loggingMiddleware sets, the request ID.
+func writeProblem(w http.ResponseWriter, p problem) {
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = w.Header().Get("X-Request-Id")
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
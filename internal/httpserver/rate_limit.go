@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimitKeys bounds the keys a requestLimiter tracks. Once it is full
+// and nothing has expired, requests with new keys are refused rather than
+// letting the map grow.
+const maxRateLimitKeys = 10000
+
+// requestLimiter allows up to limit requests per key in a fixed window. It
+// guards unauthenticated endpoints that do work or send mail on each request,
+// per instance; the login throttle in auth covers credential guessing.
+type requestLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	hits      map[string]rateWindow
+	lastPrune time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRequestLimiter(limit int, window time.Duration) *requestLimiter {
+	return &requestLimiter{limit: limit, window: window, now: time.Now, hits: make(map[string]rateWindow)}
+}
+
+// allow counts a request against every key and reports whether all of them
+// were still under the limit. Refused requests are not counted.
+func (l *requestLimiter) allow(keys ...string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	// Expired windows are swept at most once per window, not per request.
+	if now.Sub(l.lastPrune) >= l.window {
+		for key, w := range l.hits {
+			if now.Sub(w.start) >= l.window {
+				delete(l.hits, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	fresh := 0
+	for _, key := range keys {
+		w, ok := l.hits[key]
+		if !ok || now.Sub(w.start) >= l.window {
+			fresh++
+			continue
+		}
+		if w.count >= l.limit {
+			return false
+		}
+	}
+	if len(l.hits)+fresh > maxRateLimitKeys {
+		return false
+	}
+	for _, key := range keys {
+		w, ok := l.hits[key]
+		if !ok || now.Sub(w.start) >= l.window {
+			w = rateWindow{start: now}
+		}
+		w.count++
+		l.hits[key] = w
+	}
+	return true
+}
@@ -0,0 +1,896 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"myconnectionsvr/modern-mcs/internal/auth"
+)
+
+const (
+	scimUserSchema   = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema  = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema  = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	// scimMaxResults caps a single list page.
+	scimMaxResults = 200
+)
+
+// SCIMService backs the SCIM 2.0 provisioning API. Users map onto the MCS
+// accounts created over SCIM and groups onto MCS roles.
+type SCIMService interface {
+	SCIMEnabled() bool
+	AuthenticateSCIM(token string) bool
+	ListProvisionedUsers() ([]auth.User, error)
+	GetProvisionedUser(id string) (auth.User, error)
+	ProvisionUser(p auth.ProvisionedUser) (auth.User, error)
+	UpdateProvisionedUser(id string, p auth.ProvisionedUser) (auth.User, error)
+	DeprovisionUser(id string) (auth.User, error)
+	ListProvisionedRoles() ([]auth.Role, error)
+	GetProvisionedRole(name string) (auth.Role, error)
+	CreateRole(name, description string, permissions []string) (auth.Role, error)
+	ReplaceRoleMembers(name string, userIDs []string) error
+	ChangeRoleMembers(name string, add, remove []string) error
+	DeleteProvisionedRole(name string) error
+}
+
+type scimMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimUser struct {
+	Schemas    []string     `json:"schemas"`
+	ID         string       `json:"id"`
+	ExternalID string       `json:"externalId,omitempty"`
+	UserName   string       `json:"userName"`
+	Active     bool         `json:"active"`
+	Emails     []scimEmail  `json:"emails,omitempty"`
+	Groups     []scimMember `json:"groups,omitempty"`
+	Meta       scimMeta     `json:"meta"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+// scimBool accepts JSON booleans as well as "True" and "False" strings,
+// which some identity providers send in PATCH requests.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = scimBool(v)
+		return nil
+	case string:
+		parsed, err := strconv.ParseBool(strings.ToLower(v))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*b = scimBool(parsed)
+		return nil
+	}
+	return fmt.Errorf("invalid boolean %s", data)
+}
+
+type scimUserInput struct {
+	UserName   string      `json:"userName"`
+	ExternalID string      `json:"externalId"`
+	Active     *scimBool   `json:"active"`
+	Emails     []scimEmail `json:"emails"`
+}
+
+type scimGroupInput struct {
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// registerSCIMHandlers serves SCIM 2.0 (RFC 7643/7644) for identity
+// providers that push users and groups. Every request needs the dedicated
+// SCIM bearer token; session tokens are not accepted.
+func registerSCIMHandlers(mux *http.ServeMux, deps Deps) {
+	guard := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if deps.SCIM == nil || !deps.SCIM.SCIMEnabled() {
+				writeSCIMError(w, http.StatusNotFound, "", "scim not configured")
+				return
+			}
+			token, err := extractBearerToken(r.Header.Get("Authorization"))
+			if err != nil || !deps.SCIM.AuthenticateSCIM(token) {
+				auditReq(deps.Audit, r, "scim", "scim.auth", "", "failed", "", "invalid bearer token")
+				w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+				writeSCIMError(w, http.StatusUnauthorized, "", "invalid scim token")
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux.HandleFunc("/scim/v2/ServiceProviderConfig", guard(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+			return
+		}
+		writeSCIMJSON(w, http.StatusOK, map[string]any{
+			"schemas":        []string{scimConfigSchema},
+			"patch":          map[string]bool{"supported": true},
+			"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]any{"supported": true, "maxResults": scimMaxResults},
+			"changePassword": map[string]bool{"supported": false},
+			"sort":           map[string]bool{"supported": false},
+			"etag":           map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]any{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer token",
+				"description": "The SCIM token configured in AUTH_SCIM_TOKEN",
+				"primary":     true,
+			}},
+		})
+	}))
+
+	mux.HandleFunc("/scim/v2/Users", guard(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			filter, err := parseSCIMFilter(r.URL.Query().Get("filter"), "id", "username", "externalid", "active", "emails", "emails.value")
+			if err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+				return
+			}
+			users, err := deps.SCIM.ListProvisionedUsers()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", "list users failed")
+				return
+			}
+			var matched []any
+			for _, u := range users {
+				if filter.match(scimUserAttributes(u)) {
+					matched = append(matched, newSCIMUser(u))
+				}
+			}
+			writeSCIMList(w, r, matched)
+		case http.MethodPost:
+			var in scimUserInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+				return
+			}
+			u, err := deps.SCIM.ProvisionUser(in.provisioned(auth.ProvisionedUser{Active: true}))
+			if err != nil {
+				auditReq(deps.Audit, r, "scim", "scim.user.create", in.UserName, "failed", "", err.Error())
+				writeSCIMServiceError(w, err)
+				return
+			}
+			auditReq(deps.Audit, r, "scim", "scim.user.create", u.ID, "success", "", "username="+u.Username)
+			resource := newSCIMUser(u)
+			w.Header().Set("Location", resource.Meta.Location)
+			writeSCIMJSON(w, http.StatusCreated, resource)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/scim/v2/Users/", guard(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Users/")
+		if id == "" || strings.Contains(id, "/") {
+			writeSCIMError(w, http.StatusNotFound, "", "not found")
+			return
+		}
+		current, err := deps.SCIM.GetProvisionedUser(id)
+		if err != nil {
+			writeSCIMServiceError(w, err)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeSCIMJSON(w, http.StatusOK, newSCIMUser(current))
+			return
+		case http.MethodDelete:
+			// The account is disabled rather than deleted, so that its
+			// audit trail keeps pointing at it.
+			if _, err := deps.SCIM.DeprovisionUser(id); err != nil {
+				auditReq(deps.Audit, r, "scim", "scim.user.delete", id, "failed", "", err.Error())
+				writeSCIMServiceError(w, err)
+				return
+			}
+			auditReq(deps.Audit, r, "scim", "scim.user.delete", id, "success", "", "username="+current.Username+" active=false")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		var p auth.ProvisionedUser
+		switch r.Method {
+		case http.MethodPut:
+			var in scimUserInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+				return
+			}
+			// Omitted attributes are cleared, except that an account stays
+			// active unless told otherwise.
+			p = in.provisioned(auth.ProvisionedUser{Active: true})
+		case http.MethodPatch:
+			var req scimPatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !slices.Contains(req.Schemas, scimPatchSchema) {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid patch request")
+				return
+			}
+			p = provisionedFromUser(current)
+			for _, op := range req.Operations {
+				if err := applySCIMUserPatch(&p, op.Op, op.Path, op.Value); err != nil {
+					writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+					return
+				}
+			}
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+			return
+		}
+		u, err := deps.SCIM.UpdateProvisionedUser(id, p)
+		if err != nil {
+			auditReq(deps.Audit, r, "scim", "scim.user.update", id, "failed", "", err.Error())
+			writeSCIMServiceError(w, err)
+			return
+		}
+		detail := "username=" + u.Username
+		if u.Disabled != current.Disabled {
+			detail += " active=" + strconv.FormatBool(!u.Disabled)
+		}
+		auditReq(deps.Audit, r, "scim", "scim.user.update", id, "success", "", detail)
+		writeSCIMJSON(w, http.StatusOK, newSCIMUser(u))
+	}))
+
+	mux.HandleFunc("/scim/v2/Groups", guard(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			filter, err := parseSCIMFilter(r.URL.Query().Get("filter"), "id", "displayname", "members", "members.value")
+			if err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+				return
+			}
+			roles, err := deps.SCIM.ListProvisionedRoles()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", "list groups failed")
+				return
+			}
+			users, err := deps.SCIM.ListProvisionedUsers()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", "list groups failed")
+				return
+			}
+			var matched []any
+			for _, role := range roles {
+				g := newSCIMGroup(role.Name, users)
+				if filter.match(scimGroupAttributes(g)) {
+					matched = append(matched, g)
+				}
+			}
+			writeSCIMList(w, r, matched)
+		case http.MethodPost:
+			var in scimGroupInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+				return
+			}
+			members := scimMemberIDs(in.Members)
+			for _, id := range members {
+				if _, err := deps.SCIM.GetProvisionedUser(id); err != nil {
+					writeSCIMMemberError(w, err)
+					return
+				}
+			}
+			// New roles grant nothing until an administrator gives them
+			// permissions in MCS.
+			role, err := deps.SCIM.CreateRole(in.DisplayName, "", nil)
+			if err == nil {
+				err = deps.SCIM.ReplaceRoleMembers(role.Name, members)
+			}
+			if err != nil {
+				auditReq(deps.Audit, r, "scim", "scim.group.create", in.DisplayName, "failed", "", err.Error())
+				writeSCIMMemberError(w, err)
+				return
+			}
+			auditReq(deps.Audit, r, "scim", "scim.group.create", role.Name, "success", "", fmt.Sprintf("members=%d", len(members)))
+			users, err := deps.SCIM.ListProvisionedUsers()
+			if err != nil {
+				writeSCIMError(w, http.StatusInternalServerError, "", "list users failed")
+				return
+			}
+			resource := newSCIMGroup(role.Name, users)
+			w.Header().Set("Location", resource.Meta.Location)
+			writeSCIMJSON(w, http.StatusCreated, resource)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		}
+	}))
+
+	mux.HandleFunc("/scim/v2/Groups/", guard(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/scim/v2/Groups/")
+		if name == "" || strings.Contains(name, "/") {
+			writeSCIMError(w, http.StatusNotFound, "", "not found")
+			return
+		}
+		role, err := deps.SCIM.GetProvisionedRole(name)
+		if err != nil {
+			writeSCIMServiceError(w, err)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if err := deps.SCIM.DeleteProvisionedRole(role.Name); err != nil {
+				auditReq(deps.Audit, r, "scim", "scim.group.delete", role.Name, "failed", "", err.Error())
+				writeSCIMServiceError(w, err)
+				return
+			}
+			auditReq(deps.Audit, r, "scim", "scim.group.delete", role.Name, "success", "", "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		users, err := deps.SCIM.ListProvisionedUsers()
+		if err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "list users failed")
+			return
+		}
+		current := newSCIMGroup(role.Name, users)
+
+		var add, remove []string
+		switch r.Method {
+		case http.MethodGet:
+			writeSCIMJSON(w, http.StatusOK, current)
+			return
+		case http.MethodPut:
+			var in scimGroupInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid request body")
+				return
+			}
+			if in.DisplayName != "" && !strings.EqualFold(in.DisplayName, role.Name) {
+				writeSCIMError(w, http.StatusBadRequest, "mutability", "groups cannot be renamed")
+				return
+			}
+			add, remove = diffSCIMMembers(scimMemberIDs(current.Members), scimMemberIDs(in.Members))
+		case http.MethodPatch:
+			var req scimPatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !slices.Contains(req.Schemas, scimPatchSchema) {
+				writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid patch request")
+				return
+			}
+			members := scimMemberIDs(current.Members)
+			for _, op := range req.Operations {
+				if members, err = applySCIMGroupPatch(role.Name, members, op.Op, op.Path, op.Value); err != nil {
+					scimType := "invalidValue"
+					if errors.Is(err, errSCIMGroupRename) {
+						scimType = "mutability"
+					}
+					writeSCIMError(w, http.StatusBadRequest, scimType, err.Error())
+					return
+				}
+			}
+			add, remove = diffSCIMMembers(scimMemberIDs(current.Members), members)
+		default:
+			writeSCIMError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+			return
+		}
+		if err := deps.SCIM.ChangeRoleMembers(role.Name, add, remove); err != nil {
+			auditReq(deps.Audit, r, "scim", "scim.group.update", role.Name, "failed", "", err.Error())
+			writeSCIMMemberError(w, err)
+			return
+		}
+		auditReq(deps.Audit, r, "scim", "scim.group.update", role.Name, "success", "", fmt.Sprintf("added=%s removed=%s", strings.Join(add, ","), strings.Join(remove, ",")))
+		if users, err = deps.SCIM.ListProvisionedUsers(); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "list users failed")
+			return
+		}
+		writeSCIMJSON(w, http.StatusOK, newSCIMGroup(role.Name, users))
+	}))
+}
+
+func newSCIMUser(u auth.User) scimUser {
+	out := scimUser{
+		Schemas:    []string{scimUserSchema},
+		ID:         u.ID,
+		UserName:   u.Username,
+		ExternalID: u.ExternalSubject,
+		Active:     !u.Disabled,
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      u.CreatedAt,
+			LastModified: u.UpdatedAt,
+			Location:     "/scim/v2/Users/" + u.ID,
+		},
+	}
+	if u.Email != "" {
+		out.Emails = []scimEmail{{Value: u.Email, Type: "work", Primary: true}}
+	}
+	for _, role := range u.Roles {
+		out.Groups = append(out.Groups, scimMember{Value: role, Display: role})
+	}
+	return out
+}
+
+func newSCIMGroup(role string, users []auth.User) scimGroup {
+	g := scimGroup{
+		Schemas:     []string{scimGroupSchema},
+		ID:          role,
+		DisplayName: role,
+		Members:     []scimMember{},
+		Meta:        scimMeta{ResourceType: "Group", Location: "/scim/v2/Groups/" + role},
+	}
+	for _, u := range users {
+		for _, r := range u.Roles {
+			if r == role {
+				g.Members = append(g.Members, scimMember{Value: u.ID, Display: u.Username})
+				break
+			}
+		}
+	}
+	return g
+}
+
+// provisionedFromUser returns the SCIM-managed attributes of u.
+func provisionedFromUser(u auth.User) auth.ProvisionedUser {
+	return auth.ProvisionedUser{Username: u.Username, ExternalID: u.ExternalSubject, Email: u.Email, Active: !u.Disabled}
+}
+
+func (in scimUserInput) provisioned(base auth.ProvisionedUser) auth.ProvisionedUser {
+	base.Username = in.UserName
+	base.ExternalID = in.ExternalID
+	base.Email = primarySCIMEmail(in.Emails)
+	if in.Active != nil {
+		base.Active = bool(*in.Active)
+	}
+	return base
+}
+
+func primarySCIMEmail(emails []scimEmail) string {
+	for _, e := range emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// applySCIMUserPatch applies one PATCH operation to p. Attributes that MCS
+// does not store, such as name, are ignored as they are on create.
+func applySCIMUserPatch(p *auth.ProvisionedUser, op, path string, value json.RawMessage) error {
+	op = strings.ToLower(op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return fmt.Errorf("unsupported patch op %q", op)
+	}
+	path = strings.ToLower(strings.TrimSpace(path))
+	if path == "" {
+		if op == "remove" {
+			return fmt.Errorf("remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return fmt.Errorf("patch value must be an object")
+		}
+		for name, v := range attrs {
+			if err := applySCIMUserPatch(p, op, name, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	remove := op == "remove"
+	decode := func(dst any) error {
+		if err := json.Unmarshal(value, dst); err != nil {
+			return fmt.Errorf("invalid value for %s", path)
+		}
+		return nil
+	}
+	switch {
+	case path == "active":
+		if remove {
+			return fmt.Errorf("active cannot be removed")
+		}
+		var active scimBool
+		if err := decode(&active); err != nil {
+			return err
+		}
+		p.Active = bool(active)
+	case path == "username":
+		if remove {
+			return fmt.Errorf("userName cannot be removed")
+		}
+		return decode(&p.Username)
+	case path == "externalid":
+		p.ExternalID = ""
+		if !remove {
+			return decode(&p.ExternalID)
+		}
+	case path == "emails":
+		p.Email = ""
+		if !remove {
+			var emails []scimEmail
+			if err := decode(&emails); err != nil {
+				return err
+			}
+			p.Email = primarySCIMEmail(emails)
+		}
+	case path == "emails.value" || strings.HasPrefix(path, "emails[") && strings.HasSuffix(path, "].value"):
+		// MCS keeps a single address, so every email filter selects it.
+		p.Email = ""
+		if !remove {
+			return decode(&p.Email)
+		}
+	}
+	return nil
+}
+
+var errSCIMGroupRename = errors.New("groups cannot be renamed")
+
+// applySCIMGroupPatch applies one PATCH operation to the member IDs of role
+// and returns the new set.
+func applySCIMGroupPatch(role string, members []string, op, path string, value json.RawMessage) ([]string, error) {
+	op = strings.ToLower(op)
+	if op != "add" && op != "replace" && op != "remove" {
+		return nil, fmt.Errorf("unsupported patch op %q", op)
+	}
+	path = strings.TrimSpace(path)
+	lower := strings.ToLower(path)
+	if path == "" {
+		if op == "remove" {
+			return nil, fmt.Errorf("remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return nil, fmt.Errorf("patch value must be an object")
+		}
+		for name, v := range attrs {
+			var err error
+			if members, err = applySCIMGroupPatch(role, members, op, name, v); err != nil {
+				return nil, err
+			}
+		}
+		return members, nil
+	}
+	switch {
+	case lower == "displayname":
+		var name string
+		if op == "remove" || json.Unmarshal(value, &name) != nil || !strings.EqualFold(name, role) {
+			return nil, errSCIMGroupRename
+		}
+		return members, nil
+	case lower == "members":
+		var listed []scimMember
+		if len(value) > 0 {
+			if err := json.Unmarshal(value, &listed); err != nil {
+				return nil, fmt.Errorf("invalid value for members")
+			}
+		}
+		ids := scimMemberIDs(listed)
+		switch op {
+		case "add":
+			return appendMissing(members, ids...), nil
+		case "replace":
+			return ids, nil
+		}
+		if len(value) == 0 {
+			return nil, nil
+		}
+		return removeAll(members, ids), nil
+	case strings.HasPrefix(lower, "members[") && strings.HasSuffix(lower, "]") && op == "remove":
+		filter, err := parseSCIMFilter(path[len("members["):len(path)-1], "value")
+		if err != nil {
+			return nil, err
+		}
+		var kept []string
+		for _, id := range members {
+			if !filter.match(func(string) []string { return []string{id} }) {
+				kept = append(kept, id)
+			}
+		}
+		return kept, nil
+	}
+	return nil, fmt.Errorf("unsupported path %q", path)
+}
+
+func scimMemberIDs(members []scimMember) []string {
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = appendMissing(ids, m.Value)
+	}
+	return ids
+}
+
+func appendMissing(list []string, values ...string) []string {
+	for _, v := range values {
+		if v != "" && !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func removeAll(list, values []string) []string {
+	var out []string
+	for _, v := range list {
+		if !slices.Contains(values, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func diffSCIMMembers(before, after []string) (add, remove []string) {
+	for _, id := range after {
+		if !slices.Contains(before, id) {
+			add = append(add, id)
+		}
+	}
+	for _, id := range before {
+		if !slices.Contains(after, id) {
+			remove = append(remove, id)
+		}
+	}
+	return add, remove
+}
+
+func scimUserAttributes(u auth.User) func(string) []string {
+	return func(attr string) []string {
+		switch attr {
+		case "id":
+			return []string{u.ID}
+		case "username":
+			return []string{u.Username}
+		case "externalid":
+			if id := provisionedFromUser(u).ExternalID; id != "" {
+				return []string{id}
+			}
+		case "active":
+			return []string{strconv.FormatBool(!u.Disabled)}
+		case "emails", "emails.value":
+			if u.Email != "" {
+				return []string{u.Email}
+			}
+		}
+		return nil
+	}
+}
+
+func scimGroupAttributes(g scimGroup) func(string) []string {
+	return func(attr string) []string {
+		switch attr {
+		case "id", "displayname":
+			return []string{g.ID}
+		case "members", "members.value":
+			return scimMemberIDs(g.Members)
+		}
+		return nil
+	}
+}
+
+type scimCondition struct {
+	attr, op, value string
+}
+
+// scimFilter is a conjunction of conditions. It covers the filters identity
+// providers send in practice, such as `userName eq "alice"`; "or", "not" and
+// grouping are rejected.
+type scimFilter []scimCondition
+
+func parseSCIMFilter(expr string, attrs ...string) (scimFilter, error) {
+	tokens, err := scimFilterTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	var filter scimFilter
+	for len(tokens) > 0 {
+		if len(filter) > 0 {
+			if !strings.EqualFold(tokens[0], "and") {
+				return nil, fmt.Errorf("unsupported filter operator %q", tokens[0])
+			}
+			tokens = tokens[1:]
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("incomplete filter")
+		}
+		c := scimCondition{attr: strings.ToLower(tokens[0]), op: strings.ToLower(tokens[1])}
+		if !slices.Contains(attrs, c.attr) {
+			return nil, fmt.Errorf("unsupported filter attribute %q", tokens[0])
+		}
+		tokens = tokens[2:]
+		switch c.op {
+		case "pr":
+		case "eq", "ne", "co", "sw", "ew":
+			if len(tokens) == 0 {
+				return nil, fmt.Errorf("incomplete filter")
+			}
+			c.value, tokens = tokens[0], tokens[1:]
+		default:
+			return nil, fmt.Errorf("unsupported filter operator %q", c.op)
+		}
+		filter = append(filter, c)
+	}
+	return filter, nil
+}
+
+// scimFilterTokens splits a filter into words and unquoted string values.
+func scimFilterTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ':
+			i++
+		case c == '"':
+			var value string
+			end := i + 1
+			for ; end < len(expr) && expr[end] != '"'; end++ {
+				if expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			if err := json.Unmarshal([]byte(expr[i:end+1]), &value); err != nil {
+				return nil, fmt.Errorf("invalid string in filter")
+			}
+			tokens = append(tokens, value)
+			i = end + 1
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			return nil, fmt.Errorf("grouping is not supported in filters")
+		default:
+			end := strings.IndexAny(expr[i:], " \"()[]")
+			if end < 0 {
+				end = len(expr) - i
+			}
+			tokens = append(tokens, expr[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+func (f scimFilter) match(values func(attr string) []string) bool {
+	for _, c := range f {
+		if !c.match(values(c.attr)) {
+			return false
+		}
+	}
+	return true
+}
+
+// match compares case-insensitively except for identifiers, which SCIM
+// defines as case-exact.
+func (c scimCondition) match(values []string) bool {
+	if c.op == "pr" {
+		return len(values) > 0
+	}
+	exact := c.attr == "id" || c.attr == "externalid" || c.attr == "value" || c.attr == "members" || c.attr == "members.value"
+	want := c.value
+	if !exact {
+		want = strings.ToLower(want)
+	}
+	for _, v := range values {
+		if !exact {
+			v = strings.ToLower(v)
+		}
+		var ok bool
+		switch c.op {
+		case "eq", "ne":
+			ok = v == want
+		case "co":
+			ok = strings.Contains(v, want)
+		case "sw":
+			ok = strings.HasPrefix(v, want)
+		case "ew":
+			ok = strings.HasSuffix(v, want)
+		}
+		if ok {
+			return c.op != "ne"
+		}
+	}
+	return c.op == "ne"
+}
+
+func writeSCIMList(w http.ResponseWriter, r *http.Request, resources []any) {
+	start, count := 1, scimMaxResults
+	if v, err := strconv.Atoi(r.URL.Query().Get("startIndex")); err == nil && v > 1 {
+		start = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && v >= 0 && v < count {
+		count = v
+	}
+	page := []any{}
+	if start <= len(resources) {
+		page = resources[start-1 : min(len(resources), start-1+count)]
+	}
+	writeSCIMJSON(w, http.StatusOK, map[string]any{
+		"schemas":      []string{scimListSchema},
+		"totalResults": len(resources),
+		"startIndex":   start,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+func writeSCIMJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(payload)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIMJSON(w, status, body)
+}
+
+func writeSCIMServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", "user not found")
+	case errors.Is(err, auth.ErrRoleNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", "group not found")
+	case errors.Is(err, auth.ErrUsernameTaken), errors.Is(err, auth.ErrRoleExists):
+		writeSCIMError(w, http.StatusConflict, "uniqueness", err.Error())
+	case errors.Is(err, auth.ErrInvalidUserInput), errors.Is(err, auth.ErrInvalidRole):
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.Is(err, auth.ErrRoleReserved):
+		writeSCIMError(w, http.StatusBadRequest, "mutability", err.Error())
+	case errors.Is(err, auth.ErrRoleInUse):
+		writeSCIMError(w, http.StatusConflict, "", "group role is held by accounts outside scim")
+	default:
+		writeSCIMError(w, http.StatusInternalServerError, "", "scim request failed")
+	}
+}
+
+// writeSCIMMemberError reports an unknown member as a bad value rather than
+// a missing group.
+func writeSCIMMemberError(w http.ResponseWriter, err error) {
+	if errors.Is(err, auth.ErrUserNotFound) {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "unknown group member")
+		return
+	}
+	writeSCIMServiceError(w, err)
+}
@@ -3,16 +3,22 @@ package httpserver
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"myconnectionsvr/modern-mcs/internal/auth"
@@ -22,12 +28,91 @@ import (
 )
 
 type AuthService interface {
-	Login(username, password string) (auth.Session, error)
+	Login(username, password string, client auth.ClientInfo) (auth.Session, error)
 	ValidateToken(token string) (auth.Session, error)
 	Logout(token string) error
+	Refresh(refreshToken string, client auth.ClientInfo) (auth.Session, error)
 	ChangePassword(token, currentPassword, newPassword string) error
-	ListSessionViews() []auth.SessionView
+	ListSessionViews() ([]auth.SessionView, error)
+	ListUserSessionViews(userID, currentID string) ([]auth.SessionView, error)
 	RevokeSessionByID(sessionID string) error
+	RevokeOtherSessions(token string) (int, error)
+	RevokeUserSessions(userID string) error
+	Permissions(roles []string) ([]string, error)
+}
+
+type UserService interface {
+	ListUsers() ([]auth.User, error)
+	GetUser(id string) (auth.User, error)
+	CreateUser(username, password, email string, roles []string) (auth.User, error)
+	UpdateUser(id, username, email string, roles []string) (auth.User, error)
+	DeleteUser(id string) error
+	ResetUserPassword(id, newPassword string) error
+	SetUserStatus(id string, disabled bool, expiresAt *time.Time) (auth.User, error)
+}
+
+type PasswordResetService interface {
+	PasswordResetEnabled() bool
+	RequestPasswordReset(username string) error
+	ConfirmPasswordReset(token, newPassword string) (auth.User, error)
+}
+
+type WebAuthnService interface {
+	WebAuthnEnabled() bool
+	BeginWebAuthnRegistration(token string) (auth.WebAuthnCreationOptions, error)
+	FinishWebAuthnRegistration(token, name string, resp auth.WebAuthnCredentialResponse) (auth.WebAuthnCredential, error)
+	ListWebAuthnCredentials(token string) ([]auth.WebAuthnCredential, error)
+	DeleteWebAuthnCredential(token, credentialID string) error
+	BeginWebAuthnLogin(username string) (auth.WebAuthnRequestOptions, error)
+	FinishWebAuthnLogin(resp auth.WebAuthnCredentialResponse, client auth.ClientInfo) (auth.Session, error)
+	BeginWebAuthnMFA(mfaToken string) (auth.WebAuthnRequestOptions, error)
+	CompleteWebAuthnMFA(mfaToken string, resp auth.WebAuthnCredentialResponse, client auth.ClientInfo) (auth.Session, error)
+}
+
+type MFAService interface {
+	CompleteMFAChallenge(mfaToken, code string, client auth.ClientInfo) (auth.Session, []string, error)
+	BeginChallengeEnrollment(mfaToken string) (auth.MFAEnrollment, error)
+	MFAStatus(token string) (auth.MFAStatus, error)
+	BeginMFAEnrollment(token string) (auth.MFAEnrollment, error)
+	ConfirmMFAEnrollment(token, code string) ([]string, error)
+	ResetUserMFA(userID string) error
+	MFARequiredRoles() ([]string, error)
+	SetMFARequiredRoles(roles []string) error
+}
+
+type OIDCService interface {
+	OIDCEnabled() bool
+	BeginOIDCLogin(ctx context.Context) (authURL, state string, err error)
+	CompleteOIDCLogin(ctx context.Context, state, code string, client auth.ClientInfo) (auth.Session, error)
+}
+
+type AccessTokenService interface {
+	JWTEnabled() bool
+	JWKS() ([]byte, error)
+}
+
+type LockoutService interface {
+	ListLoginAttempts() ([]auth.LoginAttempt, error)
+	ClearLoginAttempts(key string) error
+}
+
+type APITokenService interface {
+	CreateAPIToken(userID, name string, scopes []string, ttl time.Duration) (auth.APIToken, string, error)
+	ListAPITokens(userID string) ([]auth.APIToken, error)
+	RevokeAPIToken(id, ownerID string) error
+}
+
+type ImpersonationService interface {
+	Impersonate(token, targetID string, client auth.ClientInfo) (auth.Session, error)
+	EndImpersonation(token string) (auth.Session, error)
+}
+
+type RoleService interface {
+	ListRoles() ([]auth.Role, error)
+	GetRole(name string) (auth.Role, error)
+	CreateRole(name, description string, permissions []string) (auth.Role, error)
+	UpdateRole(name, description string, permissions []string) (auth.Role, error)
+	DeleteRole(name string) error
 }
 
 type SQLProfileService interface {
@@ -50,20 +135,58 @@ type AuditLogger interface {
 
 type Deps struct {
 	Auth            AuthService
+	Users           UserService
+	MFA             MFAService
+	Lockouts        LockoutService
+	OIDC            OIDCService
+	ClientCerts     ClientCertService
+	AccessTokens    AccessTokenService
+	WebAuthn        WebAuthnService
+	APITokens       APITokenService
+	Impersonation   ImpersonationService
+	Roles           RoleService
+	SCIM            SCIMService
+	PasswordReset   PasswordResetService
 	SQLProfiles     SQLProfileService
 	Migrations      MigrationService
 	Audit           AuditLogger
 	FrontendDistDir string
+	SessionCookie   config.SessionCookieConfig
+	// TrustedProxies are the peers allowed to name the client in
+	// X-Forwarded-For or X-Real-IP.
+	TrustedProxies []netip.Prefix
+	// Logger receives server events outside of requests, such as
+	// certificate reloads; nil uses slog.Default().
+	Logger *slog.Logger
 }
 
 type Server struct {
 	httpServer *http.Server
+	// redirect is the plain HTTP listener that sends clients to HTTPS; nil
+	// when not configured.
+	redirect *http.Server
+	tls      config.TLSConfig
+	log      *slog.Logger
+	// background tracks work handlers leave running after they answer,
+	// which Shutdown waits for.
+	background *sync.WaitGroup
+
+	mu    sync.Mutex
+	files *tlsFiles
 }
 
 func New(cfg config.HTTPConfig, deps Deps) *Server {
-	handler := NewHandler(deps)
+	background := new(sync.WaitGroup)
+	handler := newHandler(deps, background)
+	log := deps.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	if cfg.TLS.CertFile != "" && cfg.TLS.HSTSMaxAge > 0 {
+		handler = hstsMiddleware(handler, cfg.TLS.HSTSMaxAge, cfg.TLS.HSTSIncludeSubdomains)
+	}
 
-	return &Server{
+	s := &Server{
 		httpServer: &http.Server{
 			Addr:         cfg.Addr,
 			Handler:      loggingMiddleware(handler),
@@ -71,10 +194,27 @@ func New(cfg config.HTTPConfig, deps Deps) *Server {
 			WriteTimeout: cfg.WriteTimeout,
 			IdleTimeout:  60 * time.Second,
 		},
+		tls:        cfg.TLS,
+		log:        log,
+		background: background,
+	}
+	if cfg.TLS.CertFile != "" && cfg.TLS.RedirectAddr != "" {
+		s.redirect = &http.Server{
+			Addr:         cfg.TLS.RedirectAddr,
+			Handler:      httpsRedirectHandler(cfg.Addr),
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  60 * time.Second,
+		}
 	}
+	return s
 }
 
 func NewHandler(deps Deps) http.Handler {
+	return newHandler(deps, new(sync.WaitGroup))
+}
+
+func newHandler(deps Deps, background *sync.WaitGroup) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
@@ -90,12 +230,31 @@ func NewHandler(deps Deps) http.Handler {
 	})
 
 	registerAuthHandlers(mux, deps)
+	registerPasswordResetHandlers(mux, deps, background)
+	registerMFAHandlers(mux, deps)
+	registerOIDCHandlers(mux, deps)
+	registerJWKSHandlers(mux, deps)
+	registerWebAuthnHandlers(mux, deps)
+	registerOwnSessionHandlers(mux, deps)
+	registerImpersonationHandlers(mux, deps)
 	registerSessionAdminHandlers(mux, deps)
+	registerLockoutHandlers(mux, deps)
+	registerAPITokenHandlers(mux, deps)
+	registerUserAdminHandlers(mux, deps)
+	registerRoleHandlers(mux, deps)
+	registerSCIMHandlers(mux, deps)
 	registerSQLProfileHandlers(mux, deps)
 	registerMigrationHandlers(mux, deps)
 	registerFrontendHandlers(mux, deps.FrontendDistDir)
 
-	return mux
+	var handler http.Handler = mux
+	if deps.ClientCerts != nil {
+		handler = clientCertMiddleware(handler, deps.ClientCerts, deps.Audit)
+	}
+	if deps.SessionCookie.Enabled {
+		handler = sessionCookieMiddleware(handler)
+	}
+	return clientIPMiddleware(auditIdentityMiddleware(handler), deps.TrustedProxies)
 }
 
 func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
@@ -110,8 +269,9 @@ func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
 		}
 
 		var req struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			SessionCookie bool   `json:"session_cookie"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, http.StatusBadRequest, "invalid request body")
@@ -122,11 +282,25 @@ func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
 			return
 		}
 
-		session, err := deps.Auth.Login(req.Username, req.Password)
+		session, err := deps.Auth.Login(req.Username, req.Password, clientInfo(r))
 		if err != nil {
+			if writeLoginBlocked(w, r, deps, req.Username, "", err) {
+				return
+			}
+			var mfaErr *auth.MFARequiredError
+			if errors.As(err, &mfaErr) {
+				auditReq(deps.Audit, r, mfaErr.Challenge.Username, "auth.login", "", "mfa_required", "", "")
+				writeMFARequired(w, mfaErr.Challenge)
+				return
+			}
+			if outcome := inactiveAccountOutcome(err); outcome != "" {
+				auditReq(deps.Audit, r, req.Username, "auth.login", "", outcome, "", "")
+				writeDomainError(w, err, "login failed")
+				return
+			}
 			if errors.Is(err, auth.ErrInvalidCredentials) {
 				auditReq(deps.Audit, r, req.Username, "auth.login", "", "failed", "", "invalid credentials")
-				writeError(w, http.StatusUnauthorized, "invalid credentials")
+				writeDomainError(w, err, "login failed")
 				return
 			}
 			auditReq(deps.Audit, r, req.Username, "auth.login", "", "failed", "", err.Error())
@@ -135,16 +309,7 @@ func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
 		}
 		auditReq(deps.Audit, r, session.Username, "auth.login", "", "success", session.ID, "")
 
-		writeJSON(w, http.StatusOK, map[string]any{
-			"token":      session.Token,
-			"session_id": session.ID,
-			"user": map[string]any{
-				"id":       session.UserID,
-				"username": session.Username,
-				"roles":    session.Roles,
-			},
-			"expires_at": session.ExpiresAt.UTC().Format(time.RFC3339),
-		})
+		writeSessionResponse(w, deps.SessionCookie, session, req.SessionCookie, nil)
 	})
 
 	mux.HandleFunc("/v1/auth/me", func(w http.ResponseWriter, r *http.Request) {
@@ -156,13 +321,31 @@ func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
 		if !ok {
 			return
 		}
+		perms, err := deps.Auth.Permissions(session.Roles)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "resolve permissions failed")
+			return
+		}
 
-		writeJSON(w, http.StatusOK, map[string]any{
-			"id":         session.UserID,
-			"username":   session.Username,
-			"roles":      session.Roles,
-			"expires_at": session.ExpiresAt.UTC().Format(time.RFC3339),
-		})
+		resp := map[string]any{
+			"id":          session.UserID,
+			"username":    session.Username,
+			"roles":       session.Roles,
+			"permissions": perms,
+			"expires_at":  session.ExpiresAt.UTC().Format(time.RFC3339),
+
+			"password_change_required": session.PasswordChangeRequired,
+		}
+		if session.ClientCertificate != "" {
+			resp["client_certificate"] = session.ClientCertificate
+		}
+		if session.ImpersonatorID != "" {
+			resp["impersonator"] = map[string]string{
+				"id":       session.ImpersonatorID,
+				"username": session.ImpersonatorUsername,
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
 	})
 
 	mux.HandleFunc("/v1/auth/logout", func(w http.ResponseWriter, r *http.Request) {
@@ -180,121 +363,1647 @@ func registerAuthHandlers(mux *http.ServeMux, deps Deps) {
 			return
 		}
 		session, _ := deps.Auth.ValidateToken(token)
+		noteAuditIdentity(r, session)
 		if err := deps.Auth.Logout(token); err != nil {
 			auditReq(deps.Audit, r, session.Username, "auth.logout", "", "failed", session.ID, "invalid token")
 			writeError(w, http.StatusUnauthorized, "invalid token")
 			return
 		}
 		auditReq(deps.Audit, r, session.Username, "auth.logout", "", "success", session.ID, "")
+		if deps.SessionCookie.Enabled {
+			clearSessionCookies(w, deps.SessionCookie)
+		}
 		w.WriteHeader(http.StatusNoContent)
 	})
 
+	mux.HandleFunc("/v1/auth/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.Auth == nil {
+			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+			return
+		}
+
+		var req struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		// Browsers send the refresh token as a cookie and get the new tokens
+		// back the same way.
+		fromCookie := false
+		if req.RefreshToken == "" && deps.SessionCookie.Enabled {
+			if c, err := r.Cookie(refreshCookieName); err == nil && c.Value != "" {
+				if !validCSRFToken(r) {
+					writeError(w, http.StatusForbidden, "missing or invalid csrf token")
+					return
+				}
+				req.RefreshToken = c.Value
+				fromCookie = true
+			}
+		}
+		if req.RefreshToken == "" {
+			writeError(w, http.StatusBadRequest, "refresh_token is required")
+			return
+		}
+
+		session, err := deps.Auth.Refresh(req.RefreshToken, clientInfo(r))
+		if err != nil {
+			if errors.Is(err, auth.ErrRefreshTokenReused) {
+				auditReq(deps.Audit, r, "", "auth.refresh", "", "reuse_detected", "", "session family revoked")
+				writeDomainError(w, err, "refresh failed")
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidToken) {
+				auditReq(deps.Audit, r, "", "auth.refresh", "", "failed", "", "invalid refresh token")
+				writeDomainError(w, err, "refresh failed")
+				return
+			}
+			auditReq(deps.Audit, r, "", "auth.refresh", "", "failed", "", err.Error())
+			writeError(w, http.StatusInternalServerError, "refresh failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.refresh", "", "success", session.ID, "")
+
+		writeSessionResponse(w, deps.SessionCookie, session, fromCookie, nil)
+	})
+
 	mux.HandleFunc("/v1/auth/change-password", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		if deps.Auth == nil {
-			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+		if deps.Auth == nil {
+			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+			return
+		}
+		token, err := extractBearerToken(r.Header.Get("Authorization"))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		session, _ := deps.Auth.ValidateToken(token)
+		noteAuditIdentity(r, session)
+
+		var req struct {
+			CurrentPassword string `json:"current_password"`
+			NewPassword     string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.CurrentPassword == "" || req.NewPassword == "" {
+			writeError(w, http.StatusBadRequest, "current_password and new_password are required")
+			return
+		}
+
+		if err := deps.Auth.ChangePassword(token, req.CurrentPassword, req.NewPassword); err != nil {
+			if errors.Is(err, auth.ErrWeakPassword) {
+				auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, "weak password: "+passwordRejectReason(err))
+				writeDomainError(w, err, "change password failed")
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrInvalidCredentials) {
+				auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, "invalid credentials or token")
+				writeDomainError(w, err, "change password failed")
+				return
+			}
+			auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "change password failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "success", session.ID, "")
+		if deps.SessionCookie.Enabled {
+			// The service may be configured to end the calling session too.
+			if _, err := deps.Auth.ValidateToken(token); err != nil {
+				clearSessionCookies(w, deps.SessionCookie)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// maxPendingPasswordResets bounds the reset mails being prepared at once.
+// Requests beyond it are dropped rather than queued, so a flood of them
+// cannot pile up goroutines or mailer connections.
+const maxPendingPasswordResets = 16
+
+// Reset requests are limited per client IP and per username before they are
+// queued, so that one client cannot fill the queue or flood a mailbox.
+const (
+	passwordResetWindow      = 15 * time.Minute
+	passwordResetPerIP       = 10
+	passwordResetPerUsername = 3
+)
+
+func registerPasswordResetHandlers(mux *http.ServeMux, deps Deps, background *sync.WaitGroup) {
+	pending := make(chan struct{}, maxPendingPasswordResets)
+	perIP := newRequestLimiter(passwordResetPerIP, passwordResetWindow)
+	perUsername := newRequestLimiter(passwordResetPerUsername, passwordResetWindow)
+	var dropped atomic.Int64
+	log := deps.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	enabled := func(w http.ResponseWriter) bool {
+		if deps.PasswordReset == nil || !deps.PasswordReset.PasswordResetEnabled() {
+			writeError(w, http.StatusNotFound, "password reset is not enabled")
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/v1/auth/password-reset/request", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Username == "" {
+			writeError(w, http.StatusBadRequest, "username is required")
+			return
+		}
+		// Checking the IP first keeps one client from using up the
+		// allowance of usernames it does not own.
+		if !perIP.allow(clientIP(r)) || !perUsername.allow(strings.ToLower(strings.TrimSpace(req.Username))) {
+			auditReq(deps.Audit, r, req.Username, "auth.password_reset_request", "", "throttled", "", "")
+			w.Header().Set("Retry-After", retryAfterSeconds(passwordResetWindow))
+			writeError(w, http.StatusTooManyRequests, "too many password reset requests")
+			return
+		}
+		// The mail is sent in the background and the answer is always the
+		// same, so neither the status nor the response time tells the caller
+		// whether the account exists, or whether the request was dropped.
+		select {
+		case pending <- struct{}{}:
+			bg := r.Clone(context.WithoutCancel(r.Context()))
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				defer func() { <-pending }()
+				if err := deps.PasswordReset.RequestPasswordReset(req.Username); err != nil {
+					auditReq(deps.Audit, bg, req.Username, "auth.password_reset_request", "", "failed", "", err.Error())
+					return
+				}
+				auditReq(deps.Audit, bg, req.Username, "auth.password_reset_request", "", "accepted", "", "")
+			}()
+		default:
+			n := dropped.Add(1)
+			log.Warn("password reset request dropped", "pending", maxPendingPasswordResets, "dropped_total", n)
+			auditReq(deps.Audit, r, req.Username, "auth.password_reset_request", "", "dropped", "", "too many pending password resets")
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "if the account exists and has an email address, a reset link has been sent"})
+	})
+
+	mux.HandleFunc("/v1/auth/password-reset/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			Token       string `json:"token"`
+			NewPassword string `json:"new_password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Token == "" || req.NewPassword == "" {
+			writeError(w, http.StatusBadRequest, "token and new_password are required")
+			return
+		}
+		u, err := deps.PasswordReset.ConfirmPasswordReset(req.Token, req.NewPassword)
+		if err != nil {
+			if errors.Is(err, auth.ErrWeakPassword) {
+				auditReq(deps.Audit, r, "", "auth.password_reset_confirm", "", "failed", "", "weak password: "+passwordRejectReason(err))
+				writeDomainError(w, err, "password reset failed")
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidResetToken) {
+				auditReq(deps.Audit, r, "", "auth.password_reset_confirm", "", "failed", "", "invalid or expired token")
+				writeDomainError(w, err, "password reset failed")
+				return
+			}
+			auditReq(deps.Audit, r, "", "auth.password_reset_confirm", "", "failed", "", err.Error())
+			writeError(w, http.StatusInternalServerError, "password reset failed")
+			return
+		}
+		auditReq(deps.Audit, r, u.Username, "auth.password_reset_confirm", u.ID, "success", "", "sessions revoked")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func sessionResponse(session auth.Session) map[string]any {
+	return map[string]any{
+		"token":      session.Token,
+		"session_id": session.ID,
+		"user": map[string]any{
+			"id":       session.UserID,
+			"username": session.Username,
+			"roles":    session.Roles,
+		},
+		"expires_at":         session.ExpiresAt.UTC().Format(time.RFC3339),
+		"refresh_token":      session.RefreshToken,
+		"refresh_expires_at": session.AbsoluteExpiresAt.UTC().Format(time.RFC3339),
+
+		"password_change_required": session.PasswordChangeRequired,
+	}
+}
+
+// registerOIDCHandlers serves single sign-on through the configured issuer.
+// Beginning a login stores state on the server, so it is limited per client
+// IP. The state is also set as a cookie that the callback must carry, so a
+// callback URL from someone else's login cannot sign the browser in.
+const (
+	oidcLoginBeginWindow = time.Minute
+	oidcLoginBeginPerIP  = 20
+	oidcStateCookieName  = "mcs_oidc_state"
+	oidcStateCookiePath  = "/v1/auth/oidc/callback"
+	oidcStateCookieTTL   = 10 * time.Minute
+)
+
+func registerOIDCHandlers(mux *http.ServeMux, deps Deps) {
+	loginBegins := newRequestLimiter(oidcLoginBeginPerIP, oidcLoginBeginWindow)
+
+	mux.HandleFunc("/v1/auth/oidc/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.OIDC == nil || !deps.OIDC.OIDCEnabled() {
+			writeError(w, http.StatusNotFound, "oidc login not configured")
+			return
+		}
+		if !loginBegins.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", retryAfterSeconds(oidcLoginBeginWindow))
+			writeError(w, http.StatusTooManyRequests, "too many oidc login attempts")
+			return
+		}
+		authURL, state, err := deps.OIDC.BeginOIDCLogin(r.Context())
+		if err != nil {
+			auditReq(deps.Audit, r, "", "auth.oidc.login", "", "failed", "", err.Error())
+			if errors.Is(err, auth.ErrTooManyOIDCLogins) {
+				writeDomainError(w, err, "oidc login failed")
+				return
+			}
+			writeError(w, http.StatusBadGateway, "identity provider unavailable")
+			return
+		}
+		http.SetCookie(w, oidcStateCookie(deps.SessionCookie, state, int(oidcStateCookieTTL.Seconds())))
+		http.Redirect(w, r, authURL, http.StatusFound)
+	})
+
+	mux.HandleFunc("/v1/auth/oidc/callback", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.OIDC == nil || !deps.OIDC.OIDCEnabled() {
+			writeError(w, http.StatusNotFound, "oidc login not configured")
+			return
+		}
+		q := r.URL.Query()
+		if idpErr := q.Get("error"); idpErr != "" {
+			auditReq(deps.Audit, r, "", "auth.login", "", "failed", "", "oidc: "+idpErr)
+			writeError(w, http.StatusUnauthorized, "identity provider denied login")
+			return
+		}
+		state := q.Get("state")
+		if c, err := r.Cookie(oidcStateCookieName); err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+			auditReq(deps.Audit, r, "", "auth.login", "", "failed", "", "oidc: state does not match cookie")
+			writeDomainError(w, auth.ErrInvalidOIDCState, "oidc login failed")
+			return
+		}
+		// The state is spent once it matches, whatever the outcome.
+		http.SetCookie(w, oidcStateCookie(deps.SessionCookie, "", -1))
+
+		session, err := deps.OIDC.CompleteOIDCLogin(r.Context(), state, q.Get("code"), clientInfo(r))
+		if err != nil {
+			var mfaErr *auth.MFARequiredError
+			if errors.As(err, &mfaErr) {
+				auditReq(deps.Audit, r, mfaErr.Challenge.Username, "auth.login", "", "mfa_required", "", "oidc")
+				writeMFARequired(w, mfaErr.Challenge)
+				return
+			}
+			if outcome := inactiveAccountOutcome(err); outcome != "" {
+				auditReq(deps.Audit, r, "", "auth.login", "", outcome, "", "oidc")
+				writeDomainError(w, err, "oidc login failed")
+				return
+			}
+			auditReq(deps.Audit, r, "", "auth.login", "", "failed", "", "oidc: "+err.Error())
+			switch {
+			case errors.Is(err, auth.ErrInvalidOIDCState), errors.Is(err, auth.ErrInvalidIDToken), errors.Is(err, auth.ErrExternalAccountConflict):
+				writeDomainError(w, err, "oidc login failed")
+			case errors.Is(err, auth.ErrInvalidUserInput):
+				writeErrorCode(w, http.StatusUnauthorized, "invalid_id_token", "identity provider returned an invalid username")
+			default:
+				writeError(w, http.StatusBadGateway, "oidc login failed")
+			}
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.login", "", "success", session.ID, "oidc")
+		// The callback is reached by a browser redirect, so it always uses
+		// cookies when they are enabled.
+		writeSessionResponse(w, deps.SessionCookie, session, true, nil)
+	})
+}
+
+// registerJWKSHandlers publishes the keys that signed access tokens are
+// verified with, for services that validate them without calling back.
+func registerJWKSHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.AccessTokens == nil || !deps.AccessTokens.JWTEnabled() {
+			writeError(w, http.StatusNotFound, "signed access tokens not configured")
+			return
+		}
+		b, err := deps.AccessTokens.JWKS()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to load signing keys")
+			return
+		}
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		// Keys are published a full rotation before use, so a short cache
+		// never misses a signing key.
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(b)
+	})
+}
+
+// registerWebAuthnHandlers serves passkey registration, passwordless login
+// and passkeys as the second factor of a password login. Options and
+// credentials use the browser's JSON serialization of WebAuthn.
+// Passwordless login can be begun without credentials and answers with the
+// user's credential IDs, so it is limited per client IP.
+const (
+	webauthnLoginBeginWindow = time.Minute
+	webauthnLoginBeginPerIP  = 20
+)
+
+func registerWebAuthnHandlers(mux *http.ServeMux, deps Deps) {
+	loginBegins := newRequestLimiter(webauthnLoginBeginPerIP, webauthnLoginBeginWindow)
+	enabled := func(w http.ResponseWriter) bool {
+		if deps.WebAuthn == nil || !deps.WebAuthn.WebAuthnEnabled() {
+			writeError(w, http.StatusNotFound, "webauthn not configured")
+			return false
+		}
+		return true
+	}
+
+	mux.HandleFunc("/v1/auth/webauthn/register/begin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok || !enabled(w) {
+			return
+		}
+		// Credentials outlive the session, so they may only be added by the
+		// user in person.
+		if session.APITokenID != "" || session.ImpersonatorID != "" {
+			writeError(w, http.StatusForbidden, "webauthn credentials must be registered from a login session")
+			return
+		}
+		opts, err := deps.WebAuthn.BeginWebAuthnRegistration(session.Token)
+		if err != nil {
+			if errors.Is(err, auth.ErrTooManyWebAuthnCeremonies) {
+				writeDomainError(w, err, "webauthn registration failed")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "webauthn registration failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, opts)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/register/finish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok || !enabled(w) {
+			return
+		}
+		if session.APITokenID != "" || session.ImpersonatorID != "" {
+			writeError(w, http.StatusForbidden, "webauthn credentials must be registered from a login session")
+			return
+		}
+		var req struct {
+			Name       string                          `json:"name"`
+			Credential auth.WebAuthnCredentialResponse `json:"credential"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		cred, err := deps.WebAuthn.FinishWebAuthnRegistration(session.Token, req.Name, req.Credential)
+		if err != nil {
+			auditReq(deps.Audit, r, session.Username, "webauthn.register", "", "failed", session.ID, err.Error())
+			writeDomainError(w, err, "webauthn registration failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "webauthn.register", cred.ID, "success", session.ID, "name="+cred.Name)
+		writeJSON(w, http.StatusCreated, cred)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/credentials", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok || !enabled(w) {
+			return
+		}
+		creds, err := deps.WebAuthn.ListWebAuthnCredentials(session.Token)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "list webauthn credentials failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": creds})
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/credentials/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok || !enabled(w) {
+			return
+		}
+		if session.APITokenID != "" || session.ImpersonatorID != "" {
+			writeError(w, http.StatusForbidden, "webauthn credentials must be removed from a login session")
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/v1/auth/webauthn/credentials/")
+		if id == "" || strings.Contains(id, "/") {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if err := deps.WebAuthn.DeleteWebAuthnCredential(session.Token, id); err != nil {
+			if errors.Is(err, auth.ErrWebAuthnCredentialNotFound) || errors.Is(err, auth.ErrLoginSessionRequired) {
+				writeDomainError(w, err, "delete webauthn credential failed")
+				return
+			}
+			auditReq(deps.Audit, r, session.Username, "webauthn.delete", id, "failed", session.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "delete webauthn credential failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "webauthn.delete", id, "success", session.ID, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/login/begin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if !loginBegins.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", retryAfterSeconds(webauthnLoginBeginWindow))
+			writeError(w, http.StatusTooManyRequests, "too many webauthn login attempts")
+			return
+		}
+		opts, err := deps.WebAuthn.BeginWebAuthnLogin(req.Username)
+		if err != nil {
+			if errors.Is(err, auth.ErrTooManyWebAuthnCeremonies) {
+				writeDomainError(w, err, "webauthn login failed")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "webauthn login failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, opts)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/login/finish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			Credential    auth.WebAuthnCredentialResponse `json:"credential"`
+			SessionCookie bool                            `json:"session_cookie"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		session, err := deps.WebAuthn.FinishWebAuthnLogin(req.Credential, clientInfo(r))
+		if err != nil {
+			writeWebAuthnLoginError(w, r, deps, err)
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.login", "", "success", session.ID, "webauthn")
+		writeSessionResponse(w, deps.SessionCookie, session, req.SessionCookie, nil)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/mfa/begin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		opts, err := deps.WebAuthn.BeginWebAuthnMFA(req.MFAToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidMFAChallenge), errors.Is(err, auth.ErrTooManyWebAuthnCeremonies):
+				writeDomainError(w, err, "webauthn verification failed")
+			case errors.Is(err, auth.ErrWebAuthnCredentialNotFound):
+				writeErrorCode(w, http.StatusConflict, "no_webauthn_credentials", "no webauthn credentials registered")
+			default:
+				writeError(w, http.StatusInternalServerError, "webauthn verification failed")
+			}
+			return
+		}
+		writeJSON(w, http.StatusOK, opts)
+	})
+
+	mux.HandleFunc("/v1/auth/webauthn/mfa/finish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !enabled(w) {
+			return
+		}
+		var req struct {
+			MFAToken      string                          `json:"mfa_token"`
+			Credential    auth.WebAuthnCredentialResponse `json:"credential"`
+			SessionCookie bool                            `json:"session_cookie"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		session, err := deps.WebAuthn.CompleteWebAuthnMFA(req.MFAToken, req.Credential, clientInfo(r))
+		if err != nil {
+			if writeLoginBlocked(w, r, deps, "", "mfa webauthn", err) {
+				return
+			}
+			if errors.Is(err, auth.ErrInvalidMFAChallenge) {
+				auditReq(deps.Audit, r, "", "auth.mfa.verify", "", "failed", "", "invalid challenge")
+				writeDomainError(w, err, "webauthn login failed")
+				return
+			}
+			writeWebAuthnLoginError(w, r, deps, err)
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.mfa.verify", "", "success", session.ID, "webauthn")
+		auditReq(deps.Audit, r, session.Username, "auth.login", "", "success", session.ID, "mfa webauthn")
+		writeSessionResponse(w, deps.SessionCookie, session, req.SessionCookie, nil)
+	})
+}
+
+// writeMFARequired answers a login whose first factor was accepted with the
+// challenge the client completes through the MFA or WebAuthn endpoints.
+func writeMFARequired(w http.ResponseWriter, challenge auth.MFAChallenge) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mfa_required":        true,
+		"mfa_token":           challenge.Token,
+		"enrollment_required": challenge.EnrollmentRequired,
+		"webauthn":            challenge.WebAuthn,
+		"expires_at":          challenge.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// writeLoginBlocked answers a *auth.LoginBlockedError from a login step and
+// reports whether err was one.
+func writeLoginBlocked(w http.ResponseWriter, r *http.Request, deps Deps, username, detail string, err error) bool {
+	var blockedErr *auth.LoginBlockedError
+	if !errors.As(err, &blockedErr) {
+		return false
+	}
+	w.Header().Set("Retry-After", retryAfterSeconds(blockedErr.RetryAfter))
+	if blockedErr.Locked {
+		auditReq(deps.Audit, r, username, "auth.login", "", "locked", "", detail)
+		writeError(w, http.StatusLocked, "account temporarily locked")
+		return true
+	}
+	auditReq(deps.Audit, r, username, "auth.login", "", "throttled", "", detail)
+	writeError(w, http.StatusTooManyRequests, "too many login attempts")
+	return true
+}
+
+func writeWebAuthnLoginError(w http.ResponseWriter, r *http.Request, deps Deps, err error) {
+	if outcome := inactiveAccountOutcome(err); outcome != "" {
+		auditReq(deps.Audit, r, "", "auth.login", "", outcome, "", "webauthn")
+		writeDomainError(w, err, "webauthn login failed")
+		return
+	}
+	switch {
+	case errors.Is(err, auth.ErrInvalidWebAuthnCeremony), errors.Is(err, auth.ErrInvalidWebAuthnResponse), errors.Is(err, auth.ErrWebAuthnCredentialNotFound):
+		auditReq(deps.Audit, r, "", "auth.login", "", "failed", "", "webauthn: "+err.Error())
+		writeErrorCode(w, http.StatusUnauthorized, "webauthn_verification_failed", "webauthn verification failed")
+	default:
+		auditReq(deps.Audit, r, "", "auth.login", "", "failed", "", "webauthn: "+err.Error())
+		writeError(w, http.StatusInternalServerError, "webauthn login failed")
+	}
+}
+
+func registerMFAHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/auth/mfa/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+		var req struct {
+			MFAToken      string `json:"mfa_token"`
+			Code          string `json:"code"`
+			SessionCookie bool   `json:"session_cookie"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.MFAToken == "" || req.Code == "" {
+			writeError(w, http.StatusBadRequest, "mfa_token and code are required")
+			return
+		}
+
+		session, recoveryCodes, err := deps.MFA.CompleteMFAChallenge(req.MFAToken, req.Code, clientInfo(r))
+		if err != nil {
+			if writeLoginBlocked(w, r, deps, "", "mfa", err) {
+				return
+			}
+			if outcome := inactiveAccountOutcome(err); outcome != "" {
+				auditReq(deps.Audit, r, "", "auth.login", "", outcome, "", "mfa")
+				writeDomainError(w, err, "mfa verification failed")
+				return
+			}
+			switch {
+			case errors.Is(err, auth.ErrInvalidMFACode):
+				auditReq(deps.Audit, r, "", "auth.mfa.verify", "", "failed", "", "invalid code")
+				writeDomainError(w, err, "mfa verification failed")
+			case errors.Is(err, auth.ErrInvalidMFAChallenge):
+				auditReq(deps.Audit, r, "", "auth.mfa.verify", "", "failed", "", "invalid challenge")
+				writeDomainError(w, err, "mfa verification failed")
+			case errors.Is(err, auth.ErrMFAEnrollmentNotBegun):
+				writeDomainError(w, err, "mfa verification failed")
+			default:
+				auditReq(deps.Audit, r, "", "auth.mfa.verify", "", "failed", "", err.Error())
+				writeError(w, http.StatusInternalServerError, "mfa verification failed")
+			}
+			return
+		}
+		detail := ""
+		if len(recoveryCodes) > 0 {
+			detail = "enrolled"
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.mfa.verify", "", "success", session.ID, detail)
+		auditReq(deps.Audit, r, session.Username, "auth.login", "", "success", session.ID, "mfa")
+
+		var extra map[string]any
+		if len(recoveryCodes) > 0 {
+			extra = map[string]any{"recovery_codes": recoveryCodes}
+		}
+		writeSessionResponse(w, deps.SessionCookie, session, req.SessionCookie, extra)
+	})
+
+	mux.HandleFunc("/v1/auth/mfa/enroll/challenge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+		var req struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		enrollment, err := deps.MFA.BeginChallengeEnrollment(req.MFAToken)
+		if err != nil {
+			writeDomainError(w, err, "mfa enrollment failed")
+			return
+		}
+		auditReq(deps.Audit, r, "", "auth.mfa.enroll", "", "started", "", "via login challenge")
+		writeJSON(w, http.StatusOK, enrollment)
+	})
+
+	mux.HandleFunc("/v1/auth/mfa", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+		status, err := deps.MFA.MFAStatus(session.Token)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "mfa status failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+
+	mux.HandleFunc("/v1/auth/mfa/enroll", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		if session.APITokenID != "" || session.ImpersonatorID != "" {
+			writeDomainError(w, auth.ErrLoginSessionRequired, "mfa enrollment failed")
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+		enrollment, err := deps.MFA.BeginMFAEnrollment(session.Token)
+		if err != nil {
+			if errors.Is(err, auth.ErrMFAAlreadyEnabled) || errors.Is(err, auth.ErrLoginSessionRequired) {
+				writeDomainError(w, err, "mfa enrollment failed")
+				return
+			}
+			auditReq(deps.Audit, r, session.Username, "auth.mfa.enroll", "", "failed", session.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "mfa enrollment failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.mfa.enroll", "", "started", session.ID, "")
+		writeJSON(w, http.StatusOK, enrollment)
+	})
+
+	mux.HandleFunc("/v1/auth/mfa/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		if session.APITokenID != "" || session.ImpersonatorID != "" {
+			writeDomainError(w, auth.ErrLoginSessionRequired, "mfa confirmation failed")
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		recoveryCodes, err := deps.MFA.ConfirmMFAEnrollment(session.Token, req.Code)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrInvalidMFACode):
+				auditReq(deps.Audit, r, session.Username, "auth.mfa.confirm", "", "failed", session.ID, "invalid code")
+				writeErrorCode(w, http.StatusBadRequest, "invalid_mfa_code", "invalid mfa code")
+			case errors.Is(err, auth.ErrMFAEnrollmentNotBegun), errors.Is(err, auth.ErrMFAAlreadyEnabled), errors.Is(err, auth.ErrLoginSessionRequired):
+				writeDomainError(w, err, "mfa confirmation failed")
+			default:
+				auditReq(deps.Audit, r, session.Username, "auth.mfa.confirm", "", "failed", session.ID, err.Error())
+				writeError(w, http.StatusInternalServerError, "mfa confirmation failed")
+			}
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.mfa.confirm", "", "success", session.ID, "")
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": recoveryCodes})
+	})
+
+	mux.HandleFunc("/v1/system/mfa-policy", func(w http.ResponseWriter, r *http.Request) {
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermMFAPolicyManage)
+		if !ok {
+			return
+		}
+		if deps.MFA == nil {
+			writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			roles, err := deps.MFA.MFARequiredRoles()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "load mfa policy failed")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"required_roles": roles})
+		case http.MethodPut:
+			var req struct {
+				RequiredRoles []string `json:"required_roles"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if err := deps.MFA.SetMFARequiredRoles(req.RequiredRoles); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "mfa.policy.update", "", "failed", adminSession.ID, err.Error())
+				writeError(w, http.StatusInternalServerError, "update mfa policy failed")
+				return
+			}
+			roles, _ := deps.MFA.MFARequiredRoles()
+			auditReq(deps.Audit, r, adminSession.Username, "mfa.policy.update", "", "success", adminSession.ID, "required_roles="+strings.Join(roles, ","))
+			writeJSON(w, http.StatusOK, map[string]any{"required_roles": roles})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
+
+// registerOwnSessionHandlers lets any signed-in user see and end their own
+// sessions without session admin permissions.
+func registerOwnSessionHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/auth/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		sessions, err := deps.Auth.ListUserSessionViews(session.UserID, session.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to list sessions")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": sessions})
+	})
+
+	mux.HandleFunc("/v1/auth/sessions/revoke-others", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		revoked, err := deps.Auth.RevokeOtherSessions(session.Token)
+		if err != nil {
+			auditReq(deps.Audit, r, session.Username, "session.revoke_others", session.UserID, "failed", session.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "revoke sessions failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "session.revoke_others", session.UserID, "success", session.ID, fmt.Sprintf("revoked=%d", revoked))
+		writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+	})
+}
+
+// registerImpersonationHandlers lets an admin act as another user for a
+// limited time. Audit records written with the resulting session name both
+// the user and the admin behind it.
+func registerImpersonationHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/auth/impersonate/end", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		if deps.Impersonation == nil {
+			writeError(w, http.StatusServiceUnavailable, "impersonation service unavailable")
+			return
+		}
+		if _, err := deps.Impersonation.EndImpersonation(session.Token); err != nil {
+			if errors.Is(err, auth.ErrNotImpersonating) {
+				writeDomainError(w, err, "end impersonation failed")
+				return
+			}
+			auditReq(deps.Audit, r, session.Username, "auth.impersonate.end", session.UserID, "failed", session.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "end impersonation failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "auth.impersonate.end", session.UserID, "success", session.ID, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/v1/auth/impersonate/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermUserImpersonate)
+		if !ok {
+			return
+		}
+		if deps.Impersonation == nil {
+			writeError(w, http.StatusServiceUnavailable, "impersonation service unavailable")
+			return
+		}
+		targetID := strings.TrimPrefix(r.URL.Path, "/v1/auth/impersonate/")
+		if targetID == "" || strings.Contains(targetID, "/") {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		session, err := deps.Impersonation.Impersonate(adminSession.Token, targetID, clientInfo(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrImpersonationNotAllowed):
+				auditReq(deps.Audit, r, adminSession.Username, "auth.impersonate", targetID, "denied", adminSession.ID, "")
+				writeDomainError(w, err, "impersonation failed")
+			case errors.Is(err, auth.ErrUserNotFound):
+				writeDomainError(w, err, "impersonation failed")
+			default:
+				if outcome := inactiveAccountOutcome(err); outcome != "" {
+					auditReq(deps.Audit, r, adminSession.Username, "auth.impersonate", targetID, outcome, adminSession.ID, "")
+					writeDomainError(w, err, "impersonation failed")
+					return
+				}
+				auditReq(deps.Audit, r, adminSession.Username, "auth.impersonate", targetID, "failed", adminSession.ID, err.Error())
+				writeError(w, http.StatusInternalServerError, "impersonation failed")
+			}
+			return
+		}
+		auditReq(deps.Audit, r, adminSession.Username, "auth.impersonate", targetID, "success", adminSession.ID, "username="+session.Username+" session="+session.ID)
+
+		writeSessionResponse(w, deps.SessionCookie, session, false, map[string]any{
+			"impersonator": map[string]string{
+				"id":       session.ImpersonatorID,
+				"username": session.ImpersonatorUsername,
+			},
+		})
+	})
+}
+
+func registerSessionAdminHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/system/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermSessionRead)
+		if !ok {
+			return
+		}
+		if deps.Auth == nil {
+			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+			return
+		}
+		sessions, err := deps.Auth.ListSessionViews()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to list sessions")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": sessions})
+		auditReq(deps.Audit, r, adminSession.Username, "session.list", "", "success", adminSession.ID, "")
+	})
+
+	mux.HandleFunc("/v1/system/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermSessionRevoke)
+		if !ok {
+			return
+		}
+		if deps.Auth == nil {
+			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+			return
+		}
+
+		sessionID := strings.TrimPrefix(r.URL.Path, "/v1/system/sessions/")
+		sessionID = strings.TrimSpace(sessionID)
+		if sessionID == "" || strings.Contains(sessionID, "/") {
+			writeError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+		err := deps.Auth.RevokeSessionByID(sessionID)
+		if err != nil {
+			if errors.Is(err, auth.ErrInvalidToken) {
+				auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "failed", adminSession.ID, "session not found")
+				writeErrorCode(w, http.StatusNotFound, "session_not_found", "session not found")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "failed", adminSession.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "revoke session failed")
+			return
+		}
+		auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "success", adminSession.ID, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func registerLockoutHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/system/lockouts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if _, ok := requireSession(w, r, deps.Auth, auth.PermLockoutRead); !ok {
+			return
+		}
+		if deps.Lockouts == nil {
+			writeError(w, http.StatusServiceUnavailable, "lockout service unavailable")
+			return
+		}
+		items, err := deps.Lockouts.ListLoginAttempts()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "list lockouts failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": items})
+	})
+
+	mux.HandleFunc("/v1/system/lockouts/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermLockoutClear)
+		if !ok {
+			return
+		}
+		if deps.Lockouts == nil {
+			writeError(w, http.StatusServiceUnavailable, "lockout service unavailable")
+			return
+		}
+
+		// Keys are "username:<name>" or "ip:<addr>"; usernames may contain '/'.
+		key := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/v1/system/lockouts/"))
+		if key == "" {
+			writeError(w, http.StatusBadRequest, "invalid lockout key")
+			return
+		}
+		if err := deps.Lockouts.ClearLoginAttempts(key); err != nil {
+			if errors.Is(err, auth.ErrLoginAttemptNotFound) {
+				writeDomainError(w, err, "clear lockout failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "auth.lockout.clear", key, "failed", adminSession.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, "clear lockout failed")
+			return
+		}
+		auditReq(deps.Audit, r, adminSession.Username, "auth.lockout.clear", key, "success", adminSession.ID, "")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func registerAPITokenHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		if deps.APITokens == nil {
+			writeError(w, http.StatusServiceUnavailable, "api token service unavailable")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			items, err := deps.APITokens.ListAPITokens(session.UserID)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "list api tokens failed")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"items": items})
+		case http.MethodPost:
+			// A leaked API token must not be able to mint fresh credentials.
+			if session.APITokenID != "" {
+				writeError(w, http.StatusForbidden, "api tokens cannot create api tokens")
+				return
+			}
+			// Nor may an admin keep access to the account after impersonation ends.
+			if session.ImpersonatorID != "" {
+				writeError(w, http.StatusForbidden, "impersonation sessions cannot create api tokens")
+				return
+			}
+			var req struct {
+				Name             string   `json:"name"`
+				Scopes           []string `json:"scopes"`
+				ExpiresInSeconds int64    `json:"expires_in_seconds"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			created, token, err := deps.APITokens.CreateAPIToken(session.UserID, req.Name, req.Scopes, time.Duration(req.ExpiresInSeconds)*time.Second)
+			if err != nil {
+				auditReq(deps.Audit, r, session.Username, "api_token.create", req.Name, "failed", session.ID, err.Error())
+				if errors.Is(err, auth.ErrInvalidAPIToken) {
+					writeDomainError(w, err, "create api token failed")
+					return
+				}
+				writeError(w, http.StatusInternalServerError, "create api token failed")
+				return
+			}
+			auditReq(deps.Audit, r, session.Username, "api_token.create", created.ID, "success", session.ID, "name="+created.Name)
+			writeJSON(w, http.StatusCreated, struct {
+				auth.APIToken
+				Token string `json:"token"`
+			}{APIToken: created, Token: token})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/v1/auth/tokens/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		session, ok := requireSession(w, r, deps.Auth, "")
+		if !ok {
+			return
+		}
+		revokeAPIToken(w, r, deps, session, strings.TrimPrefix(r.URL.Path, "/v1/auth/tokens/"), session.UserID)
+	})
+
+	mux.HandleFunc("/v1/system/api-tokens", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermAPITokenRead)
+		if !ok {
+			return
+		}
+		if deps.APITokens == nil {
+			writeError(w, http.StatusServiceUnavailable, "api token service unavailable")
+			return
+		}
+		items, err := deps.APITokens.ListAPITokens("")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "list api tokens failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": items})
+		auditReq(deps.Audit, r, adminSession.Username, "api_token.list", "", "success", adminSession.ID, "")
+	})
+
+	mux.HandleFunc("/v1/system/api-tokens/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermAPITokenRevoke)
+		if !ok {
+			return
+		}
+		revokeAPIToken(w, r, deps, adminSession, strings.TrimPrefix(r.URL.Path, "/v1/system/api-tokens/"), "")
+	})
+}
+
+func revokeAPIToken(w http.ResponseWriter, r *http.Request, deps Deps, session auth.Session, id, ownerID string) {
+	if deps.APITokens == nil {
+		writeError(w, http.StatusServiceUnavailable, "api token service unavailable")
+		return
+	}
+	id = strings.TrimSpace(id)
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusBadRequest, "invalid api token id")
+		return
+	}
+	if err := deps.APITokens.RevokeAPIToken(id, ownerID); err != nil {
+		if errors.Is(err, auth.ErrAPITokenNotFound) {
+			auditReq(deps.Audit, r, session.Username, "api_token.revoke", id, "failed", session.ID, "api token not found")
+			writeDomainError(w, err, "revoke api token failed")
+			return
+		}
+		auditReq(deps.Audit, r, session.Username, "api_token.revoke", id, "failed", session.ID, err.Error())
+		writeError(w, http.StatusInternalServerError, "revoke api token failed")
+		return
+	}
+	auditReq(deps.Audit, r, session.Username, "api_token.revoke", id, "success", session.ID, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func registerUserAdminHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermUserRead, auth.PermUserWrite))
+		if !ok {
+			return
+		}
+		if deps.Users == nil {
+			writeError(w, http.StatusServiceUnavailable, "user service unavailable")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			users, err := deps.Users.ListUsers()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "list users failed")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"items": users})
+			auditReq(deps.Audit, r, adminSession.Username, "user.list", "", "success", adminSession.ID, "")
+		case http.MethodPost:
+			var req struct {
+				Username string   `json:"username"`
+				Password string   `json:"password"`
+				Email    string   `json:"email"`
+				Roles    []string `json:"roles"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.Password == "" {
+				writeError(w, http.StatusBadRequest, "password is required")
+				return
+			}
+			if !requireRolesWithinCaller(w, deps.Auth, adminSession, req.Roles) {
+				auditReq(deps.Audit, r, adminSession.Username, "user.create", req.Username, "denied", adminSession.ID, "roles="+strings.Join(req.Roles, ","))
+				return
+			}
+			created, err := deps.Users.CreateUser(req.Username, req.Password, req.Email, req.Roles)
+			if err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.create", req.Username, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "create user failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.create", created.ID, "success", adminSession.ID, "username="+created.Username)
+			writeJSON(w, http.StatusCreated, created)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	mux.HandleFunc("/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermUserRead, auth.PermUserWrite))
+		if !ok {
+			return
+		}
+		if deps.Users == nil {
+			writeError(w, http.StatusServiceUnavailable, "user service unavailable")
+			return
+		}
+
+		trimmed := strings.TrimPrefix(r.URL.Path, "/v1/users/")
+		if id, ok := strings.CutSuffix(trimmed, "/mfa/reset"); ok {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if id == "" || strings.Contains(id, "/") {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			if deps.MFA == nil {
+				writeError(w, http.StatusServiceUnavailable, "mfa service unavailable")
+				return
+			}
+			if !requireManageableUser(w, r, deps, adminSession, id, "user.mfa_reset") {
+				return
+			}
+			if err := deps.MFA.ResetUserMFA(id); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.mfa_reset", id, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "reset mfa failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.mfa_reset", id, "success", adminSession.ID, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if id, ok := strings.CutSuffix(trimmed, "/revoke-sessions"); ok {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if id == "" || strings.Contains(id, "/") {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			if !requireManageableUser(w, r, deps, adminSession, id, "user.revoke_sessions") {
+				return
+			}
+			if err := deps.Auth.RevokeUserSessions(id); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.revoke_sessions", id, "failed", adminSession.ID, err.Error())
+				writeError(w, http.StatusInternalServerError, "revoke sessions failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.revoke_sessions", id, "success", adminSession.ID, "")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if id, ok := strings.CutSuffix(trimmed, "/status"); ok {
+			if r.Method != http.MethodPut {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if id == "" || strings.Contains(id, "/") {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			var req struct {
+				Disabled  bool       `json:"disabled"`
+				ExpiresAt *time.Time `json:"expires_at"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if id == adminSession.UserID && (req.Disabled || req.ExpiresAt != nil) {
+				writeError(w, http.StatusBadRequest, "cannot disable or expire own account")
+				return
+			}
+			if !requireManageableUser(w, r, deps, adminSession, id, "user.status") {
+				return
+			}
+			updated, err := deps.Users.SetUserStatus(id, req.Disabled, req.ExpiresAt)
+			if err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.status", id, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "update user status failed")
+				return
+			}
+			detail := fmt.Sprintf("disabled=%t", updated.Disabled)
+			if updated.ExpiresAt != nil {
+				detail += " expires_at=" + updated.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.status", id, "success", adminSession.ID, detail)
+			writeJSON(w, http.StatusOK, updated)
 			return
 		}
-		token, err := extractBearerToken(r.Header.Get("Authorization"))
-		if err != nil {
-			writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		if id, ok := strings.CutSuffix(trimmed, "/reset-password"); ok {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+				return
+			}
+			if id == "" || strings.Contains(id, "/") {
+				writeError(w, http.StatusNotFound, "user not found")
+				return
+			}
+			var req struct {
+				NewPassword string `json:"new_password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if req.NewPassword == "" {
+				writeError(w, http.StatusBadRequest, "new_password is required")
+				return
+			}
+			if !requireManageableUser(w, r, deps, adminSession, id, "user.reset_password") {
+				return
+			}
+			if err := deps.Users.ResetUserPassword(id, req.NewPassword); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.reset_password", id, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "reset password failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.reset_password", id, "success", adminSession.ID, "")
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		session, _ := deps.Auth.ValidateToken(token)
 
-		var req struct {
-			CurrentPassword string `json:"current_password"`
-			NewPassword     string `json:"new_password"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeError(w, http.StatusBadRequest, "invalid request body")
-			return
-		}
-		if req.CurrentPassword == "" || req.NewPassword == "" {
-			writeError(w, http.StatusBadRequest, "current_password and new_password are required")
+		id := trimmed
+		if id == "" || strings.Contains(id, "/") {
+			writeError(w, http.StatusNotFound, "user not found")
 			return
 		}
 
-		if err := deps.Auth.ChangePassword(token, req.CurrentPassword, req.NewPassword); err != nil {
-			if errors.Is(err, auth.ErrWeakPassword) {
-				auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, "weak password")
-				writeError(w, http.StatusBadRequest, "new password does not meet policy")
+		switch r.Method {
+		case http.MethodGet:
+			u, err := deps.Users.GetUser(id)
+			if err != nil {
+				writeDomainError(w, err, "get user failed")
 				return
 			}
-			if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrInvalidCredentials) {
-				auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, "invalid credentials or token")
-				writeError(w, http.StatusUnauthorized, "invalid credentials or token")
+			writeJSON(w, http.StatusOK, u)
+		case http.MethodPut:
+			var req struct {
+				Username string   `json:"username"`
+				Email    *string  `json:"email"`
+				Roles    []string `json:"roles"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
 				return
 			}
-			auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "failed", session.ID, err.Error())
-			writeError(w, http.StatusInternalServerError, "change password failed")
-			return
+			current, ok := manageableUser(w, r, deps, adminSession, id, "user.update")
+			if !ok {
+				return
+			}
+			if !requireRolesWithinCaller(w, deps.Auth, adminSession, req.Roles) {
+				auditReq(deps.Audit, r, adminSession.Username, "user.update", id, "denied", adminSession.ID, "roles="+strings.Join(req.Roles, ","))
+				return
+			}
+			// Clients that predate email addresses leave the field out; keep
+			// the stored address rather than clearing it.
+			email := current.Email
+			if req.Email != nil {
+				email = *req.Email
+			}
+			updated, err := deps.Users.UpdateUser(id, req.Username, email, req.Roles)
+			if err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.update", id, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "update user failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.update", updated.ID, "success", adminSession.ID, "username="+updated.Username)
+			writeJSON(w, http.StatusOK, updated)
+		case http.MethodDelete:
+			if id == adminSession.UserID {
+				writeError(w, http.StatusBadRequest, "cannot delete own account")
+				return
+			}
+			if !requireManageableUser(w, r, deps, adminSession, id, "user.delete") {
+				return
+			}
+			if err := deps.Users.DeleteUser(id); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "user.delete", id, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "delete user failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "user.delete", id, "success", adminSession.ID, "")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		}
-		auditReq(deps.Audit, r, session.Username, "auth.change_password", "", "success", session.ID, "")
-		w.WriteHeader(http.StatusNoContent)
 	})
 }
 
-func registerSessionAdminHandlers(mux *http.ServeMux, deps Deps) {
-	mux.HandleFunc("/v1/system/sessions", func(w http.ResponseWriter, r *http.Request) {
+func registerRoleHandlers(mux *http.ServeMux, deps Deps) {
+	mux.HandleFunc("/v1/system/permissions", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		if _, ok := requireSession(w, r, deps.Auth, auth.PermRoleRead); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"items": auth.AllPermissions()})
+	})
+
+	mux.HandleFunc("/v1/system/roles", func(w http.ResponseWriter, r *http.Request) {
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermRoleRead, auth.PermRoleWrite))
 		if !ok {
 			return
 		}
-		if deps.Auth == nil {
-			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+		if deps.Roles == nil {
+			writeError(w, http.StatusServiceUnavailable, "role service unavailable")
 			return
 		}
-		writeJSON(w, http.StatusOK, map[string]any{"items": deps.Auth.ListSessionViews()})
-		auditReq(deps.Audit, r, adminSession.Username, "session.list", "", "success", adminSession.ID, "")
-	})
 
-	mux.HandleFunc("/v1/system/sessions/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
+		switch r.Method {
+		case http.MethodGet:
+			roles, err := deps.Roles.ListRoles()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "list roles failed")
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"items": roles})
+		case http.MethodPost:
+			var req struct {
+				Name        string   `json:"name"`
+				Description string   `json:"description"`
+				Permissions []string `json:"permissions"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			if !requireWithinCaller(w, deps.Auth, adminSession, req.Permissions) {
+				auditReq(deps.Audit, r, adminSession.Username, "role.create", req.Name, "denied", adminSession.ID, "permissions="+strings.Join(req.Permissions, ","))
+				return
+			}
+			created, err := deps.Roles.CreateRole(req.Name, req.Description, req.Permissions)
+			if err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "role.create", req.Name, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "create role failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "role.create", created.Name, "success", adminSession.ID, "permissions="+strings.Join(created.Permissions, ","))
+			writeJSON(w, http.StatusCreated, created)
+		default:
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
-			return
 		}
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+	})
+
+	mux.HandleFunc("/v1/system/roles/", func(w http.ResponseWriter, r *http.Request) {
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermRoleRead, auth.PermRoleWrite))
 		if !ok {
 			return
 		}
-		if deps.Auth == nil {
-			writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
+		if deps.Roles == nil {
+			writeError(w, http.StatusServiceUnavailable, "role service unavailable")
 			return
 		}
 
-		sessionID := strings.TrimPrefix(r.URL.Path, "/v1/system/sessions/")
-		sessionID = strings.TrimSpace(sessionID)
-		if sessionID == "" || strings.Contains(sessionID, "/") {
-			writeError(w, http.StatusBadRequest, "invalid session id")
+		name := strings.TrimPrefix(r.URL.Path, "/v1/system/roles/")
+		if name == "" || strings.Contains(name, "/") {
+			writeError(w, http.StatusNotFound, "role not found")
 			return
 		}
-		err := deps.Auth.RevokeSessionByID(sessionID)
-		if err != nil {
-			if errors.Is(err, auth.ErrInvalidToken) {
-				auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "failed", adminSession.ID, "session not found")
-				writeError(w, http.StatusNotFound, "session not found")
+
+		switch r.Method {
+		case http.MethodGet:
+			role, err := deps.Roles.GetRole(name)
+			if err != nil {
+				writeDomainError(w, err, "get role failed")
 				return
 			}
-			auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "failed", adminSession.ID, err.Error())
-			writeError(w, http.StatusInternalServerError, "revoke session failed")
-			return
+			writeJSON(w, http.StatusOK, role)
+		case http.MethodPut:
+			var req struct {
+				Description string   `json:"description"`
+				Permissions []string `json:"permissions"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+			// Both the permissions taken away and those added must be the
+			// caller's own.
+			current, err := deps.Roles.GetRole(name)
+			if err != nil {
+				writeDomainError(w, err, "update role failed")
+				return
+			}
+			if !requireWithinCaller(w, deps.Auth, adminSession, append(current.Permissions, req.Permissions...)) {
+				auditReq(deps.Audit, r, adminSession.Username, "role.update", name, "denied", adminSession.ID, "permissions="+strings.Join(req.Permissions, ","))
+				return
+			}
+			updated, err := deps.Roles.UpdateRole(name, req.Description, req.Permissions)
+			if err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "role.update", name, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "update role failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "role.update", updated.Name, "success", adminSession.ID, "permissions="+strings.Join(updated.Permissions, ","))
+			writeJSON(w, http.StatusOK, updated)
+		case http.MethodDelete:
+			if err := deps.Roles.DeleteRole(name); err != nil {
+				auditReq(deps.Audit, r, adminSession.Username, "role.delete", name, "failed", adminSession.ID, err.Error())
+				writeDomainError(w, err, "delete role failed")
+				return
+			}
+			auditReq(deps.Audit, r, adminSession.Username, "role.delete", name, "success", adminSession.ID, "")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 		}
-		auditReq(deps.Audit, r, adminSession.Username, "session.revoke", sessionID, "success", adminSession.ID, "")
-		w.WriteHeader(http.StatusNoContent)
 	})
 }
 
 func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 	mux.HandleFunc("/v1/sql-profiles", func(w http.ResponseWriter, r *http.Request) {
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermSQLProfileRead, auth.PermSQLProfileWrite))
 		if !ok {
 			return
 		}
@@ -314,11 +2023,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 			}
 			created, err := deps.SQLProfiles.Create(req)
 			if err != nil {
-				if errors.Is(err, sqlprofile.ErrInvalidInput) {
-					writeError(w, http.StatusBadRequest, err.Error())
-					return
-				}
-				writeError(w, http.StatusInternalServerError, "create profile failed")
+				writeDomainError(w, err, "create profile failed")
 				return
 			}
 			auditReq(deps.Audit, r, adminSession.Username, "sqlprofile.create", created.ID, "success", adminSession.ID, "")
@@ -329,7 +2034,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 	})
 
 	mux.HandleFunc("/v1/sql-profiles/", func(w http.ResponseWriter, r *http.Request) {
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		adminSession, ok := requireSession(w, r, deps.Auth, methodPermission(r, auth.PermSQLProfileRead, auth.PermSQLProfileWrite))
 		if !ok {
 			return
 		}
@@ -348,11 +2053,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 		case http.MethodGet:
 			p, err := deps.SQLProfiles.Get(id)
 			if err != nil {
-				if errors.Is(err, sqlprofile.ErrNotFound) {
-					writeError(w, http.StatusNotFound, "profile not found")
-					return
-				}
-				writeError(w, http.StatusInternalServerError, "get profile failed")
+				writeDomainError(w, err, "get profile failed")
 				return
 			}
 			writeJSON(w, http.StatusOK, p)
@@ -364,15 +2065,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 			}
 			updated, err := deps.SQLProfiles.Update(id, req)
 			if err != nil {
-				if errors.Is(err, sqlprofile.ErrInvalidInput) {
-					writeError(w, http.StatusBadRequest, err.Error())
-					return
-				}
-				if errors.Is(err, sqlprofile.ErrNotFound) {
-					writeError(w, http.StatusNotFound, "profile not found")
-					return
-				}
-				writeError(w, http.StatusInternalServerError, "update profile failed")
+				writeDomainError(w, err, "update profile failed")
 				return
 			}
 			auditReq(deps.Audit, r, adminSession.Username, "sqlprofile.update", updated.ID, "success", adminSession.ID, "")
@@ -380,11 +2073,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 		case http.MethodDelete:
 			err := deps.SQLProfiles.Delete(id)
 			if err != nil {
-				if errors.Is(err, sqlprofile.ErrNotFound) {
-					writeError(w, http.StatusNotFound, "profile not found")
-					return
-				}
-				writeError(w, http.StatusInternalServerError, "delete profile failed")
+				writeDomainError(w, err, "delete profile failed")
 				return
 			}
 			auditReq(deps.Audit, r, adminSession.Username, "sqlprofile.delete", id, "success", adminSession.ID, "")
@@ -397,7 +2086,7 @@ func registerSQLProfileHandlers(mux *http.ServeMux, deps Deps) {
 
 func registerMigrationHandlers(mux *http.ServeMux, deps Deps) {
 	mux.HandleFunc("/v1/system/migrations", func(w http.ResponseWriter, r *http.Request) {
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermMigrationRead)
 		if !ok {
 			return
 		}
@@ -425,7 +2114,7 @@ func registerMigrationHandlers(mux *http.ServeMux, deps Deps) {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermMigrationRead)
 		if !ok {
 			return
 		}
@@ -447,7 +2136,7 @@ func registerMigrationHandlers(mux *http.ServeMux, deps Deps) {
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		adminSession, ok := requireSession(w, r, deps.Auth, "admin")
+		adminSession, ok := requireSession(w, r, deps.Auth, auth.PermMigrationApply)
 		if !ok {
 			return
 		}
@@ -513,40 +2202,119 @@ func registerFrontendHandlers(mux *http.ServeMux, distDir string) {
 	})
 }
 
-func requireSession(w http.ResponseWriter, r *http.Request, authSvc AuthService, requiredRole string) (auth.Session, bool) {
+// passwordChangeRequiredCode lets clients route to the change-password page
+// instead of treating the 403 as a missing permission.
+const passwordChangeRequiredCode = "password_change_required"
+
+// requireSession authenticates the request and, when requiredPermission is
+// non-empty, checks that the session's roles grant it.
+func requireSession(w http.ResponseWriter, r *http.Request, authSvc AuthService, requiredPermission string) (auth.Session, bool) {
 	if authSvc == nil {
 		writeError(w, http.StatusServiceUnavailable, "auth service unavailable")
 		return auth.Session{}, false
 	}
-	token, err := extractBearerToken(r.Header.Get("Authorization"))
-	if err != nil {
-		writeError(w, http.StatusUnauthorized, "missing or invalid bearer token")
-		return auth.Session{}, false
+	var session auth.Session
+	if token, err := extractBearerToken(r.Header.Get("Authorization")); err == nil {
+		session, err = authSvc.ValidateToken(token)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return auth.Session{}, false
+		}
+	} else {
+		var ok bool
+		if session, ok = clientCertSession(w, r); !ok {
+			return auth.Session{}, false
+		}
 	}
-
-	session, err := authSvc.ValidateToken(token)
-	if err != nil {
-		writeError(w, http.StatusUnauthorized, "invalid token")
+	noteAuditIdentity(r, session)
+	// A session whose password has expired may only look itself up; changing
+	// the password and logging out do not pass through here.
+	if session.PasswordChangeRequired && r.URL.Path != "/v1/auth/me" {
+		writeErrorCode(w, http.StatusForbidden, passwordChangeRequiredCode, "password change required")
 		return auth.Session{}, false
 	}
 
-	if requiredRole != "" && !hasRole(session.Roles, requiredRole) {
-		writeError(w, http.StatusForbidden, "forbidden")
-		return auth.Session{}, false
+	if requiredPermission != "" {
+		perms, err := authSvc.Permissions(session.Roles)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "resolve permissions failed")
+			return auth.Session{}, false
+		}
+		if !hasPermission(perms, requiredPermission) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return auth.Session{}, false
+		}
 	}
 
 	return session, true
 }
 
-func hasRole(roles []string, role string) bool {
-	for _, r := range roles {
-		if strings.EqualFold(strings.TrimSpace(r), role) {
+func hasPermission(perms []string, perm string) bool {
+	for _, p := range perms {
+		if p == perm {
 			return true
 		}
 	}
 	return false
 }
 
+// requireWithinCaller refuses with 403 unless the caller holds every one of
+// perms. user:write and role:write must not reach beyond the caller's own
+// access, whether by granting roles, defining them or taking over an account
+// that has more.
+func requireWithinCaller(w http.ResponseWriter, authSvc AuthService, caller auth.Session, perms []string) bool {
+	own, err := authSvc.Permissions(caller.Roles)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "resolve permissions failed")
+		return false
+	}
+	for _, p := range perms {
+		if !hasPermission(own, strings.ToLower(strings.TrimSpace(p))) {
+			writeErrorCode(w, http.StatusForbidden, "permission_not_held", "caller does not hold permission "+p)
+			return false
+		}
+	}
+	return true
+}
+
+func requireRolesWithinCaller(w http.ResponseWriter, authSvc AuthService, caller auth.Session, roles []string) bool {
+	perms, err := authSvc.Permissions(roles)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "resolve permissions failed")
+		return false
+	}
+	return requireWithinCaller(w, authSvc, caller, perms)
+}
+
+// manageableUser loads the target of a user admin action and refuses it when
+// the target holds permissions the caller lacks.
+func manageableUser(w http.ResponseWriter, r *http.Request, deps Deps, caller auth.Session, id, action string) (auth.User, bool) {
+	u, err := deps.Users.GetUser(id)
+	if err != nil {
+		writeDomainError(w, err, "get user failed")
+		return auth.User{}, false
+	}
+	if !requireRolesWithinCaller(w, deps.Auth, caller, u.Roles) {
+		auditReq(deps.Audit, r, caller.Username, action, id, "denied", caller.ID, "target holds permissions the caller lacks")
+		return auth.User{}, false
+	}
+	return u, true
+}
+
+func requireManageableUser(w http.ResponseWriter, r *http.Request, deps Deps, caller auth.Session, id, action string) bool {
+	_, ok := manageableUser(w, r, deps, caller, id, action)
+	return ok
+}
+
+// methodPermission picks the read permission for safe methods and the write
+// permission for everything else.
+func methodPermission(r *http.Request, read, write string) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return read
+	}
+	return write
+}
+
 func extractBearerToken(authHeader string) (string, error) {
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
@@ -555,12 +2323,59 @@ func extractBearerToken(authHeader string) (string, error) {
 	return strings.TrimSpace(parts[1]), nil
 }
 
+// Start serves HTTPS when a TLS certificate is configured and plain HTTP
+// otherwise. With a redirect listener it returns when either listener stops.
 func (s *Server) Start() error {
-	return s.httpServer.ListenAndServe()
+	if s.tls.CertFile == "" {
+		return s.httpServer.ListenAndServe()
+	}
+	files, err := newTLSFiles(s.tls, s.log)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.files = files
+	s.mu.Unlock()
+	s.httpServer.TLSConfig = files.tlsConfig()
+	if s.redirect == nil {
+		return s.httpServer.ListenAndServeTLS("", "")
+	}
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.redirect.ListenAndServe() }()
+	go func() { errCh <- s.httpServer.ListenAndServeTLS("", "") }()
+	return <-errCh
+}
+
+// ReloadTLS rereads the certificate, key and client CA files without waiting
+// for the periodic change check.
+func (s *Server) ReloadTLS() error {
+	s.mu.Lock()
+	files := s.files
+	s.mu.Unlock()
+	if files == nil {
+		return fmt.Errorf("tls is not being served")
+	}
+	return files.reload()
 }
 
+// Shutdown stops accepting requests and then waits, until ctx is done, for
+// in-flight requests and the background work they started.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	if s.redirect != nil {
+		err = errors.Join(err, s.redirect.Shutdown(ctx))
+	}
+	drained := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("wait for background work: %w", ctx.Err()))
+	}
+	return err
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload any) {
@@ -569,8 +2384,12 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func writeError(w http.ResponseWriter, status int, message string) {
-	writeJSON(w, status, map[string]string{"error": message})
+func passwordRejectReason(err error) string {
+	var policyErr *auth.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return string(policyErr.Reason)
+	}
+	return "policy"
 }
 
 type statusRecorder struct {
@@ -598,6 +2417,30 @@ func loggingMiddleware(next http.Handler) http.Handler {
 
 type requestIDKey struct{}
 
+// auditIdentity records who is behind the session of the current request,
+// so that auditReq can name the admin during impersonation without every
+// handler passing the session along. auditIdentityMiddleware installs an
+// empty one and the session checks fill it in.
+type auditIdentity struct {
+	impersonatorID       string
+	impersonatorUsername string
+}
+
+type auditIdentityKey struct{}
+
+func auditIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditIdentityKey{}, &auditIdentity{})))
+	})
+}
+
+func noteAuditIdentity(r *http.Request, session auth.Session) {
+	if id, ok := r.Context().Value(auditIdentityKey{}).(*auditIdentity); ok {
+		id.impersonatorID = session.ImpersonatorID
+		id.impersonatorUsername = session.ImpersonatorUsername
+	}
+}
+
 func newRequestID() string {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
@@ -617,14 +2460,85 @@ func requestIDFromContext(ctx context.Context) string {
 	return ""
 }
 
+// inactiveAccountOutcome returns the audit outcome for sign-ins refused
+// because the account is disabled or expired, or an empty string for any
+// other error.
+func inactiveAccountOutcome(err error) string {
+	switch {
+	case errors.Is(err, auth.ErrAccountDisabled):
+		return "disabled"
+	case errors.Is(err, auth.ErrAccountExpired):
+		return "expired"
+	}
+	return ""
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return fmt.Sprintf("%d", secs)
+}
+
+type clientIPKey struct{}
+
+// clientIPMiddleware resolves the client address once per request. The
+// forwarding headers are only believed from a trusted proxy; anyone else
+// could set them to dodge the login throttle or to forge audit records.
+func clientIPMiddleware(next http.Handler, trusted []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, resolveClientIP(r, trusted))))
+	})
+}
+
 func clientIP(r *http.Request) string {
-	if fwd := strings.TrimSpace(r.Header.Get("X-Forwarded-For")); fwd != "" {
-		parts := strings.Split(fwd, ",")
-		return strings.TrimSpace(parts[0])
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// resolveClientIP walks X-Forwarded-For from the right, past the trusted
+// proxies, because only the entries they appended can be relied on. The
+// first other address is the client.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer := peerIP(r)
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !trustedProxy(addr, trusted) {
+		return peer
 	}
-	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
-		return realIP
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		hops := strings.Split(strings.Join(fwd, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !trustedProxy(addr, trusted) {
+				break
+			}
+		}
+		return addr.String()
+	}
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+	return peer
+}
+
+func trustedProxy(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
 	}
+	return false
+}
+
+func peerIP(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err == nil {
 		return host
@@ -632,6 +2546,10 @@ func clientIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+func clientInfo(r *http.Request) auth.ClientInfo {
+	return auth.ClientInfo{IP: clientIP(r), UserAgent: strings.TrimSpace(r.UserAgent())}
+}
+
 func auditReq(a AuditLogger, r *http.Request, actor, action, target, outcome, sessionID, detail string) {
 	parts := []string{
 		"rid=" + requestIDFromContext(r.Context()),
@@ -641,6 +2559,9 @@ func auditReq(a AuditLogger, r *http.Request, actor, action, target, outcome, se
 	if sessionID != "" {
 		parts = append(parts, "sid="+sessionID)
 	}
+	if id, ok := r.Context().Value(auditIdentityKey{}).(*auditIdentity); ok && id.impersonatorID != "" {
+		parts = append(parts, "impersonator="+id.impersonatorUsername, "impersonator_id="+id.impersonatorID)
+	}
 	if strings.TrimSpace(detail) != "" {
 		parts = append(parts, "detail="+strings.TrimSpace(detail))
 	}
@@ -2,16 +2,32 @@ package httpserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"myconnectionsvr/modern-mcs/internal/auth"
+	"myconnectionsvr/modern-mcs/internal/config"
 	"myconnectionsvr/modern-mcs/internal/migrations"
 	"myconnectionsvr/modern-mcs/internal/sqlprofile"
 )
@@ -20,12 +36,18 @@ type fakeAuthService struct {
 	loginFunc             func(username, password string) (auth.Session, error)
 	validateFunc          func(token string) (auth.Session, error)
 	logoutFunc            func(token string) error
+	refreshFunc           func(refreshToken string) (auth.Session, error)
 	changePasswordFunc    func(token, currentPassword, newPassword string) error
-	listSessionViewsFunc  func() []auth.SessionView
+	listSessionViewsFunc  func() ([]auth.SessionView, error)
 	revokeSessionByIDFunc func(sessionID string) error
+	permissionsFunc       func(roles []string) ([]string, error)
+
+	listUserSessionViewsFunc func(userID, currentID string) ([]auth.SessionView, error)
+	revokeOtherSessionsFunc  func(token string) (int, error)
+	revokeUserSessionsFunc   func(userID string) error
 }
 
-func (f fakeAuthService) Login(username, password string) (auth.Session, error) {
+func (f fakeAuthService) Login(username, password string, client auth.ClientInfo) (auth.Session, error) {
 	if f.loginFunc == nil {
 		return auth.Session{}, errors.New("not implemented")
 	}
@@ -46,6 +68,13 @@ func (f fakeAuthService) Logout(token string) error {
 	return f.logoutFunc(token)
 }
 
+func (f fakeAuthService) Refresh(refreshToken string, client auth.ClientInfo) (auth.Session, error) {
+	if f.refreshFunc == nil {
+		return auth.Session{}, errors.New("not implemented")
+	}
+	return f.refreshFunc(refreshToken)
+}
+
 func (f fakeAuthService) ChangePassword(token, currentPassword, newPassword string) error {
 	if f.changePasswordFunc == nil {
 		return errors.New("not implemented")
@@ -53,9 +82,9 @@ func (f fakeAuthService) ChangePassword(token, currentPassword, newPassword stri
 	return f.changePasswordFunc(token, currentPassword, newPassword)
 }
 
-func (f fakeAuthService) ListSessionViews() []auth.SessionView {
+func (f fakeAuthService) ListSessionViews() ([]auth.SessionView, error) {
 	if f.listSessionViewsFunc == nil {
-		return nil
+		return nil, nil
 	}
 	return f.listSessionViewsFunc()
 }
@@ -67,6 +96,381 @@ func (f fakeAuthService) RevokeSessionByID(sessionID string) error {
 	return f.revokeSessionByIDFunc(sessionID)
 }
 
+func (f fakeAuthService) ListUserSessionViews(userID, currentID string) ([]auth.SessionView, error) {
+	if f.listUserSessionViewsFunc == nil {
+		return nil, nil
+	}
+	return f.listUserSessionViewsFunc(userID, currentID)
+}
+
+func (f fakeAuthService) RevokeOtherSessions(token string) (int, error) {
+	if f.revokeOtherSessionsFunc == nil {
+		return 0, errors.New("not implemented")
+	}
+	return f.revokeOtherSessionsFunc(token)
+}
+
+func (f fakeAuthService) RevokeUserSessions(userID string) error {
+	if f.revokeUserSessionsFunc == nil {
+		return errors.New("not implemented")
+	}
+	return f.revokeUserSessionsFunc(userID)
+}
+
+// Permissions defaults to the built-in behaviour: admin grants everything,
+// other roles grant nothing.
+func (f fakeAuthService) Permissions(roles []string) ([]string, error) {
+	if f.permissionsFunc != nil {
+		return f.permissionsFunc(roles)
+	}
+	for _, r := range roles {
+		if r == auth.AdminRole {
+			return auth.AllPermissions(), nil
+		}
+	}
+	return nil, nil
+}
+
+type fakeUserService struct {
+	listFunc          func() ([]auth.User, error)
+	getFunc           func(id string) (auth.User, error)
+	createFunc        func(username, password, email string, roles []string) (auth.User, error)
+	updateFunc        func(id, username, email string, roles []string) (auth.User, error)
+	deleteFunc        func(id string) error
+	resetPasswordFunc func(id, newPassword string) error
+	setStatusFunc     func(id string, disabled bool, expiresAt *time.Time) (auth.User, error)
+}
+
+func (f fakeUserService) ListUsers() ([]auth.User, error) { return f.listFunc() }
+
+// GetUser defaults to a user without roles, which any caller may manage.
+func (f fakeUserService) GetUser(id string) (auth.User, error) {
+	if f.getFunc == nil {
+		return auth.User{ID: id}, nil
+	}
+	return f.getFunc(id)
+}
+func (f fakeUserService) CreateUser(username, password, email string, roles []string) (auth.User, error) {
+	return f.createFunc(username, password, email, roles)
+}
+func (f fakeUserService) UpdateUser(id, username, email string, roles []string) (auth.User, error) {
+	return f.updateFunc(id, username, email, roles)
+}
+func (f fakeUserService) DeleteUser(id string) error { return f.deleteFunc(id) }
+func (f fakeUserService) ResetUserPassword(id, newPassword string) error {
+	return f.resetPasswordFunc(id, newPassword)
+}
+func (f fakeUserService) SetUserStatus(id string, disabled bool, expiresAt *time.Time) (auth.User, error) {
+	return f.setStatusFunc(id, disabled, expiresAt)
+}
+
+type fakeImpersonationService struct {
+	impersonateFunc func(token, targetID string) (auth.Session, error)
+	endFunc         func(token string) (auth.Session, error)
+}
+
+func (f fakeImpersonationService) Impersonate(token, targetID string, client auth.ClientInfo) (auth.Session, error) {
+	return f.impersonateFunc(token, targetID)
+}
+
+func (f fakeImpersonationService) EndImpersonation(token string) (auth.Session, error) {
+	return f.endFunc(token)
+}
+
+type auditRecord struct {
+	actor, action, target, outcome, detail string
+}
+
+type recordingAudit struct {
+	events *[]auditRecord
+}
+
+func (a recordingAudit) Log(actor, action, target, outcome, detail string) error {
+	*a.events = append(*a.events, auditRecord{actor, action, target, outcome, detail})
+	return nil
+}
+
+type fakePasswordResetService struct {
+	enabled     bool
+	requestFunc func(username string) error
+	confirmFunc func(token, newPassword string) (auth.User, error)
+}
+
+func (f fakePasswordResetService) PasswordResetEnabled() bool { return f.enabled }
+func (f fakePasswordResetService) RequestPasswordReset(username string) error {
+	return f.requestFunc(username)
+}
+func (f fakePasswordResetService) ConfirmPasswordReset(token, newPassword string) (auth.User, error) {
+	return f.confirmFunc(token, newPassword)
+}
+
+type fakeMFAService struct {
+	completeFunc func(mfaToken, code string) (auth.Session, []string, error)
+}
+
+func (f fakeMFAService) CompleteMFAChallenge(mfaToken, code string, client auth.ClientInfo) (auth.Session, []string, error) {
+	return f.completeFunc(mfaToken, code)
+}
+func (f fakeMFAService) BeginChallengeEnrollment(mfaToken string) (auth.MFAEnrollment, error) {
+	return auth.MFAEnrollment{}, errors.New("not implemented")
+}
+func (f fakeMFAService) MFAStatus(token string) (auth.MFAStatus, error) {
+	return auth.MFAStatus{}, errors.New("not implemented")
+}
+func (f fakeMFAService) BeginMFAEnrollment(token string) (auth.MFAEnrollment, error) {
+	return auth.MFAEnrollment{}, errors.New("not implemented")
+}
+func (f fakeMFAService) ConfirmMFAEnrollment(token, code string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+func (f fakeMFAService) ResetUserMFA(userID string) error    { return errors.New("not implemented") }
+func (f fakeMFAService) MFARequiredRoles() ([]string, error) { return nil, nil }
+func (f fakeMFAService) SetMFARequiredRoles(roles []string) error {
+	return errors.New("not implemented")
+}
+
+type fakeLockoutService struct {
+	listFunc  func() ([]auth.LoginAttempt, error)
+	clearFunc func(key string) error
+}
+
+func (f fakeLockoutService) ListLoginAttempts() ([]auth.LoginAttempt, error) { return f.listFunc() }
+func (f fakeLockoutService) ClearLoginAttempts(key string) error             { return f.clearFunc(key) }
+
+type fakeOIDCService struct {
+	beginFunc    func() (string, error)
+	completeFunc func(state, code string) (auth.Session, error)
+}
+
+func (f fakeOIDCService) OIDCEnabled() bool { return true }
+func (f fakeOIDCService) BeginOIDCLogin(ctx context.Context) (string, string, error) {
+	authURL, err := f.beginFunc()
+	return authURL, "st-1", err
+}
+func (f fakeOIDCService) CompleteOIDCLogin(ctx context.Context, state, code string, client auth.ClientInfo) (auth.Session, error) {
+	return f.completeFunc(state, code)
+}
+
+type fakeAccessTokenService struct {
+	enabled bool
+	jwks    string
+}
+
+func (f fakeAccessTokenService) JWTEnabled() bool      { return f.enabled }
+func (f fakeAccessTokenService) JWKS() ([]byte, error) { return []byte(f.jwks), nil }
+
+type fakeClientCertService struct {
+	authenticateFunc func(cert *x509.Certificate) (auth.Session, error)
+}
+
+func (f fakeClientCertService) ClientCertEnabled() bool { return true }
+func (f fakeClientCertService) AuthenticateClientCertificate(cert *x509.Certificate, client auth.ClientInfo) (auth.Session, error) {
+	return f.authenticateFunc(cert)
+}
+
+type fakeWebAuthnService struct {
+	enabled      bool
+	finishLogin  func(resp auth.WebAuthnCredentialResponse) (auth.Session, error)
+	completeMFA  func(mfaToken string, resp auth.WebAuthnCredentialResponse) (auth.Session, error)
+	registerFunc func(token string) (auth.WebAuthnCreationOptions, error)
+}
+
+func (f fakeWebAuthnService) WebAuthnEnabled() bool { return f.enabled }
+func (f fakeWebAuthnService) BeginWebAuthnRegistration(token string) (auth.WebAuthnCreationOptions, error) {
+	return f.registerFunc(token)
+}
+func (f fakeWebAuthnService) FinishWebAuthnRegistration(token, name string, resp auth.WebAuthnCredentialResponse) (auth.WebAuthnCredential, error) {
+	return auth.WebAuthnCredential{}, errors.New("not implemented")
+}
+func (f fakeWebAuthnService) ListWebAuthnCredentials(token string) ([]auth.WebAuthnCredential, error) {
+	return nil, errors.New("not implemented")
+}
+func (f fakeWebAuthnService) DeleteWebAuthnCredential(token, credentialID string) error {
+	return errors.New("not implemented")
+}
+func (f fakeWebAuthnService) BeginWebAuthnLogin(username string) (auth.WebAuthnRequestOptions, error) {
+	return auth.WebAuthnRequestOptions{Challenge: "login-challenge", RPID: "mcs.example.com"}, nil
+}
+func (f fakeWebAuthnService) FinishWebAuthnLogin(resp auth.WebAuthnCredentialResponse, client auth.ClientInfo) (auth.Session, error) {
+	return f.finishLogin(resp)
+}
+func (f fakeWebAuthnService) BeginWebAuthnMFA(mfaToken string) (auth.WebAuthnRequestOptions, error) {
+	return auth.WebAuthnRequestOptions{}, errors.New("not implemented")
+}
+func (f fakeWebAuthnService) CompleteWebAuthnMFA(mfaToken string, resp auth.WebAuthnCredentialResponse, client auth.ClientInfo) (auth.Session, error) {
+	return f.completeMFA(mfaToken, resp)
+}
+
+type fakeSCIMService struct {
+	users map[string]auth.User
+	roles []string
+}
+
+func (f *fakeSCIMService) SCIMEnabled() bool                  { return true }
+func (f *fakeSCIMService) AuthenticateSCIM(token string) bool { return token == "scim-token" }
+func (f *fakeSCIMService) ListProvisionedUsers() ([]auth.User, error) {
+	out := make([]auth.User, 0, len(f.users))
+	for _, u := range f.users {
+		if u.AuthProvider == "scim" {
+			out = append(out, u)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+func (f *fakeSCIMService) GetProvisionedUser(id string) (auth.User, error) {
+	u, ok := f.users[id]
+	if !ok || u.AuthProvider != "scim" {
+		return auth.User{}, auth.ErrUserNotFound
+	}
+	return u, nil
+}
+func (f *fakeSCIMService) ProvisionUser(p auth.ProvisionedUser) (auth.User, error) {
+	for _, u := range f.users {
+		if u.Username == p.Username {
+			return auth.User{}, auth.ErrUsernameTaken
+		}
+	}
+	u := auth.User{ID: fmt.Sprintf("u-%d", len(f.users)), Username: p.Username, Email: p.Email, Disabled: !p.Active, AuthProvider: "scim", ExternalSubject: p.ExternalID}
+	f.users[u.ID] = u
+	return u, nil
+}
+func (f *fakeSCIMService) UpdateProvisionedUser(id string, p auth.ProvisionedUser) (auth.User, error) {
+	u, err := f.GetProvisionedUser(id)
+	if err != nil {
+		return auth.User{}, err
+	}
+	u.Username, u.Email, u.Disabled, u.ExternalSubject = p.Username, p.Email, !p.Active, p.ExternalID
+	f.users[id] = u
+	return u, nil
+}
+func (f *fakeSCIMService) DeprovisionUser(id string) (auth.User, error) {
+	u, err := f.GetProvisionedUser(id)
+	if err != nil {
+		return auth.User{}, err
+	}
+	u.Disabled = true
+	f.users[id] = u
+	return u, nil
+}
+func (f *fakeSCIMService) ListProvisionedRoles() ([]auth.Role, error) {
+	out := make([]auth.Role, 0, len(f.roles))
+	for _, name := range f.roles {
+		out = append(out, auth.Role{Name: name})
+	}
+	return out, nil
+}
+func (f *fakeSCIMService) GetProvisionedRole(name string) (auth.Role, error) {
+	for _, r := range f.roles {
+		if r == name {
+			return auth.Role{Name: name}, nil
+		}
+	}
+	return auth.Role{}, auth.ErrRoleNotFound
+}
+func (f *fakeSCIMService) CreateRole(name, description string, permissions []string) (auth.Role, error) {
+	name = strings.ToLower(name)
+	if _, err := f.GetProvisionedRole(name); err == nil {
+		return auth.Role{}, auth.ErrRoleExists
+	}
+	f.roles = append(f.roles, name)
+	return auth.Role{Name: name}, nil
+}
+func (f *fakeSCIMService) ReplaceRoleMembers(name string, userIDs []string) error {
+	for id, u := range f.users {
+		if u.AuthProvider == "scim" {
+			u.Roles = slices.DeleteFunc(u.Roles, func(r string) bool { return r == name })
+			f.users[id] = u
+		}
+	}
+	return f.ChangeRoleMembers(name, userIDs, nil)
+}
+func (f *fakeSCIMService) ChangeRoleMembers(name string, add, remove []string) error {
+	for _, id := range add {
+		if _, err := f.GetProvisionedUser(id); err != nil {
+			return err
+		}
+	}
+	for _, id := range add {
+		u := f.users[id]
+		u.Roles = append(u.Roles, name)
+		f.users[id] = u
+	}
+	for _, id := range remove {
+		if u, err := f.GetProvisionedUser(id); err == nil {
+			u.Roles = slices.DeleteFunc(u.Roles, func(r string) bool { return r == name })
+			f.users[id] = u
+		}
+	}
+	return nil
+}
+func (f *fakeSCIMService) DeleteProvisionedRole(name string) error {
+	if err := f.ReplaceRoleMembers(name, nil); err != nil {
+		return err
+	}
+	f.roles = slices.DeleteFunc(f.roles, func(r string) bool { return r == name })
+	return nil
+}
+
+type fakeAPITokenService struct {
+	createFunc func(userID, name string, scopes []string, ttl time.Duration) (auth.APIToken, string, error)
+	listFunc   func(userID string) ([]auth.APIToken, error)
+	revokeFunc func(id, ownerID string) error
+}
+
+func (f fakeAPITokenService) CreateAPIToken(userID, name string, scopes []string, ttl time.Duration) (auth.APIToken, string, error) {
+	return f.createFunc(userID, name, scopes, ttl)
+}
+func (f fakeAPITokenService) ListAPITokens(userID string) ([]auth.APIToken, error) {
+	return f.listFunc(userID)
+}
+func (f fakeAPITokenService) RevokeAPIToken(id, ownerID string) error {
+	return f.revokeFunc(id, ownerID)
+}
+
+type fakeRoleService struct {
+	roles map[string]auth.Role
+}
+
+func (f fakeRoleService) ListRoles() ([]auth.Role, error) {
+	out := make([]auth.Role, 0, len(f.roles))
+	for _, r := range f.roles {
+		out = append(out, r)
+	}
+	return out, nil
+}
+func (f fakeRoleService) GetRole(name string) (auth.Role, error) {
+	r, ok := f.roles[name]
+	if !ok {
+		return auth.Role{}, auth.ErrRoleNotFound
+	}
+	return r, nil
+}
+func (f fakeRoleService) CreateRole(name, description string, permissions []string) (auth.Role, error) {
+	if _, ok := f.roles[name]; ok {
+		return auth.Role{}, auth.ErrRoleExists
+	}
+	f.roles[name] = auth.Role{Name: name, Description: description, Permissions: permissions}
+	return f.roles[name], nil
+}
+func (f fakeRoleService) UpdateRole(name, description string, permissions []string) (auth.Role, error) {
+	if _, ok := f.roles[name]; !ok {
+		return auth.Role{}, auth.ErrRoleNotFound
+	}
+	f.roles[name] = auth.Role{Name: name, Description: description, Permissions: permissions}
+	return f.roles[name], nil
+}
+func (f fakeRoleService) DeleteRole(name string) error {
+	if name == auth.AdminRole {
+		return auth.ErrRoleReserved
+	}
+	if _, ok := f.roles[name]; !ok {
+		return auth.ErrRoleNotFound
+	}
+	delete(f.roles, name)
+	return nil
+}
+
 type fakeSQLProfileService struct {
 	listFunc   func() []sqlprofile.Profile
 	createFunc func(p sqlprofile.Profile) (sqlprofile.Profile, error)
@@ -134,6 +538,50 @@ func TestInfo(t *testing.T) {
 	}
 }
 
+func TestProblemResponses(t *testing.T) {
+	createErr := error(&sqlprofile.ValidationError{Fields: []sqlprofile.FieldError{{Field: "name", Message: "is required"}, {Field: "port", Message: "must be between 1 and 65535"}}})
+	handler := loggingMiddleware(NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{ID: "s1", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+		}},
+		SQLProfiles: fakeSQLProfileService{createFunc: func(p sqlprofile.Profile) (sqlprofile.Profile, error) {
+			return sqlprofile.Profile{}, createErr
+		}},
+	}))
+	do := func(method string) (*httptest.ResponseRecorder, problem) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/v1/sql-profiles", bytes.NewBufferString(`{}`))
+		req.Header.Set("Authorization", "Bearer token-123")
+		req.Header.Set("X-Request-Id", "req-42")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Fatalf("expected problem+json, got %q body=%s", ct, rec.Body.String())
+		}
+		var p problem
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatalf("decode problem: %v", err)
+		}
+		return rec, p
+	}
+
+	rec, p := do(http.MethodPost)
+	if rec.Code != http.StatusBadRequest || p.Status != http.StatusBadRequest || p.Code != "invalid_input" || p.Title != "Bad Request" || p.RequestID != "req-42" {
+		t.Fatalf("unexpected validation problem %d %+v", rec.Code, p)
+	}
+	if len(p.Errors) != 2 || p.Errors[1] != (fieldError{Field: "port", Message: "must be between 1 and 65535"}) || !strings.Contains(p.Detail, "name is required") {
+		t.Fatalf("expected field errors, got %+v", p)
+	}
+
+	createErr = errors.New("disk full at /var/lib/mcs")
+	if rec, p = do(http.MethodPost); rec.Code != http.StatusInternalServerError || p.Code != "internal_server_error" || p.Detail != "create profile failed" {
+		t.Fatalf("expected an opaque internal error, got %d %+v", rec.Code, p)
+	}
+	if rec, p = do(http.MethodPatch); rec.Code != http.StatusMethodNotAllowed || p.Code != "method_not_allowed" || p.Detail != "method not allowed" {
+		t.Fatalf("unexpected method problem %d %+v", rec.Code, p)
+	}
+}
+
 func TestLoginSuccess(t *testing.T) {
 	handler := NewHandler(Deps{Auth: fakeAuthService{loginFunc: func(username, password string) (auth.Session, error) {
 		if username != "admin" || password != "secret" {
@@ -164,113 +612,1351 @@ func TestLoginSuccess(t *testing.T) {
 	}
 }
 
-func TestAuthMeSuccess(t *testing.T) {
-	handler := NewHandler(Deps{Auth: fakeAuthService{loginFunc: func(_, _ string) (auth.Session, error) {
-		return auth.Session{}, errors.New("not used")
-	}, validateFunc: func(token string) (auth.Session, error) {
-		if token != "token-123" {
-			return auth.Session{}, auth.ErrInvalidToken
-		}
-		return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
-	}, logoutFunc: func(token string) error { return errors.New("not used") }}})
+func TestLoginMFAChallengeAndVerify(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{loginFunc: func(username, password string) (auth.Session, error) {
+			return auth.Session{}, &auth.MFARequiredError{Challenge: auth.MFAChallenge{Token: "mfa-1", Username: "admin", ExpiresAt: time.Now().Add(time.Minute)}}
+		}},
+		MFA: fakeMFAService{completeFunc: func(mfaToken, code string) (auth.Session, []string, error) {
+			if code == "999999" {
+				return auth.Session{}, nil, &auth.LoginBlockedError{RetryAfter: 2 * time.Second}
+			}
+			if mfaToken != "mfa-1" || code != "123456" {
+				return auth.Session{}, nil, auth.ErrInvalidMFACode
+			}
+			return auth.Session{ID: "s1", Token: "token-123", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil, nil
+		}},
+	})
 
-	req := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
-	req.Header.Set("Authorization", "Bearer token-123")
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewBufferString(`{"username":"admin","password":"secret"}`))
 	rec := httptest.NewRecorder()
-
 	handler.ServeHTTP(rec, req)
-
 	if rec.Code != http.StatusOK {
-		t.Fatalf("expected status 200, got %d", rec.Code)
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
 	}
-}
-
-func TestAuthLogout(t *testing.T) {
-	handler := NewHandler(Deps{Auth: fakeAuthService{
-		loginFunc: func(_, _ string) (auth.Session, error) { return auth.Session{}, errors.New("not used") },
-		validateFunc: func(token string) (auth.Session, error) {
-			return auth.Session{}, errors.New("not used")
-		},
-		logoutFunc: func(token string) error {
-			if token != "token-123" {
-				return auth.ErrInvalidToken
-			}
-			return nil
-		},
-	}})
-
-	req := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
-	req.Header.Set("Authorization", "Bearer token-123")
-	rec := httptest.NewRecorder()
-
-	handler.ServeHTTP(rec, req)
-	if rec.Code != http.StatusNoContent {
-		t.Fatalf("expected status 204, got %d", rec.Code)
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode login response: %v", err)
+	}
+	if got["mfa_required"] != true || got["mfa_token"] != "mfa-1" || got["token"] != nil {
+		t.Fatalf("expected mfa challenge without token, got %v", got)
 	}
 
-	reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
-	reqBad.Header.Set("Authorization", "Bearer bad-token")
+	reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/mfa/verify", bytes.NewBufferString(`{"mfa_token":"mfa-1","code":"000000"}`))
 	recBad := httptest.NewRecorder()
 	handler.ServeHTTP(recBad, reqBad)
 	if recBad.Code != http.StatusUnauthorized {
 		t.Fatalf("expected status 401, got %d", recBad.Code)
 	}
+
+	reqBlocked := httptest.NewRequest(http.MethodPost, "/v1/auth/mfa/verify", bytes.NewBufferString(`{"mfa_token":"mfa-1","code":"999999"}`))
+	recBlocked := httptest.NewRecorder()
+	handler.ServeHTTP(recBlocked, reqBlocked)
+	if recBlocked.Code != http.StatusTooManyRequests || recBlocked.Header().Get("Retry-After") != "2" {
+		t.Fatalf("expected throttled status 429 with Retry-After, got %d %q", recBlocked.Code, recBlocked.Header().Get("Retry-After"))
+	}
+
+	reqOK := httptest.NewRequest(http.MethodPost, "/v1/auth/mfa/verify", bytes.NewBufferString(`{"mfa_token":"mfa-1","code":"123456"}`))
+	recOK := httptest.NewRecorder()
+	handler.ServeHTTP(recOK, reqOK)
+	if recOK.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", recOK.Code, recOK.Body.String())
+	}
+	got = map[string]any{}
+	if err := json.Unmarshal(recOK.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode verify response: %v", err)
+	}
+	if got["token"] != "token-123" {
+		t.Fatalf("expected session token, got %v", got)
+	}
 }
 
-func TestAuthChangePassword(t *testing.T) {
-	handler := NewHandler(Deps{Auth: fakeAuthService{
-		changePasswordFunc: func(token, currentPassword, newPassword string) error {
-			if token != "token-123" {
-				return auth.ErrInvalidToken
+func TestMFAEnrollmentRequiresLoginSession(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			session := auth.Session{ID: "s1", Token: token, UserID: "u-1", Username: "ops", Roles: []string{"operator"}, ExpiresAt: time.Now().Add(time.Hour)}
+			switch token {
+			case "imp-token":
+				session.ImpersonatorID, session.ImpersonatorUsername = "u-9", "root"
+			case "api-token":
+				session.APITokenID = "t-1"
 			}
-			if currentPassword != "oldpass123" || newPassword != "NewPassword123!" {
-				return auth.ErrInvalidCredentials
+			return session, nil
+		}},
+		MFA: fakeMFAService{},
+	})
+
+	for _, token := range []string{"imp-token", "api-token"} {
+		for _, target := range []string{"/v1/auth/mfa/enroll", "/v1/auth/mfa/confirm"} {
+			req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(`{"code":"123456"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "login_session_required") {
+				t.Fatalf("%s with %s: expected 403, got %d body=%s", target, token, rec.Code, rec.Body.String())
 			}
-			return nil
-		},
-	}})
+		}
+	}
+}
 
-	body := bytes.NewBufferString(`{"current_password":"oldpass123","new_password":"NewPassword123!"}`)
-	req := httptest.NewRequest(http.MethodPost, "/v1/auth/change-password", body)
-	req.Header.Set("Authorization", "Bearer token-123")
+func TestLoginThrottledAndLocked(t *testing.T) {
+	locked := false
+	handler := NewHandler(Deps{Auth: fakeAuthService{loginFunc: func(username, password string) (auth.Session, error) {
+		return auth.Session{}, &auth.LoginBlockedError{RetryAfter: 1500 * time.Millisecond, Locked: locked}
+	}}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewBufferString(`{"username":"admin","password":"secret"}`))
 	rec := httptest.NewRecorder()
 	handler.ServeHTTP(rec, req)
-	if rec.Code != http.StatusNoContent {
-		t.Fatalf("expected status 204, got %d body=%s", rec.Code, rec.Body.String())
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
 	}
-
-	bad := bytes.NewBufferString(`{"current_password":"oldpass123","new_password":"short"}`)
-	reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/change-password", bad)
-	reqBad.Header.Set("Authorization", "Bearer token-123")
-	handlerBad := NewHandler(Deps{Auth: fakeAuthService{
-		changePasswordFunc: func(token, currentPassword, newPassword string) error { return auth.ErrWeakPassword },
-	}})
-	recBad := httptest.NewRecorder()
-	handlerBad.ServeHTTP(recBad, reqBad)
-	if recBad.Code != http.StatusBadRequest {
-		t.Fatalf("expected status 400, got %d", recBad.Code)
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Fatalf("expected Retry-After 2, got %q", got)
 	}
-}
-
-func TestSQLProfilesUnauthorized(t *testing.T) {
-	handler := NewHandler(Deps{})
-	req := httptest.NewRequest(http.MethodGet, "/v1/sql-profiles", nil)
-	rec := httptest.NewRecorder()
 
+	locked = true
+	req = httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewBufferString(`{"username":"admin","password":"secret"}`))
+	rec = httptest.NewRecorder()
 	handler.ServeHTTP(rec, req)
-
-	if rec.Code != http.StatusServiceUnavailable {
-		t.Fatalf("expected status 503 for missing auth service, got %d", rec.Code)
+	if rec.Code != http.StatusLocked {
+		t.Fatalf("expected status 423, got %d", rec.Code)
 	}
 }
 
-func TestSQLProfilesListAuthorized(t *testing.T) {
+func TestAdminLockoutListAndClear(t *testing.T) {
+	cleared := ""
 	handler := NewHandler(Deps{
-		Auth: fakeAuthService{loginFunc: nil, validateFunc: func(token string) (auth.Session, error) {
-			if token != "admin-token" {
-				return auth.Session{}, auth.ErrInvalidToken
-			}
-			return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{ID: "s1", Token: token, Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+		}},
+		Lockouts: fakeLockoutService{
+			listFunc: func() ([]auth.LoginAttempt, error) {
+				return []auth.LoginAttempt{{Key: "username:bob/ops", Failures: 10, Locked: true}}, nil
+			},
+			clearFunc: func(key string) error {
+				if key != "username:bob/ops" {
+					return auth.ErrLoginAttemptNotFound
+				}
+				cleared = key
+				return nil
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/system/lockouts", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/system/lockouts/username:nobody", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/system/lockouts/username:bob/ops", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || cleared != "username:bob/ops" {
+		t.Fatalf("expected lockout to be cleared, got status %d cleared=%q", rec.Code, cleared)
+	}
+}
+
+func TestAPITokenCreateListAndRevoke(t *testing.T) {
+	var gotTTL time.Duration
+	revokes := map[string]string{}
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			switch token {
+			case "session-token":
+				return auth.Session{ID: "s1", UserID: "u1", Username: "ci", Roles: []string{"operator"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			case "mcs_pat_abc":
+				return auth.Session{ID: "t1", UserID: "u1", Username: "ci", Roles: []string{"operator"}, APITokenID: "t1", ExpiresAt: time.Now().Add(time.Hour)}, nil
+			case "admin-token":
+				return auth.Session{ID: "s2", UserID: "u2", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			}
+			return auth.Session{}, auth.ErrInvalidToken
+		}},
+		APITokens: fakeAPITokenService{
+			createFunc: func(userID, name string, scopes []string, ttl time.Duration) (auth.APIToken, string, error) {
+				gotTTL = ttl
+				return auth.APIToken{ID: "t1", Name: name, UserID: userID, Scopes: scopes}, "mcs_pat_abc", nil
+			},
+			listFunc: func(userID string) ([]auth.APIToken, error) {
+				return []auth.APIToken{{ID: "t1", UserID: "u1"}}, nil
+			},
+			revokeFunc: func(id, ownerID string) error {
+				if id != "t1" {
+					return auth.ErrAPITokenNotFound
+				}
+				revokes[ownerID] = id
+				return nil
+			},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/tokens", bytes.NewBufferString(`{"name":"deploy","scopes":["operator"],"expires_in_seconds":3600}`))
+	req.Header.Set("Authorization", "Bearer session-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var created map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if created["token"] != "mcs_pat_abc" || created["id"] != "t1" || gotTTL != time.Hour {
+		t.Fatalf("unexpected create response %v ttl=%v", created, gotTTL)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/auth/tokens", bytes.NewBufferString(`{"name":"again"}`))
+	req.Header.Set("Authorization", "Bearer mcs_pat_abc")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected api token to be unable to mint tokens, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/auth/tokens", nil)
+	req.Header.Set("Authorization", "Bearer mcs_pat_abc")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/system/api-tokens", nil)
+	req.Header.Set("Authorization", "Bearer session-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be forbidden, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/auth/tokens/t1", nil)
+	req.Header.Set("Authorization", "Bearer session-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || revokes["u1"] != "t1" {
+		t.Fatalf("expected owner revoke, got status %d revokes=%v", rec.Code, revokes)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/system/api-tokens/missing", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/v1/system/api-tokens/t1", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || revokes[""] != "t1" {
+		t.Fatalf("expected admin revoke, got status %d revokes=%v", rec.Code, revokes)
+	}
+}
+
+func TestOIDCLoginRedirectAndCallback(t *testing.T) {
+	handler := NewHandler(Deps{OIDC: fakeOIDCService{
+		beginFunc: func() (string, error) { return "https://idp.example.com/authorize?state=st-1", nil },
+		completeFunc: func(state, code string) (auth.Session, error) {
+			if state != "st-1" {
+				return auth.Session{}, auth.ErrInvalidOIDCState
+			}
+			return auth.Session{ID: "s1", Token: "token-123", UserID: "u-1", Username: "alice", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+		},
+	}})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/login", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "https://idp.example.com/authorize?state=st-1" {
+		t.Fatalf("expected redirect to issuer, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	var stateCookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookieName {
+			stateCookie = c
+		}
+	}
+	if stateCookie == nil || stateCookie.Value != "st-1" || !stateCookie.HttpOnly || stateCookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected an HttpOnly, SameSite=Lax state cookie, got %+v", stateCookie)
+	}
+
+	// A callback without the browser's state cookie is a login CSRF attempt.
+	for _, cookie := range []*http.Cookie{nil, {Name: oidcStateCookieName, Value: "other"}} {
+		req = httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/callback?state=st-1&code=c", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for cookie %v, got %d", cookie, rec.Code)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/callback?state=bogus&code=c", nil)
+	req.AddCookie(&http.Cookie{Name: oidcStateCookieName, Value: "bogus"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/callback?state=st-1&code=c", nil)
+	req.AddCookie(stateCookie)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode callback response: %v", err)
+	}
+	if got["token"] != "token-123" {
+		t.Fatalf("expected session token, got %v", got)
+	}
+
+	mfa := NewHandler(Deps{OIDC: fakeOIDCService{
+		completeFunc: func(state, code string) (auth.Session, error) {
+			return auth.Session{}, &auth.MFARequiredError{Challenge: auth.MFAChallenge{Token: "mfa-1", Username: "alice", ExpiresAt: time.Now().Add(time.Minute)}}
+		},
+	}})
+	req = httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/callback?state=st-1&code=c", nil)
+	req.AddCookie(stateCookie)
+	rec = httptest.NewRecorder()
+	mfa.ServeHTTP(rec, req)
+	got = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got["mfa_required"] != true || got["mfa_token"] != "mfa-1" || got["token"] != nil {
+		t.Fatalf("expected an mfa challenge instead of a session, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Beginning a login stores state, so one client cannot flood it.
+	for i := 0; ; i++ {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/login", nil))
+		if rec.Code == http.StatusTooManyRequests {
+			if i != oidcLoginBeginPerIP-1 || rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("expected 429 with Retry-After after %d begins, got it after %d", oidcLoginBeginPerIP, i+1)
+			}
+			break
+		}
+		if rec.Code != http.StatusFound || i > oidcLoginBeginPerIP {
+			t.Fatalf("unexpected begin response %d after %d requests", rec.Code, i+1)
+		}
+	}
+
+	disabled := NewHandler(Deps{})
+	rec = httptest.NewRecorder()
+	disabled.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/auth/oidc/login", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 when oidc is not configured, got %d", rec.Code)
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	jwks := `{"keys":[{"kty":"OKP","kid":"k1","use":"sig","alg":"EdDSA","crv":"Ed25519","x":"abc"}]}`
+	handler := NewHandler(Deps{AccessTokens: fakeAccessTokenService{enabled: true, jwks: jwks}})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != jwks {
+		t.Fatalf("expected key set, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/jwk-set+json" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", rec.Code)
+	}
+
+	disabled := NewHandler(Deps{AccessTokens: fakeAccessTokenService{}})
+	rec = httptest.NewRecorder()
+	disabled.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 when signed access tokens are off, got %d", rec.Code)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for commonName and its
+// key as PEM files into dir.
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile := filepath.Join(dir, commonName+".crt")
+	keyFile := filepath.Join(dir, commonName+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	_, _, nodeCert := writeTestCertificate(t, t.TempDir(), "node-17")
+	_, _, revokedCert := writeTestCertificate(t, t.TempDir(), "node-18")
+	var events []auditRecord
+	lookups := 0
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{ID: "s1", UserID: "u-1", Username: "alice", Roles: []string{"admin"}}, nil
+		}},
+		ClientCerts: fakeClientCertService{authenticateFunc: func(cert *x509.Certificate) (auth.Session, error) {
+			lookups++
+			if cert.Subject.CommonName == "node-18" {
+				return auth.Session{}, auth.ErrAccountDisabled
+			}
+			return auth.Session{ID: "mtls-1", UserID: "u-17", Username: cert.Subject.CommonName, Roles: []string{"viewer"}, ClientCertificate: "ab12"}, nil
+		}},
+		Audit: recordingAudit{events: &events},
+	})
+	withCert := func(method, path string, cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	// Requests that need no session never look the certificate user up.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, withCert(http.MethodGet, "/healthz", nodeCert))
+	if rec.Code != http.StatusOK || lookups != 0 {
+		t.Fatalf("expected /healthz without a lookup, got %d after %d lookups", rec.Code, lookups)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withCert(http.MethodGet, "/v1/auth/me", nodeCert))
+	if rec.Code != http.StatusOK || lookups != 1 {
+		t.Fatalf("expected status 200 after one lookup, got %d body=%s lookups=%d", rec.Code, rec.Body.String(), lookups)
+	}
+	var me map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil {
+		t.Fatalf("decode me response: %v", err)
+	}
+	if me["username"] != "node-17" || me["client_certificate"] != "ab12" {
+		t.Fatalf("expected the certificate identity, got %v", me)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withCert(http.MethodGet, "/v1/users", nodeCert))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the certificate's roles to be enforced, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withCert(http.MethodPost, "/v1/auth/tokens", nodeCert))
+	if rec.Code != http.StatusUnauthorized || lookups != 2 {
+		t.Fatalf("expected account endpoints to require a bearer token without a lookup, got %d after %d lookups", rec.Code, lookups)
+	}
+
+	req := withCert(http.MethodGet, "/v1/auth/me", nodeCert)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil || me["username"] != "alice" {
+		t.Fatalf("expected the bearer token to win over the certificate, got %v", me)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, withCert(http.MethodGet, "/v1/auth/me", revokedCert))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a disabled certificate user, got %d", rec.Code)
+	}
+	last := events[len(events)-1]
+	if last.action != "auth.mtls" || last.outcome != "disabled" || last.actor != "CN=node-18" {
+		t.Fatalf("unexpected audit record %+v", last)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without credentials, got %d", rec.Code)
+	}
+}
+
+func TestTLSFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCertificate(t, dir, "mcs-old")
+	caFile, _, _ := writeTestCertificate(t, dir, "clients-ca")
+	files, err := newTLSFiles(config.TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}, slog.Default())
+	if err != nil {
+		t.Fatalf("newTLSFiles() error: %v", err)
+	}
+	serverName := func() string {
+		t.Helper()
+		cfg, err := files.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatalf("GetConfigForClient() error: %v", err)
+		}
+		if cfg.ClientAuth != tls.VerifyClientCertIfGiven || cfg.ClientCAs == nil {
+			t.Fatalf("expected optional client certificates, got %v", cfg.ClientAuth)
+		}
+		leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("parse served certificate: %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+	if got := serverName(); got != "mcs-old" {
+		t.Fatalf("expected mcs-old served, got %q", got)
+	}
+
+	newCert, newKey, _ := writeTestCertificate(t, dir, "mcs-new")
+	for _, pair := range [][2]string{{newCert, certFile}, {newKey, keyFile}} {
+		b, _ := os.ReadFile(pair[0])
+		if err := os.WriteFile(pair[1], b, 0o600); err != nil {
+			t.Fatalf("replace %s: %v", pair[1], err)
+		}
+		later := time.Now().Add(time.Minute)
+		_ = os.Chtimes(pair[1], later, later)
+	}
+	if got := serverName(); got != "mcs-old" {
+		t.Fatalf("expected files to be checked at most every %s, got %q", tlsReloadCheckInterval, got)
+	}
+	files.checkedAt = time.Time{}
+	if got := serverName(); got != "mcs-new" {
+		t.Fatalf("expected the replaced certificate served, got %q", got)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	files.checkedAt = time.Time{}
+	if got := serverName(); got != "mcs-new" {
+		t.Fatalf("expected a broken key to keep the loaded certificate, got %q", got)
+	}
+	if err := files.reload(); err == nil {
+		t.Fatalf("expected a forced reload to report the broken key")
+	}
+
+	hupCert, hupKey, _ := writeTestCertificate(t, t.TempDir(), "mcs-hup")
+	for _, pair := range [][2]string{{hupCert, certFile}, {hupKey, keyFile}} {
+		b, _ := os.ReadFile(pair[0])
+		_ = os.WriteFile(pair[1], b, 0o600)
+	}
+	if err := files.reload(); err != nil {
+		t.Fatalf("reload() error: %v", err)
+	}
+	if got := serverName(); got != "mcs-hup" {
+		t.Fatalf("expected a forced reload to take effect before the next check, got %q", got)
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	certFile, keyFile, _ := writeTestCertificate(t, t.TempDir(), "mcs")
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	files, err := newTLSFiles(config.TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: tls.VersionTLS13, CipherSuites: suites}, slog.Default())
+	if err != nil {
+		t.Fatalf("newTLSFiles() error: %v", err)
+	}
+	cfg, err := files.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient() error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 || !slices.Equal(cfg.CipherSuites, suites) || cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected tls policy: min %x, suites %v, client auth %v", cfg.MinVersion, cfg.CipherSuites, cfg.ClientAuth)
+	}
+
+	srv := New(config.HTTPConfig{Addr: ":8443"}, Deps{})
+	if err := srv.ReloadTLS(); err == nil {
+		t.Fatalf("expected ReloadTLS() to fail without tls")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		httpsAddr, host, target, want string
+	}{
+		{":8443", "mcs.example.com:8080", "/v1/info?x=1", "https://mcs.example.com:8443/v1/info?x=1"},
+		{":443", "mcs.example.com", "/", "https://mcs.example.com/"},
+		{"0.0.0.0:443", "[::1]:80", "/login", "https://[::1]/login"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, tc.target, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+		httpsRedirectHandler(tc.httpsAddr).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tc.want {
+			t.Fatalf("%s via %s: expected 308 to %s, got %d %q", tc.host, tc.httpsAddr, tc.want, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	handler := hstsMiddleware(NewHandler(Deps{}), 24*time.Hour, true)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Fatalf("expected no HSTS over plain HTTP, got %q", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=86400; includeSubDomains" {
+		t.Fatalf("unexpected HSTS header %q", got)
+	}
+}
+
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	var got string
+	handler := clientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}), []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/64")})
+
+	cases := []struct {
+		remote, forwardedFor, realIP, want string
+	}{
+		{"203.0.113.9:5000", "198.51.100.1", "198.51.100.2", "203.0.113.9"},
+		{"10.0.0.2:5000", "", "", "10.0.0.2"},
+		{"10.0.0.2:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.2:5000", "192.0.2.66, 198.51.100.1, 10.0.0.3", "", "198.51.100.1"},
+		{"[fd00::5]:5000", "10.1.1.1, 10.0.0.3", "", "10.1.1.1"},
+		{"[::ffff:10.0.0.2]:5000", "::ffff:198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.2:5000", "not-an-ip", "", "10.0.0.2"},
+		{"10.0.0.2:5000", "", "198.51.100.2", "198.51.100.2"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tc.want {
+			t.Fatalf("remote %s, X-Forwarded-For %q, X-Real-IP %q: got %q, want %q", tc.remote, tc.forwardedFor, tc.realIP, got, tc.want)
+		}
+	}
+}
+
+func TestWebAuthnEndpoints(t *testing.T) {
+	session := auth.Session{ID: "s1", Token: "token-123", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}
+	var events []auditRecord
+	deps := Deps{
+		Auth: fakeAuthService{
+			loginFunc: func(username, password string) (auth.Session, error) {
+				return auth.Session{}, &auth.MFARequiredError{Challenge: auth.MFAChallenge{Token: "mfa-1", Username: "admin", ExpiresAt: time.Now().Add(time.Minute), WebAuthn: true}}
+			},
+			validateFunc: func(token string) (auth.Session, error) {
+				if token == "imp-token" {
+					imp := session
+					imp.ImpersonatorID, imp.ImpersonatorUsername = "u-9", "root"
+					return imp, nil
+				}
+				return auth.Session{}, auth.ErrInvalidToken
+			},
+		},
+		WebAuthn: fakeWebAuthnService{
+			enabled: true,
+			finishLogin: func(resp auth.WebAuthnCredentialResponse) (auth.Session, error) {
+				if resp.ID != "cred-1" {
+					return auth.Session{}, auth.ErrInvalidWebAuthnResponse
+				}
+				return session, nil
+			},
+			completeMFA: func(mfaToken string, resp auth.WebAuthnCredentialResponse) (auth.Session, error) {
+				if mfaToken != "mfa-1" {
+					return auth.Session{}, auth.ErrInvalidMFAChallenge
+				}
+				return session, nil
+			},
+			registerFunc: func(token string) (auth.WebAuthnCreationOptions, error) {
+				t.Fatalf("registration must not start from an impersonation session")
+				return auth.WebAuthnCreationOptions{}, nil
+			},
+		},
+		Audit: recordingAudit{events: &events},
+	}
+	handler := NewHandler(deps)
+
+	do := func(target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/v1/auth/webauthn/login/begin", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"challenge":"login-challenge"`) {
+		t.Fatalf("login/begin: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do("/v1/auth/webauthn/login/finish", `{"credential":{"id":"cred-2"}}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("login/finish with unknown credential: expected 401, got %d", rec.Code)
+	}
+	events = nil
+	rec := do("/v1/auth/webauthn/login/finish", `{"credential":{"id":"cred-1"}}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"token":"token-123"`) {
+		t.Fatalf("login/finish: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(events) != 1 || events[0].action != "auth.login" || events[0].outcome != "success" || !strings.HasSuffix(events[0].detail, "detail=webauthn") {
+		t.Fatalf("unexpected login audit events %+v", events)
+	}
+
+	rec = do("/v1/auth/login", `{"username":"admin","password":"secret"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"webauthn":true`) {
+		t.Fatalf("login: expected webauthn challenge, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do("/v1/auth/webauthn/mfa/finish", `{"mfa_token":"mfa-2","credential":{"id":"cred-1"}}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("mfa/finish with bad challenge: expected 401, got %d", rec.Code)
+	}
+	events = nil
+	if rec := do("/v1/auth/webauthn/mfa/finish", `{"mfa_token":"mfa-1","credential":{"id":"cred-1"}}`); rec.Code != http.StatusOK {
+		t.Fatalf("mfa/finish: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(events) != 2 || events[0].action != "auth.mfa.verify" || !strings.HasSuffix(events[1].detail, "detail=mfa webauthn") {
+		t.Fatalf("unexpected mfa audit events %+v", events)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/webauthn/register/begin", nil)
+	req.Header.Set("Authorization", "Bearer imp-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("register/begin while impersonating: expected 403, got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodDelete, "/v1/auth/webauthn/credentials/cred-1", nil)
+	req.Header.Set("Authorization", "Bearer imp-token")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("credential delete while impersonating: expected 403, got %d", rec.Code)
+	}
+
+	var last *httptest.ResponseRecorder
+	for i := 0; i < webauthnLoginBeginPerIP; i++ {
+		last = do("/v1/auth/webauthn/login/begin", `{"username":"admin"}`)
+	}
+	if last.Code != http.StatusTooManyRequests || last.Header().Get("Retry-After") == "" {
+		t.Fatalf("login/begin flood: expected 429, got %d", last.Code)
+	}
+
+	deps.WebAuthn = fakeWebAuthnService{}
+	handler = NewHandler(deps)
+	if rec := do("/v1/auth/webauthn/login/begin", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("disabled: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestSCIMUsersAndGroups(t *testing.T) {
+	scim := &fakeSCIMService{
+		users: map[string]auth.User{"u-0": {ID: "u-0", Username: "admin", Roles: []string{"admin"}}},
+		roles: []string{"admin"},
+	}
+	var events []auditRecord
+	handler := NewHandler(Deps{SCIM: scim, Audit: recordingAudit{events: &events}})
+
+	do := func(method, target, token, body string) (*httptest.ResponseRecorder, map[string]any) {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var got map[string]any
+		_ = json.Unmarshal(rec.Body.Bytes(), &got)
+		return rec, got
+	}
+
+	if rec, _ := do(http.MethodGet, "/scim/v2/Users", "", ""); rec.Code != http.StatusUnauthorized || rec.Header().Get("Content-Type") != "application/scim+json" {
+		t.Fatalf("no token: expected 401 scim+json, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec, _ := do(http.MethodGet, "/scim/v2/Users", "session-token", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: expected 401, got %d", rec.Code)
+	}
+
+	rec, got := do(http.MethodPost, "/scim/v2/Users", "scim-token", `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"carol","externalId":"okta-1","emails":[{"value":"c@example.com","primary":true}],"name":{"givenName":"Carol"}}`)
+	if rec.Code != http.StatusCreated || got["id"] != "u-1" || got["active"] != true || got["externalId"] != "okta-1" || rec.Header().Get("Location") != "/scim/v2/Users/u-1" {
+		t.Fatalf("create: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, got := do(http.MethodPost, "/scim/v2/Users", "scim-token", `{"userName":"carol"}`); rec.Code != http.StatusConflict || got["scimType"] != "uniqueness" {
+		t.Fatalf("duplicate: got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	if rec, _ := do(http.MethodPost, "/scim/v2/Users", "scim-token", `{"userName":"dave"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	rec, got = do(http.MethodGet, `/scim/v2/Users?filter=userName+eq+%22CAROL%22`, "scim-token", "")
+	if rec.Code != http.StatusOK || got["totalResults"] != float64(1) {
+		t.Fatalf("filter: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, got := do(http.MethodGet, `/scim/v2/Users?startIndex=2&count=1`, "scim-token", ""); got["totalResults"] != float64(2) || got["itemsPerPage"] != float64(1) || !strings.Contains(rec.Body.String(), `"userName":"dave"`) {
+		t.Fatalf("paging: got body=%s", rec.Body.String())
+	}
+	if rec, got := do(http.MethodGet, `/scim/v2/Users?filter=userName+eq+%22a%22+or+userName+eq+%22b%22`, "scim-token", ""); rec.Code != http.StatusBadRequest || got["scimType"] != "invalidFilter" {
+		t.Fatalf("unsupported filter: got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	events = nil
+	rec, got = do(http.MethodPatch, "/scim/v2/Users/u-1", "scim-token", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"Replace","path":"active","value":"False"}]}`)
+	if rec.Code != http.StatusOK || got["active"] != false || got["userName"] != "carol" || got["externalId"] != "okta-1" {
+		t.Fatalf("deactivate: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(events) != 1 || events[0].actor != "scim" || events[0].action != "scim.user.update" || !strings.Contains(events[0].detail, "active=false") {
+		t.Fatalf("unexpected audit events %+v", events)
+	}
+	rec, got = do(http.MethodPatch, "/scim/v2/Users/u-1", "scim-token", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","value":{"active":true,"emails":[{"value":"carol@example.com"}]}}]}`)
+	if rec.Code != http.StatusOK || got["active"] != true || !strings.Contains(rec.Body.String(), `"value":"carol@example.com"`) {
+		t.Fatalf("reactivate: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodPut, "/scim/v2/Users/u-1", "scim-token", `{"userName":"carol.b"}`); rec.Code != http.StatusOK || scim.users["u-1"].Email != "" || scim.users["u-1"].Disabled {
+		t.Fatalf("replace: got %d user=%+v", rec.Code, scim.users["u-1"])
+	}
+
+	// The local admin account is invisible to SCIM and cannot be changed.
+	if rec, got := do(http.MethodGet, "/scim/v2/Users/u-0", "scim-token", ""); rec.Code != http.StatusNotFound || got["status"] != "404" {
+		t.Fatalf("local user: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	for _, method := range []string{http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		body := `{"userName":"mallory","active":false}`
+		if method == http.MethodPatch {
+			body = `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`
+		}
+		if rec, _ := do(method, "/scim/v2/Users/u-0", "scim-token", body); rec.Code != http.StatusNotFound {
+			t.Fatalf("%s local user: got %d body=%s", method, rec.Code, rec.Body.String())
+		}
+	}
+	if rec, _ := do(http.MethodPut, "/scim/v2/Groups/admin", "scim-token", `{"displayName":"admin","members":[]}`); rec.Code != http.StatusOK {
+		t.Fatalf("replace admin group: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if u := scim.users["u-0"]; u.Username != "admin" || u.Disabled || !slices.Equal(u.Roles, []string{"admin"}) {
+		t.Fatalf("expected the local admin to be untouched, got %+v", u)
+	}
+
+	rec, got = do(http.MethodPost, "/scim/v2/Groups", "scim-token", `{"displayName":"Operators","members":[{"value":"u-1"}]}`)
+	if rec.Code != http.StatusCreated || got["id"] != "operators" || !slices.Equal(scim.users["u-1"].Roles, []string{"operators"}) {
+		t.Fatalf("create group: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, got := do(http.MethodPost, "/scim/v2/Groups", "scim-token", `{"displayName":"auditors","members":[{"value":"u-9"}]}`); rec.Code != http.StatusBadRequest || got["scimType"] != "invalidValue" {
+		t.Fatalf("unknown member: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if _, err := scim.GetProvisionedRole("auditors"); err == nil {
+		t.Fatalf("expected no group to be created for an unknown member")
+	}
+	if rec, got := do(http.MethodPatch, "/scim/v2/Groups/admin", "scim-token", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"remove","path":"members[value eq \"u-0\"]"},{"op":"add","path":"members","value":[{"value":"u-0"}]}]}`); rec.Code != http.StatusBadRequest || got["scimType"] != "invalidValue" {
+		t.Fatalf("local member: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodPatch, "/scim/v2/Groups/operators", "scim-token", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"add","path":"members","value":[{"value":"u-2"}]},{"op":"remove","path":"members[value eq \"u-1\"]"}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("patch group: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(scim.users["u-1"].Roles) != 0 || !slices.Equal(scim.users["u-2"].Roles, []string{"operators"}) {
+		t.Fatalf("unexpected roles after patch: %+v", scim.users)
+	}
+	if rec, got := do(http.MethodPatch, "/scim/v2/Groups/operators", "scim-token", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"displayName","value":"ops"}]}`); rec.Code != http.StatusBadRequest || got["scimType"] != "mutability" {
+		t.Fatalf("rename group: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	rec, got = do(http.MethodGet, `/scim/v2/Groups?filter=displayName+eq+%22Operators%22`, "scim-token", "")
+	if rec.Code != http.StatusOK || got["totalResults"] != float64(1) || !strings.Contains(rec.Body.String(), `"members":[{"value":"u-2","display":"dave"}]`) {
+		t.Fatalf("group filter: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec, _ := do(http.MethodDelete, "/scim/v2/Groups/operators", "scim-token", ""); rec.Code != http.StatusNoContent || len(scim.users["u-2"].Roles) != 0 {
+		t.Fatalf("delete group: got %d", rec.Code)
+	}
+
+	// Deleting a user disables the account instead of removing it.
+	if rec, _ := do(http.MethodDelete, "/scim/v2/Users/u-1", "scim-token", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete user: got %d", rec.Code)
+	}
+	if rec, got := do(http.MethodGet, "/scim/v2/Users/u-1", "scim-token", ""); rec.Code != http.StatusOK || got["active"] != false {
+		t.Fatalf("deleted user: got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuthMeSuccess(t *testing.T) {
+	handler := NewHandler(Deps{Auth: fakeAuthService{loginFunc: func(_, _ string) (auth.Session, error) {
+		return auth.Session{}, errors.New("not used")
+	}, validateFunc: func(token string) (auth.Session, error) {
+		if token != "token-123" {
+			return auth.Session{}, auth.ErrInvalidToken
+		}
+		return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}, logoutFunc: func(token string) error { return errors.New("not used") }}})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestAuthLogout(t *testing.T) {
+	handler := NewHandler(Deps{Auth: fakeAuthService{
+		loginFunc: func(_, _ string) (auth.Session, error) { return auth.Session{}, errors.New("not used") },
+		validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{}, errors.New("not used")
+		},
+		logoutFunc: func(token string) error {
+			if token != "token-123" {
+				return auth.ErrInvalidToken
+			}
+			return nil
+		},
+	}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+
+	reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
+	reqBad.Header.Set("Authorization", "Bearer bad-token")
+	recBad := httptest.NewRecorder()
+	handler.ServeHTTP(recBad, reqBad)
+	if recBad.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", recBad.Code)
+	}
+}
+
+func TestAuthRefresh(t *testing.T) {
+	handler := NewHandler(Deps{Auth: fakeAuthService{
+		refreshFunc: func(refreshToken string) (auth.Session, error) {
+			switch refreshToken {
+			case "refresh-1":
+				return auth.Session{ID: "s2", Token: "token-2", RefreshToken: "refresh-2", UserID: "u-1", Username: "admin", ExpiresAt: time.Now().Add(time.Hour), AbsoluteExpiresAt: time.Now().Add(12 * time.Hour)}, nil
+			case "refresh-old":
+				return auth.Session{}, auth.ErrRefreshTokenReused
+			default:
+				return auth.Session{}, auth.ErrInvalidToken
+			}
+		},
+	}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/refresh", bytes.NewBufferString(`{"refresh_token":"refresh-1"}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode refresh response: %v", err)
+	}
+	if got["token"] != "token-2" || got["refresh_token"] != "refresh-2" {
+		t.Fatalf("expected rotated tokens, got %v", got)
+	}
+
+	for _, token := range []string{"refresh-old", "bogus"} {
+		reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/refresh", bytes.NewBufferString(`{"refresh_token":"`+token+`"}`))
+		recBad := httptest.NewRecorder()
+		handler.ServeHTTP(recBad, reqBad)
+		if recBad.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401 for %s, got %d", token, recBad.Code)
+		}
+	}
+
+	reqEmpty := httptest.NewRequest(http.MethodPost, "/v1/auth/refresh", bytes.NewBufferString(`{}`))
+	recEmpty := httptest.NewRecorder()
+	handler.ServeHTTP(recEmpty, reqEmpty)
+	if recEmpty.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", recEmpty.Code)
+	}
+}
+
+func TestPasswordResetEndpoints(t *testing.T) {
+	requested := make(chan string, 2)
+	handler := NewHandler(Deps{PasswordReset: fakePasswordResetService{
+		enabled: true,
+		requestFunc: func(username string) error {
+			requested <- username
+			return nil
+		},
+		confirmFunc: func(token, newPassword string) (auth.User, error) {
+			switch {
+			case newPassword == "weak":
+				return auth.User{}, auth.ErrWeakPassword
+			case token != "u-1.good":
+				return auth.User{}, auth.ErrInvalidResetToken
+			}
+			return auth.User{ID: "u-1", Username: "alice"}, nil
+		},
+	}})
+
+	post := func(target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	known := post("/v1/auth/password-reset/request", `{"username":"alice"}`)
+	unknown := post("/v1/auth/password-reset/request", `{"username":"nobody"}`)
+	if known.Code != http.StatusAccepted || unknown.Code != http.StatusAccepted || known.Body.String() != unknown.Body.String() {
+		t.Fatalf("expected identical 202 responses, got %d %q and %d %q", known.Code, known.Body.String(), unknown.Code, unknown.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-requested:
+		case <-time.After(time.Second):
+			t.Fatalf("expected reset request to reach the service")
+		}
+	}
+
+	cases := []struct {
+		body string
+		want int
+	}{
+		{`{"token":"u-1.good","new_password":"NewPassword456?"}`, http.StatusNoContent},
+		{`{"token":"u-1.good","new_password":"weak"}`, http.StatusBadRequest},
+		{`{"token":"u-1.bad","new_password":"NewPassword456?"}`, http.StatusBadRequest},
+		{`{"token":"u-1.good"}`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		if rec := post("/v1/auth/password-reset/confirm", tc.body); rec.Code != tc.want {
+			t.Fatalf("confirm %s: expected %d, got %d body=%s", tc.body, tc.want, rec.Code, rec.Body.String())
+		}
+	}
+
+	disabled := NewHandler(Deps{PasswordReset: fakePasswordResetService{}})
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/password-reset/request", bytes.NewBufferString(`{"username":"alice"}`))
+	rec := httptest.NewRecorder()
+	disabled.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when password reset is disabled, got %d", rec.Code)
+	}
+}
+
+func TestPasswordResetRequestsAreBounded(t *testing.T) {
+	calls := make(chan string, maxPendingPasswordResets+1)
+	release := make(chan struct{})
+	handler := NewHandler(Deps{PasswordReset: fakePasswordResetService{
+		enabled: true,
+		requestFunc: func(username string) error {
+			calls <- username
+			<-release
+			return nil
+		},
+	}})
+	sent := 0
+	post := func() *httptest.ResponseRecorder {
+		sent++
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/password-reset/request", bytes.NewBufferString(fmt.Sprintf(`{"username":"user%d"}`, sent)))
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", sent)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := post()
+	for i := 1; i < maxPendingPasswordResets; i++ {
+		post()
+	}
+	for i := 0; i < maxPendingPasswordResets; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d pending reset requests, got %d", maxPendingPasswordResets, i)
+		}
+	}
+	dropped := post()
+	if dropped.Code != http.StatusAccepted || dropped.Body.String() != first.Body.String() {
+		t.Fatalf("expected a dropped request to get the usual 202, got %d %q", dropped.Code, dropped.Body.String())
+	}
+	close(release)
+	select {
+	case <-calls:
+		t.Fatalf("expected the request beyond the limit to be dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	deadline := time.After(time.Second)
+	for {
+		post()
+		select {
+		case <-calls:
+			return
+		case <-deadline:
+			t.Fatalf("expected requests to be accepted again once pending ones finish")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestPasswordResetRequestsThrottledAndDrainedOnShutdown(t *testing.T) {
+	calls := make(chan string, 100)
+	release := make(chan struct{})
+	srv := New(config.HTTPConfig{}, Deps{
+		PasswordReset: fakePasswordResetService{
+			enabled: true,
+			requestFunc: func(username string) error {
+				calls <- username
+				<-release
+				return nil
+			},
+		},
+	})
+	post := func(username, remote string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/password-reset/request", bytes.NewBufferString(`{"username":"`+username+`"}`))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		srv.httpServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < passwordResetPerUsername; i++ {
+		if code := post("Alice", fmt.Sprintf("198.51.100.%d:1234", i+1)); code != http.StatusAccepted {
+			t.Fatalf("request %d: expected 202, got %d", i, code)
+		}
+	}
+	if code := post(" alice ", "198.51.100.99:1234"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the username to be throttled, got %d", code)
+	}
+	for i := 0; i < passwordResetPerIP; i++ {
+		post(fmt.Sprintf("user%d", i), "203.0.113.5:1234")
+	}
+	if code := post("bob", "203.0.113.5:1234"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the client IP to be throttled, got %d", code)
+	}
+	<-calls
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Shutdown to wait for pending resets, got %v", err)
+	}
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+}
+
+func TestCookieSessionsWithCSRF(t *testing.T) {
+	session := auth.Session{ID: "s1", Token: "token-123", RefreshToken: "refresh-123", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour), AbsoluteExpiresAt: time.Now().Add(12 * time.Hour)}
+	logoutCalled := false
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			loginFunc: func(_, _ string) (auth.Session, error) { return session, nil },
+			validateFunc: func(token string) (auth.Session, error) {
+				if token != "token-123" {
+					return auth.Session{}, auth.ErrInvalidToken
+				}
+				return session, nil
+			},
+			logoutFunc: func(token string) error {
+				logoutCalled = token == "token-123"
+				return nil
+			},
+		},
+		SessionCookie: config.SessionCookieConfig{Enabled: true, Secure: true, SameSite: "strict"},
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewBufferString(`{"username":"admin","password":"secret","session_cookie":true}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode login response: %v", err)
+	}
+	if _, ok := got["token"]; ok {
+		t.Fatalf("expected token omitted from cookie login body, got %v", got)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	sessionCookie, csrfCookie := cookies["mcs_session"], cookies["mcs_csrf"]
+	if sessionCookie == nil || sessionCookie.Value != "token-123" || !sessionCookie.HttpOnly || !sessionCookie.Secure || sessionCookie.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("unexpected session cookie: %+v", sessionCookie)
+	}
+	if csrfCookie == nil || csrfCookie.HttpOnly || csrfCookie.Value != got["csrf_token"] {
+		t.Fatalf("unexpected csrf cookie: %+v", csrfCookie)
+	}
+	if c := cookies["mcs_refresh"]; c == nil || c.Value != "refresh-123" || c.Path != "/v1/auth/refresh" {
+		t.Fatalf("unexpected refresh cookie: %+v", c)
+	}
+
+	reqMe := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+	reqMe.AddCookie(sessionCookie)
+	recMe := httptest.NewRecorder()
+	handler.ServeHTTP(recMe, reqMe)
+	if recMe.Code != http.StatusOK {
+		t.Fatalf("expected cookie-authenticated GET to succeed, got %d", recMe.Code)
+	}
+
+	reqNoCSRF := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
+	reqNoCSRF.AddCookie(sessionCookie)
+	reqNoCSRF.AddCookie(csrfCookie)
+	recNoCSRF := httptest.NewRecorder()
+	handler.ServeHTTP(recNoCSRF, reqNoCSRF)
+	if recNoCSRF.Code != http.StatusForbidden || logoutCalled {
+		t.Fatalf("expected 403 without csrf header, got %d", recNoCSRF.Code)
+	}
+
+	reqBearer := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+	reqBearer.Header.Set("Authorization", "Bearer token-123")
+	recBearer := httptest.NewRecorder()
+	handler.ServeHTTP(recBearer, reqBearer)
+	if recBearer.Code != http.StatusOK {
+		t.Fatalf("expected bearer token to keep working, got %d", recBearer.Code)
+	}
+
+	reqLogout := httptest.NewRequest(http.MethodPost, "/v1/auth/logout", nil)
+	reqLogout.AddCookie(sessionCookie)
+	reqLogout.AddCookie(csrfCookie)
+	reqLogout.Header.Set("X-CSRF-Token", csrfCookie.Value)
+	recLogout := httptest.NewRecorder()
+	handler.ServeHTTP(recLogout, reqLogout)
+	if recLogout.Code != http.StatusNoContent || !logoutCalled {
+		t.Fatalf("expected logout with csrf header to succeed, got %d", recLogout.Code)
+	}
+	for _, c := range recLogout.Result().Cookies() {
+		if c.MaxAge >= 0 {
+			t.Fatalf("expected cookie %s cleared on logout, got %+v", c.Name, c)
+		}
+	}
+}
+
+func TestAuthChangePassword(t *testing.T) {
+	handler := NewHandler(Deps{Auth: fakeAuthService{
+		changePasswordFunc: func(token, currentPassword, newPassword string) error {
+			if token != "token-123" {
+				return auth.ErrInvalidToken
+			}
+			if currentPassword != "oldpass123" || newPassword != "NewPassword123!" {
+				return auth.ErrInvalidCredentials
+			}
+			return nil
+		},
+	}})
+
+	body := bytes.NewBufferString(`{"current_password":"oldpass123","new_password":"NewPassword123!"}`)
+	req := httptest.NewRequest(http.MethodPost, "/v1/auth/change-password", body)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	bad := bytes.NewBufferString(`{"current_password":"oldpass123","new_password":"short"}`)
+	reqBad := httptest.NewRequest(http.MethodPost, "/v1/auth/change-password", bad)
+	reqBad.Header.Set("Authorization", "Bearer token-123")
+	handlerBad := NewHandler(Deps{Auth: fakeAuthService{
+		changePasswordFunc: func(token, currentPassword, newPassword string) error {
+			return &auth.PasswordPolicyError{Reason: auth.PasswordReused, Detail: "password must differ from the last 5 passwords"}
+		},
+	}})
+	recBad := httptest.NewRecorder()
+	handlerBad.ServeHTTP(recBad, reqBad)
+	if recBad.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", recBad.Code)
+	}
+	var badBody map[string]any
+	if err := json.Unmarshal(recBad.Body.Bytes(), &badBody); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if badBody["code"] != "weak_password" || badBody["reason"] != "reused" || badBody["detail"] != "password must differ from the last 5 passwords" {
+		t.Fatalf("expected structured policy reason, got %v", badBody)
+	}
+}
+
+func TestPasswordChangeRequiredRestrictsSession(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour), PasswordChangeRequired: true}, nil
+		}, changePasswordFunc: func(token, currentPassword, newPassword string) error { return nil }},
+		SQLProfiles: fakeSQLProfileService{listFunc: func() []sqlprofile.Profile { return nil }},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/sql-profiles", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"code":"password_change_required"`) {
+		t.Fatalf("expected password_change_required 403, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"password_change_required":true`) {
+		t.Fatalf("expected /me to report the restriction, got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/auth/change-password", bytes.NewBufferString(`{"current_password":"oldpass123","new_password":"NewPassword123!"}`))
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected change-password to stay available, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSQLProfilesUnauthorized(t *testing.T) {
+	handler := NewHandler(Deps{})
+	req := httptest.NewRequest(http.MethodGet, "/v1/sql-profiles", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 for missing auth service, got %d", rec.Code)
+	}
+}
+
+func TestSQLProfilesListAuthorized(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{loginFunc: nil, validateFunc: func(token string) (auth.Session, error) {
+			if token != "admin-token" {
+				return auth.Session{}, auth.ErrInvalidToken
+			}
+			return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
 		}, logoutFunc: func(token string) error { return errors.New("not used") }},
 		SQLProfiles: fakeSQLProfileService{
 			listFunc: func() []sqlprofile.Profile {
@@ -306,6 +1992,184 @@ func TestSQLProfilesListAuthorized(t *testing.T) {
 	}
 }
 
+func TestSQLProfilesPermissionChecks(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				return auth.Session{ID: "s1", Username: "viewer", Roles: []string{"viewer"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			},
+			permissionsFunc: func(roles []string) ([]string, error) {
+				return []string{auth.PermSQLProfileRead}, nil
+			},
+		},
+		SQLProfiles: fakeSQLProfileService{
+			listFunc: func() []sqlprofile.Profile { return nil },
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/sql-profiles", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected read permission to allow list, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1/sql-profiles", bytes.NewBufferString(`{"name":"p"}`))
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected missing write permission to be forbidden, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/system/migrations", nil)
+	req.Header.Set("Authorization", "Bearer token-123")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected migrations to be forbidden, got %d", rec.Code)
+	}
+}
+
+func TestRoleAdminCRUD(t *testing.T) {
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
+			return auth.Session{ID: "s1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+		}},
+		Roles: fakeRoleService{roles: map[string]auth.Role{}},
+	})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer token-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/v1/system/roles", `{"name":"operator","permissions":["sqlprofile:read"]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/system/roles", `{"name":"operator"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/v1/system/roles/operator", `{"permissions":["sqlprofile:read","sqlprofile:write"]}`); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v1/system/roles/operator", ""); rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte("sqlprofile:write")) {
+		t.Fatalf("expected updated role, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodGet, "/v1/system/permissions", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/v1/system/roles/admin", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("expected built-in role delete to conflict, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/v1/system/roles/operator", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v1/system/roles/operator", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestUserAndRoleAdminCannotExceedOwnPermissions(t *testing.T) {
+	roles := fakeRoleService{roles: map[string]auth.Role{
+		"useradmin": {Name: "useradmin", Permissions: []string{auth.PermUserRead, auth.PermUserWrite, auth.PermRoleRead, auth.PermRoleWrite}},
+		"operator":  {Name: "operator", Permissions: []string{auth.PermSQLProfileRead}},
+		"deployer":  {Name: "deployer", Permissions: []string{auth.PermMigrationApply}},
+	}}
+	users := map[string]auth.User{
+		"u-admin": {ID: "u-admin", Username: "root", Roles: []string{auth.AdminRole}},
+		"u-op":    {ID: "u-op", Username: "op", Roles: []string{"operator"}},
+	}
+	var events []auditRecord
+	var changed []string
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				return auth.Session{ID: "s1", UserID: "u-2", Username: "helpdesk", Roles: []string{"useradmin", "operator"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			},
+			permissionsFunc: func(names []string) ([]string, error) {
+				var perms []string
+				for _, name := range names {
+					if name == auth.AdminRole {
+						return auth.AllPermissions(), nil
+					}
+					perms = append(perms, roles.roles[name].Permissions...)
+				}
+				return perms, nil
+			},
+		},
+		Users: fakeUserService{
+			getFunc: func(id string) (auth.User, error) {
+				if u, ok := users[id]; ok {
+					return u, nil
+				}
+				return auth.User{}, auth.ErrUserNotFound
+			},
+			createFunc: func(username, password, email string, roles []string) (auth.User, error) {
+				changed = append(changed, "create "+username)
+				return auth.User{ID: "u-new", Username: username, Roles: roles}, nil
+			},
+			updateFunc: func(id, username, email string, roles []string) (auth.User, error) {
+				changed = append(changed, "update "+id)
+				return auth.User{ID: id, Username: username, Roles: roles}, nil
+			},
+			resetPasswordFunc: func(id, newPassword string) error {
+				changed = append(changed, "reset "+id)
+				return nil
+			},
+			setStatusFunc: func(id string, disabled bool, expiresAt *time.Time) (auth.User, error) {
+				changed = append(changed, "status "+id)
+				return auth.User{ID: id}, nil
+			},
+		},
+		Roles: roles,
+		Audit: recordingAudit{events: &events},
+	})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer token-123")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	refused := []struct{ method, path, body string }{
+		{http.MethodPost, "/v1/users", `{"username":"mallory","password":"Secret-pass-123","roles":["admin"]}`},
+		{http.MethodPut, "/v1/users/u-op", `{"username":"op","roles":["operator","deployer"]}`},
+		{http.MethodPut, "/v1/users/u-admin", `{"username":"root","roles":["operator"]}`},
+		{http.MethodPost, "/v1/users/u-admin/reset-password", `{"new_password":"Secret-pass-123"}`},
+		{http.MethodPut, "/v1/users/u-admin/status", `{"disabled":true}`},
+		{http.MethodPost, "/v1/system/roles", `{"name":"everything","permissions":["migration:apply"]}`},
+		{http.MethodPut, "/v1/system/roles/useradmin", `{"permissions":["user:read","user:write","role:read","role:write","migration:apply"]}`},
+		{http.MethodPut, "/v1/system/roles/deployer", `{"permissions":[]}`},
+	}
+	for _, tc := range refused {
+		if rec := do(tc.method, tc.path, tc.body); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"code":"permission_not_held"`) {
+			t.Fatalf("%s %s: expected 403 permission_not_held, got %d body=%s", tc.method, tc.path, rec.Code, rec.Body.String())
+		}
+	}
+	if len(changed) != 0 || roles.roles["useradmin"].Permissions[0] != auth.PermUserRead || len(roles.roles["deployer"].Permissions) != 1 {
+		t.Fatalf("expected refused requests to change nothing, got %v", changed)
+	}
+	if len(events) != len(refused) || events[0].outcome != "denied" {
+		t.Fatalf("expected every refusal audited as denied, got %+v", events)
+	}
+
+	if rec := do(http.MethodPost, "/v1/users", `{"username":"alice","password":"Secret-pass-123","roles":["operator"]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected granting a held role to succeed, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/users/u-op/reset-password", `{"new_password":"Secret-pass-123"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected managing a lesser user to succeed, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/system/roles", `{"name":"reader","permissions":["user:read","sqlprofile:read"]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected a role within the caller's permissions to be created, got %d body=%s", rec.Code, rec.Body.String())
+	}
+}
+
 func TestMigrationsListAuthorized(t *testing.T) {
 	handler := NewHandler(Deps{
 		Auth: fakeAuthService{validateFunc: func(token string) (auth.Session, error) {
@@ -337,8 +2201,8 @@ func TestAdminSessionListAndRevoke(t *testing.T) {
 			validateFunc: func(token string) (auth.Session, error) {
 				return auth.Session{UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
 			},
-			listSessionViewsFunc: func() []auth.SessionView {
-				return []auth.SessionView{{ID: "s1", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}}
+			listSessionViewsFunc: func() ([]auth.SessionView, error) {
+				return []auth.SessionView{{ID: "s1", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}}, nil
 			},
 			revokeSessionByIDFunc: func(sessionID string) error {
 				if sessionID != "s1" {
@@ -370,6 +2234,354 @@ func TestAdminSessionListAndRevoke(t *testing.T) {
 	}
 }
 
+func TestOwnSessionsAndRevokeSessions(t *testing.T) {
+	revokedOthersFor := ""
+	revokedUser := ""
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				return auth.Session{ID: "s-1", UserID: "u-1", Username: "admin", Roles: []string{"admin"}, Token: token, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			},
+			listUserSessionViewsFunc: func(userID, currentID string) ([]auth.SessionView, error) {
+				if userID != "u-1" || currentID != "s-1" {
+					t.Fatalf("unexpected list arguments %q, %q", userID, currentID)
+				}
+				return []auth.SessionView{
+					{ID: "s-1", UserID: "u-1", ClientIP: "192.0.2.1", UserAgent: "curl/8.0", Current: true},
+					{ID: "s-2", UserID: "u-1", ClientIP: "198.51.100.7"},
+				}, nil
+			},
+			revokeOtherSessionsFunc: func(token string) (int, error) {
+				revokedOthersFor = token
+				return 1, nil
+			},
+			revokeUserSessionsFunc: func(userID string) error {
+				revokedUser = userID
+				return nil
+			},
+		},
+		Users: fakeUserService{
+			getFunc: func(id string) (auth.User, error) {
+				if id == "u-2" {
+					return auth.User{ID: "u-2", Username: "ops"}, nil
+				}
+				return auth.User{}, auth.ErrUserNotFound
+			},
+		},
+	})
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer user-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/v1/auth/sessions")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var listed struct {
+		Items []auth.SessionView `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil || len(listed.Items) != 2 || !listed.Items[0].Current || listed.Items[0].UserAgent != "curl/8.0" {
+		t.Fatalf("unexpected session list: %s", rec.Body.String())
+	}
+
+	rec = do(http.MethodPost, "/v1/auth/sessions/revoke-others")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"revoked":1`) {
+		t.Fatalf("revoke-others: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if revokedOthersFor != "user-token" {
+		t.Fatalf("expected the current token to be kept, got %q", revokedOthersFor)
+	}
+
+	if rec := do(http.MethodPost, "/v1/users/u-9/revoke-sessions"); rec.Code != http.StatusNotFound {
+		t.Fatalf("revoke unknown user: expected 404, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/v1/users/u-2/revoke-sessions"); rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke user sessions: expected 204, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if revokedUser != "u-2" {
+		t.Fatalf("expected sessions of u-2 to be revoked, got %q", revokedUser)
+	}
+}
+
+func TestLoginRejectsInactiveAccounts(t *testing.T) {
+	var events []auditRecord
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			loginFunc: func(username, password string) (auth.Session, error) {
+				switch username {
+				case "gone":
+					return auth.Session{}, auth.ErrAccountDisabled
+				case "old":
+					return auth.Session{}, auth.ErrAccountExpired
+				}
+				return auth.Session{}, auth.ErrInvalidCredentials
+			},
+		},
+		Audit: recordingAudit{events: &events},
+	})
+
+	for username, want := range map[string]string{"gone": "disabled", "old": "expired"} {
+		events = nil
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/login", bytes.NewBufferString(`{"username":"`+username+`","password":"Password123!x"}`))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "account "+want) {
+			t.Fatalf("login %s: got %d body=%s", username, rec.Code, rec.Body.String())
+		}
+		if len(events) != 1 || events[0].action != "auth.login" || events[0].outcome != want {
+			t.Fatalf("login %s: unexpected audit events %+v", username, events)
+		}
+	}
+}
+
+func TestUserStatusEndpoint(t *testing.T) {
+	var gotDisabled bool
+	var gotExpiry *time.Time
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				return auth.Session{ID: "s-admin", UserID: "u-admin", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			},
+		},
+		Users: fakeUserService{
+			setStatusFunc: func(id string, disabled bool, expiresAt *time.Time) (auth.User, error) {
+				if id != "u-2" {
+					return auth.User{}, auth.ErrUserNotFound
+				}
+				gotDisabled, gotExpiry = disabled, expiresAt
+				return auth.User{ID: id, Username: "ops", Disabled: disabled, ExpiresAt: expiresAt}, nil
+			},
+		},
+	})
+
+	do := func(target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, target, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("/v1/users/u-2/status", `{"disabled":true,"expires_at":"2026-12-31T00:00:00Z"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"disabled":true`) {
+		t.Fatalf("status: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if !gotDisabled || gotExpiry == nil || gotExpiry.Year() != 2026 {
+		t.Fatalf("unexpected status arguments %v %v", gotDisabled, gotExpiry)
+	}
+	if rec := do("/v1/users/u-9/status", `{"disabled":true}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown user: expected 404, got %d", rec.Code)
+	}
+	if rec := do("/v1/users/u-admin/status", `{"disabled":true}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("own account: expected 400, got %d", rec.Code)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	admin := auth.Session{ID: "s-admin", Token: "admin-token", UserID: "u-admin", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}
+	imp := auth.Session{
+		ID:                   "s-imp",
+		Token:                "imp-token",
+		UserID:               "u-2",
+		Username:             "ops",
+		Roles:                []string{"operator"},
+		ExpiresAt:            time.Now().Add(30 * time.Minute),
+		AbsoluteExpiresAt:    time.Now().Add(30 * time.Minute),
+		ImpersonatorID:       "u-admin",
+		ImpersonatorUsername: "admin",
+	}
+	ended := false
+	var events []auditRecord
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				switch token {
+				case "admin-token":
+					return admin, nil
+				case "imp-token":
+					if !ended {
+						return imp, nil
+					}
+				case "viewer-token":
+					return auth.Session{ID: "s-viewer", UserID: "u-3", Username: "viewer", Roles: []string{"viewer"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+				}
+				return auth.Session{}, auth.ErrInvalidToken
+			},
+			revokeOtherSessionsFunc: func(token string) (int, error) { return 0, nil },
+		},
+		APITokens: fakeAPITokenService{},
+		Impersonation: fakeImpersonationService{
+			impersonateFunc: func(token, targetID string) (auth.Session, error) {
+				switch targetID {
+				case "u-2":
+					return imp, nil
+				case "u-other-admin":
+					return auth.Session{}, auth.ErrImpersonationNotAllowed
+				}
+				return auth.Session{}, auth.ErrUserNotFound
+			},
+			endFunc: func(token string) (auth.Session, error) {
+				if token != "imp-token" {
+					return auth.Session{}, auth.ErrNotImpersonating
+				}
+				ended = true
+				return imp, nil
+			},
+		},
+		Audit: recordingAudit{events: &events},
+	})
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/v1/auth/impersonate/u-2", "viewer-token", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("viewer: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/v1/auth/impersonate/u-other-admin", "admin-token", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("other admin: expected 403, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/v1/auth/impersonate/u-9", "admin-token", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown user: expected 404, got %d", rec.Code)
+	}
+
+	events = nil
+	rec := do(http.MethodPost, "/v1/auth/impersonate/u-2", "admin-token", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"token":"imp-token"`) || !strings.Contains(rec.Body.String(), `"impersonator":{"id":"u-admin","username":"admin"}`) {
+		t.Fatalf("impersonate: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if len(events) != 1 || events[0].actor != "admin" || events[0].action != "auth.impersonate" || events[0].target != "u-2" || events[0].outcome != "success" {
+		t.Fatalf("unexpected impersonate audit events %+v", events)
+	}
+
+	rec = do(http.MethodGet, "/v1/auth/me", "imp-token", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"impersonator":{"id":"u-admin","username":"admin"}`) {
+		t.Fatalf("me: got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/auth/tokens", "imp-token", `{"name":"keep"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("api token during impersonation: expected 403, got %d", rec.Code)
+	}
+
+	events = nil
+	if rec := do(http.MethodPost, "/v1/auth/sessions/revoke-others", "imp-token", ""); rec.Code != http.StatusOK {
+		t.Fatalf("revoke-others: got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/v1/auth/impersonate/end", "imp-token", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("end: expected 204, got %d", rec.Code)
+	}
+	if len(events) != 2 || events[1].action != "auth.impersonate.end" {
+		t.Fatalf("unexpected audit events %+v", events)
+	}
+	for _, e := range events {
+		if e.actor != "ops" || !strings.Contains(e.detail, "impersonator=admin | impersonator_id=u-admin") {
+			t.Fatalf("expected audit record to name both identities, got %+v", e)
+		}
+	}
+	if rec := do(http.MethodPost, "/v1/auth/impersonate/end", "admin-token", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("end without impersonation: expected 400, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v1/auth/me", "imp-token", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("ended impersonation: expected 401, got %d", rec.Code)
+	}
+}
+
+func TestUserAdminCRUD(t *testing.T) {
+	deleted := ""
+	resetFor := ""
+	updatedEmail := ""
+	handler := NewHandler(Deps{
+		Auth: fakeAuthService{
+			validateFunc: func(token string) (auth.Session, error) {
+				return auth.Session{ID: "s-admin", UserID: "u-admin", Username: "admin", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}, nil
+			},
+		},
+		Users: fakeUserService{
+			listFunc: func() ([]auth.User, error) {
+				return []auth.User{{ID: "u-admin", Username: "admin", PasswordHash: "secret-hash", Roles: []string{"admin"}}}, nil
+			},
+			getFunc: func(id string) (auth.User, error) {
+				if id == "u-2" {
+					return auth.User{ID: "u-2", Username: "ops", Email: "ops@example.com"}, nil
+				}
+				return auth.User{}, auth.ErrUserNotFound
+			},
+			createFunc: func(username, password, email string, roles []string) (auth.User, error) {
+				if username == "admin" {
+					return auth.User{}, auth.ErrUsernameTaken
+				}
+				return auth.User{ID: "u-2", Username: username, Email: email, Roles: roles}, nil
+			},
+			updateFunc: func(id, username, email string, roles []string) (auth.User, error) {
+				updatedEmail = email
+				return auth.User{ID: id, Username: username, Email: email, Roles: roles}, nil
+			},
+			deleteFunc: func(id string) error {
+				deleted = id
+				return nil
+			},
+			resetPasswordFunc: func(id, newPassword string) error {
+				if newPassword == "weak" {
+					return auth.ErrWeakPassword
+				}
+				resetFor = id
+				return nil
+			},
+		},
+	})
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/v1/users", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", rec.Code)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte("secret-hash")) {
+		t.Fatalf("list response must not expose password hashes: %s", rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/users", `{"username":"ops","password":"Password123!x","roles":["operator"]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d body=%s", rec.Code, rec.Body.String())
+	}
+	if rec := do(http.MethodPost, "/v1/users", `{"username":"admin","password":"Password123!x"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("create duplicate: expected 409, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/v1/users/missing", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get missing: expected 404, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "/v1/users/u-2", `{"username":"ops2","roles":[]}`); rec.Code != http.StatusOK || updatedEmail != "ops@example.com" {
+		t.Fatalf("update without email: expected 200 keeping the stored email, got %d (%q)", rec.Code, updatedEmail)
+	}
+	if rec := do(http.MethodPut, "/v1/users/u-2", `{"username":"ops2","email":"","roles":[]}`); rec.Code != http.StatusOK || updatedEmail != "" {
+		t.Fatalf("update clearing email: expected 200, got %d (%q)", rec.Code, updatedEmail)
+	}
+	if rec := do(http.MethodPost, "/v1/users/u-2/reset-password", `{"new_password":"weak"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reset weak: expected 400, got %d", rec.Code)
+	}
+	if rec := do(http.MethodPost, "/v1/users/u-2/reset-password", `{"new_password":"AnotherPass456?"}`); rec.Code != http.StatusNoContent || resetFor != "u-2" {
+		t.Fatalf("reset: expected 204 for u-2, got %d (%q)", rec.Code, resetFor)
+	}
+	if rec := do(http.MethodDelete, "/v1/users/u-admin", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("delete self: expected 400, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/v1/users/u-2", ""); rec.Code != http.StatusNoContent || deleted != "u-2" {
+		t.Fatalf("delete: expected 204 for u-2, got %d (%q)", rec.Code, deleted)
+	}
+}
+
 func TestMigrationsStatusAndApplyAuthorized(t *testing.T) {
 	applyCalled := false
 	handler := NewHandler(Deps{
@@ -0,0 +1,164 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"myconnectionsvr/modern-mcs/internal/auth"
+	"myconnectionsvr/modern-mcs/internal/config"
+)
+
+const (
+	sessionCookieName = "mcs_session"
+	refreshCookieName = "mcs_refresh"
+	csrfCookieName    = "mcs_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+	// The refresh cookie is only sent to the refresh endpoint.
+	refreshCookiePath = "/v1/auth/refresh"
+)
+
+// cookieExemptPaths issue credentials rather than use them, so a stale
+// session cookie must not get in their way.
+var cookieExemptPaths = map[string]bool{
+	"/v1/auth/login":                  true,
+	"/v1/auth/mfa/verify":             true,
+	"/v1/auth/mfa/enroll/challenge":   true,
+	"/v1/auth/webauthn/login/begin":   true,
+	"/v1/auth/webauthn/login/finish":  true,
+	"/v1/auth/webauthn/mfa/begin":     true,
+	"/v1/auth/webauthn/mfa/finish":    true,
+	"/v1/auth/refresh":                true,
+	"/v1/auth/password-reset/request": true,
+	"/v1/auth/password-reset/confirm": true,
+}
+
+// sessionCookieMiddleware lets browsers authenticate with the session cookie.
+// The cookie is only used when no Authorization header is sent, so bearer
+// clients are unaffected. Cookie-authenticated requests that change state must
+// echo the CSRF cookie in the X-CSRF-Token header: a cross-site page can make
+// the browser send cookies but cannot read them.
+func sessionCookieMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" || cookieExemptPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c, err := r.Cookie(sessionCookieName)
+		if err != nil || c.Value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !isSafeMethod(r.Method) && !validCSRFToken(r) {
+			writeError(w, http.StatusForbidden, "missing or invalid csrf token")
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+c.Value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func validCSRFToken(r *http.Request) bool {
+	header := r.Header.Get(csrfHeaderName)
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(c.Value)) == 1
+}
+
+// writeSessionResponse sends a newly issued session. With useCookie, and
+// cookie sessions enabled, the tokens are set as HttpOnly cookies and left out
+// of the body so that page scripts never see them.
+func writeSessionResponse(w http.ResponseWriter, cfg config.SessionCookieConfig, session auth.Session, useCookie bool, extra map[string]any) {
+	resp := sessionResponse(session)
+	if useCookie && cfg.Enabled {
+		csrfToken, err := newCSRFToken()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "issue session cookie failed")
+			return
+		}
+		expires := session.AbsoluteExpiresAt
+		http.SetCookie(w, newSessionCookie(cfg, sessionCookieName, session.Token, "/", expires, true))
+		http.SetCookie(w, newSessionCookie(cfg, refreshCookieName, session.RefreshToken, refreshCookiePath, expires, true))
+		http.SetCookie(w, newSessionCookie(cfg, csrfCookieName, csrfToken, "/", expires, false))
+		delete(resp, "token")
+		delete(resp, "refresh_token")
+		resp["csrf_token"] = csrfToken
+	}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func clearSessionCookies(w http.ResponseWriter, cfg config.SessionCookieConfig) {
+	for _, c := range []*http.Cookie{
+		newSessionCookie(cfg, sessionCookieName, "", "/", time.Time{}, true),
+		newSessionCookie(cfg, refreshCookieName, "", refreshCookiePath, time.Time{}, true),
+		newSessionCookie(cfg, csrfCookieName, "", "/", time.Time{}, false),
+	} {
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+func newSessionCookie(cfg config.SessionCookieConfig, name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   cfg.Domain,
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   cfg.Secure,
+		SameSite: sameSiteMode(cfg.SameSite),
+	}
+}
+
+// oidcStateCookie binds an OIDC login to the browser that began it. It must
+// be Lax rather than Strict to be sent on the issuer's redirect back, and it
+// is set whether or not session cookies are enabled.
+func oidcStateCookie(cfg config.SessionCookieConfig, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     oidcStateCookiePath,
+		Domain:   cfg.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   cfg.Secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func sameSiteMode(mode string) http.SameSite {
+	switch mode {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate csrf token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,196 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"myconnectionsvr/modern-mcs/internal/config"
+)
+
+// tlsReloadCheckInterval bounds how often handshakes look for changed
+// certificate files.
+const tlsReloadCheckInterval = 5 * time.Second
+
+// tlsFiles serves the certificate, key and client CA bundle from disk and
+// picks up replaced files on a later handshake, so that renewed certificates
+// take effect without a restart. A file that fails to load keeps the
+// previous version in use.
+type tlsFiles struct {
+	cfg config.TLSConfig
+	log *slog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	checkedAt time.Time
+}
+
+func newTLSFiles(cfg config.TLSConfig, log *slog.Logger) (*tlsFiles, error) {
+	f := &tlsFiles{cfg: cfg, log: log}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// tlsConfig returns the server configuration. Client certificates are
+// requested but optional, so that browsers and token clients are unaffected;
+// a certificate that is sent must chain to the client CA.
+func (f *tlsFiles) tlsConfig() *tls.Config {
+	minVersion := f.cfg.MinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: f.cfg.CipherSuites,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := f.current()
+			cfg := &tls.Config{
+				MinVersion:   minVersion,
+				CipherSuites: f.cfg.CipherSuites,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if clientCAs != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = clientCAs
+			}
+			return cfg, nil
+		},
+	}
+}
+
+func (f *tlsFiles) current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	due := time.Since(f.checkedAt) >= tlsReloadCheckInterval
+	if due {
+		f.checkedAt = time.Now()
+	}
+	f.mu.Unlock()
+	if due && f.changed() {
+		if err := f.load(); err != nil {
+			f.log.Error("reload tls files", "error", err)
+		} else {
+			f.log.Info("tls files reloaded", "cert", f.cfg.CertFile)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cert, f.clientCAs
+}
+
+// reload rereads the files right away, for SIGHUP. Unlike the check on
+// handshakes it reports a failure; the previous files stay in use either way.
+func (f *tlsFiles) reload() error {
+	if err := f.load(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.checkedAt = time.Now()
+	f.mu.Unlock()
+	f.log.Info("tls files reloaded", "cert", f.cfg.CertFile)
+	return nil
+}
+
+func (f *tlsFiles) paths() []string {
+	paths := []string{f.cfg.CertFile, f.cfg.KeyFile}
+	if f.cfg.ClientCAFile != "" {
+		paths = append(paths, f.cfg.ClientCAFile)
+	}
+	return paths
+}
+
+func (f *tlsFiles) changed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range f.paths() {
+		info, err := os.Stat(p)
+		if err != nil || !info.ModTime().Equal(f.modTimes[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *tlsFiles) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, p := range f.paths() {
+		info, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", p, err)
+		}
+		modTimes[p] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(f.cfg.CertFile, f.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if f.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(f.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client ca file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client ca file %s contains no certificates", f.cfg.ClientCAFile)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cert = &cert
+	f.clientCAs = clientCAs
+	f.modTimes = modTimes
+	return nil
+}
+
+// hstsMiddleware tells browsers to use HTTPS only. The header is only sent
+// over TLS, as browsers ignore it on plain HTTP.
+func hstsMiddleware(next http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same host and path on
+// the HTTPS listener. 308 keeps the method and body of API calls.
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	if port == "443" {
+		port = ""
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			writeError(w, http.StatusBadRequest, "host header required")
+			return
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -57,11 +57,15 @@ func TestPostgresAuthUserAndSessionRoundTrip(t *testing.T) {
 		t.Fatalf("NewService() error: %v", err)
 	}
 
+	passwordHash, err := svc.HashPassword("Password123!")
+	if err != nil {
+		t.Fatalf("HashPassword() error: %v", err)
+	}
 	username := fmt.Sprintf("itest_auth_%d", time.Now().UnixNano())
 	u := auth.User{
 		ID:           fmt.Sprintf("u-%d", time.Now().UnixNano()),
 		Username:     username,
-		PasswordHash: svc.HashPassword("Password123!"),
+		PasswordHash: passwordHash,
 		Roles:        []string{"admin"},
 	}
 	if err := userStore.Put(u); err != nil {
@@ -72,7 +76,7 @@ func TestPostgresAuthUserAndSessionRoundTrip(t *testing.T) {
 		_, _ = db.Exec("DELETE FROM auth_users WHERE username = $1", username)
 	})
 
-	session, err := svc.Login(username, "Password123!")
+	session, err := svc.Login(username, "Password123!", auth.ClientInfo{})
 	if err != nil {
 		t.Fatalf("Login() error: %v", err)
 	}
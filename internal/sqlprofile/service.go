@@ -207,25 +207,55 @@ func cloneProfiles(src map[string]Profile) map[string]Profile {
 	return out
 }
 
+// ValidationError lists every invalid field of a profile, keyed by its JSON
+// name. It matches ErrInvalidInput.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+" "+f.Message)
+	}
+	return ErrInvalidInput.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidInput
+}
+
 func validate(p Profile) error {
+	var fields []FieldError
+	invalid := func(field, message string) {
+		fields = append(fields, FieldError{Field: field, Message: message})
+	}
 	if strings.TrimSpace(p.Name) == "" {
-		return fmt.Errorf("%w: name is required", ErrInvalidInput)
+		invalid("name", "is required")
 	}
 	dbType := strings.ToLower(strings.TrimSpace(p.DBType))
 	if _, ok := allowedDBTypes[dbType]; !ok {
-		return fmt.Errorf("%w: db_type must be mysql, mssql, or pgsql", ErrInvalidInput)
+		invalid("db_type", "must be mysql, mssql, or pgsql")
 	}
 	if strings.TrimSpace(p.Host) == "" {
-		return fmt.Errorf("%w: host is required", ErrInvalidInput)
+		invalid("host", "is required")
 	}
 	if p.Port <= 0 || p.Port > 65535 {
-		return fmt.Errorf("%w: port must be between 1 and 65535", ErrInvalidInput)
+		invalid("port", "must be between 1 and 65535")
 	}
 	if strings.TrimSpace(p.Database) == "" {
-		return fmt.Errorf("%w: database is required", ErrInvalidInput)
+		invalid("database", "is required")
 	}
 	if strings.TrimSpace(p.Commands) == "" {
-		return fmt.Errorf("%w: commands is required", ErrInvalidInput)
+		invalid("commands", "is required")
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
 	}
 	return nil
 }
@@ -66,6 +66,15 @@ func TestValidation(t *testing.T) {
 	if !errors.Is(err, ErrInvalidInput) {
 		t.Fatalf("expected ErrInvalidInput, got %v", err)
 	}
+	var verr *ValidationError
+	if !errors.As(err, &verr) || len(verr.Fields) != 6 || verr.Fields[1] != (FieldError{Field: "db_type", Message: "must be mysql, mssql, or pgsql"}) {
+		t.Fatalf("expected every invalid field reported, got %v", err)
+	}
+
+	_, err = svc.Create(Profile{Name: "n", DBType: "mysql", Host: "h", Port: 70000, Database: "d", Commands: "c"})
+	if err == nil || err.Error() != "invalid sql profile input: port must be between 1 and 65535" {
+		t.Fatalf("unexpected error for one invalid field: %v", err)
+	}
 }
 
 func TestServicePersistsToFile(t *testing.T) {
@@ -0,0 +1,14 @@
+-- TOTP two-factor authentication.
+-- These definitions mirror the runtime-created schemas in:
+-- - internal/auth/store_postgres.go
+-- - internal/auth/mfa_policy_store.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS mfa_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_pending_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS recovery_code_hashes JSONB NOT NULL DEFAULT '[]'::jsonb;
+
+CREATE TABLE IF NOT EXISTS auth_mfa_required_roles (
+  role TEXT PRIMARY KEY
+);
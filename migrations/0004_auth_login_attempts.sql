@@ -0,0 +1,11 @@
+-- Shared login failure counters for throttling and lockout.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/login_attempt_store.go
+
+CREATE TABLE IF NOT EXISTS auth_login_attempts (
+  key TEXT PRIMARY KEY,
+  failures INTEGER NOT NULL DEFAULT 0,
+  last_failure_at TIMESTAMPTZ NOT NULL,
+  blocked_until TIMESTAMPTZ NOT NULL,
+  locked BOOLEAN NOT NULL DEFAULT FALSE
+);
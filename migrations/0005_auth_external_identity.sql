@@ -0,0 +1,6 @@
+-- External identity links for users provisioned by an identity provider.
+-- These definitions mirror the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS auth_provider TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS external_subject TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+-- Custom roles as named permission sets. The built-in admin role is not stored.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/role_store.go
+
+CREATE TABLE IF NOT EXISTS auth_roles (
+  name TEXT PRIMARY KEY,
+  description TEXT NOT NULL DEFAULT '',
+  permissions JSONB NOT NULL DEFAULT '[]'::jsonb
+);
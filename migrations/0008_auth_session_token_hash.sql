@@ -0,0 +1,15 @@
+-- Sessions are keyed by an HMAC of the bearer token instead of the raw token.
+-- Existing rows hold raw tokens and are dropped; users sign in again once.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/session_store_postgres.go
+
+DO $$
+BEGIN
+  IF EXISTS (
+    SELECT 1 FROM information_schema.columns
+    WHERE table_schema = current_schema() AND table_name = 'auth_sessions' AND column_name = 'token'
+  ) THEN
+    DELETE FROM auth_sessions;
+    ALTER TABLE auth_sessions RENAME COLUMN token TO token_hash;
+  END IF;
+END $$;
@@ -0,0 +1,10 @@
+-- Sliding session expiry and rotating refresh tokens.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/session_store_postgres.go
+
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS absolute_expires_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS family_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS refresh_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMPTZ NULL;
+CREATE INDEX IF NOT EXISTS auth_sessions_refresh_hash_idx ON auth_sessions (refresh_hash);
@@ -0,0 +1,7 @@
+-- User email addresses and self-service password reset tokens.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_reset_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_reset_expires_at TIMESTAMPTZ NULL;
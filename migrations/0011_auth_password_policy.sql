@@ -0,0 +1,9 @@
+-- Password change tracking for expiry and reuse checks, and sessions limited
+-- to changing an expired password.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+-- - internal/auth/session_store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS password_history JSONB NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS password_change_required BOOLEAN NOT NULL DEFAULT FALSE;
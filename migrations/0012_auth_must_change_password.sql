@@ -0,0 +1,5 @@
+-- Users that must change their password before using the API.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
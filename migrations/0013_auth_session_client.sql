@@ -0,0 +1,6 @@
+-- Client address and user agent recorded when a session is issued.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/session_store_postgres.go
+
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS client_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '';
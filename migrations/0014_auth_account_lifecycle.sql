@@ -0,0 +1,7 @@
+-- Disabled and expiring accounts and last sign-in time.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NULL;
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ NULL;
@@ -0,0 +1,6 @@
+-- Admin behind an impersonation session; empty for ordinary sessions.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/session_store_postgres.go
+
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS impersonator_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE auth_sessions ADD COLUMN IF NOT EXISTS impersonator_username TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- WebAuthn credentials (passkeys and security keys) registered by the user.
+-- This definition mirrors the runtime-created schema in:
+-- - internal/auth/store_postgres.go
+
+ALTER TABLE auth_users ADD COLUMN IF NOT EXISTS webauthn_credentials JSONB NOT NULL DEFAULT '[]'::jsonb;
@@ -1,11 +1,22 @@
 const API_BASE = import.meta.env.VITE_API_BASE || ''
 
+export interface FieldError {
+  field: string
+  message: string
+}
+
+// ApiError carries the problem details (RFC 7807) returned by the API. Branch
+// on code; message is for display.
 export class ApiError extends Error {
   status: number
+  code: string
+  fieldErrors: FieldError[]
 
-  constructor(status: number, message: string) {
+  constructor(status: number, message: string, code = '', fieldErrors: FieldError[] = []) {
     super(message)
     this.status = status
+    this.code = code
+    this.fieldErrors = fieldErrors
   }
 }
 
@@ -25,15 +36,23 @@ export async function request<T>(path: string, init: RequestInit = {}, token?: s
 
   if (!response.ok) {
     let message = `Request failed with status ${response.status}`
+    let code = ''
+    let fieldErrors: FieldError[] = []
     try {
       const payload = await response.json()
-      if (payload && typeof payload.error === 'string') {
-        message = payload.error
+      if (payload && typeof payload.detail === 'string') {
+        message = payload.detail
+      }
+      if (payload && typeof payload.code === 'string') {
+        code = payload.code
+      }
+      if (payload && Array.isArray(payload.errors)) {
+        fieldErrors = payload.errors
       }
     } catch {
       // keep fallback message
     }
-    throw new ApiError(response.status, message)
+    throw new ApiError(response.status, message, code, fieldErrors)
   }
 
   if (response.status === 204) {